@@ -0,0 +1,45 @@
+package evaluator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+)
+
+// withAnonymousKey returns ctx with a targetingKey from the WithAnonymousKey
+// generator when neither ctx nor the default context provides a non-empty
+// one (see targetingKeyValue), and whether it generated one. ctx itself is
+// not modified. The key is generated once, so every flag and every
+// serialization of one call sees the same key.
+func (e *FlagEvaluator) withAnonymousKey(ctx map[string]interface{}) (map[string]interface{}, bool) {
+	if e.anonymousKey == nil {
+		return ctx, false
+	}
+	if tk, _ := targetingKeyValue(ctx, e.loadDefaultContext(), e.targetingKeyField); tk != nil && tk != "" {
+		return ctx, false
+	}
+	withKey := make(map[string]interface{}, len(ctx)+1)
+	maps.Copy(withKey, ctx)
+	withKey["targetingKey"] = e.anonymousKey()
+	return withKey, true
+}
+
+// randomUUID returns a random (version 4) UUID, the default anonymous key.
+func randomUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+
+	var s [36]byte
+	hex.Encode(s[0:8], u[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], u[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], u[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], u[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], u[10:])
+	return string(s[:])
+}
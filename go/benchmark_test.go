@@ -1,6 +1,8 @@
 package evaluator
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"testing"
@@ -65,6 +67,27 @@ const (
 		}
 	}`
 
+	// Same rule as simpleTargetingConfig, but also reading $flagd, so every
+	// context carries the enrichment block
+	flagdTargetingConfig = `{
+		"flags": {
+			"targeting-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ "==": [{ "var": "tier" }, "premium"] },
+							{ "==": [{ "var": "$flagd.flagKey" }, "targeting-flag"] }
+						]},
+						"on", "off"
+					]
+				}
+			}
+		}
+	}`
+
 	complexTargetingConfig = `{
 		"flags": {
 			"complex-flag": {
@@ -202,9 +225,9 @@ const (
 	}`
 )
 
-func newBenchEvaluator(b *testing.B) *FlagEvaluator {
+func newBenchEvaluator(b *testing.B, opts ...Option) *FlagEvaluator {
 	b.Helper()
-	e, err := NewFlagEvaluator(WithPermissiveValidation())
+	e, err := NewFlagEvaluator(append([]Option{WithPermissiveValidation()}, opts...)...)
 	if err != nil {
 		b.Fatalf("failed to create evaluator: %v", err)
 	}
@@ -347,6 +370,91 @@ func BenchmarkE11_MissingFlag(b *testing.B) {
 	}
 }
 
+// E12: Simple targeting with $flagd enrichment. Compare allocations with E4,
+// whose rule doesn't reference $flagd and so skips enrichment.
+func BenchmarkE12_SimpleTargeting_FlagdEnrichment(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(flagdTargetingConfig)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFlag("targeting-flag", smallCtx)
+	}
+}
+
+// E13: E4 under the interpreter (WithInterpreter), for the cost of running
+// without the compiler
+func BenchmarkE13_SimpleTargeting_Interpreter(b *testing.B) {
+	e := newBenchEvaluator(b, WithInterpreter())
+	e.UpdateState(simpleTargetingConfig)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFlag("targeting-flag", smallCtx)
+	}
+}
+
+// E14: Host-side serialization of a context holding a 10-element string slice
+// and a nested object, without the WASM call
+func BenchmarkE14_SerializeContext_Collections(b *testing.B) {
+	ctx := map[string]interface{}{
+		"targetingKey": "user-123",
+		"roles":        []string{"admin", "billing", "support", "sales", "ops", "dev", "qa", "audit", "hr", "legal"},
+		"profile":      map[string]interface{}{"tier": "gold", "country": "DE", "age": 42},
+	}
+	required := map[string]bool{"targetingKey": true, "roles": true, "profile": true}
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		serializeContext(&buf, ctx, nil, "", required, "f", false, 0)
+	}
+}
+
+// E15: Simple targeting, large context received as JSON and decoded first
+// (baseline for E16)
+func BenchmarkE15_SimpleTargeting_LargeContext_Decoded(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(simpleTargetingConfig)
+	data, _ := json.Marshal(makeLargeCtx())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ctx map[string]interface{}
+		json.Unmarshal(data, &ctx)
+		e.EvaluateFlag("targeting-flag", ctx)
+	}
+}
+
+// E16: E15 with the JSON passed through by EvaluateFlagJSON
+func BenchmarkE16_SimpleTargeting_LargeContext_JSON(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(simpleTargetingConfig)
+	data, _ := json.Marshal(makeLargeCtx())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFlagJSON("targeting-flag", data)
+	}
+}
+
+// E17: Static flag through a typed accessor with a nil context, which
+// allocates nothing
+func BenchmarkE17_SimpleFlag_NilContext_Typed(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(simpleFlagConfig)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateBool("simple-flag", nil, false)
+	}
+}
+
 // ====================================================================
 // O1-O6: Custom Operator Benchmarks
 // ====================================================================
@@ -429,7 +537,7 @@ func BenchmarkO6_EndsWith(b *testing.B) {
 
 // S1: Update state (5 flags)
 func BenchmarkS1_UpdateState_5Flags(b *testing.B) {
-	e := newBenchEvaluator(b)
+	e := newBenchEvaluator(b, WithForceUpdate())
 	config := generateFlagConfig(5)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -439,7 +547,7 @@ func BenchmarkS1_UpdateState_5Flags(b *testing.B) {
 
 // S2: Update state (50 flags)
 func BenchmarkS2_UpdateState_50Flags(b *testing.B) {
-	e := newBenchEvaluator(b)
+	e := newBenchEvaluator(b, WithForceUpdate())
 	config := generateFlagConfig(50)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -449,7 +557,7 @@ func BenchmarkS2_UpdateState_50Flags(b *testing.B) {
 
 // S3: Update state (200 flags)
 func BenchmarkS3_UpdateState_200Flags(b *testing.B) {
-	e := newBenchEvaluator(b)
+	e := newBenchEvaluator(b, WithForceUpdate())
 	config := generateFlagConfig(200)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -457,7 +565,7 @@ func BenchmarkS3_UpdateState_200Flags(b *testing.B) {
 	}
 }
 
-// S4: Update state (no change — same config twice)
+// S4: Update state (no change — same config twice, skipped by hash)
 func BenchmarkS4_UpdateState_NoChange(b *testing.B) {
 	e := newBenchEvaluator(b)
 	config := generateFlagConfig(100)
@@ -468,6 +576,17 @@ func BenchmarkS4_UpdateState_NoChange(b *testing.B) {
 	}
 }
 
+// S4: Update state (no change, re-applied with WithForceUpdate)
+func BenchmarkS4_UpdateState_NoChange_Forced(b *testing.B) {
+	e := newBenchEvaluator(b, WithForceUpdate())
+	config := generateFlagConfig(100)
+	e.UpdateState(config) // first call
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.UpdateState(config) // no changes
+	}
+}
+
 // S5: Update state (1 flag changed in 100)
 func BenchmarkS5_UpdateState_1Changed(b *testing.B) {
 	e := newBenchEvaluator(b)
@@ -485,6 +604,28 @@ func BenchmarkS5_UpdateState_1Changed(b *testing.B) {
 	}
 }
 
+// S6: Create an evaluator with a pool of 8 (module compilation cached)
+func BenchmarkS6_NewEvaluator_Pool8(b *testing.B) {
+	benchmarkNewEvaluator(b)
+}
+
+// S7: S6 with WithLazyPool, deferring instance creation to first use
+func BenchmarkS7_NewEvaluator_Pool8_Lazy(b *testing.B) {
+	benchmarkNewEvaluator(b, WithLazyPool())
+}
+
+func benchmarkNewEvaluator(b *testing.B, opts ...Option) {
+	opts = append([]Option{WithPermissiveValidation(), WithPoolSize(8),
+		WithCompilationCache(testCompilationCache)}, opts...)
+	for i := 0; i < b.N; i++ {
+		e, err := NewFlagEvaluator(opts...)
+		if err != nil {
+			b.Fatalf("failed to create evaluator: %v", err)
+		}
+		e.Close()
+	}
+}
+
 // ====================================================================
 // C1-C6: Concurrency Benchmarks
 // ====================================================================
@@ -573,18 +714,23 @@ func BenchmarkC5_MixedWorkload(b *testing.B) {
 	})
 }
 
-// C6: Read/write contention (evaluate + update_state concurrently)
+// C6: Read/write contention (evaluate + update_state concurrently). The flag
+// has targeting, so evaluations need a pool instance rather than being served
+// from the pre-evaluated cache.
 func BenchmarkC6_ReadWriteContention(b *testing.B) {
-	config1 := `{
-		"flags": {
-			"flag-a": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } }
-		}
-	}`
-	config2 := `{
-		"flags": {
-			"flag-a": { "state": "ENABLED", "defaultVariant": "off", "variants": { "off": false } }
-		}
-	}`
+	config := func(variant string) string {
+		return `{
+			"flags": {
+				"flag-a": {
+					"state": "ENABLED",
+					"defaultVariant": "` + variant + `",
+					"variants": { "on": true, "off": false },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "on", null] }
+				}
+			}
+		}`
+	}
+	config1, config2 := config("on"), config("off")
 
 	e := newBenchEvaluator(b)
 	e.UpdateState(config1)
@@ -613,7 +759,7 @@ func BenchmarkC6_ReadWriteContention(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		e.EvaluateFlag("flag-a", emptyCtx)
+		e.EvaluateFlag("flag-a", smallCtx)
 	}
 	b.StopTimer()
 
@@ -621,6 +767,36 @@ func BenchmarkC6_ReadWriteContention(b *testing.B) {
 	wg.Wait()
 }
 
+// ====================================================================
+// B1-B2: Batch Evaluation Benchmarks
+// ====================================================================
+
+var batchFlagKeys = []string{"static-flag", "targeting-flag", "disabled-flag"}
+
+// B1: Mixed flags evaluated one at a time (baseline for B2)
+func BenchmarkB1_Mixed_Sequential(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(mixedConfig)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range batchFlagKeys {
+			e.EvaluateFlag(key, smallCtx)
+		}
+	}
+}
+
+// B2: Mixed flags evaluated with EvaluateFlags (single pool acquisition)
+func BenchmarkB2_Mixed_Batch(b *testing.B) {
+	e := newBenchEvaluator(b)
+	e.UpdateState(mixedConfig)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFlags(batchFlagKeys, smallCtx)
+	}
+}
+
 // ====================================================================
 // T: Throughput benchmarks — 1000 evaluations per op across N goroutines.
 // Exposes mutex contention by measuring aggregate throughput scaling.
@@ -673,6 +849,21 @@ func BenchmarkT9_Mixed_16G(b *testing.B) {
 	benchThroughputMixed(b, 16)
 }
 
+// T10: Targeting flag, 32 goroutines
+func BenchmarkT10_Targeting_32G(b *testing.B) {
+	benchThroughput(b, 32, "targeting-flag", smallCtx, mixedConfig)
+}
+
+// T11: Targeting flag, 16 goroutines, pool split into 4 shards (compare with T6)
+func BenchmarkT11_Targeting_Sharded_16G(b *testing.B) {
+	benchThroughput(b, 16, "targeting-flag", smallCtx, mixedConfig, WithShardedPool(4))
+}
+
+// T12: Targeting flag, 32 goroutines, pool split into 4 shards (compare with T10)
+func BenchmarkT12_Targeting_Sharded_32G(b *testing.B) {
+	benchThroughput(b, 32, "targeting-flag", smallCtx, mixedConfig, WithShardedPool(4))
+}
+
 const mixedConfig = `{
 	"flags": {
 		"static-flag": {
@@ -695,9 +886,9 @@ const mixedConfig = `{
 }`
 
 // benchThroughput runs throughputOps evaluations split across n goroutines per b.N op.
-func benchThroughput(b *testing.B, goroutines int, flagKey string, ctx map[string]interface{}, config string) {
+func benchThroughput(b *testing.B, goroutines int, flagKey string, ctx map[string]interface{}, config string, opts ...Option) {
 	b.Helper()
-	e := newBenchEvaluator(b)
+	e := newBenchEvaluator(b, opts...)
 	e.UpdateState(config)
 
 	opsPerG := throughputOps / goroutines
@@ -0,0 +1,32 @@
+package evaluator
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize caps the capacity of buffers kept in bufferPool, so one
+// oversized context doesn't pin its memory for the life of the process.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool recycles the buffers used to serialize evaluation contexts and
+// to copy evaluation results out of WASM memory.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b to bufferPool. b must not be used afterwards, including
+// through slices returned by b.Bytes().
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
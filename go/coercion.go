@@ -0,0 +1,62 @@
+package evaluator
+
+import (
+	"strconv"
+)
+
+// converter returns coerce when the evaluator was created WithTypeCoercion,
+// and strict otherwise.
+func converter[T any](e *FlagEvaluator, strict, coerce func(*EvaluationResult) (T, error)) func(*EvaluationResult) (T, error) {
+	if e.typeCoercion {
+		return coerce
+	}
+	return strict
+}
+
+// coerceBool is toBool that also parses strings such as "true" and "0", as
+// strconv.ParseBool does.
+func coerceBool(r *EvaluationResult) (bool, error) {
+	if s, ok := r.Value.(string); ok {
+		if v, err := strconv.ParseBool(s); err == nil {
+			return v, nil
+		}
+	}
+	return toBool(r)
+}
+
+// coerceString is toString that also formats numbers and booleans.
+func coerceString(r *EvaluationResult) (string, error) {
+	switch v := r.Value.(type) {
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return toString(r)
+}
+
+// coerceInt is toInt that also parses numeric strings, truncating fractions
+// as toInt does.
+func coerceInt(r *EvaluationResult) (int64, error) {
+	if s, ok := r.Value.(string); ok {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v, nil
+		}
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return int64(v), nil
+		}
+	}
+	return toInt(r)
+}
+
+// coerceFloat is toFloat that also parses numeric strings.
+func coerceFloat(r *EvaluationResult) (float64, error) {
+	if s, ok := r.Value.(string); ok {
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v, nil
+		}
+	}
+	return toFloat(r)
+}
@@ -0,0 +1,132 @@
+package evaluator
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// CompiledModule is the flagd-evaluator WASM module compiled in its own wazero
+// runtime, for several evaluators to share one compilation (e.g. one
+// evaluator per tenant). Create evaluators from it with
+// NewFlagEvaluatorFromCompiled.
+//
+// Closing an evaluator does not close the CompiledModule: the caller closes
+// it once every evaluator created from it has been closed.
+type CompiledModule struct {
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+
+	// Sequence for unique module names in the runtime, shared by the
+	// evaluators instantiating the module
+	instanceSeq atomic.Uint64
+
+	// WASM details reported by Version
+	info EvaluatorInfo
+
+	// Calls are stopped when their context is done (see
+	// WithEvaluationTimeout)
+	closeOnContextDone bool
+}
+
+// Compile compiles the WASM module for use with NewFlagEvaluatorFromCompiled.
+// Only the options configuring the runtime and the module apply here:
+// WithInterpreter, WithRuntimeConfig, WithMaxMemoryPages, WithCompilationCache
+// and WithWasmModule. WithEvaluationTimeout makes the runtime able to stop
+// calls, and must be passed to NewFlagEvaluatorFromCompiled as well to set the
+// timeout. Other options are ignored and are passed to
+// NewFlagEvaluatorFromCompiled instead.
+func Compile(opts ...Option) (*CompiledModule, error) {
+	cfg, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return compile(cfg)
+}
+
+// compile creates a runtime configured by cfg and compiles the module in it.
+func compile(cfg *evaluatorConfig) (*CompiledModule, error) {
+	ctx := context.Background()
+
+	// Create runtime
+	rtConfig := wazero.NewRuntimeConfig()
+	switch {
+	case cfg.runtimeConfig != nil:
+		rtConfig = cfg.runtimeConfig
+	case cfg.interpreter:
+		rtConfig = wazero.NewRuntimeConfigInterpreter()
+	}
+	if cfg.maxMemoryPages != 0 {
+		rtConfig = rtConfig.WithMemoryLimitPages(cfg.maxMemoryPages)
+	}
+	if cfg.compilationCache != nil {
+		rtConfig = rtConfig.WithCompilationCache(cfg.compilationCache)
+	}
+	if cfg.evaluationTimeout > 0 {
+		rtConfig = rtConfig.WithCloseOnContextDone(true)
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, rtConfig)
+
+	// Register host functions (shared across all instances)
+	if err := registerHostFunctions(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("failed to register host functions: %w", err)
+	}
+
+	// Compile WASM module once
+	module := wasmBytes
+	if cfg.wasmModule != nil {
+		module = cfg.wasmModule
+	}
+	compiled, err := r.CompileModule(ctx, module)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("failed to compile WASM module: %w", err)
+	}
+	if err := checkImports(r, compiled); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	if err := checkRequiredExports(compiled); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	cm := &CompiledModule{rt: r, compiled: compiled, closeOnContextDone: cfg.evaluationTimeout > 0}
+	if cm.info, err = readModuleInfo(ctx, cm, module); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("failed to read WASM module version: %w", err)
+	}
+	return cm, nil
+}
+
+// Close releases the runtime and compiled module. Evaluators created from it
+// must have been closed first; any still open stop working.
+func (cm *CompiledModule) Close() error {
+	return cm.rt.Close(context.Background())
+}
+
+// NewFlagEvaluatorFromCompiled creates a flag evaluator instantiating cm
+// rather than compiling the module itself. It accepts the same options as
+// NewFlagEvaluator, except those applied by Compile, which return an error.
+//
+// The evaluator does not take ownership of cm: Close releases its instances
+// but leaves cm open for other evaluators.
+func NewFlagEvaluatorFromCompiled(cm *CompiledModule, opts ...Option) (*FlagEvaluator, error) {
+	if cm == nil {
+		return nil, fmt.Errorf("compiled module is nil")
+	}
+	cfg, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.interpreter || cfg.runtimeConfig != nil || cfg.maxMemoryPages != 0 ||
+		cfg.compilationCache != nil || cfg.wasmModule != nil {
+		return nil, fmt.Errorf("invalid option: runtime and module options must be passed to Compile")
+	}
+	if cfg.evaluationTimeout > 0 && !cm.closeOnContextDone {
+		return nil, fmt.Errorf("invalid option: WithEvaluationTimeout must also be passed to Compile")
+	}
+	return newFlagEvaluator(cm, cfg)
+}
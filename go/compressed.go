@@ -0,0 +1,42 @@
+package evaluator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// maxDecompressedConfigSize bounds the config UpdateStateCompressed inflates,
+// so a small gzip bomb can't exhaust memory. It is far above the size of
+// configs with thousands of flags.
+const maxDecompressedConfigSize = 64 << 20 // 64MB
+
+// UpdateStateCompressed applies a gzip-compressed config like UpdateState.
+// Configs that decompress to more than 64MB are rejected with
+// ErrConfigTooLarge, without being fully decompressed.
+func (e *FlagEvaluator) UpdateStateCompressed(gzipped []byte) (*UpdateStateResult, error) {
+	config, err := decompressConfig(gzipped)
+	if err != nil {
+		return nil, err
+	}
+	return e.updateStateBytes(config)
+}
+
+// decompressConfig inflates gzipped, reading at most one byte past
+// maxDecompressedConfigSize to detect an oversized config.
+func decompressConfig(gzipped []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress config: %w", err)
+	}
+	defer zr.Close()
+	config, err := io.ReadAll(io.LimitReader(zr, maxDecompressedConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress config: %w", err)
+	}
+	if len(config) > maxDecompressedConfigSize {
+		return nil, fmt.Errorf("%w: decompressed config exceeds %d bytes", ErrConfigTooLarge, maxDecompressedConfigSize)
+	}
+	return config, nil
+}
@@ -0,0 +1,64 @@
+package evaluator
+
+import (
+	"sort"
+	"strings"
+)
+
+// validateContext returns the keys in requiredKeys that neither ctx nor
+// defaults provide, sorted. $flagd fields are added by enrichment and never
+// count as missing. If targetingKey is missing or empty, failed is the error
+// result to return instead of evaluating the flag; tkField is the field
+// standing in for it (see targetingKeyValue), or "".
+func validateContext(ctx, defaults map[string]interface{}, requiredKeys map[string]bool, tkField string) (missing []string, failed *EvaluationResult) {
+	targetingKeyMissing := false
+	for key := range requiredKeys {
+		if strings.HasPrefix(key, "$flagd.") {
+			continue
+		}
+		if key == "targetingKey" {
+			if tk, _ := targetingKeyValue(ctx, defaults, tkField); tk == nil || tk == "" {
+				targetingKeyMissing = true
+				missing = append(missing, key)
+			}
+			continue
+		}
+		if !hasContextPath(ctx, defaults, key) {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+
+	if targetingKeyMissing {
+		failed = &EvaluationResult{
+			Reason:       ReasonError,
+			ErrorCode:    ErrorTargetingKeyMissing,
+			ErrorMessage: "targetingKey is missing from the evaluation context",
+			MissingKeys:  missing,
+		}
+	}
+	return missing, failed
+}
+
+// hasContextPath reports whether the context holds a value at key, which may
+// be a dotted path into nested objects.
+func hasContextPath(ctx, defaults map[string]interface{}, key string) bool {
+	_, ok := lookupContextPath(ctx, defaults, key)
+	return ok
+}
+
+// lookupContextPath returns the context value at key, which may be a dotted
+// path into nested objects.
+func lookupContextPath(ctx, defaults map[string]interface{}, key string) (interface{}, bool) {
+	name, rest, nested := strings.Cut(key, ".")
+	val, ok := contextValue(ctx, defaults, name)
+	for ok && nested {
+		m, isMap := val.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		name, rest, nested = strings.Cut(rest, ".")
+		val, ok = m[name]
+	}
+	return val, ok
+}
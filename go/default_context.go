@@ -0,0 +1,128 @@
+package evaluator
+
+import (
+	"maps"
+	"strings"
+)
+
+// SetDefaultContext replaces the context merged into every evaluation.
+// Per-call context takes precedence: a key present in both, including
+// targetingKey, uses the per-call value. The merge is shallow, so a nested
+// object in the call replaces the default one rather than being combined with
+// it. Only keys a flag's targeting requires are serialized, whichever context
+// they come from. The map is copied; a nil or empty map clears the defaults.
+// Evaluations already running keep the defaults they started with.
+//
+// The defaults also apply to evaluations in named flag sets.
+func (e *FlagEvaluator) SetDefaultContext(ctx map[string]interface{}) {
+	if len(ctx) == 0 {
+		e.defaultContext.Store(nil)
+	} else {
+		defaults := maps.Clone(ctx)
+		e.defaultContext.Store(&defaults)
+	}
+
+	// Under setsMu so a flag-set evaluator being created doesn't miss it
+	e.setsMu.Lock()
+	defer e.setsMu.Unlock()
+	if sets := e.sets.Load(); sets != nil {
+		sets.SetDefaultContext(ctx)
+	}
+}
+
+// loadDefaultContext returns the current default context, or nil if none.
+func (e *FlagEvaluator) loadDefaultContext() map[string]interface{} {
+	if p := e.defaultContext.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// contextValue looks key up in the per-call context, falling back to the
+// defaults.
+func contextValue(ctx, defaults map[string]interface{}, key string) (interface{}, bool) {
+	if val, ok := ctx[key]; ok {
+		return val, true
+	}
+	val, ok := defaults[key]
+	return val, ok
+}
+
+// targetingKeyValue looks up the targeting key in the per-call context,
+// falling back to the defaults. With a targeting key field (see
+// WithTargetingKeyField) a context without targetingKey supplies the field's
+// value instead; the per-call context is checked for both before the
+// defaults, so a per-call field takes precedence over a default targetingKey.
+func targetingKeyValue(ctx, defaults map[string]interface{}, field string) (interface{}, bool) {
+	for _, layer := range [...]map[string]interface{}{ctx, defaults} {
+		if val, ok := layer["targetingKey"]; ok {
+			return val, true
+		}
+		if field != "" {
+			if val, ok := layer[field]; ok {
+				return val, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// mergeContext returns ctx layered over defaults, with targetingKey taken
+// from targetingKeyValue when there is a targeting key field. Neither map is
+// modified.
+func mergeContext(ctx, defaults map[string]interface{}, field string) map[string]interface{} {
+	merged := mergeDefaultContext(ctx, defaults)
+	if _, ok := ctx["targetingKey"]; ok || field == "" {
+		return merged
+	}
+	tk, ok := targetingKeyValue(ctx, defaults, field)
+	if !ok {
+		return merged
+	}
+	if len(defaults) == 0 {
+		merged = maps.Clone(ctx)
+	}
+	merged["targetingKey"] = tk
+	return merged
+}
+
+// mergeDefaultContext returns ctx layered over defaults. ctx is returned as is
+// when there are no defaults.
+func mergeDefaultContext(ctx, defaults map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return ctx
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(ctx))
+	maps.Copy(merged, defaults)
+	maps.Copy(merged, ctx)
+	return merged
+}
+
+// overlayContext returns override layered over base. With requiredKeys, the
+// keys a flag reads, only the top-level keys they name are copied, along with
+// targetingKey and the targeting key field; without, both maps are merged in
+// full. Neither map is modified.
+func overlayContext(base, override map[string]interface{}, requiredKeys map[string]bool, field string) map[string]interface{} {
+	if len(base) == 0 {
+		return override
+	}
+	if requiredKeys == nil {
+		return mergeDefaultContext(override, base)
+	}
+	vals := make(map[string]interface{}, len(requiredKeys)+1)
+	copyKey := func(key string) {
+		if val, ok := contextValue(override, base, key); ok {
+			vals[key] = val
+		}
+	}
+	for key := range requiredKeys {
+		if top, _, _ := strings.Cut(key, "."); top != "$flagd" {
+			copyKey(top)
+		}
+	}
+	copyKey("targetingKey")
+	if field != "" {
+		copyKey(field)
+	}
+	return vals
+}
@@ -0,0 +1,102 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors. Evaluation failures are returned as *EvaluationError
+// wrapping one of these (or another cause), so they can be matched with
+// errors.Is.
+var (
+	// ErrEvaluatorClosed is returned by evaluations and state updates
+	// attempted after Close has been called.
+	ErrEvaluatorClosed = errors.New("flag evaluator is closed")
+
+	// ErrFlagKeyTooLarge is returned, as a *FlagKeyTooLargeError, when a
+	// flag key doesn't fit the instance's flag key buffer.
+	ErrFlagKeyTooLarge = errors.New("flag key too large")
+
+	// ErrContextTooLarge is returned when the serialized evaluation context
+	// doesn't fit the instance's context buffer.
+	ErrContextTooLarge = errors.New("evaluation context too large")
+
+	// ErrConfigTooLarge is returned by UpdateStateCompressed for a config
+	// that decompresses to more than the size it accepts.
+	ErrConfigTooLarge = errors.New("config too large")
+
+	// ErrFlagNotFound is returned by host-side flag queries for a flag key
+	// missing from the active configuration.
+	ErrFlagNotFound = errors.New("flag not found")
+
+	// ErrNotFractional is returned by FractionalBucket for a flag whose
+	// targeting has no fractional operation.
+	ErrNotFractional = errors.New("flag targeting has no fractional operation")
+
+	// ErrWasmTrap is returned when the WASM module traps or panics during an
+	// evaluation.
+	ErrWasmTrap = errors.New("WASM trap")
+
+	// ErrPoolTimeout is returned when no pool instance became available
+	// within the WithPoolWaitTimeout limit.
+	ErrPoolTimeout = errors.New("timed out waiting for a pool instance")
+
+	// ErrEvaluationTimeout is returned when a WASM evaluation call ran past
+	// the WithEvaluationTimeout limit and was stopped.
+	ErrEvaluationTimeout = errors.New("evaluation timed out")
+
+	// ErrABIMismatch is returned when creating an evaluator from a WASM
+	// module importing host functions the evaluator doesn't provide, as a
+	// module built with a different wasm-bindgen version does.
+	ErrABIMismatch = errors.New("WASM module ABI mismatch")
+)
+
+// FlagKeyTooLargeError reports a flag key longer than the flag key buffer (see
+// WithMaxFlagKeySize). It matches ErrFlagKeyTooLarge with errors.Is.
+type FlagKeyTooLargeError struct {
+	Size int // length of the flag key in bytes
+	Max  int // size of the flag key buffer in bytes
+}
+
+func (e *FlagKeyTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes exceeds maximum of %d", ErrFlagKeyTooLarge, e.Size, e.Max)
+}
+
+func (e *FlagKeyTooLargeError) Is(target error) bool {
+	return target == ErrFlagKeyTooLarge
+}
+
+// EvaluationError describes a failed evaluation of a single flag. Code is one
+// of the Error* codes. Err is the underlying cause, so errors.Is and
+// errors.As see through an EvaluationError.
+type EvaluationError struct {
+	FlagKey string
+	Code    string
+	Err     error
+}
+
+func (e *EvaluationError) Error() string {
+	if e.Code == ErrorGeneral {
+		return fmt.Sprintf("flag %q: %v", e.FlagKey, e.Err)
+	}
+	return fmt.Sprintf("flag %q: %s: %v", e.FlagKey, e.Code, e.Err)
+}
+
+func (e *EvaluationError) Unwrap() error {
+	return e.Err
+}
+
+// newEvaluationError wraps err for flagKey, deriving the error code from the
+// sentinel it wraps.
+func newEvaluationError(flagKey string, err error) *EvaluationError {
+	code := ErrorGeneral
+	switch {
+	case errors.Is(err, ErrContextTooLarge):
+		code = ErrorInvalidContext
+	case errors.Is(err, ErrFlagNotFound):
+		code = ErrorFlagNotFound
+	case errors.Is(err, ErrPoolTimeout):
+		code = ErrorPoolTimeout
+	}
+	return &EvaluationError{FlagKey: flagKey, Code: code, Err: err}
+}
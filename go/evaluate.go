@@ -1,193 +1,1018 @@
 package evaluator
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // EvaluateFlag evaluates a flag and returns the full result.
 func (e *FlagEvaluator) EvaluateFlag(flagKey string, ctx map[string]interface{}) (*EvaluationResult, error) {
-	return e.evaluateFlag(flagKey, ctx)
+	return e.evaluateFlag(e.ctx, flagKey, ctx)
 }
 
-// EvaluateBool evaluates a boolean flag. Returns defaultValue on error.
-func (e *FlagEvaluator) EvaluateBool(flagKey string, ctx map[string]interface{}, defaultValue bool) bool {
-	result, err := e.evaluateFlag(flagKey, ctx)
-	if err != nil || result.IsError() || result.Value == nil {
-		return defaultValue
+// EvaluateFlagNoContext evaluates a flag without an evaluation context, as
+// EvaluateFlag(flagKey, nil) does, for flags that don't target. A static or
+// disabled flag is served from the pre-evaluated cache with no allocation
+// beyond the returned copy; the typed accessors, passed a nil context,
+// allocate nothing.
+func (e *FlagEvaluator) EvaluateFlagNoContext(flagKey string) (*EvaluationResult, error) {
+	return e.evaluateFlag(e.ctx, flagKey, nil)
+}
+
+// EvaluateFlagContext evaluates a flag like EvaluateFlag, but gives up when ctx
+// is cancelled or its deadline passes. Waiting for a pool instance is bounded
+// by ctx, and ctx is passed to the WASM calls. On cancellation the returned
+// error is ctx.Err().
+func (e *FlagEvaluator) EvaluateFlagContext(ctx context.Context, flagKey string, vals map[string]interface{}) (*EvaluationResult, error) {
+	return e.evaluateFlag(withEntropy(withClock(ctx, e.clock), e.entropy), flagKey, vals)
+}
+
+// EvaluateFlagWith evaluates a flag like EvaluateFlag, against override
+// layered over base: a key present in both uses override's value, and both
+// are layered over the default context. The merge is shallow, as with the
+// default context. Neither map is modified, and when the flag's targeting
+// reads only some keys, only those are copied out of the two maps, so
+// previewing a change to a large context stays cheap.
+func (e *FlagEvaluator) EvaluateFlagWith(flagKey string, base, override map[string]interface{}) (*EvaluationResult, error) {
+	if len(override) == 0 {
+		return e.evaluateFlag(e.ctx, flagKey, base)
 	}
-	if v, ok := result.Value.(bool); ok {
-		return v
+	result, _, err := e.evaluateFlagAs(e.ctx, flagKey, base, override, outputOwned)
+	return result, err
+}
+
+// EvaluateFlagRaw evaluates a flag like EvaluateFlag, returning the result as
+// JSON encoded as EvaluationResult is, for handlers writing it straight to a
+// response. A result evaluated by the module is the JSON it produced, copied
+// out without decoding and re-encoding it; a static or disabled flag's is
+// encoded once per configuration. Other results, such as result cache hits,
+// are encoded with encoding/json. The returned bytes are the caller's own.
+func (e *FlagEvaluator) EvaluateFlagRaw(flagKey string, ctx map[string]interface{}) (json.RawMessage, error) {
+	result, data, err := e.evaluateFlagAs(e.ctx, flagKey, ctx, nil, outputJSON)
+	if err != nil || data != nil {
+		return data, err
 	}
-	return defaultValue
+	return json.Marshal(result)
+}
+
+// EvaluateBool evaluates a boolean flag. Returns defaultValue on error.
+func (e *FlagEvaluator) EvaluateBool(flagKey string, ctx map[string]interface{}, defaultValue bool) bool {
+	return e.EvaluateBoolDetails(flagKey, ctx, defaultValue).Value
 }
 
 // EvaluateString evaluates a string flag. Returns defaultValue on error.
 func (e *FlagEvaluator) EvaluateString(flagKey string, ctx map[string]interface{}, defaultValue string) string {
-	result, err := e.evaluateFlag(flagKey, ctx)
-	if err != nil || result.IsError() || result.Value == nil {
-		return defaultValue
-	}
-	if v, ok := result.Value.(string); ok {
-		return v
-	}
-	return defaultValue
+	return e.EvaluateStringDetails(flagKey, ctx, defaultValue).Value
 }
 
 // EvaluateInt evaluates an integer flag. Returns defaultValue on error.
 func (e *FlagEvaluator) EvaluateInt(flagKey string, ctx map[string]interface{}, defaultValue int64) int64 {
-	result, err := e.evaluateFlag(flagKey, ctx)
-	if err != nil || result.IsError() || result.Value == nil {
-		return defaultValue
-	}
-	// JSON numbers unmarshal as float64
-	if v, ok := result.Value.(float64); ok {
-		return int64(v)
-	}
-	return defaultValue
+	return e.EvaluateIntDetails(flagKey, ctx, defaultValue).Value
 }
 
 // EvaluateFloat evaluates a float flag. Returns defaultValue on error.
 func (e *FlagEvaluator) EvaluateFloat(flagKey string, ctx map[string]interface{}, defaultValue float64) float64 {
-	result, err := e.evaluateFlag(flagKey, ctx)
-	if err != nil || result.IsError() || result.Value == nil {
-		return defaultValue
+	return e.EvaluateFloatDetails(flagKey, ctx, defaultValue).Value
+}
+
+// EvaluateObject evaluates an object flag and unmarshals its value into T.
+// Returns def when the flag has no value, and def with a non-nil error when
+// evaluation fails or the value doesn't unmarshal into T.
+//
+// The value is decoded from the JSON returned by the evaluator, so numbers
+// keep full precision for integer fields of T.
+func EvaluateObject[T any](e *FlagEvaluator, flagKey string, ctx map[string]interface{}, def T) (T, error) {
+	d := EvaluateObjectDetails(e, flagKey, ctx, def)
+	return d.Value, d.Err
+}
+
+// EvaluateBoolDetails evaluates a boolean flag and returns the value together
+// with its variant and reason.
+func (e *FlagEvaluator) EvaluateBoolDetails(flagKey string, ctx map[string]interface{}, defaultValue bool) EvaluationDetails[bool] {
+	return evaluateDetails(e, flagKey, ctx, defaultValue, converter(e, toBool, coerceBool))
+}
+
+// EvaluateStringDetails evaluates a string flag and returns the value together
+// with its variant and reason.
+func (e *FlagEvaluator) EvaluateStringDetails(flagKey string, ctx map[string]interface{}, defaultValue string) EvaluationDetails[string] {
+	return evaluateDetails(e, flagKey, ctx, defaultValue, converter(e, toString, coerceString))
+}
+
+// EvaluateIntDetails evaluates an integer flag and returns the value together
+// with its variant and reason.
+func (e *FlagEvaluator) EvaluateIntDetails(flagKey string, ctx map[string]interface{}, defaultValue int64) EvaluationDetails[int64] {
+	return evaluateDetails(e, flagKey, ctx, defaultValue, converter(e, toInt, coerceInt))
+}
+
+// EvaluateFloatDetails evaluates a float flag and returns the value together
+// with its variant and reason.
+func (e *FlagEvaluator) EvaluateFloatDetails(flagKey string, ctx map[string]interface{}, defaultValue float64) EvaluationDetails[float64] {
+	return evaluateDetails(e, flagKey, ctx, defaultValue, converter(e, toFloat, coerceFloat))
+}
+
+// EvaluateObjectDetails is like EvaluateObject but also returns the variant
+// and reason.
+func EvaluateObjectDetails[T any](e *FlagEvaluator, flagKey string, ctx map[string]interface{}, def T) EvaluationDetails[T] {
+	return evaluateDetails(e, flagKey, ctx, def, toObject[T])
+}
+
+// evaluateDetails evaluates flagKey and converts the value with convert. A
+// null value yields def without an error. A value convert rejects yields def
+// with a TYPE_MISMATCH error and the variant that was selected. It is logged,
+// as it points at a flag whose variants don't match how it is read, once per
+// flag and configuration so a flag read in a hot path doesn't flood the log.
+func evaluateDetails[T any](e *FlagEvaluator, flagKey string, ctx map[string]interface{}, def T, convert func(*EvaluationResult) (T, error)) EvaluationDetails[T] {
+	// The result is only read, so a cached one needn't be copied
+	result, _, err := e.evaluateFlagAs(e.ctx, flagKey, ctx, nil, outputShared)
+	if err != nil {
+		return EvaluationDetails[T]{Value: def, Reason: ReasonError, Err: err}
+	}
+	if result.IsError() {
+		return EvaluationDetails[T]{
+			Value:  def,
+			Reason: result.Reason,
+			Err:    &EvaluationError{FlagKey: flagKey, Code: result.ErrorCode, Err: errors.New(result.ErrorMessage)},
+		}
 	}
-	if v, ok := result.Value.(float64); ok {
-		return v
+	if result.Value == nil {
+		return EvaluationDetails[T]{Value: def, Variant: result.Variant, Reason: result.Reason}
 	}
-	return defaultValue
+	v, err := convert(result)
+	if err != nil {
+		if _, logged := e.active.Load().snap.mismatchLogged.LoadOrStore(flagKey, struct{}{}); !logged {
+			e.logger.Warn("flag value type mismatch, default returned",
+				"flagKey", flagKey, "variant", result.Variant, "error", err)
+		}
+		return EvaluationDetails[T]{Value: def, Variant: result.Variant, Reason: ReasonError,
+			Err: &EvaluationError{FlagKey: flagKey, Code: ErrorTypeMismatch, Err: err}}
+	}
+	return EvaluationDetails[T]{Value: v, Variant: result.Variant, Reason: result.Reason}
+}
+
+func toBool(r *EvaluationResult) (bool, error) {
+	if v, ok := r.Value.(bool); ok {
+		return v, nil
+	}
+	return false, typeMismatch(r, "bool")
+}
+
+func toString(r *EvaluationResult) (string, error) {
+	if v, ok := r.Value.(string); ok {
+		return v, nil
+	}
+	return "", typeMismatch(r, "string")
+}
+
+func toInt(r *EvaluationResult) (int64, error) {
+	switch v := r.Value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, typeMismatch(r, "int64")
+}
+
+func toFloat(r *EvaluationResult) (float64, error) {
+	switch v := r.Value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, typeMismatch(r, "float64")
+}
+
+// toObject unmarshals the raw JSON value into T, falling back to
+// re-marshalling Value for results that carry no raw bytes.
+func toObject[T any](r *EvaluationResult) (T, error) {
+	var v T
+	raw := r.rawValue
+	if raw == nil {
+		var err error
+		if raw, err = json.Marshal(r.Value); err != nil {
+			return v, fmt.Errorf("failed to marshal value: %w", err)
+		}
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return v, fmt.Errorf("value does not match %T: %w", v, err)
+	}
+	return v, nil
+}
+
+func typeMismatch(r *EvaluationResult, want string) error {
+	return fmt.Errorf("value is %T, want %s", r.Value, want)
 }
 
 // evaluateFlag is the internal evaluation pipeline.
-func (e *FlagEvaluator) evaluateFlag(flagKey string, ctx map[string]interface{}) (*EvaluationResult, error) {
+func (e *FlagEvaluator) evaluateFlag(ctx context.Context, flagKey string, vals map[string]interface{}) (*EvaluationResult, error) {
+	result, _, err := e.evaluateFlagAs(ctx, flagKey, vals, nil, outputOwned)
+	return result, err
+}
+
+// evalOutput selects what evaluateFlagAs returns.
+type evalOutput int
+
+const (
+	// outputOwned returns a result of the caller's own.
+	outputOwned evalOutput = iota
+	// outputShared may return a result held by a cache, for callers that
+	// only read it, sparing the copy.
+	outputShared
+	// outputJSON is outputShared that also returns a result the module
+	// evaluated, or a pre-evaluated one, as JSON in data, the caller's own
+	// copy. result is then nil unless it was needed anyway, for metrics, the
+	// result cache or missing keys.
+	outputJSON
+)
+
+// share returns cached, a result held by a cache, as out requires: as is if
+// the caller only reads it, otherwise as a copy carrying missing.
+func (out evalOutput) share(cached *EvaluationResult, missing []string) *EvaluationResult {
+	if out != outputOwned && missing == nil {
+		return cached
+	}
+	return withMissingKeys(cached.clone(), missing)
+}
+
+// evaluateFlagAs runs the evaluation pipeline, returning the result as out
+// selects. With a non-nil override the context is override layered over vals,
+// built by evalInput for the snapshot the evaluation ends up using.
+func (e *FlagEvaluator) evaluateFlagAs(ctx context.Context, flagKey string, vals, override map[string]interface{}, out evalOutput) (result *EvaluationResult, data json.RawMessage, err error) {
+	if e.metrics != nil {
+		defer func(start time.Time) { e.recordEvaluation(start, result, err) }(time.Now())
+	}
+	defer func() {
+		if err != nil {
+			if errors.Is(err, ErrContextTooLarge) {
+				e.logger.Warn("evaluation context rejected",
+					"flagKey", flagKey, "error", err)
+			}
+			err = newEvaluationError(flagKey, err)
+		}
+	}()
+	if e.closed.Load() {
+		return nil, nil, ErrEvaluatorClosed
+	}
+	e.counters.evaluations.Add(1)
+
 	// Load caches atomically (lock-free)
-	snap := e.cache.Load()
+	snap := e.active.Load().snap
 
 	// Fast path: pre-evaluated cache hit (static/disabled flags)
 	if cached, ok := snap.preEvaluated[flagKey]; ok {
-		return cached, nil
+		e.counters.cacheHits.Add(1)
+		if out == outputJSON {
+			return cached, snap.preEvaluatedJSON(flagKey), nil
+		}
+		return out.share(cached, nil), nil, nil
 	}
+	input, anonymous := e.withAnonymousKey(e.evalInput(snap, flagKey, vals, override))
 
-	// Acquire an instance from the pool
-	inst := <-e.pool
-	defer func() { e.pool <- inst }()
+	// Serialize the context before acquiring an instance, so a result cache
+	// hit or a validation failure never touches the pool
+	buf := getBuffer()
+	defer putBuffer(buf)
+	requiredKeys, missing, failed, err := e.prepareContext(buf, snap, flagKey, input)
+	if err != nil || failed != nil {
+		return failed, nil, err
+	}
+	if precomputed, ok := snap.precomputedResult(flagKey, buf.Bytes()); ok {
+		e.counters.precomputedHits.Add(1)
+		return out.share(precomputed, missing), nil, nil
+	}
+	// A generated key makes the context unique, so its result isn't cached
+	var cacheKey *bytes.Buffer
+	if e.results != nil && !anonymous {
+		cacheKey = getBuffer()
+		defer putBuffer(cacheKey)
+		writeResultCacheKey(cacheKey, flagKey, buf.Bytes())
+		if cached, ok := e.results.get(snap.generation, cacheKey.Bytes()); ok {
+			e.counters.resultCacheHits.Add(1)
+			return out.share(cached, missing), nil, nil
+		}
+	}
+
+	// Acquire an instance from the pool. It is released as soon as the result
+	// has been copied out of its memory; held tracks whether that happened.
+	set, inst, err := e.acquireInstance(ctx)
+	if errors.Is(err, ErrPoolTimeout) {
+		return e.poolTimeoutResult(), nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	held := true
+	defer func() {
+		if held {
+			e.releaseInstance(set, inst, err)
+		}
+	}()
 
-	// If an UpdateState completed between cache.Load() and pool acquire,
-	// the snap has stale indices. Reload to match the instance's generation.
-	if snap.generation != inst.generation {
-		snap = e.cache.Load()
+	// If an UpdateState completed between the load and the acquire, the
+	// instance belongs to a newer set; use that set's snapshot so the flag
+	// indices match the instance's state.
+	if set.snap != snap {
+		snap = set.snap
+		e.counters.snapshotReloads.Add(1)
 		// Re-check pre-eval cache — flag may now be static
 		if cached, ok := snap.preEvaluated[flagKey]; ok {
-			return cached, nil
+			e.counters.cacheHits.Add(1)
+			if out == outputJSON {
+				return cached, snap.preEvaluatedJSON(flagKey), nil
+			}
+			return out.share(cached, nil), nil, nil
+		}
+		// An override is narrowed to the keys the flag reads in this snapshot
+		if override != nil {
+			input, _ = e.withAnonymousKey(e.evalInput(snap, flagKey, vals, override))
+		}
+		buf.Reset()
+		requiredKeys, missing, failed, err = e.prepareContext(buf, snap, flagKey, input)
+		if err != nil || failed != nil {
+			return failed, nil, err
+		}
+		if precomputed, ok := snap.precomputedResult(flagKey, buf.Bytes()); ok {
+			e.counters.precomputedHits.Add(1)
+			return out.share(precomputed, missing), nil, nil
+		}
+		if cacheKey != nil {
+			cacheKey.Reset()
+			writeResultCacheKey(cacheKey, flagKey, buf.Bytes())
 		}
 	}
 
-	// Determine context serialization strategy
-	var contextBytes []byte
-	requiredKeys := snap.requiredCtxKey[flagKey]
-	if requiredKeys != nil && len(ctx) > 0 {
-		contextBytes = serializeFilteredContext(ctx, requiredKeys, flagKey)
-	} else if len(ctx) > 0 {
-		var err error
-		contextBytes, err = json.Marshal(ctx)
+	// Don't start a WASM call for a request that has already been abandoned
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	resultBuf := getBuffer()
+	defer putBuffer(resultBuf)
+	resultData, err := e.evaluateWithTimeout(ctx, inst, snap, flagKey, requiredKeys, buf.Bytes(), resultBuf)
+
+	// Parsing is host-side only, so other evaluations can use the instance
+	// meanwhile
+	held = false
+	e.releaseInstance(set, inst, err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The module's JSON lacks missing keys, which need the result re-encoded
+	if out == outputJSON && missing == nil {
+		data = bytes.Clone(resultData)
+		if e.metrics == nil && cacheKey == nil {
+			return nil, data, nil
+		}
+	}
+	result, err = e.decodeEvalResult(flagKey, resultData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cacheKey != nil && !result.IsError() {
+		e.results.put(snap.generation, cacheKey.Bytes(), result)
+		return out.share(result, missing), data, nil
+	}
+	return withMissingKeys(result, missing), data, nil
+}
+
+// evalInput returns the context to evaluate flagKey with under snap: vals, or
+// with an override (see EvaluateFlagWith), override layered over vals and
+// narrowed to the keys the flag reads under snap.
+func (e *FlagEvaluator) evalInput(snap *cacheSnapshot, flagKey string, vals, override map[string]interface{}) map[string]interface{} {
+	if override == nil {
+		return vals
+	}
+	return overlayContext(vals, override, snap.requiredCtxKey[flagKey], e.targetingKeyField)
+}
+
+// prepareContext writes the evaluation context of flagKey under snap to buf
+// and returns the flag's required keys. With context validation it also
+// returns the missing keys, or failed if the flag must not be evaluated.
+func (e *FlagEvaluator) prepareContext(buf *bytes.Buffer, snap *cacheSnapshot, flagKey string, vals map[string]interface{}) (requiredKeys map[string]bool, missing []string, failed *EvaluationResult, err error) {
+	requiredKeys = snap.requiredCtxKey[flagKey]
+	defaults := e.loadDefaultContext()
+	if e.contextValidation && requiredKeys != nil {
+		if missing, failed = validateContext(vals, defaults, requiredKeys, e.targetingKeyField); failed != nil {
+			return nil, nil, failed, nil
+		}
+	}
+	enrich := e.needsEnrichment(snap, flagKey)
+	var timestamp int64
+	if enrich {
+		timestamp = e.clock().Unix()
+	}
+	if err := serializeContext(buf, vals, defaults, e.targetingKeyField, requiredKeys, e.enrichmentKey(flagKey), enrich, timestamp); err != nil {
+		return nil, nil, nil, err
+	}
+	return requiredKeys, missing, nil, nil
+}
+
+// withMissingKeys returns result with MissingKeys set to missing, if any.
+// result must be the caller's own: a result shared through a cache is cloned
+// first.
+func withMissingKeys(result *EvaluationResult, missing []string) *EvaluationResult {
+	if missing != nil {
+		result.MissingKeys = missing
+	}
+	return result
+}
+
+// clone returns a copy of r sharing nothing a caller could modify, so results
+// held in the pre-evaluated cache, the result cache or the precomputed
+// results can be handed out without callers affecting each other.
+func (r *EvaluationResult) clone() *EvaluationResult {
+	c := *r
+	c.Value = cloneValue(r.Value)
+	if r.FlagMetadata != nil {
+		c.FlagMetadata = make(map[string]interface{}, len(r.FlagMetadata))
+		for k, v := range r.FlagMetadata {
+			c.FlagMetadata[k] = cloneValue(v)
+		}
+	}
+	c.MissingKeys = slices.Clone(r.MissingKeys)
+	return &c
+}
+
+// cloneValue returns a deep copy of a decoded JSON value.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			c[k] = cloneValue(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, child := range v {
+			c[i] = cloneValue(child)
+		}
+		return c
+	}
+	return v
+}
+
+// poolTimeoutResult returns the result of an evaluation that gave up waiting
+// for a pool instance (see WithPoolWaitTimeout).
+func (e *FlagEvaluator) poolTimeoutResult() *EvaluationResult {
+	return &EvaluationResult{
+		Reason:       ReasonError,
+		ErrorCode:    ErrorPoolTimeout,
+		ErrorMessage: fmt.Sprintf("no pool instance available within %s", e.poolWaitTimeout),
+	}
+}
+
+// slowPoolWait is how long an acquire may wait for a pool instance before the
+// wait is logged as a warning.
+const slowPoolWait = 100 * time.Millisecond
+
+// poolGrowWait is how long an acquire waits for an instance before growing
+// the pool, and poolShrinkAfter how long the pool must go without waits
+// before it shrinks back, with WithMaxPoolSize.
+const (
+	poolGrowWait    = 10 * time.Millisecond
+	poolShrinkAfter = 30 * time.Second
+)
+
+// acquireInstance takes an instance from the active set's pool, blocking until
+// one is available, ctx is done, or the evaluator is closed. With
+// WithPoolWaitTimeout it returns ErrPoolTimeout once it has waited that long.
+// The instance must be returned to the returned set's pool. With
+// WithLazyPool, an acquire that finds the pool empty grows it before waiting;
+// with WithMaxPoolSize, one that has waited poolGrowWait grows it past the
+// pool size.
+//
+// The instance's generation always matches the set's snapshot. A caller that
+// waited on a set which was swapped out and then caught up with a newer state
+// gets an instance stamped with a later generation; it is put back and the
+// acquire retried on the current active set.
+func (e *FlagEvaluator) acquireInstance(ctx context.Context) (*instanceSet, *wasmInstance, error) {
+	// Bounds the total wait across retries; started by the first wait
+	var timeout *time.Timer
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		set := e.active.Load()
+		inst, shard := set.pool.tryGet()
+		if inst == nil && e.lazyPool {
+			grown, err := e.growPool(set, e.poolSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			if grown != nil {
+				return set, grown, nil
+			}
+			if e.active.Load() != set {
+				continue
+			}
+		}
+		if inst != nil {
+			if e.metrics != nil {
+				e.metrics.RecordPoolWait(0)
+			}
+		} else {
+			// Every shard is empty; wait on the one the search started at
+			e.counters.poolWaits.Add(1)
+			if timeout == nil && e.poolWaitTimeout > 0 {
+				timeout = time.NewTimer(e.poolWaitTimeout)
+				defer timeout.Stop()
+			}
+			var timedOut <-chan time.Time
+			if timeout != nil {
+				timedOut = timeout.C
+			}
+			start := time.Now()
+			// With WithMaxPoolSize, a wait that outlasts poolGrowWait grows
+			// the pool, and any wait holds off shrinking it
+			var grow *time.Timer
+			var growC <-chan time.Time
+			if e.maxPoolSize > e.poolSize {
+				e.lastPoolWait.Store(start.UnixNano())
+				if int(set.pool.created.Load()) < e.maxPoolSize {
+					grow = time.NewTimer(poolGrowWait)
+					growC = grow.C
+				}
+			}
+			select {
+			case inst = <-set.pool.shards[shard]:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-e.done:
+				return nil, nil, ErrEvaluatorClosed
+			case <-set.retired:
+				// Instances returned to the swapped-out set are taken by
+				// its catch-up; wait on the active set instead
+				if grow != nil {
+					grow.Stop()
+				}
+				continue
+			case <-timedOut:
+				e.observePoolWait(time.Since(start))
+				return nil, nil, ErrPoolTimeout
+			case <-growC:
+				grown, err := e.growPool(set, e.maxPoolSize)
+				if err != nil {
+					return nil, nil, err
+				}
+				if grown != nil {
+					e.observePoolWait(time.Since(start))
+					return set, grown, nil
+				}
+				// Grown to the limit by another acquire, or swapped out
+				continue
+			}
+			if grow != nil {
+				grow.Stop()
+			}
+			e.observePoolWait(time.Since(start))
+		}
+		if inst.generation == set.snap.generation {
+			return set, inst, nil
+		}
+		set.pool.put(inst)
+	}
+}
+
+// observePoolWait records a wait for a pool instance, logging slow ones.
+func (e *FlagEvaluator) observePoolWait(wait time.Duration) {
+	if e.metrics != nil {
+		e.metrics.RecordPoolWait(wait)
+	}
+	if wait >= slowPoolWait {
+		e.logger.Warn("slow wait for a pool instance",
+			"wait", wait, "poolSize", e.poolSize)
+	}
+}
+
+// EvaluateFlags evaluates several flags against the same context and returns
+// the results keyed by flag key.
+//
+// Pre-evaluated (static/disabled) flags are served from the cache without
+// touching the pool. The remaining flags are evaluated under a single pool
+// instance, and the filtered context is serialized once per distinct set of
+// required keys rather than once per flag.
+func (e *FlagEvaluator) EvaluateFlags(flagKeys []string, ctx map[string]interface{}) (map[string]*EvaluationResult, error) {
+	return e.evaluateFlags(func(*cacheSnapshot) []string { return flagKeys }, ctx)
+}
+
+// EvaluateAllFlags evaluates every flag in the current configuration against
+// ctx, as needed for OFREP-style bulk evaluation. Results are keyed by flag key.
+//
+// All results come from a single generation: if UpdateState races with the
+// call, the flag set is re-read from the snapshot matching the acquired
+// instance before anything is evaluated.
+func (e *FlagEvaluator) EvaluateAllFlags(ctx map[string]interface{}) (map[string]*EvaluationResult, error) {
+	return e.evaluateFlags((*cacheSnapshot).allFlagKeys, ctx)
+}
+
+// evaluateFlags is the shared batch pipeline. keysFor selects the flag keys to
+// evaluate from a snapshot, so the set can be re-derived if the generation
+// changes before an instance is acquired.
+func (e *FlagEvaluator) evaluateFlags(keysFor func(*cacheSnapshot) []string, ctx map[string]interface{}) (results map[string]*EvaluationResult, err error) {
+	if e.metrics != nil {
+		defer func(start time.Time) { e.recordBatch(start, results, err) }(time.Now())
+	}
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+
+	snap := e.active.Load().snap
+	flagKeys := keysFor(snap)
+	results = make(map[string]*EvaluationResult, len(flagKeys))
+
+	pending := servePreEvaluated(snap, flagKeys, results)
+	if len(pending) == 0 {
+		e.countBatch(len(flagKeys), len(pending))
+		return results, nil
+	}
+
+	// Acquire one instance for the whole batch
+	set, inst, err := e.acquireInstance(e.ctx)
+	if errors.Is(err, ErrPoolTimeout) {
+		// Cached results are still served; the rest fail with POOL_TIMEOUT
+		e.countBatch(len(flagKeys), len(pending))
+		for _, flagKey := range pending {
+			results[flagKey] = e.poolTimeoutResult()
+		}
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { e.releaseInstance(set, inst, err) }()
+
+	// Same snapshot check as evaluateFlag. Holding the instance pins the
+	// generation, so every result in the batch comes from one snapshot.
+	if set.snap != snap {
+		snap = set.snap
+		e.counters.snapshotReloads.Add(1)
+		flagKeys = keysFor(snap)
+		clear(results)
+		pending = servePreEvaluated(snap, flagKeys, results)
+	}
+	e.countBatch(len(flagKeys), len(pending))
+
+	ctx, anonymous := e.withAnonymousKey(ctx)
+	if err := e.evaluateBatch(inst, snap, pending, ctx, anonymous, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// countBatch records a batch of flag evaluations, of which all but pending
+// were served from the pre-evaluated cache.
+func (e *FlagEvaluator) countBatch(flags, pending int) {
+	e.counters.evaluations.Add(uint64(flags))
+	e.counters.cacheHits.Add(uint64(flags - pending))
+}
+
+// servePreEvaluated copies pre-evaluated results for flagKeys into results and
+// returns the keys that still need a WASM evaluation.
+func servePreEvaluated(snap *cacheSnapshot, flagKeys []string, results map[string]*EvaluationResult) []string {
+	pending := make([]string, 0, len(flagKeys))
+	for _, flagKey := range flagKeys {
+		if cached, ok := snap.preEvaluated[flagKey]; ok {
+			results[flagKey] = cached.clone()
+			continue
+		}
+		pending = append(pending, flagKey)
+	}
+	return pending
+}
+
+// evaluateBatch evaluates flagKeys on an already-acquired instance, reusing the
+// serialized context across flags that share the same required keys. The
+// result cache is bypassed when ctx holds a generated anonymous key.
+func (e *FlagEvaluator) evaluateBatch(inst *wasmInstance, snap *cacheSnapshot, flagKeys []string, ctx map[string]interface{}, anonymous bool, results map[string]*EvaluationResult) error {
+	cache := e.results
+	if anonymous {
+		cache = nil
+	}
+	// Context bodies (without $flagd enrichment): filtered bodies keyed by
+	// key-set signature, plus the full context for flags without required keys
+	bodies := make(map[string]string)
+	defaults := e.loadDefaultContext()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	resultBuf := getBuffer()
+	defer putBuffer(resultBuf)
+	cacheKey := getBuffer()
+	defer putBuffer(cacheKey)
+	var fullBody string
+	haveFullBody := false
+	var timestamp int64
+	haveTimestamp := false
+
+	for _, flagKey := range flagKeys {
+		var body string
+		requiredKeys := snap.requiredCtxKey[flagKey]
+		var missing []string
+		if e.contextValidation && requiredKeys != nil {
+			var failed *EvaluationResult
+			if missing, failed = validateContext(ctx, defaults, requiredKeys, e.targetingKeyField); failed != nil {
+				results[flagKey] = failed
+				continue
+			}
+		}
+		if requiredKeys != nil {
+			sig := keySetSignature(requiredKeys)
+			var ok bool
+			if body, ok = bodies[sig]; !ok {
+				buf.Reset()
+				writeFilteredContext(buf, ctx, defaults, e.targetingKeyField, requiredKeys)
+				body = buf.String()
+				bodies[sig] = body
+			}
+		} else {
+			if !haveFullBody {
+				buf.Reset()
+				if err := writeFullContext(buf, ctx, defaults, e.targetingKeyField); err != nil {
+					return newEvaluationError(flagKey, err)
+				}
+				fullBody = buf.String()
+				haveFullBody = true
+			}
+			body = fullBody
+		}
+
+		buf.Reset()
+		buf.WriteString(body)
+		enrich := e.needsEnrichment(snap, flagKey)
+		if enrich && !haveTimestamp {
+			timestamp = e.clock().Unix()
+			haveTimestamp = true
+		}
+		writeContextEnd(buf, e.enrichmentKey(flagKey), enrich, timestamp)
+
+		if precomputed, ok := snap.precomputedResult(flagKey, buf.Bytes()); ok {
+			e.counters.precomputedHits.Add(1)
+			results[flagKey] = withMissingKeys(precomputed.clone(), missing)
+			continue
+		}
+		if cache != nil {
+			cacheKey.Reset()
+			writeResultCacheKey(cacheKey, flagKey, buf.Bytes())
+			if cached, ok := cache.get(snap.generation, cacheKey.Bytes()); ok {
+				e.counters.resultCacheHits.Add(1)
+				results[flagKey] = withMissingKeys(cached.clone(), missing)
+				continue
+			}
+		}
+
+		resultBuf.Reset()
+		data, err := e.evaluateWithTimeout(e.ctx, inst, snap, flagKey, requiredKeys, buf.Bytes(), resultBuf)
+		if err != nil {
+			return newEvaluationError(flagKey, err)
+		}
+		result, err := e.decodeEvalResult(flagKey, data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to marshal context: %w", err)
+			return newEvaluationError(flagKey, err)
+		}
+		if cache != nil && !result.IsError() {
+			cache.put(snap.generation, cacheKey.Bytes(), result)
+			result = result.clone()
 		}
+		results[flagKey] = withMissingKeys(result, missing)
 	}
+	return nil
+}
 
-	// Evaluate using the instance
+// keySetSignature returns a canonical string identifying a required-key set,
+// so flags with equal sets can share one serialized context body.
+func keySetSignature(keys map[string]bool) string {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x00")
+}
+
+// evaluateOnInstance evaluates a single flag on an already-acquired instance,
+// preferring the index-based export when the flag has a known index. The
+// result JSON is copied into buf and returned undecoded, so the instance can
+// be released before decodeEvalResult runs.
+func evaluateOnInstance(ctx context.Context, inst *wasmInstance, snap *cacheSnapshot, flagKey string, requiredKeys map[string]bool, contextBytes []byte, buf *bytes.Buffer) ([]byte, error) {
 	flagIndex, hasIndex := snap.flagIndex[flagKey]
 	if hasIndex && inst.evalByIndexFn != nil && requiredKeys != nil {
-		return evaluateByIndex(e.ctx, inst, flagIndex, contextBytes)
+		return evaluateByIndex(ctx, inst, flagIndex, contextBytes, buf)
+	}
+	return evaluateReusable(ctx, inst, flagKey, contextBytes, buf)
+}
+
+// evaluateWithTimeout is evaluateOnInstance bounded by the evaluation
+// timeout, if one is set. ctx is the evaluation's own context: a call stopped
+// by its cancellation fails with ctx.Err(), one stopped by the timeout with
+// ErrEvaluationTimeout, each wrapping the call's error.
+func (e *FlagEvaluator) evaluateWithTimeout(ctx context.Context, inst *wasmInstance, snap *cacheSnapshot, flagKey string, requiredKeys map[string]bool, contextBytes []byte, buf *bytes.Buffer) ([]byte, error) {
+	if e.evaluationTimeout <= 0 {
+		return evaluateOnInstance(ctx, inst, snap, flagKey, requiredKeys, contextBytes, buf)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, e.evaluationTimeout)
+	defer cancel()
+	data, err := evaluateOnInstance(callCtx, inst, snap, flagKey, requiredKeys, contextBytes, buf)
+	if err != nil && callCtx.Err() != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return nil, fmt.Errorf("%w after %s: %w", ErrEvaluationTimeout, e.evaluationTimeout, err)
 	}
-	return evaluateReusable(e.ctx, inst, flagKey, contextBytes)
+	return data, err
 }
 
 // evaluateByIndex calls the evaluate_by_index WASM export on a specific instance.
-func evaluateByIndex(ctx context.Context, inst *wasmInstance, flagIndex uint32, contextBytes []byte) (result *EvaluationResult, err error) {
+func evaluateByIndex(ctx context.Context, inst *wasmInstance, flagIndex uint32, contextBytes []byte, buf *bytes.Buffer) (data []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			result = nil
-			err = fmt.Errorf("WASM panic: %v", r)
+			data = nil
+			err = fmt.Errorf("%w: panic: %v", ErrWasmTrap, r)
 		}
 	}()
 
-	var contextPtr, contextLen uint32
-	if len(contextBytes) > 0 {
-		if err := writeToPreallocBuffer(inst.module, inst.contextBufPtr, maxContextSize, contextBytes); err != nil {
-			return nil, err
-		}
-		contextPtr = inst.contextBufPtr
-		contextLen = uint32(len(contextBytes))
+	contextPtr, contextLen, err := writeContext(ctx, inst, contextBytes)
+	if err != nil {
+		return nil, err
 	}
 
+	inst.evals++
 	results, err := inst.evalByIndexFn.Call(ctx, uint64(flagIndex), uint64(contextPtr), uint64(contextLen))
 	if err != nil {
-		return nil, fmt.Errorf("evaluate_by_index call failed: %w", err)
+		return nil, fmt.Errorf("%w: evaluate_by_index call failed: %w", ErrWasmTrap, err)
 	}
 
-	return readEvalResult(ctx, inst, results[0])
+	return readEvalResult(ctx, inst, results[0], buf)
 }
 
 // evaluateReusable calls the evaluate_reusable WASM export on a specific instance.
-func evaluateReusable(ctx context.Context, inst *wasmInstance, flagKey string, contextBytes []byte) (result *EvaluationResult, err error) {
+func evaluateReusable(ctx context.Context, inst *wasmInstance, flagKey string, contextBytes []byte, buf *bytes.Buffer) (data []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			result = nil
-			err = fmt.Errorf("WASM panic: %v", r)
+			data = nil
+			err = fmt.Errorf("%w: panic: %v", ErrWasmTrap, r)
 		}
 	}()
 
 	flagBytes := []byte(flagKey)
-	if err := writeToPreallocBuffer(inst.module, inst.flagKeyBufPtr, maxFlagKeySize, flagBytes); err != nil {
-		return nil, fmt.Errorf("flag key too large: %w", err)
+	if len(flagBytes) > int(inst.flagKeyBufSize) {
+		return nil, &FlagKeyTooLargeError{Size: len(flagBytes), Max: int(inst.flagKeyBufSize)}
+	}
+	if err := writeToPreallocBuffer(inst.module, inst.flagKeyBufPtr, inst.flagKeyBufSize, flagBytes); err != nil {
+		return nil, err
 	}
 
-	var contextPtr, contextLen uint32
-	if len(contextBytes) > 0 {
-		if err := writeToPreallocBuffer(inst.module, inst.contextBufPtr, maxContextSize, contextBytes); err != nil {
-			return nil, err
-		}
-		contextPtr = inst.contextBufPtr
-		contextLen = uint32(len(contextBytes))
+	contextPtr, contextLen, err := writeContext(ctx, inst, contextBytes)
+	if err != nil {
+		return nil, err
 	}
 
+	inst.evals++
 	results, err := inst.evalReusableFn.Call(ctx,
 		uint64(inst.flagKeyBufPtr), uint64(len(flagBytes)),
 		uint64(contextPtr), uint64(contextLen))
 	if err != nil {
-		return nil, fmt.Errorf("evaluate_reusable call failed: %w", err)
+		return nil, fmt.Errorf("%w: evaluate_reusable call failed: %w", ErrWasmTrap, err)
 	}
 
-	return readEvalResult(ctx, inst, results[0])
+	return readEvalResult(ctx, inst, results[0], buf)
 }
 
-// readEvalResult reads and parses an evaluation result from a packed u64.
-func readEvalResult(ctx context.Context, inst *wasmInstance, packed uint64) (*EvaluationResult, error) {
+// writeContext copies contextBytes into the instance's context buffer,
+// growing it if needed, and returns the pointer and length to pass to an
+// evaluate export. An empty context is passed as (0, 0).
+func writeContext(ctx context.Context, inst *wasmInstance, contextBytes []byte) (uint32, uint32, error) {
+	if len(contextBytes) == 0 {
+		return 0, 0, nil
+	}
+	if len(contextBytes) > int(inst.contextBufMax) {
+		return 0, 0, fmt.Errorf("%w: %d bytes exceeds maximum of %d", ErrContextTooLarge, len(contextBytes), inst.contextBufMax)
+	}
+	if len(contextBytes) > int(inst.contextBufSize) {
+		if err := growContextBuffer(ctx, inst, uint32(len(contextBytes))); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := writeToPreallocBuffer(inst.module, inst.contextBufPtr, inst.contextBufSize, contextBytes); err != nil {
+		return 0, 0, err
+	}
+	return inst.contextBufPtr, uint32(len(contextBytes)), nil
+}
+
+// growContextBuffer replaces inst's context buffer with one of at least size
+// bytes, doubling the current size up to contextBufMax. WASM memory never
+// shrinks, so the instance keeps the larger buffer until it is recycled.
+func growContextBuffer(ctx context.Context, inst *wasmInstance, size uint32) error {
+	grown := uint64(inst.contextBufSize)
+	for grown < uint64(size) {
+		grown *= 2
+	}
+	grown = min(grown, uint64(inst.contextBufMax))
+
+	results, err := inst.allocFn.Call(ctx, grown)
+	if err != nil {
+		return fmt.Errorf("%w: alloc failed: %w", ErrWasmTrap, err)
+	}
+	if results[0] == 0 {
+		return fmt.Errorf("%w: alloc of %d bytes for the context buffer failed: out of memory", ErrWasmTrap, grown)
+	}
+	inst.deallocFn.Call(ctx, uint64(inst.contextBufPtr), uint64(inst.contextBufSize))
+	inst.contextBufPtr = uint32(results[0])
+	inst.contextBufSize = uint32(grown)
+	return nil
+}
+
+// readEvalResult copies the evaluation result at the packed u64 into buf and
+// frees it in WASM memory.
+func readEvalResult(ctx context.Context, inst *wasmInstance, packed uint64, buf *bytes.Buffer) ([]byte, error) {
 	resultPtr, resultLen := unpackPtrLen(packed)
-	resultBytes, err := readFromWasm(inst.module, resultPtr, resultLen)
+	data, err := readFromWasmInto(inst.module, resultPtr, resultLen, buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read evaluation result: %w", err)
 	}
 	inst.deallocFn.Call(ctx, uint64(resultPtr), uint64(resultLen))
+	return data, nil
+}
 
-	result, err := parseEvalResult(resultBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse evaluation result: %w", err)
+// decodeEvalResult parses flagKey's evaluation result read by readEvalResult.
+// The result doesn't reference data, which may be a pooled buffer.
+// Results the fast parser doesn't recognize are counted in Stats.
+func (e *FlagEvaluator) decodeEvalResult(flagKey string, data []byte) (*EvaluationResult, error) {
+	result, ok := parseEvalResultFast(data)
+	if !ok {
+		e.counters.parseFallbacks.Add(1)
+		e.logger.Debug("evaluation result not recognized by the fast parser, falling back to encoding/json",
+			"flagKey", flagKey, "result", string(data))
+		var err error
+		if result, err = unmarshalEvalResult(data); err != nil {
+			return nil, fmt.Errorf("failed to parse evaluation result: %w", err)
+		}
 	}
+	result.rawValue = bytes.Clone(result.rawValue)
 	return result, nil
 }
 
-// serializeFilteredContext builds a JSON context with only the required keys,
-// plus targetingKey and $flagd enrichment. Uses strings.Builder for performance.
-func serializeFilteredContext(ctx map[string]interface{}, requiredKeys map[string]bool, flagKey string) []byte {
-	var b strings.Builder
-	b.Grow(256)
+// serializeContext writes the JSON evaluation context for flagKey to b. When the
+// flag's required keys are known only those are serialized; otherwise the
+// whole context is. Both paths add targetingKey and, if enrich is set, $flagd
+// enrichment, so a rule sees the same fields whichever path produced its
+// context. timestamp is the Unix time reported as $flagd.timestamp. Keys
+// missing from ctx are taken from defaults. tkField is the field standing in
+// for a missing targetingKey (see targetingKeyValue), or "".
+func serializeContext(b *bytes.Buffer, ctx, defaults map[string]interface{}, tkField string, requiredKeys map[string]bool, flagKey string, enrich bool, timestamp int64) error {
+	if requiredKeys != nil {
+		serializeFilteredContext(b, ctx, defaults, tkField, requiredKeys, flagKey, enrich, timestamp)
+		return nil
+	}
+	if err := writeFullContext(b, ctx, defaults, tkField); err != nil {
+		return err
+	}
+	writeContextEnd(b, flagKey, enrich, timestamp)
+	return nil
+}
+
+// writeFullContext writes every key of ctx layered over defaults, plus an
+// empty targetingKey if neither has one. Like writeFilteredContext, the object
+// is left open for writeFlagdEnrichment.
+func writeFullContext(b *bytes.Buffer, ctx, defaults map[string]interface{}, tkField string) error {
+	ctx = mergeContext(ctx, defaults, tkField)
+	b.WriteByte('{')
+	if len(ctx) > 0 {
+		data, err := json.Marshal(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to marshal context: %w", err)
+		}
+		b.Write(data[1 : len(data)-1]) // members without the braces
+	}
+	if _, ok := ctx["targetingKey"]; !ok {
+		if len(ctx) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"targetingKey":""`)
+	}
+	return nil
+}
+
+// serializeFilteredContext writes a JSON context with only the required keys,
+// plus targetingKey and $flagd enrichment, to b.
+func serializeFilteredContext(b *bytes.Buffer, ctx, defaults map[string]interface{}, tkField string, requiredKeys map[string]bool, flagKey string, enrich bool, timestamp int64) {
+	writeFilteredContext(b, ctx, defaults, tkField, requiredKeys)
+	writeContextEnd(b, flagKey, enrich, timestamp)
+}
+
+// writeFilteredContext writes the opening brace, the required keys present in
+// ctx or defaults, and targetingKey. The object is left open for
+// writeFlagdEnrichment.
+func writeFilteredContext(b *bytes.Buffer, ctx, defaults map[string]interface{}, tkField string, requiredKeys map[string]bool) {
 	b.WriteByte('{')
 
 	first := true
@@ -198,12 +1023,28 @@ func serializeFilteredContext(ctx map[string]interface{}, requiredKeys map[strin
 		first = false
 	}
 
-	// Write required keys from context
+	// Write required keys from context in sorted order, so equal contexts
+	// serialize to equal bytes. Dotted paths are collected and written
+	// afterwards as minimal nested objects.
+	var paths *pathNode
+	var keyArray [16]string
+	keys := keyArray[:0]
 	for key := range requiredKeys {
-		if key == "targetingKey" || key == "$flagd.flagKey" || key == "$flagd.timestamp" {
+		if key == "targetingKey" || strings.HasPrefix(key, "$flagd.") {
 			continue // handled separately
 		}
-		val, exists := ctx[key]
+		if strings.IndexByte(key, '.') >= 0 {
+			if paths == nil {
+				paths = &pathNode{}
+			}
+			paths.insert(key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		val, exists := contextValue(ctx, defaults, key)
 		if !exists {
 			continue
 		}
@@ -211,38 +1052,148 @@ func serializeFilteredContext(ctx map[string]interface{}, requiredKeys map[strin
 		b.WriteByte('"')
 		b.WriteString(key)
 		b.WriteString(`":`)
-		writeJSONValue(&b, val)
+		writeJSONValue(b, val)
+	}
+
+	if paths != nil {
+		for _, name := range paths.sortedChildren() {
+			if requiredKeys[name] {
+				continue // whole value already written
+			}
+			val, exists := contextValue(ctx, defaults, name)
+			if !exists {
+				continue
+			}
+			writeComma()
+			b.WriteByte('"')
+			b.WriteString(name)
+			b.WriteString(`":`)
+			paths.children[name].write(b, val)
+		}
 	}
 
-	// Always include targetingKey
+	// Always include targetingKey, which fractional bucketing reads
 	writeComma()
 	b.WriteString(`"targetingKey":`)
-	if tk, ok := ctx["targetingKey"]; ok {
-		writeJSONValue(&b, tk)
+	if tk, ok := targetingKeyValue(ctx, defaults, tkField); ok {
+		writeJSONValue(b, tk)
 	} else {
 		b.WriteString(`""`)
 	}
+}
 
-	// $flagd enrichment
-	writeComma()
-	b.WriteString(`"$flagd":{"flagKey":"`)
-	b.WriteString(flagKey)
-	b.WriteString(`","timestamp":`)
-	b.WriteString(strconv.FormatInt(time.Now().Unix(), 10))
-	b.WriteByte('}')
+// pathNode is a trie of dotted context paths such as "user.profile.tier".
+// A leaf selects the whole value at that path.
+type pathNode struct {
+	leaf     bool
+	children map[string]*pathNode
+}
+
+func (n *pathNode) insert(path string) {
+	for _, seg := range strings.Split(path, ".") {
+		if n.leaf {
+			return // an ancestor is already required in full
+		}
+		child, ok := n.children[seg]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*pathNode)
+			}
+			child = &pathNode{}
+			n.children[seg] = child
+		}
+		n = child
+	}
+	n.leaf = true
+	n.children = nil
+}
+
+func (n *pathNode) sortedChildren() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
+// write writes the parts of val selected by n. Intermediate levels that are
+// missing or not objects yield an empty object, which resolves the same as
+// an absent value in targeting rules.
+func (n *pathNode) write(b *bytes.Buffer, val interface{}) {
+	if n.leaf {
+		writeJSONValue(b, val)
+		return
+	}
+	m, _ := val.(map[string]interface{})
+	b.WriteByte('{')
+	first := true
+	for _, name := range n.sortedChildren() {
+		child, exists := m[name]
+		if !exists {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteByte('"')
+		b.WriteString(name)
+		b.WriteString(`":`)
+		n.children[name].write(b, child)
+	}
 	b.WriteByte('}')
-	return []byte(b.String())
 }
 
+// needsEnrichment reports whether flagKey's context must carry $flagd.
+func (e *FlagEvaluator) needsEnrichment(snap *cacheSnapshot, flagKey string) bool {
+	return !e.withoutEnrichment && !snap.flagdFree[flagKey]
+}
+
+// writeContextEnd closes a context with either the $flagd enrichment or the
+// empty placeholder.
+func writeContextEnd(b *bytes.Buffer, flagKey string, enrich bool, timestamp int64) {
+	if enrich {
+		writeFlagdEnrichment(b, flagKey, timestamp)
+	} else {
+		writeFlagdPlaceholder(b)
+	}
+}
+
+// writeFlagdPlaceholder appends an empty $flagd object and closes the context.
+// The module enriches any context without a $flagd key itself, so the
+// placeholder is what actually skips enrichment.
+func writeFlagdPlaceholder(b *bytes.Buffer) {
+	b.WriteString(`,"$flagd":{}}`)
+}
+
+// writeFlagdEnrichment appends the $flagd object and closes the context
+// opened by writeFilteredContext.
+func writeFlagdEnrichment(b *bytes.Buffer, flagKey string, timestamp int64) {
+	b.WriteString(`,"$flagd":{"flagKey":"`)
+	b.WriteString(flagKey)
+	b.WriteString(`","timestamp":`)
+	b.WriteString(strconv.FormatInt(timestamp, 10))
+	b.WriteString("}}")
+}
+
+// maxJSONFastPathDepth bounds how deeply writeJSONValue recurses into slices
+// and maps itself. Deeper values go through json.Marshal, which also turns a
+// cyclic map into an error rather than a stack overflow.
+const maxJSONFastPathDepth = 32
+
 // writeJSONValue writes a JSON-encoded value to the builder.
-// For simple types it avoids json.Marshal overhead.
-func writeJSONValue(b *strings.Builder, val interface{}) {
+// For scalars, string slices and JSON-shaped slices and maps it avoids
+// json.Marshal overhead. Map keys are sorted, as json.Marshal sorts them, so
+// equal contexts serialize identically for the result cache.
+func writeJSONValue(b *bytes.Buffer, val interface{}) {
+	writeJSONValueDepth(b, val, 0)
+}
+
+func writeJSONValueDepth(b *bytes.Buffer, val interface{}, depth int) {
 	switch v := val.(type) {
 	case string:
-		b.WriteByte('"')
-		b.WriteString(escapeJSONString(v))
-		b.WriteByte('"')
+		writeJSONString(b, v)
 	case bool:
 		if v {
 			b.WriteString("true")
@@ -257,56 +1208,213 @@ func writeJSONValue(b *strings.Builder, val interface{}) {
 		b.WriteString(strconv.Itoa(v))
 	case int64:
 		b.WriteString(strconv.FormatInt(v, 10))
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int16:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case int8:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case uint:
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint64:
+		b.WriteString(strconv.FormatUint(v, 10))
+	case uint32:
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint16:
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint8:
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	case json.Number:
+		// Written as decoded, keeping the caller's precision; text that
+		// isn't a JSON number is left to json.Marshal, which rejects it
+		if isJSONNumber(string(v)) {
+			b.WriteString(string(v))
+		} else {
+			writeMarshaledJSON(b, v)
+		}
 	case nil:
 		b.WriteString("null")
-	default:
-		// Fall back to json.Marshal for complex types
-		data, err := json.Marshal(v)
-		if err != nil {
+	case []string:
+		if v == nil {
 			b.WriteString("null")
 			return
 		}
-		b.Write(data)
+		b.WriteByte('[')
+		for i, s := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, s)
+		}
+		b.WriteByte(']')
+	case []interface{}:
+		if v == nil || depth >= maxJSONFastPathDepth {
+			writeMarshaledJSON(b, v)
+			return
+		}
+		b.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONValueDepth(b, elem, depth+1)
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		if v == nil || depth >= maxJSONFastPathDepth {
+			writeMarshaledJSON(b, v)
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(b, key)
+			b.WriteByte(':')
+			writeJSONValueDepth(b, v[key], depth+1)
+		}
+		b.WriteByte('}')
+	default:
+		// Fall back to json.Marshal for other types
+		writeMarshaledJSON(b, v)
 	}
 }
 
-// escapeJSONString escapes special characters in a JSON string value.
+// writeJSONString writes s as a JSON string.
+func writeJSONString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	b.WriteString(escapeJSONString(s))
+	b.WriteByte('"')
+}
+
+// isJSONNumber reports whether s is a number in JSON's grammar.
+func isJSONNumber(s string) bool {
+	digits := func(i int) int {
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	switch {
+	case i < len(s) && s[i] == '0':
+		i++
+	case i < len(s) && s[i] >= '1' && s[i] <= '9':
+		i = digits(i + 1)
+	default:
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		if j := digits(i + 1); j > i+1 {
+			i = j
+		} else {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if j := digits(i); j > i {
+			i = j
+		} else {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+// writeMarshaledJSON writes v encoded by json.Marshal, or null if it can't be
+// encoded.
+func writeMarshaledJSON(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		b.WriteString("null")
+		return
+	}
+	b.Write(data)
+}
+
+// escapeJSONString escapes special characters in a JSON string value as
+// encoding/json does without HTML escaping: quotes, backslashes and control
+// characters are escaped, as are U+2028 and U+2029, which JavaScript
+// consumers can't take verbatim, and invalid UTF-8 bytes become U+FFFD.
 func escapeJSONString(s string) string {
 	// Fast path: no escaping needed for most strings
-	needsEscape := false
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if c == '"' || c == '\\' || c < 0x20 {
-			needsEscape = true
+	i := 0
+	for i < len(s) {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c == '"' || c == '\\' || c < 0x20 {
+				break
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' || r == '\u2029' {
 			break
 		}
+		i += size
 	}
-	if !needsEscape {
+	if i == len(s) {
 		return s
 	}
 
+	const hex = "0123456789abcdef"
 	var b strings.Builder
 	b.Grow(len(s) + 10)
-	for i := 0; i < len(s); i++ {
+	b.WriteString(s[:i])
+	for i < len(s) {
 		c := s[i]
-		switch c {
-		case '"':
-			b.WriteString(`\"`)
-		case '\\':
-			b.WriteString(`\\`)
-		case '\n':
-			b.WriteString(`\n`)
-		case '\r':
-			b.WriteString(`\r`)
-		case '\t':
-			b.WriteString(`\t`)
-		default:
-			if c < 0x20 {
-				fmt.Fprintf(&b, `\u%04x`, c)
-			} else {
-				b.WriteByte(c)
+		if c < utf8.RuneSelf {
+			switch c {
+			case '"':
+				b.WriteString(`\"`)
+			case '\\':
+				b.WriteString(`\\`)
+			case '\b':
+				b.WriteString(`\b`)
+			case '\f':
+				b.WriteString(`\f`)
+			case '\n':
+				b.WriteString(`\n`)
+			case '\r':
+				b.WriteString(`\r`)
+			case '\t':
+				b.WriteString(`\t`)
+			default:
+				if c < 0x20 {
+					b.WriteString(`\u00`)
+					b.WriteByte(hex[c>>4])
+					b.WriteByte(hex[c&0xf])
+				} else {
+					b.WriteByte(c)
+				}
 			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`\ufffd`)
+		case r == '\u2028' || r == '\u2029':
+			b.WriteString(`\u202`)
+			b.WriteByte(hex[r&0xf])
+		default:
+			b.WriteString(s[i : i+size])
 		}
+		i += size
 	}
 	return b.String()
 }
@@ -0,0 +1,219 @@
+package evaluator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EvaluateFlagJSON evaluates a flag against a context already serialized as a
+// JSON object (e.g. forwarded from an upstream service or an OFREP request
+// body), without decoding it into a map only for it to be encoded again.
+//
+// The context's members are copied as they are: only those the flag's
+// targeting reads (all of them if that isn't known) are kept, and $flagd is
+// replaced by the evaluator's own enrichment as in EvaluateFlag. The caller is
+// responsible for everything else: the context should include targetingKey,
+// and the default context, WithTargetingKeyField, WithAnonymousKey and
+// WithContextValidation don't apply. An empty targetingKey is added if the
+// context has none. Results bypass the result cache.
+//
+// A context larger than the context buffer (see WithMaxContextSize) fails with
+// ErrContextTooLarge before an instance is acquired. A context that isn't a
+// JSON object is passed to the module unchanged, which reports it as a
+// PARSE_ERROR result; values of members the flag doesn't read are skipped
+// without being validated.
+func (e *FlagEvaluator) EvaluateFlagJSON(flagKey string, contextJSON []byte) (result *EvaluationResult, err error) {
+	if e.metrics != nil {
+		defer func(start time.Time) { e.recordEvaluation(start, result, err) }(time.Now())
+	}
+	defer func() {
+		if err != nil {
+			err = newEvaluationError(flagKey, err)
+		}
+	}()
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+	e.counters.evaluations.Add(1)
+
+	snap := e.active.Load().snap
+	if cached, ok := snap.preEvaluated[flagKey]; ok {
+		e.counters.cacheHits.Add(1)
+		return cached.clone(), nil
+	}
+	if len(contextJSON) > int(e.maxContextSize) {
+		return nil, fmt.Errorf("%w: %d bytes exceeds maximum of %d", ErrContextTooLarge, len(contextJSON), e.maxContextSize)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	requiredKeys, ok := e.prepareJSONContext(buf, snap, flagKey, contextJSON)
+
+	set, inst, err := e.acquireInstance(e.ctx)
+	if errors.Is(err, ErrPoolTimeout) {
+		return e.poolTimeoutResult(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	held := true
+	defer func() {
+		if held {
+			e.releaseInstance(set, inst, err)
+		}
+	}()
+
+	// As in EvaluateFlag, the context must be filtered with the snapshot
+	// matching the instance's flag indices
+	if set.snap != snap {
+		snap = set.snap
+		e.counters.snapshotReloads.Add(1)
+		if cached, ok := snap.preEvaluated[flagKey]; ok {
+			e.counters.cacheHits.Add(1)
+			return cached.clone(), nil
+		}
+		buf.Reset()
+		requiredKeys, ok = e.prepareJSONContext(buf, snap, flagKey, contextJSON)
+	}
+
+	resultBuf := getBuffer()
+	defer putBuffer(resultBuf)
+	var data []byte
+	if ok {
+		data, err = e.evaluateWithTimeout(e.ctx, inst, snap, flagKey, requiredKeys, buf.Bytes(), resultBuf)
+	} else {
+		// Without required keys the context is passed to evaluate_reusable
+		// unchanged
+		data, err = e.evaluateWithTimeout(e.ctx, inst, snap, flagKey, nil, contextJSON, resultBuf)
+	}
+	held = false
+	e.releaseInstance(set, inst, err)
+	if err != nil {
+		return nil, err
+	}
+	return e.decodeEvalResult(flagKey, data)
+}
+
+// prepareJSONContext writes the evaluation context of flagKey under snap to
+// buf, taking its members from contextJSON, and returns the flag's required
+// keys. ok is false if contextJSON isn't a JSON object.
+func (e *FlagEvaluator) prepareJSONContext(buf *bytes.Buffer, snap *cacheSnapshot, flagKey string, contextJSON []byte) (requiredKeys map[string]bool, ok bool) {
+	requiredKeys = snap.requiredCtxKey[flagKey]
+	if !writeRawContext(buf, contextJSON, requiredKeys) {
+		return nil, false
+	}
+	enrich := e.needsEnrichment(snap, flagKey)
+	var timestamp int64
+	if enrich {
+		timestamp = e.clock().Unix()
+	}
+	writeContextEnd(buf, e.enrichmentKey(flagKey), enrich, timestamp)
+	return requiredKeys, true
+}
+
+// writeRawContext writes the members of the JSON object data selected by
+// requiredKeys, or all of them if requiredKeys is nil, copying their values
+// without decoding them. A member holding a dotted path's first segment is
+// copied whole. $flagd is left out and targetingKey always written, so like
+// writeFilteredContext the object is left open for writeContextEnd. It returns
+// false, with b partly written, if data isn't a JSON object.
+func writeRawContext(b *bytes.Buffer, data []byte, requiredKeys map[string]bool) bool {
+	var headArray [8]string
+	heads := headArray[:0]
+	for key := range requiredKeys {
+		if dot := strings.IndexByte(key, '.'); dot > 0 && !strings.HasPrefix(key, "$flagd.") {
+			heads = append(heads, key[:dot])
+		}
+	}
+
+	n := len(data)
+	i := skipWhitespace(data, 0)
+	if i >= n || data[i] != '{' {
+		return false
+	}
+	b.WriteByte('{')
+	first, hasTargetingKey := true, false
+	i = skipWhitespace(data, i+1)
+	for i < n && data[i] != '}' {
+		if data[i] != '"' {
+			return false
+		}
+		keyStart := i
+		key, end := rawKey(data, i)
+		if end < 0 {
+			return false
+		}
+		i = skipWhitespace(data, end)
+		if i >= n || data[i] != ':' {
+			return false
+		}
+		valStart := skipWhitespace(data, i+1)
+		valEnd := skipValue(data, valStart)
+		if valEnd <= valStart {
+			return false
+		}
+
+		keep := requiredKeys == nil || key == "targetingKey" || requiredKeys[key] || slices.Contains(heads, key)
+		if keep && key != "$flagd" && !strings.HasPrefix(key, "$flagd.") {
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			b.Write(data[keyStart:end])
+			b.WriteByte(':')
+			b.Write(data[valStart:valEnd])
+			hasTargetingKey = hasTargetingKey || key == "targetingKey"
+		}
+
+		i = skipWhitespace(data, valEnd)
+		if i < n && data[i] == ',' {
+			i = skipWhitespace(data, i+1)
+			if i < n && data[i] == '}' {
+				return false // trailing comma
+			}
+		} else if i >= n || data[i] != '}' {
+			return false
+		}
+	}
+	if i >= n || skipWhitespace(data, i+1) != n {
+		return false
+	}
+
+	if !hasTargetingKey {
+		if !first {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"targetingKey":""`)
+	}
+	return true
+}
+
+// rawKey returns the object key whose opening quote is at data[i] and the
+// index after its closing quote, or -1 on error. Unescaped keys are returned
+// without copying, so they are only valid as long as data.
+func rawKey(data []byte, i int) (string, int) {
+	j := i + 1
+	for j < len(data) && data[j] != '"' {
+		if data[j] == '\\' {
+			return parseString(data, i)
+		}
+		j++
+	}
+	if j >= len(data) {
+		return "", -1
+	}
+	return unsafeBytesToString(data[i+1 : j]), j + 1
+}
+
+// skipWhitespace returns the index of the first non-whitespace byte of data
+// at or after i.
+func skipWhitespace(data []byte, i int) int {
+	for i < len(data) && isWhitespace(data[i]) {
+		i++
+	}
+	return i
+}
@@ -1,12 +1,22 @@
 package evaluator
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"reflect"
 	"runtime"
+	"slices"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
@@ -21,17 +31,115 @@ type wasmInstance struct {
 	updateStateFn  api.Function
 	evalReusableFn api.Function
 	evalByIndexFn  api.Function // nil if unavailable
+	setModeFn      api.Function // set_validation_mode; nil if unavailable
 	flagKeyBufPtr  uint32
+	flagKeyBufSize uint32
 	contextBufPtr  uint32
+	contextBufSize uint32 // grown on demand up to contextBufMax
+	contextBufMax  uint32
 	generation     uint64 // set during UpdateState
+	shard          int    // pool shard the instance belongs to
+	evals          int    // WASM evaluations run; only touched by the holder
 }
 
 // cacheSnapshot holds all host-side caches. Replaced atomically on UpdateState.
 type cacheSnapshot struct {
 	generation     uint64
+	config         []byte // config the snapshot was built from; nil before the first update
 	preEvaluated   map[string]*EvaluationResult
 	requiredCtxKey map[string]map[string]bool
 	flagIndex      map[string]uint32
+
+	// Flags whose targeting is known not to read $flagd; their contexts skip
+	// the enrichment block. Flags absent from the map are always enriched.
+	flagdFree map[string]bool
+
+	// Results of targeting flags for the context set with
+	// WithPrecomputeContext, served to evaluations agreeing with it
+	precomputed map[string]*precomputedResult
+
+	// Metadata of flags that are not pre-evaluated, and of the flag set,
+	// parsed from config on first use by FlagMetadata or FlagSetMetadata
+	metadataOnce sync.Once
+	metadata     map[string]map[string]interface{}
+	setMetadata  map[string]interface{}
+
+	// Raw variant values of every flag, parsed from config on first use by
+	// Variants
+	variantsOnce sync.Once
+	variants     map[string]map[string]json.RawMessage
+
+	// Targeting rules as written in config, compacted, parsed on first use
+	// by TargetingRule
+	targetingOnce sync.Once
+	targeting     map[string]json.RawMessage
+
+	// JSON of the pre-evaluated results, encoded on first use by
+	// EvaluateFlagRaw
+	preEvaluatedJSONOnce sync.Once
+	preEvaluatedJSONs    map[string]json.RawMessage
+
+	// Decoded targeting rules, parsed from config on first use by
+	// host-side rule inspection
+	rulesOnce sync.Once
+	rules     map[string]interface{}
+
+	// Keys of flags whose type mismatch has been logged for this
+	// configuration
+	mismatchLogged sync.Map
+}
+
+// allFlagKeys returns the keys of every flag known to the snapshot, sorted.
+func (s *cacheSnapshot) allFlagKeys() []string {
+	keys := make([]string, 0, len(s.flagIndex))
+	for k := range s.flagIndex {
+		keys = append(keys, k)
+	}
+	// flagIndex normally covers every flag; include pre-evaluated flags too
+	// in case a module build omits them from the index.
+	for k := range s.preEvaluated {
+		if _, ok := s.flagIndex[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// preEvaluatedJSON returns the JSON of flagKey's pre-evaluated result, as a
+// copy.
+func (s *cacheSnapshot) preEvaluatedJSON(flagKey string) json.RawMessage {
+	s.preEvaluatedJSONOnce.Do(func() {
+		s.preEvaluatedJSONs = make(map[string]json.RawMessage, len(s.preEvaluated))
+		for key, result := range s.preEvaluated {
+			if data, err := json.Marshal(result); err == nil {
+				s.preEvaluatedJSONs[key] = data
+			}
+		}
+	})
+	return bytes.Clone(s.preEvaluatedJSONs[flagKey])
+}
+
+// instanceSet pairs a pool of WASM instances with the cache snapshot built
+// from the state they hold. UpdateState publishes a new instanceSet for every
+// generation; the pool is reused across generations of the same instances.
+type instanceSet struct {
+	pool *instancePool
+	snap *cacheSnapshot
+
+	// Closed once the set is swapped out, so evaluations waiting for one of
+	// its instances move to the active set rather than wait for the swapped
+	// out set to be drained and caught up
+	retired chan struct{}
+}
+
+// hasFlag reports whether flagKey is known to the snapshot.
+func (s *cacheSnapshot) hasFlag(flagKey string) bool {
+	if _, ok := s.flagIndex[flagKey]; ok {
+		return true
+	}
+	_, ok := s.preEvaluated[flagKey]
+	return ok
 }
 
 // FlagEvaluator evaluates feature flags using a pool of flagd-evaluator WASM
@@ -39,93 +147,286 @@ type cacheSnapshot struct {
 //
 // Pre-evaluated (static/disabled) flags are served lock-free via atomic cache.
 // Targeting flags evaluate in parallel up to the pool size.
+//
+// Instances come in two sets of poolSize, each with its own pool channel.
+// Evaluations draw from the active set while UpdateState applies new state to
+// the standby set and then swaps the two, so evaluations never wait for an
+// update. The standby set is created on the first UpdateState.
 type FlagEvaluator struct {
-	ctx      context.Context
-	rt       wazero.Runtime
-	compiled wazero.CompiledModule
+	// ctx carries the evaluator's clock and entropy source to the host
+	// functions
+	ctx context.Context
+
+	// Compiled module the instances are created from, and whether the
+	// evaluator created it and so closes it on Close
+	module     *CompiledModule
+	ownsModule bool
+
+	// Pools of the two instance sets
+	pools          [2]*instancePool
+	poolSize       int
+	standbyCreated atomic.Bool
 
-	// Pool of WASM instances (buffered channel)
-	pool     chan *wasmInstance
-	poolSize int
+	// Size a pool may grow to under contention; poolSize unless
+	// WithMaxPoolSize is used. lastPoolWait is the time (UnixNano) of the
+	// latest acquire that had to wait, which holds off shrinking.
+	maxPoolSize  int
+	lastPoolWait atomic.Int64
 
-	// Host-side caches — atomically swapped on UpdateState
-	cache atomic.Pointer[cacheSnapshot]
+	// Active instance set and its host-side caches — atomically swapped on
+	// UpdateState
+	active atomic.Pointer[instanceSet]
+
+	// Pool of the set not currently serving, and a channel closed once that
+	// set has caught up with the active state. Guarded by updateMu.
+	standby      *instancePool
+	standbyReady chan struct{}
 
 	// Serializes UpdateState calls
 	updateMu sync.Mutex
 
+	// Hash and result of the last successfully applied config, used with a
+	// comparison against the active config to skip byte-identical updates.
+	// Guarded by updateMu.
+	lastConfigHash uint64
+	lastUpdate     *UpdateStateResult
+	forceUpdate    bool
+
+	// Full-config update waiting for updateMu that later ones are merged
+	// into, with WithUpdateCoalescing. Guarded by coalesceMu.
+	coalesceUpdates bool
+	coalesceMu      sync.Mutex
+	pendingUpdate   *pendingUpdate
+
 	// Generation counter — incremented on each UpdateState
 	generation atomic.Uint64
 
+	// Set at the start of Close; done is closed at the same time to wake
+	// goroutines waiting on the pool.
+	closed atomic.Bool
+	done   chan struct{}
+
+	// Receivers of StateChangeEvents
+	subscribers subscribers
+
+	// Counters reported by Stats
+	counters evaluatorCounters
+
+	// Optional telemetry sink; nil disables recording
+	metrics MetricsRecorder
+
+	// Diagnostics logger; discards records unless WithLogger is used
+	logger *slog.Logger
+
 	// Config retained for creating new instances
 	permissiveValidation bool
+
+	// Time source for $flagd.timestamp
+	clock func() time.Time
+
+	// Source of the module's random bytes; nil for crypto/rand
+	entropy io.Reader
+
+	// Omit $flagd enrichment for every flag
+	withoutEnrichment bool
+
+	// Context merged under every evaluation's context; nil if none
+	defaultContext atomic.Pointer[map[string]interface{}]
+
+	// Size of each instance's flag key buffer, and initial and largest
+	// size of its context buffer
+	maxFlagKeySize    uint32
+	contextBufferSize uint32
+	maxContextSize    uint32
+
+	// Report required keys missing from evaluation contexts
+	contextValidation bool
+
+	// Context field standing in for a missing targetingKey; "" if none
+	targetingKeyField string
+
+	// Generates targetingKey for contexts without one; nil if disabled
+	anonymousKey func() string
+
+	// Typed evaluations convert values of other types
+	typeCoercion bool
+
+	// Context targeting flags are evaluated against on every update; nil if
+	// none
+	precomputeContext map[string]interface{}
+
+	// Cache of targeting results; nil if disabled
+	results *resultCache
+
+	// Evaluations after which an instance is recycled; 0 disables recycling
+	instanceMaxEvals int
+
+	// Longest wait for a pool instance; 0 waits indefinitely
+	poolWaitTimeout time.Duration
+
+	// Longest WASM evaluation call; 0 leaves calls unbounded
+	evaluationTimeout time.Duration
+
+	// Options the evaluator was created with, for the flag-set evaluator
+	cfg *evaluatorConfig
+
+	// Evaluator serving the named flag sets (UpdateStateSet), created on
+	// first use. setsMu serializes set updates and guards setConfigs, the
+	// config of each set.
+	sets       atomic.Pointer[FlagEvaluator]
+	setsMu     sync.Mutex
+	setConfigs map[string][]byte
+
+	// Flag keys are namespaced by flag set; set on the flag-set evaluator
+	namespacedKeys bool
+
+	// Create instances on demand rather than filling pools up front.
+	// lazyMu serializes on-demand creation with set swaps and Close, so an
+	// instance is only ever added to the active set's pool.
+	lazyPool bool
+	lazyMu   sync.Mutex
 }
 
 // NewFlagEvaluator creates a new flag evaluator with the given options.
 // The WASM module is compiled once, then instantiated poolSize times.
 // Call Close() when done to release resources.
 func NewFlagEvaluator(opts ...Option) (*FlagEvaluator, error) {
+	cfg, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newFlagEvaluator(cm, cfg)
+	if err != nil {
+		cm.Close()
+		return nil, err
+	}
+	e.ownsModule = true
+	return e, nil
+}
+
+// applyOptions applies opts to a new config, returning the first invalid
+// option's error.
+func applyOptions(opts []Option) (*evaluatorConfig, error) {
 	cfg := &evaluatorConfig{}
 	for _, opt := range opts {
 		opt(cfg)
 	}
+	if cfg.interpreter && cfg.runtimeConfig != nil {
+		cfg.setErr(fmt.Errorf("WithInterpreter cannot be combined with WithRuntimeConfig; use wazero.NewRuntimeConfigInterpreter()"))
+	}
+	if cfg.err != nil {
+		return nil, fmt.Errorf("invalid option: %w", cfg.err)
+	}
+	return cfg, nil
+}
 
+// newFlagEvaluator creates an evaluator instantiating cm, configured by cfg.
+// Its options that configure the runtime and module have already been applied
+// by compile.
+func newFlagEvaluator(cm *CompiledModule, cfg *evaluatorConfig) (*FlagEvaluator, error) {
 	poolSize := cfg.poolSize
 	if poolSize <= 0 {
 		poolSize = runtime.NumCPU()
 	}
+	shards := min(max(cfg.poolShards, 1), poolSize)
+	maxPoolSize := poolSize
+	if cfg.maxPoolSize > 0 {
+		if cfg.maxPoolSize < poolSize {
+			return nil, fmt.Errorf("invalid option: max pool size %d is smaller than pool size %d", cfg.maxPoolSize, poolSize)
+		}
+		maxPoolSize = cfg.maxPoolSize
+	}
 
-	ctx := context.Background()
-
-	// Create runtime
-	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig())
-
-	// Register host functions (shared across all instances)
-	if err := registerHostFunctions(ctx, r); err != nil {
-		r.Close(ctx)
-		return nil, fmt.Errorf("failed to register host functions: %w", err)
+	clock := cfg.clock
+	if clock == nil {
+		clock = time.Now
 	}
 
-	// Compile WASM module once
-	compiled, err := r.CompileModule(ctx, wasmBytes)
-	if err != nil {
-		r.Close(ctx)
-		return nil, fmt.Errorf("failed to compile WASM module: %w", err)
+	maxFlagKeySize := cfg.maxFlagKeySize
+	if maxFlagKeySize == 0 {
+		maxFlagKeySize = defaultMaxFlagKeySize
+	}
+	maxContextSize := cfg.maxContextSize
+	if maxContextSize == 0 {
+		maxContextSize = defaultMaxContextSize
+	}
+	contextBufferSize := cfg.contextBufferSize
+	if contextBufferSize == 0 {
+		contextBufferSize = min(defaultContextBufferSize, maxContextSize)
+	} else if contextBufferSize > maxContextSize {
+		return nil, fmt.Errorf("invalid option: context buffer size %d exceeds max context size %d", contextBufferSize, maxContextSize)
 	}
 
 	e := &FlagEvaluator{
-		ctx:                  ctx,
-		rt:                   r,
-		compiled:             compiled,
-		pool:                 make(chan *wasmInstance, poolSize),
+		ctx:                  withEntropy(withClock(context.Background(), clock), cfg.entropy),
+		module:               cm,
+		pools:                [2]*instancePool{newInstancePool(maxPoolSize, shards), newInstancePool(maxPoolSize, shards)},
 		poolSize:             poolSize,
+		maxPoolSize:          maxPoolSize,
+		done:                 make(chan struct{}),
+		clock:                clock,
+		entropy:              cfg.entropy,
+		maxFlagKeySize:       uint32(maxFlagKeySize),
+		contextBufferSize:    uint32(contextBufferSize),
+		maxContextSize:       uint32(maxContextSize),
 		permissiveValidation: cfg.permissiveValidation,
+		forceUpdate:          cfg.forceUpdate,
+		coalesceUpdates:      cfg.coalesceUpdates,
+		withoutEnrichment:    cfg.withoutEnrichment,
+		contextValidation:    cfg.contextValidation,
+		targetingKeyField:    cfg.targetingKeyField,
+		anonymousKey:         cfg.anonymousKey,
+		typeCoercion:         cfg.typeCoercion,
+		precomputeContext:    cfg.precomputeContext,
+		metrics:              cfg.metrics,
+		instanceMaxEvals:     cfg.instanceMaxEvals,
+		poolWaitTimeout:      cfg.poolWaitTimeout,
+		evaluationTimeout:    cfg.evaluationTimeout,
+		lazyPool:             cfg.lazyPool,
+		cfg:                  cfg,
+		logger:               cfg.logger,
+	}
+	if e.logger == nil {
+		e.logger = slog.New(slog.DiscardHandler)
 	}
 
-	// Store empty cache
-	e.cache.Store(&cacheSnapshot{
-		preEvaluated:   make(map[string]*EvaluationResult),
-		requiredCtxKey: make(map[string]map[string]bool),
-		flagIndex:      make(map[string]uint32),
+	// Publish the first set with an empty cache
+	e.active.Store(&instanceSet{
+		pool: e.pools[0],
+		snap: &cacheSnapshot{
+			preEvaluated:   make(map[string]*EvaluationResult),
+			requiredCtxKey: make(map[string]map[string]bool),
+			flagIndex:      make(map[string]uint32),
+		},
+		retired: make(chan struct{}),
 	})
+	e.standby = e.pools[1]
+	e.SetDefaultContext(cfg.defaultContext)
+	if cfg.resultCacheSize > 0 {
+		e.results = newResultCache(cfg.resultCacheSize, cfg.resultCacheTTL, clock)
+	}
 
-	// Create pool of instances
-	for i := 0; i < poolSize; i++ {
-		inst, err := e.newInstance(i)
+	// Create pool of instances, unless they are created on demand
+	for i := 0; i < poolSize && !e.lazyPool; i++ {
+		inst, err := e.newInstance()
 		if err != nil {
-			e.Close()
+			e.pools[0].drain(nil, e.closeInstance)
 			return nil, fmt.Errorf("failed to create WASM instance %d: %w", i, err)
 		}
-		e.pool <- inst
+		e.pools[0].add(inst)
 	}
 
 	return e, nil
 }
 
 // newInstance creates a single WASM module instance with pre-allocated buffers.
-func (e *FlagEvaluator) newInstance(id int) (*wasmInstance, error) {
-	name := fmt.Sprintf("flagd_evaluator_%d", id)
-	mod, err := e.rt.InstantiateModule(e.ctx, e.compiled,
+func (e *FlagEvaluator) newInstance() (*wasmInstance, error) {
+	name := fmt.Sprintf("flagd_evaluator_%d", e.module.instanceSeq.Add(1)-1)
+	mod, err := e.module.rt.InstantiateModule(e.ctx, e.module.compiled,
 		wazero.NewModuleConfig().WithName(name))
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate module %q: %w", name, err)
@@ -143,117 +444,812 @@ func (e *FlagEvaluator) newInstance(id int) (*wasmInstance, error) {
 	}
 
 	// Pre-allocate buffers
-	results, err := allocFn.Call(e.ctx, maxFlagKeySize)
+	results, err := allocFn.Call(e.ctx, uint64(e.maxFlagKeySize))
+	if err == nil && results[0] == 0 {
+		err = errors.New("out of memory")
+	}
 	if err != nil {
 		mod.Close(e.ctx)
 		return nil, fmt.Errorf("failed to allocate flag key buffer: %w", err)
 	}
 	flagKeyBufPtr := uint32(results[0])
 
-	results, err = allocFn.Call(e.ctx, maxContextSize)
+	results, err = allocFn.Call(e.ctx, uint64(e.contextBufferSize))
+	if err == nil && results[0] == 0 {
+		err = errors.New("out of memory")
+	}
 	if err != nil {
 		mod.Close(e.ctx)
 		return nil, fmt.Errorf("failed to allocate context buffer: %w", err)
 	}
 	contextBufPtr := uint32(results[0])
 
-	// Set validation mode
-	setValidationFn := mod.ExportedFunction("set_validation_mode")
-	if setValidationFn != nil {
-		mode := uint64(0) // strict
-		if e.permissiveValidation {
-			mode = 1
-		}
-		if _, err := setValidationFn.Call(e.ctx, mode); err != nil {
-			mod.Close(e.ctx)
-			return nil, fmt.Errorf("failed to set validation mode: %w", err)
-		}
-	}
-
-	return &wasmInstance{
+	inst := &wasmInstance{
 		module:         mod,
 		allocFn:        allocFn,
 		deallocFn:      deallocFn,
 		updateStateFn:  updateStateFn,
 		evalReusableFn: evalReusableFn,
 		evalByIndexFn:  evalByIndexFn,
+		setModeFn:      mod.ExportedFunction("set_validation_mode"),
 		flagKeyBufPtr:  flagKeyBufPtr,
+		flagKeyBufSize: e.maxFlagKeySize,
 		contextBufPtr:  contextBufPtr,
-	}, nil
+		contextBufSize: e.contextBufferSize,
+		contextBufMax:  e.maxContextSize,
+	}
+
+	// Set validation mode
+	if err := setValidationMode(e.ctx, inst, e.permissiveValidation); err != nil {
+		mod.Close(e.ctx)
+		return nil, fmt.Errorf("failed to set validation mode: %w", err)
+	}
+	return inst, nil
+}
+
+// setValidationMode switches inst to permissive or strict validation of
+// update_state configs. It is a no-op for a module without the export.
+func setValidationMode(ctx context.Context, inst *wasmInstance, permissive bool) error {
+	if inst.setModeFn == nil {
+		return nil
+	}
+	mode := uint64(0) // strict
+	if permissive {
+		mode = 1
+	}
+	results, err := inst.setModeFn.Call(ctx, mode)
+	if err != nil {
+		return err
+	}
+	if ptr, length := unpackPtrLen(results[0]); ptr != 0 {
+		inst.deallocFn.Call(ctx, uint64(ptr), uint64(length))
+	}
+	return nil
+}
+
+// closeInstance frees an instance's pre-allocated buffers and closes its module.
+func (e *FlagEvaluator) closeInstance(inst *wasmInstance) {
+	inst.deallocFn.Call(e.ctx, uint64(inst.flagKeyBufPtr), uint64(inst.flagKeyBufSize))
+	inst.deallocFn.Call(e.ctx, uint64(inst.contextBufPtr), uint64(inst.contextBufSize))
+	inst.module.Close(e.ctx)
+}
+
+// releaseInstance returns inst, acquired from set, to set's pool. err is the
+// result of the evaluation that used it.
+//
+// An instance whose evaluation trapped may be left with corrupted memory, and
+// one whose evaluation timed out has had its module closed, so it is torn
+// down and replaced by a fresh instance loaded with the same state.
+// With WithInstanceMaxEvals, an instance that has run its quota of
+// evaluations is recycled the same way. If the replacement can't be created
+// the old instance is kept.
+func (e *FlagEvaluator) releaseInstance(set *instanceSet, inst *wasmInstance, err error) {
+	if !e.closed.Load() {
+		switch {
+		case errors.Is(err, ErrWasmTrap), errors.Is(err, ErrEvaluationTimeout):
+			what := "WASM trap during evaluation"
+			if errors.Is(err, ErrEvaluationTimeout) {
+				what = "evaluation timed out"
+			}
+			if fresh, rerr := e.replaceInstance(inst, set.snap); rerr == nil {
+				e.counters.instancesReplaced.Add(1)
+				inst = fresh
+				e.logger.Warn(what+", instance replaced", "error", err)
+			} else {
+				e.logger.Error(what+", instance could not be replaced",
+					"error", err, "replaceError", rerr)
+			}
+		case e.instanceMaxEvals > 0 && inst.evals >= e.instanceMaxEvals:
+			if fresh, rerr := e.replaceInstance(inst, set.snap); rerr == nil {
+				e.counters.instancesRecycled.Add(1)
+				inst = fresh
+			}
+		}
+		if e.maxPoolSize > e.poolSize && e.shrinkPool(set, inst) {
+			return
+		}
+	}
+	set.pool.put(inst)
+}
+
+// replaceInstance creates an instance holding snap's state to stand in for
+// old, and closes old.
+func (e *FlagEvaluator) replaceInstance(old *wasmInstance, snap *cacheSnapshot) (*wasmInstance, error) {
+	fresh, err := e.newLoadedInstance(snap)
+	if err != nil {
+		return nil, err
+	}
+	fresh.generation = old.generation
+	fresh.shard = old.shard
+
+	// Closing the module frees its memory; after a trap the deallocs
+	// couldn't be trusted anyway
+	old.module.Close(e.ctx)
+	return fresh, nil
+}
+
+// newLoadedInstance creates an instance and loads snap's state into it.
+func (e *FlagEvaluator) newLoadedInstance(snap *cacheSnapshot) (*wasmInstance, error) {
+	fresh, err := e.newInstance()
+	if err != nil {
+		return nil, err
+	}
+	if snap.config != nil {
+		result, err := updateInstance(e.ctx, fresh, snap.config)
+		if err == nil && !result.Success {
+			err = errors.New(result.Error)
+		}
+		if err != nil {
+			fresh.module.Close(e.ctx)
+			return nil, err
+		}
+	}
+	fresh.generation = snap.generation
+	return fresh, nil
+}
+
+// growPool creates an instance for set's pool, with WithLazyPool or
+// WithMaxPoolSize, and returns it checked out. It returns nil if the pool
+// already has limit instances or set is no longer active.
+func (e *FlagEvaluator) growPool(set *instanceSet, limit int) (*wasmInstance, error) {
+	e.lazyMu.Lock()
+	defer e.lazyMu.Unlock()
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+	if e.active.Load() != set || int(set.pool.created.Load()) >= limit {
+		return nil, nil
+	}
+	inst, err := e.newLoadedInstance(set.snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WASM instance: %w", err)
+	}
+	set.pool.assign(inst)
+	return inst, nil
+}
+
+// shrinkPool closes inst, being released to set, instead of returning it if
+// set's pool has grown past poolSize (see WithMaxPoolSize) and no acquire has
+// waited for poolShrinkAfter. Only an instance of the shard the last instance
+// was assigned to is closed, so the shards stay as drain expects them. It
+// reports whether inst was closed.
+func (e *FlagEvaluator) shrinkPool(set *instanceSet, inst *wasmInstance) bool {
+	created := set.pool.created.Load()
+	if int(created) <= e.poolSize || inst.shard != set.pool.shardFor(int(created)-1) ||
+		time.Since(time.Unix(0, e.lastPoolWait.Load())) < poolShrinkAfter {
+		return false
+	}
+	// Under lazyMu, the set can't be swapped out and start draining
+	e.lazyMu.Lock()
+	defer e.lazyMu.Unlock()
+	if e.closed.Load() || e.active.Load() != set || set.pool.created.Load() != created {
+		return false
+	}
+	set.pool.created.Add(-1)
+	e.closeInstance(inst)
+	return true
 }
 
-// Close releases all resources associated with the evaluator.
+// Close releases all resources associated with the evaluator. It waits for
+// in-flight evaluations and state updates to return their instances before
+// tearing down the runtime. An evaluator created with
+// NewFlagEvaluatorFromCompiled closes its instances but leaves the shared
+// CompiledModule open. Subsequent evaluations and state updates return
+// ErrEvaluatorClosed. Calling Close more than once is a no-op.
 func (e *FlagEvaluator) Close() error {
-	// Drain and close all instances
-	for i := 0; i < e.poolSize; i++ {
-		select {
-		case inst := <-e.pool:
-			inst.deallocFn.Call(e.ctx, uint64(inst.flagKeyBufPtr), maxFlagKeySize)
-			inst.deallocFn.Call(e.ctx, uint64(inst.contextBufPtr), maxContextSize)
-			inst.module.Close(e.ctx)
-		default:
-			// Instance is in use; skip (runtime.Close will clean up)
+	return e.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but bounds how long it waits for in-flight work.
+// If ctx is done before every instance has been returned, the runtime is
+// closed anyway and ctx.Err() is returned; evaluations still running at that
+// point fail or may panic inside the WASM call. With a shared CompiledModule
+// the instances not yet returned are instead left open until the module is
+// closed.
+func (e *FlagEvaluator) CloseContext(ctx context.Context) error {
+	if e.closed.Swap(true) {
+		return nil
+	}
+	// Taking lazyMu lets an on-demand instance creation finish, so the
+	// drains below include it
+	e.lazyMu.Lock()
+	close(e.done)
+	e.lazyMu.Unlock()
+	e.subscribers.close()
+
+	// Drain every instance from each set, blocking until checked-out ones
+	// return
+	pools := e.pools[:1]
+	if e.standbyCreated.Load() {
+		pools = e.pools[:]
+	}
+	var err error
+	for _, pool := range pools {
+		if !pool.drain(ctx.Done(), e.closeInstance) {
+			err = ctx.Err()
+			break
+		}
+	}
+
+	// The flag-set evaluator shares the module, so it is closed first
+	e.setsMu.Lock()
+	sets := e.sets.Load()
+	e.setsMu.Unlock()
+	if sets != nil && err == nil {
+		err = sets.CloseContext(ctx)
+	}
+
+	if e.ownsModule {
+		if closeErr := e.module.Close(); err == nil {
+			err = closeErr
 		}
 	}
-	return e.rt.Close(e.ctx)
+	return err
 }
 
 // UpdateState updates the flag configuration across all WASM instances.
 // Returns information about changed flags and populates internal caches.
+//
+// A config byte-identical to the last successfully applied one is not
+// re-applied: the previous result is returned with no added, removed or
+// changed flags, and no instance is touched. WithForceUpdate disables this.
 func (e *FlagEvaluator) UpdateState(configJSON string) (*UpdateStateResult, error) {
+	return e.updateStateBytes([]byte(configJSON))
+}
+
+// UpdateStateReader applies the config read from r like UpdateState. The
+// config is read into a single buffer, which the evaluator keeps as the
+// applied config, so a config read from a file or HTTP body isn't copied
+// into a string first. r is read to EOF before the update starts; a read
+// error fails the update without changing the state.
+func (e *FlagEvaluator) UpdateStateReader(r io.Reader) (*UpdateStateResult, error) {
+	configBytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return e.updateStateBytes(configBytes)
+}
+
+// updateStateBytes applies configBytes, which the evaluator takes ownership
+// of.
+func (e *FlagEvaluator) updateStateBytes(configBytes []byte) (*UpdateStateResult, error) {
+	if e.coalesceUpdates {
+		return e.coalesceUpdate(configBytes)
+	}
+	return e.updateState(func([]byte) ([]byte, error) {
+		return configBytes, nil
+	}, nil)
+}
+
+// pendingUpdate is a full-config update waiting for the one in progress,
+// shared by every call merged into it.
+type pendingUpdate struct {
+	config []byte
+	done   chan struct{}
+	result *UpdateStateResult
+	err    error
+}
+
+// coalesceUpdate applies configBytes as updateStateBytes does, unless an
+// update is already waiting: configBytes then replaces that update's config
+// and the result of applying it is returned.
+func (e *FlagEvaluator) coalesceUpdate(configBytes []byte) (*UpdateStateResult, error) {
+	e.coalesceMu.Lock()
+	if p := e.pendingUpdate; p != nil {
+		p.config = configBytes
+		e.coalesceMu.Unlock()
+		e.counters.updatesCoalesced.Add(1)
+		<-p.done
+		if p.err != nil {
+			return nil, p.err
+		}
+		shared := *p.result
+		return &shared, nil
+	}
+	p := &pendingUpdate{config: configBytes, done: make(chan struct{})}
+	e.pendingUpdate = p
+	e.coalesceMu.Unlock()
+
+	result, err := e.updateState(func([]byte) ([]byte, error) {
+		// Holding updateMu, the update is no longer waiting: later calls
+		// start the next one
+		e.coalesceMu.Lock()
+		defer e.coalesceMu.Unlock()
+		e.pendingUpdate = nil
+		return p.config, nil
+	}, nil)
+
+	// An update that failed before taking its config is still pending
+	e.coalesceMu.Lock()
+	if e.pendingUpdate == p {
+		e.pendingUpdate = nil
+	}
+	e.coalesceMu.Unlock()
+	if err == nil {
+		shared := *result
+		p.result = &shared
+	}
+	p.err = err
+	close(p.done)
+	return result, err
+}
+
+// DryRunUpdateState validates configJSON as UpdateState would apply it,
+// without applying it. The config is loaded into a scratch instance holding
+// the active state, which is then discarded, so the result reports success,
+// the error of a rejected config, and the flags it would add, remove or
+// change relative to the active configuration. The active instances,
+// caches and generation are left untouched, and a config identical to the
+// applied one is validated rather than skipped.
+func (e *FlagEvaluator) DryRunUpdateState(configJSON string) (*UpdateStateResult, error) {
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+	snap := e.active.Load().snap
+	inst, err := e.newLoadedInstance(snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch instance: %w", err)
+	}
+	// The instance is discarded whatever happens, so its buffers needn't be
+	// freed
+	defer inst.module.Close(e.ctx)
+
+	result, err := e.applyConfig(inst, []byte(configJSON))
+	if err != nil {
+		return nil, err
+	}
+	if result.Success {
+		classifyChangedFlags(snap, buildCacheSnapshot(snap, result), result)
+	}
+	return result, nil
+}
+
+// updateState applies the config returned by build, which is passed the
+// currently applied config (nil before the first update). build runs under
+// updateMu, so a config derived from the current one cannot race another
+// update. restored, if not nil, is a snapshot of the same config from
+// ImportState, used instead of one built from the module's result when the
+// two agree.
+func (e *FlagEvaluator) updateState(build func(current []byte) ([]byte, error), restored *cacheSnapshot) (result *UpdateStateResult, err error) {
+	defer func(start time.Time) {
+		elapsed := time.Since(start)
+		e.counters.lastUpdateDuration.Store(int64(elapsed))
+		if result != nil {
+			result.Elapsed = elapsed
+		}
+		if e.metrics != nil {
+			e.metrics.RecordUpdateState(elapsed)
+		}
+	}(time.Now())
+
 	e.updateMu.Lock()
 	defer e.updateMu.Unlock()
 
-	configBytes := []byte(configJSON)
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
 
-	// Drain all instances from pool (blocks until all are returned)
-	instances := make([]*wasmInstance, e.poolSize)
-	for i := 0; i < e.poolSize; i++ {
-		instances[i] = <-e.pool
+	current := e.active.Load().snap.config
+	configBytes, err := build(current)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hash is a fast pre-check; a collision must not drop a real change,
+	// so the bytes are compared with the applied config too
+	h := fnv.New64a()
+	h.Write(configBytes)
+	configHash := h.Sum64()
+	if !e.forceUpdate && e.lastUpdate != nil && configHash == e.lastConfigHash && bytes.Equal(configBytes, current) {
+		unchanged := *e.lastUpdate
+		return &unchanged, nil
+	}
+
+	if err := e.awaitStandby(); err != nil {
+		return nil, err
 	}
 
+	// The standby set is idle, so all of its instances are in its pool
+	instances := make([]*wasmInstance, 0, e.poolSize)
+	e.standby.drain(nil, func(inst *wasmInstance) {
+		instances = append(instances, inst)
+	})
+
 	// Update first instance and capture result
-	result, err := updateInstance(e.ctx, instances[0], configBytes)
-	if err != nil {
-		// Return all instances before failing
+	result, err = e.applyConfig(instances[0], configBytes)
+	if err != nil || !result.Success {
+		// A rejected config leaves the state untouched, so the standby set
+		// stays in step with the active one, which keeps serving. An
+		// instance that trapped (e.g. at the memory limit) is replaced with
+		// one holding that state.
+		if errors.Is(err, ErrWasmTrap) {
+			if fresh, rerr := e.replaceInstance(instances[0], e.active.Load().snap); rerr == nil {
+				e.counters.instancesReplaced.Add(1)
+				instances[0] = fresh
+				e.logger.Warn("WASM trap during state update, instance replaced", "error", err)
+			} else {
+				e.logger.Error("WASM trap during state update, instance could not be replaced",
+					"error", err, "replaceError", rerr)
+			}
+		}
 		for _, inst := range instances {
-			e.pool <- inst
+			e.standby.put(inst)
 		}
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
 	}
 
-	// Update remaining instances in parallel
-	if len(instances) > 1 {
-		var wg sync.WaitGroup
-		wg.Add(len(instances) - 1)
-		for _, inst := range instances[1:] {
-			go func(inst *wasmInstance) {
-				defer wg.Done()
-				updateInstance(e.ctx, inst, configBytes)
-			}(inst)
-		}
-		wg.Wait()
+	if len(result.Warnings) > 0 {
+		e.logger.Warn("config applied with validation warnings", "warnings", result.Warnings)
 	}
 
-	// Increment generation and stamp on cache + all instances
+	// Update remaining instances in parallel
+	fanOutStart := time.Now()
+	fanOutErrs := updateInstances(e.ctx, instances[1:], configBytes)
+	result.FanOut = time.Since(fanOutStart)
+	e.counters.lastUpdateFanOut.Store(int64(result.FanOut))
+
+	// Increment generation and stamp on cache + all instances. A restored
+	// snapshot carries its generation forward, if that is later.
 	gen := e.generation.Add(1)
+	if restored != nil && restored.generation > gen {
+		gen = restored.generation
+		e.generation.Store(gen)
+	}
 
-	snap := buildCacheSnapshot(result)
+	prev := e.active.Load()
+	var snap *cacheSnapshot
+	if restored != nil && maps.Equal(restored.flagIndex, result.FlagIndices) {
+		snap = restored
+	} else {
+		// Without a restored snapshot, or one whose flag indices differ
+		// from the module's (e.g. exported with another module build)
+		snap = buildCacheSnapshot(prev.snap, result)
+		snap.flagdFree = flagsWithoutFlagdRefs(configBytes)
+	}
 	snap.generation = gen
+	snap.config = configBytes
 
+	e.replaceFailed(instances[1:], fanOutErrs, snap)
 	for _, inst := range instances {
 		inst.generation = gen
 	}
+	if e.precomputeContext != nil {
+		e.applyPrecompute(instances, snap)
+	}
+
+	classifyChangedFlags(prev.snap, snap, result)
 
-	// Atomically swap caches, then return instances
-	e.cache.Store(snap)
+	// Atomically swap sets. Evaluations pick up the new set on their next
+	// acquire; those holding an instance of the previous set finish on it.
 	for _, inst := range instances {
-		e.pool <- inst
+		e.standby.put(inst)
+	}
+	e.lazyMu.Lock()
+	e.active.Store(&instanceSet{pool: e.standby, snap: snap, retired: make(chan struct{})})
+	e.lazyMu.Unlock()
+	close(prev.retired)
+
+	// The previous set becomes the standby and is brought up to date in the
+	// background once in-flight evaluations have returned its instances.
+	e.standby = prev.pool
+	e.standbyReady = make(chan struct{})
+	go e.catchUp(e.standby, snap, e.standbyReady)
+
+	// Remember the applied config so identical re-pushes can be skipped
+	last := *result
+	last.AddedFlags, last.RemovedFlags, last.ChangedFlags = nil, nil, nil
+	last.FanOut = 0
+	e.lastConfigHash = configHash
+	e.lastUpdate = &last
+
+	if e.metrics != nil {
+		e.recordUpdate(result)
 	}
 
+	// Notify subscribers only once the new generation is live. The event gets
+	// its own slices, as the result's are shared with the caller and with
+	// coalesced callers.
+	e.subscribers.publish(StateChangeEvent{
+		Generation:   gen,
+		AddedFlags:   slices.Clone(result.AddedFlags),
+		RemovedFlags: slices.Clone(result.RemovedFlags),
+		ChangedFlags: slices.Clone(result.ChangedFlags),
+	})
+
 	return result, nil
 }
 
+// CurrentConfig returns the config JSON the active generation was built from,
+// exactly as it was last successfully applied, or "" before the first update.
+// After SetFlag, RemoveFlag or UpdateStateFromSources it is the patched or
+// merged config.
+func (e *FlagEvaluator) CurrentConfig() string {
+	return string(e.active.Load().snap.config)
+}
+
+// Generation returns the generation of the active configuration: 0 before the
+// first update, then incremented by every update that was applied. Updates
+// skipped as identical to the current config leave it unchanged.
+func (e *FlagEvaluator) Generation() uint64 {
+	return e.active.Load().snap.generation
+}
+
+// awaitStandby waits until the standby set can take a new state, creating it
+// on first use. Must be called with updateMu held.
+func (e *FlagEvaluator) awaitStandby() error {
+	if !e.standbyCreated.Load() {
+		// A lazy pool starts the standby set with the one instance an
+		// update needs; the rest are created on demand once it is active
+		n := e.poolSize
+		if e.lazyPool {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			inst, err := e.newInstance()
+			if err != nil {
+				e.standby.drain(nil, e.closeInstance)
+				e.standby.created.Store(0)
+				return fmt.Errorf("failed to create WASM instance %d: %w", e.poolSize+i, err)
+			}
+			e.standby.add(inst)
+		}
+		// Ready as created, in case this update fails and the next one
+		// waits on it without a catch-up having run
+		e.standbyReady = make(chan struct{})
+		close(e.standbyReady)
+		e.standbyCreated.Store(true)
+	} else {
+		select {
+		case <-e.standbyReady:
+		case <-e.done:
+			return ErrEvaluatorClosed
+		}
+		// A lazy set that never served an evaluation has no instances. The
+		// one created here is loaded with the active state, so the update
+		// reports changes relative to it.
+		if e.standby.created.Load() == 0 {
+			inst, err := e.newLoadedInstance(e.active.Load().snap)
+			if err != nil {
+				return fmt.Errorf("failed to create WASM instance: %w", err)
+			}
+			e.standby.add(inst)
+		}
+	}
+	if e.closed.Load() {
+		return ErrEvaluatorClosed
+	}
+	return nil
+}
+
+// catchUp applies snap's config to every instance in pool and stamps them
+// with its generation, once evaluations that acquired them before the swap
+// have returned them. An instance that fails to apply it is replaced with one
+// holding snap's state. It closes ready when done, or early if the evaluator
+// is closed.
+func (e *FlagEvaluator) catchUp(pool *instancePool, snap *cacheSnapshot, ready chan struct{}) {
+	defer close(ready)
+
+	instances := make([]*wasmInstance, 0, e.poolSize)
+	defer func() {
+		for _, inst := range instances {
+			pool.put(inst)
+		}
+	}()
+	caughtUp := pool.drain(e.done, func(inst *wasmInstance) {
+		instances = append(instances, inst)
+	})
+	if !caughtUp || e.closed.Load() {
+		return
+	}
+
+	errs := updateInstances(e.ctx, instances, snap.config)
+	e.replaceFailed(instances, errs, snap)
+	for _, inst := range instances {
+		inst.generation = snap.generation
+	}
+}
+
+// updateInstances calls update_state on each instance in parallel and returns
+// each one's error, nil if it applied the config. The first instance's result
+// has already validated the config, so an error means that instance trapped
+// (e.g. at the memory limit) and holds a partial or previous state.
+func updateInstances(ctx context.Context, instances []*wasmInstance, configBytes []byte) []error {
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	wg.Add(len(instances))
+	for i, inst := range instances {
+		go func(i int, inst *wasmInstance) {
+			defer wg.Done()
+			result, err := updateInstance(ctx, inst, configBytes)
+			if err == nil && !result.Success {
+				err = errors.New(result.Error)
+			}
+			errs[i] = err
+		}(i, inst)
+	}
+	wg.Wait()
+	return errs
+}
+
+// replaceFailed replaces each instance whose update failed, per errs from
+// updateInstances, with a fresh one holding snap's state, so none is served
+// under snap's generation without its state. An instance that can't be
+// replaced is kept.
+func (e *FlagEvaluator) replaceFailed(instances []*wasmInstance, errs []error, snap *cacheSnapshot) {
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		fresh, rerr := e.replaceInstance(instances[i], snap)
+		if rerr != nil {
+			e.logger.Error("state update failed on an instance, instance could not be replaced",
+				"error", err, "replaceError", rerr)
+			continue
+		}
+		e.counters.instancesReplaced.Add(1)
+		instances[i] = fresh
+		e.logger.Warn("state update failed on an instance, instance replaced", "error", err)
+	}
+}
+
+// applyConfig calls update_state on inst like updateInstance, reporting
+// validation warnings in permissive mode. The module only logs the schema
+// errors of a config it accepts permissively, so the config is first tried
+// under strict validation: if that rejects it for schema errors, they become
+// the result's Warnings and the config is applied again permissively. A
+// config with a $ref that can't be resolved (see checkRefs) or a flag key
+// too long to be evaluated (see checkFlagKeys) is rejected without reaching
+// the module, as is one defining a flag key twice (see duplicateFlagKeys)
+// unless validation is permissive, which warns about it instead.
+func (e *FlagEvaluator) applyConfig(inst *wasmInstance, configBytes []byte) (*UpdateStateResult, error) {
+	if msg := checkFlagKeys(configBytes, int(e.maxFlagKeySize)); msg != "" {
+		return &UpdateStateResult{Success: false, Error: msg}, nil
+	}
+	if msg := checkRefs(configBytes); msg != "" {
+		return &UpdateStateResult{Success: false, Error: msg}, nil
+	}
+	var duplicates []string
+	for _, flagKey := range duplicateFlagKeys(configBytes) {
+		msg := fmt.Sprintf("Flag key '%s' is defined more than once; the last definition is used", flagKey)
+		if !e.permissiveValidation {
+			return &UpdateStateResult{Success: false, Error: msg}, nil
+		}
+		duplicates = append(duplicates, msg)
+	}
+	result, err := e.applyValidated(inst, configBytes)
+	if err == nil && result.Success && duplicates != nil {
+		result.Warnings = append(duplicates, result.Warnings...)
+	}
+	return result, err
+}
+
+// applyValidated is applyConfig past the host-side checks.
+func (e *FlagEvaluator) applyValidated(inst *wasmInstance, configBytes []byte) (*UpdateStateResult, error) {
+	if !e.permissiveValidation || inst.setModeFn == nil {
+		return updateInstance(e.ctx, inst, configBytes)
+	}
+	if err := setValidationMode(e.ctx, inst, false); err != nil {
+		return nil, fmt.Errorf("%w: set_validation_mode call failed: %w", ErrWasmTrap, err)
+	}
+	result, err := updateInstance(e.ctx, inst, configBytes)
+	if merr := setValidationMode(e.ctx, inst, true); merr != nil && err == nil {
+		return nil, fmt.Errorf("%w: set_validation_mode call failed: %w", ErrWasmTrap, merr)
+	}
+	if err != nil || result.Success {
+		return result, err
+	}
+
+	// Any other error comes from parsing, which permissive mode runs too
+	warnings, ok := parseValidationErrors(result.Error)
+	if !ok {
+		return result, nil
+	}
+	result, err = updateInstance(e.ctx, inst, configBytes)
+	if err == nil && result.Success {
+		result.Warnings = warnings
+	}
+	return result, err
+}
+
+// checkFlagKeys returns why a flag key in config is longer than max bytes, so
+// it could never be evaluated, or "" if none is. The first such key in sorted
+// order is reported. A config that can't be parsed is left for the module to
+// report.
+func checkFlagKeys(config []byte, max int) string {
+	var parsed struct {
+		Flags map[string]json.RawMessage `json:"flags"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return ""
+	}
+	var tooLarge []string
+	for flagKey := range parsed.Flags {
+		if len(flagKey) > max {
+			tooLarge = append(tooLarge, flagKey)
+		}
+	}
+	if len(tooLarge) == 0 {
+		return ""
+	}
+	slices.Sort(tooLarge)
+	return fmt.Sprintf("Flag key '%s' is %d bytes, exceeding the maximum flag key size of %d bytes", tooLarge[0], len(tooLarge[0]), max)
+}
+
+// duplicateFlagKeys returns the keys defined more than once in config's flags
+// object, sorted. JSON decoders, the module's included, silently keep the
+// last definition of a duplicated key, which can hide a bad merge. A config
+// that can't be parsed is left for the module to report.
+func duplicateFlagKeys(config []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(config))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var duplicates []string
+	var skip json.RawMessage
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if tok != "flags" {
+			if dec.Decode(&skip) != nil {
+				return nil
+			}
+			continue
+		}
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return nil
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil
+			}
+			flagKey, _ := tok.(string)
+			if seen[flagKey] && !slices.Contains(duplicates, flagKey) {
+				duplicates = append(duplicates, flagKey)
+			}
+			seen[flagKey] = true
+			if dec.Decode(&skip) != nil {
+				return nil
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil
+		}
+	}
+	slices.Sort(duplicates)
+	return duplicates
+}
+
+// parseValidationErrors returns the errors of a failed schema validation
+// reported by update_state in strict mode, each as "path: message" (or just
+// the message for the document root). ok is false if errMsg isn't one.
+func parseValidationErrors(errMsg string) (warnings []string, ok bool) {
+	var validation struct {
+		Valid  *bool `json:"valid"`
+		Errors []struct {
+			Path    string `json:"path"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(errMsg), &validation); err != nil || validation.Valid == nil || *validation.Valid {
+		return nil, false
+	}
+	for _, verr := range validation.Errors {
+		if verr.Path == "" {
+			warnings = append(warnings, verr.Message)
+		} else {
+			warnings = append(warnings, verr.Path+": "+verr.Message)
+		}
+	}
+	return warnings, true
+}
+
 // updateInstance calls update_state on a single WASM instance.
 func updateInstance(ctx context.Context, inst *wasmInstance, configBytes []byte) (*UpdateStateResult, error) {
 	configPtr, configLen, err := writeToWasm(ctx, inst.module, inst.allocFn, configBytes)
@@ -264,7 +1260,7 @@ func updateInstance(ctx context.Context, inst *wasmInstance, configBytes []byte)
 
 	results, err := inst.updateStateFn.Call(ctx, uint64(configPtr), uint64(configLen))
 	if err != nil {
-		return nil, fmt.Errorf("update_state call failed: %w", err)
+		return nil, fmt.Errorf("%w: update_state call failed: %w", ErrWasmTrap, err)
 	}
 
 	resultPtr, resultLen := unpackPtrLen(results[0])
@@ -274,40 +1270,211 @@ func updateInstance(ctx context.Context, inst *wasmInstance, configBytes []byte)
 	}
 	defer inst.deallocFn.Call(ctx, uint64(resultPtr), uint64(resultLen))
 
-	var result UpdateStateResult
-	if err := json.Unmarshal(resultBytes, &result); err != nil {
+	// Pre-evaluated results go through parseEvalResult so their values decode
+	// exactly like results of a WASM evaluation (e.g. int64 for integers).
+	var raw struct {
+		UpdateStateResult
+		PreEvaluated map[string]json.RawMessage `json:"preEvaluated,omitempty"`
+	}
+	if err := json.Unmarshal(resultBytes, &raw); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal update_state result: %w", err)
 	}
+	result := raw.UpdateStateResult
+	if raw.PreEvaluated != nil {
+		result.PreEvaluated = make(map[string]*EvaluationResult, len(raw.PreEvaluated))
+		for flagKey, data := range raw.PreEvaluated {
+			evalResult, err := parseEvalResult(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse pre-evaluated result for %q: %w", flagKey, err)
+			}
+			result.PreEvaluated[flagKey] = evalResult
+		}
+	}
 	return &result, nil
 }
 
-// buildCacheSnapshot constructs a cacheSnapshot from an UpdateStateResult.
-func buildCacheSnapshot(result *UpdateStateResult) *cacheSnapshot {
+// classifyChangedFlags splits the module's changedFlags, which lists added,
+// removed and modified flags alike, into AddedFlags, RemovedFlags and
+// ChangedFlags by comparing the flag sets of the previous and new snapshots.
+func classifyChangedFlags(prev, next *cacheSnapshot, result *UpdateStateResult) {
+	changed := result.ChangedFlags
+	result.ChangedFlags = nil
+	for _, flagKey := range changed {
+		switch {
+		case !prev.hasFlag(flagKey):
+			result.AddedFlags = append(result.AddedFlags, flagKey)
+		case !next.hasFlag(flagKey):
+			result.RemovedFlags = append(result.RemovedFlags, flagKey)
+		default:
+			result.ChangedFlags = append(result.ChangedFlags, flagKey)
+		}
+	}
+}
+
+// flagsWithoutFlagdRefs returns the flags in config whose targeting cannot
+// read $flagd. The check is textual and conservative: a rule mentioning
+// "$flagd" or "fractional" (which buckets on $flagd.flagKey by default), or a
+// $ref to any evaluator that does, counts as a reference. Returns nil if the
+// config cannot be parsed, so every flag stays enriched.
+func flagsWithoutFlagdRefs(config []byte) map[string]bool {
+	var parsed struct {
+		Flags map[string]struct {
+			Targeting json.RawMessage `json:"targeting"`
+		} `json:"flags"`
+		Evaluators map[string]json.RawMessage `json:"$evaluators"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil
+	}
+
+	readsFlagd := func(rule []byte) bool {
+		return bytes.Contains(rule, []byte("$flagd")) || bytes.Contains(rule, []byte("fractional"))
+	}
+	evaluatorsReadFlagd := false
+	for _, rule := range parsed.Evaluators {
+		if readsFlagd(rule) {
+			evaluatorsReadFlagd = true
+			break
+		}
+	}
+
+	free := make(map[string]bool, len(parsed.Flags))
+	for flagKey, flag := range parsed.Flags {
+		if readsFlagd(flag.Targeting) {
+			continue
+		}
+		if evaluatorsReadFlagd && bytes.Contains(flag.Targeting, []byte("$ref")) {
+			continue
+		}
+		free[flagKey] = true
+	}
+	return free
+}
+
+// buildCacheSnapshot constructs a cacheSnapshot from an UpdateStateResult,
+// the snapshot prev was built from the state it replaces. Snapshots are never
+// modified once built, so entries of flags outside result.ChangedFlags that
+// are unchanged from prev are shared with it rather than rebuilt, as is a
+// whole map with no changed entries. The remaining entries are still
+// compared, as a change to flag-set metadata alters pre-evaluated results
+// without changing the flags.
+func buildCacheSnapshot(prev *cacheSnapshot, result *UpdateStateResult) *cacheSnapshot {
 	snap := &cacheSnapshot{
-		preEvaluated:   make(map[string]*EvaluationResult),
-		requiredCtxKey: make(map[string]map[string]bool),
-		flagIndex:      make(map[string]uint32),
+		preEvaluated:   buildPreEvaluated(prev.preEvaluated, result),
+		requiredCtxKey: buildRequiredCtxKeys(prev.requiredCtxKey, result),
+		flagIndex:      result.FlagIndices,
+	}
+	if snap.flagIndex == nil {
+		snap.flagIndex = make(map[string]uint32)
 	}
+	return snap
+}
+
+// flagChanged reports whether result lists flagKey as added, removed or
+// changed.
+func flagChanged(result *UpdateStateResult, flagKey string) bool {
+	// The module reports changed flags sorted
+	_, found := slices.BinarySearch(result.ChangedFlags, flagKey)
+	return found
+}
 
-	if result.PreEvaluated != nil {
-		snap.preEvaluated = result.PreEvaluated
+// buildPreEvaluated returns the pre-evaluated results of a snapshot built
+// from result, sharing unchanged entries with prev (see buildCacheSnapshot).
+func buildPreEvaluated(prev map[string]*EvaluationResult, result *UpdateStateResult) map[string]*EvaluationResult {
+	reuse := func(flagKey string, pre *EvaluationResult) *EvaluationResult {
+		if old := prev[flagKey]; old != nil && !flagChanged(result, flagKey) && sameResult(old, pre) {
+			return old
+		}
+		return nil
 	}
 
-	if result.RequiredContextKeys != nil {
-		keyCache := make(map[string]map[string]bool, len(result.RequiredContextKeys))
-		for flagKey, keys := range result.RequiredContextKeys {
-			keySet := make(map[string]bool, len(keys))
-			for _, k := range keys {
-				keySet[k] = true
+	if len(result.PreEvaluated) == len(prev) {
+		shared := true
+		for flagKey, pre := range result.PreEvaluated {
+			if pre == nil || reuse(flagKey, pre) == nil {
+				shared = false
+				break
 			}
-			keyCache[flagKey] = keySet
 		}
-		snap.requiredCtxKey = keyCache
+		if shared {
+			return prev
+		}
 	}
 
-	if result.FlagIndices != nil {
-		snap.flagIndex = result.FlagIndices
+	preEvaluated := make(map[string]*EvaluationResult, len(result.PreEvaluated))
+	for flagKey, pre := range result.PreEvaluated {
+		if pre == nil {
+			continue
+		}
+		if old := reuse(flagKey, pre); old != nil {
+			preEvaluated[flagKey] = old
+			continue
+		}
+		// Copied so the results in UpdateStateResult aren't marked as cached,
+		// and modifying them doesn't reach the cache
+		cached := pre.clone()
+		cached.Cached = true
+		preEvaluated[flagKey] = cached
 	}
+	return preEvaluated
+}
 
-	return snap
+// sameResult reports whether the cached result old holds the same result as
+// pre.
+func sameResult(old, pre *EvaluationResult) bool {
+	return old.Variant == pre.Variant &&
+		old.Reason == pre.Reason &&
+		old.ErrorCode == pre.ErrorCode &&
+		old.ErrorMessage == pre.ErrorMessage &&
+		slices.Equal(old.MissingKeys, pre.MissingKeys) &&
+		bytes.Equal(old.rawValue, pre.rawValue) &&
+		reflect.DeepEqual(old.Value, pre.Value) &&
+		reflect.DeepEqual(old.FlagMetadata, pre.FlagMetadata)
+}
+
+// buildRequiredCtxKeys returns the required context keys of a snapshot built
+// from result, sharing unchanged key sets with prev (see buildCacheSnapshot).
+func buildRequiredCtxKeys(prev map[string]map[string]bool, result *UpdateStateResult) map[string]map[string]bool {
+	if result.RequiredContextKeys == nil {
+		return make(map[string]map[string]bool)
+	}
+	reuse := func(flagKey string, keys []string) map[string]bool {
+		old, ok := prev[flagKey]
+		if !ok || len(old) != len(keys) || flagChanged(result, flagKey) {
+			return nil
+		}
+		for _, k := range keys {
+			if !old[k] {
+				return nil
+			}
+		}
+		return old
+	}
+
+	if len(result.RequiredContextKeys) == len(prev) {
+		shared := true
+		for flagKey, keys := range result.RequiredContextKeys {
+			if reuse(flagKey, keys) == nil {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			return prev
+		}
+	}
+
+	keyCache := make(map[string]map[string]bool, len(result.RequiredContextKeys))
+	for flagKey, keys := range result.RequiredContextKeys {
+		if old := reuse(flagKey, keys); old != nil {
+			keyCache[flagKey] = old
+			continue
+		}
+		keySet := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			keySet[k] = true
+		}
+		keyCache[flagKey] = keySet
+	}
+	return keyCache
 }
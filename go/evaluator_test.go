@@ -1,14 +1,39 @@
 package evaluator
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero"
 )
 
+// testCompilationCache is shared by test evaluators so the WASM module is
+// compiled once per test binary rather than once per test.
+var testCompilationCache = wazero.NewCompilationCache()
+
 func newTestEvaluator(t *testing.T) *FlagEvaluator {
 	t.Helper()
-	e, err := NewFlagEvaluator(WithPermissiveValidation())
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache))
 	if err != nil {
 		t.Fatalf("failed to create evaluator: %v", err)
 	}
@@ -39,7 +64,7 @@ func TestSimpleBooleanFlag(t *testing.T) {
 	if !result.Success {
 		t.Fatalf("UpdateState not successful: %s", result.Error)
 	}
-	assertContains(t, result.ChangedFlags, "simple-flag")
+	assertContains(t, result.AddedFlags, "simple-flag")
 
 	evalResult, err := e.EvaluateFlag("simple-flag", map[string]interface{}{})
 	if err != nil {
@@ -137,6 +162,138 @@ func TestTargetingRule(t *testing.T) {
 	}
 	assertEqual(t, false, result.Value)
 	assertEqual(t, "default", result.Variant)
+	assertEqual(t, "DEFAULT", result.Reason)
+}
+
+func TestDefaultAndStaticReasons(t *testing.T) {
+	config := `{
+		"flags": {
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false }
+			},
+			"empty-targeting": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {}
+			},
+			"null-branch": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "on", null] }
+			},
+			"no-else": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "on"] }
+			},
+			"disabled": {
+				"state": "DISABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "on", null] }
+			}
+		}
+	}`
+	want := map[string]map[string]string{
+		"premium": {
+			"static": ReasonStatic, "empty-targeting": ReasonStatic, "null-branch": ReasonTargetingMatch,
+			"no-else": ReasonTargetingMatch, "disabled": ReasonDisabled,
+		},
+		"basic": {
+			"static": ReasonStatic, "empty-targeting": ReasonStatic, "null-branch": ReasonDefault,
+			"no-else": ReasonDefault, "disabled": ReasonDisabled,
+		},
+	}
+
+	// The single-flag, batch and result cache paths all report the same reasons
+	cached, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache), WithResultCache(16, 0))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { cached.Close() })
+	for _, e := range []*FlagEvaluator{newTestEvaluator(t), cached} {
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		for tier, reasons := range want {
+			ctx := map[string]interface{}{"targetingKey": "user-1", "tier": tier}
+			for i := 0; i < 2; i++ {
+				for flagKey, reason := range reasons {
+					result, err := e.EvaluateFlag(flagKey, ctx)
+					if err != nil {
+						t.Fatalf("EvaluateFlag(%q) failed: %v", flagKey, err)
+					}
+					if result.Reason != reason {
+						t.Errorf("%s with tier %s: reason = %s, want %s", flagKey, tier, result.Reason, reason)
+					}
+				}
+			}
+			results, err := e.EvaluateAllFlags(ctx)
+			if err != nil {
+				t.Fatalf("EvaluateAllFlags failed: %v", err)
+			}
+			for flagKey, reason := range reasons {
+				if results[flagKey].Reason != reason {
+					t.Errorf("batch %s with tier %s: reason = %s, want %s", flagKey, tier, results[flagKey].Reason, reason)
+				}
+			}
+		}
+	}
+}
+
+func TestCachedResults(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"disabled": {
+				"state": "DISABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"targeted": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "on", null] }
+			}
+		}
+	}`
+	updateResult, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	for flagKey, pre := range updateResult.PreEvaluated {
+		if pre.Cached {
+			t.Errorf("UpdateStateResult.PreEvaluated[%q] is marked cached", flagKey)
+		}
+	}
+
+	want := map[string]bool{"static": true, "disabled": true, "targeted": false}
+	ctx := map[string]interface{}{"tier": "premium"}
+	for flagKey, cached := range want {
+		result, err := e.EvaluateFlag(flagKey, ctx)
+		if err != nil {
+			t.Fatalf("EvaluateFlag failed: %v", err)
+		}
+		assertEqual(t, cached, result.Cached)
+	}
+	results, err := e.EvaluateAllFlags(ctx)
+	if err != nil {
+		t.Fatalf("EvaluateAllFlags failed: %v", err)
+	}
+	for flagKey, cached := range want {
+		assertEqual(t, cached, results[flagKey].Cached)
+	}
 }
 
 func TestFlagNotFound(t *testing.T) {
@@ -211,8 +368,68 @@ func TestNumericFlag(t *testing.T) {
 	if err != nil {
 		t.Fatalf("EvaluateFlag failed: %v", err)
 	}
-	// JSON numbers unmarshal as float64
-	assertEqual(t, float64(42), result.Value)
+	// Integral JSON numbers decode as int64
+	assertEqual(t, int64(42), result.Value)
+}
+
+func TestIntegerPrecision(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	// 2^53 + 1 cannot be represented exactly as float64
+	config := `{
+		"flags": {
+			"static-id": {
+				"state": "ENABLED",
+				"defaultVariant": "id",
+				"variants": { "id": 9007199254740993 }
+			},
+			"targeted-id": {
+				"state": "ENABLED",
+				"defaultVariant": "small",
+				"variants": { "big": 9007199254740993, "small": 1, "ratio": 0.5 },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "tier" }, "premium"] }, "big",
+						{ "==": [{ "var": "tier" }, "half"] }, "ratio",
+						null
+					]
+				}
+			}
+		}
+	}`
+
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	const want int64 = 9007199254740993
+	premium := map[string]interface{}{"tier": "premium"}
+
+	result, err := e.EvaluateFlag("static-id", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, want, result.Value)
+
+	result, err = e.EvaluateFlag("targeted-id", premium)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, want, result.Value)
+
+	if v := e.EvaluateInt("static-id", nil, 0); v != want {
+		t.Errorf("EvaluateInt static: expected %d, got %d", want, v)
+	}
+	if v := e.EvaluateInt("targeted-id", premium, 0); v != want {
+		t.Errorf("EvaluateInt targeting: expected %d, got %d", want, v)
+	}
+
+	// Non-integral numbers stay float64
+	result, err = e.EvaluateFlag("targeted-id", map[string]interface{}{"tier": "half"})
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, 0.5, result.Value)
 }
 
 func TestContextEnrichment(t *testing.T) {
@@ -277,7 +494,8 @@ func TestUpdateStateChangedFlags(t *testing.T) {
 	if !result1.Success {
 		t.Fatalf("UpdateState not successful")
 	}
-	assertContains(t, result1.ChangedFlags, "flag-a")
+	assertContains(t, result1.AddedFlags, "flag-a")
+	assertEqual(t, 0, len(result1.ChangedFlags))
 
 	// Update with changed + new flags
 	config2 := `{
@@ -302,313 +520,5896 @@ func TestUpdateStateChangedFlags(t *testing.T) {
 		t.Fatalf("UpdateState not successful")
 	}
 	assertContains(t, result2.ChangedFlags, "flag-a")
-	assertContains(t, result2.ChangedFlags, "flag-b")
-}
-
-func TestRequiredContextKeys(t *testing.T) {
-	e := newTestEvaluator(t)
+	assertContains(t, result2.AddedFlags, "flag-b")
+	assertEqual(t, 0, len(result2.RemovedFlags))
 
-	config := `{
+	// Remove flag-a, leave flag-b untouched
+	config3 := `{
 		"flags": {
-			"targeted-flag": {
-				"state": "ENABLED",
-				"defaultVariant": "off",
-				"variants": { "on": true, "off": false },
-				"targeting": {
-					"if": [
-						{ "==": [{ "var": "email" }, "admin@example.com"] },
-						"on", "off"
-					]
-				}
-			},
-			"static-flag": {
+			"flag-b": {
 				"state": "ENABLED",
 				"defaultVariant": "on",
 				"variants": { "on": true }
 			}
 		}
 	}`
-
-	result, err := e.UpdateState(config)
+	result3, err := e.UpdateState(config3)
 	if err != nil {
 		t.Fatalf("UpdateState failed: %v", err)
 	}
-	if !result.Success {
-		t.Fatalf("UpdateState not successful")
-	}
+	assertContains(t, result3.RemovedFlags, "flag-a")
+	assertEqual(t, 0, len(result3.AddedFlags))
+	assertEqual(t, 0, len(result3.ChangedFlags))
+}
 
-	// Should have required context keys for the targeted flag
-	if result.RequiredContextKeys == nil {
-		t.Fatal("RequiredContextKeys is nil")
+func TestUpdateStateReader(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	result, err := e.UpdateStateReader(strings.NewReader(simpleFlagConfig))
+	if err != nil {
+		t.Fatalf("UpdateStateReader failed: %v", err)
 	}
-	keys, ok := result.RequiredContextKeys["targeted-flag"]
-	if !ok {
-		t.Fatal("targeted-flag not in RequiredContextKeys")
+	assertEqual(t, true, result.Success)
+	assertContains(t, result.AddedFlags, "simple-flag")
+	assertEqual(t, simpleFlagConfig, e.CurrentConfig())
+	assertEqual(t, true, e.EvaluateBool("simple-flag", nil, false))
+
+	// Same config as UpdateState applies, so it's skipped as unchanged
+	result, err = e.UpdateState(simpleFlagConfig)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
 	}
-	assertContains(t, keys, "email")
-	assertContains(t, keys, "targetingKey")
+	assertEqual(t, 0, len(result.AddedFlags))
+	assertEqual(t, uint64(1), e.Generation())
 
-	// Static flags should not be in required context keys
-	if _, ok := result.RequiredContextKeys["static-flag"]; ok {
-		t.Error("static-flag should not have required context keys")
+	readErr := errors.New("connection reset")
+	if _, err := e.UpdateStateReader(iotest.ErrReader(readErr)); !errors.Is(err, readErr) {
+		t.Errorf("expected the read error, got %v", err)
 	}
+	assertEqual(t, simpleFlagConfig, e.CurrentConfig())
 }
 
-func TestFlagIndices(t *testing.T) {
+func TestUpdateStateCompressed(t *testing.T) {
 	e := newTestEvaluator(t)
 
-	config := `{
-		"flags": {
-			"flagB": {
-				"state": "ENABLED",
-				"defaultVariant": "on",
-				"variants": { "on": true }
-			},
-			"flagA": {
-				"state": "ENABLED",
-				"defaultVariant": "off",
-				"variants": { "off": false }
-			}
-		}
-	}`
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
 
-	result, err := e.UpdateState(config)
+	result, err := e.UpdateStateCompressed(gzipped([]byte(simpleFlagConfig)))
 	if err != nil {
-		t.Fatalf("UpdateState failed: %v", err)
-	}
-	if !result.Success {
-		t.Fatalf("UpdateState not successful")
+		t.Fatalf("UpdateStateCompressed failed: %v", err)
 	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, simpleFlagConfig, e.CurrentConfig())
 
-	if result.FlagIndices == nil {
-		t.Fatal("FlagIndices is nil")
-	}
-	if _, ok := result.FlagIndices["flagA"]; !ok {
-		t.Fatal("flagA not in FlagIndices")
+	if _, err := e.UpdateStateCompressed([]byte(simpleFlagConfig)); err == nil {
+		t.Error("expected an error for uncompressed input")
 	}
-	if _, ok := result.FlagIndices["flagB"]; !ok {
-		t.Fatal("flagB not in FlagIndices")
+
+	// A bomb is rejected without touching the applied config
+	bomb := gzipped(make([]byte, maxDecompressedConfigSize+1))
+	if _, err := e.UpdateStateCompressed(bomb); !errors.Is(err, ErrConfigTooLarge) {
+		t.Errorf("expected ErrConfigTooLarge, got %v", err)
 	}
-	// Indices should be in sorted order
-	assertEqual(t, uint32(0), result.FlagIndices["flagA"])
-	assertEqual(t, uint32(1), result.FlagIndices["flagB"])
+	assertEqual(t, simpleFlagConfig, e.CurrentConfig())
 }
 
-func TestFilteredContextEvaluation(t *testing.T) {
-	e := newTestEvaluator(t)
-
+func TestExportImportState(t *testing.T) {
+	src := newTestEvaluator(t)
+	if _, err := src.ExportState(); err == nil {
+		t.Error("expected an error exporting before the first update")
+	}
 	config := `{
 		"flags": {
-			"email-flag": {
+			"big-int": { "state": "ENABLED", "defaultVariant": "big", "variants": { "big": 9007199254740993 } },
+			"tier-flag": {
 				"state": "ENABLED",
-				"defaultVariant": "default",
-				"variants": { "default": false, "premium": true },
-				"targeting": {
-					"if": [
-						{ "==": [{ "var": "email" }, "admin@example.com"] },
-						"premium", null
-					]
-				}
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			},
+			"key-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "$flagd.flagKey" }, "key-flag"] }, "on", "off"] }
 			}
 		}
 	}`
-
-	_, err := e.UpdateState(config)
-	if err != nil {
+	if _, err := src.UpdateState(simpleFlagConfig); err != nil {
 		t.Fatalf("UpdateState failed: %v", err)
 	}
+	if _, err := src.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	data, err := src.ExportState()
+	if err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
 
-	// Large context — only "email" matters
-	ctx := map[string]interface{}{
-		"targetingKey": "user-123",
-		"email":        "admin@example.com",
-		"name":         "Admin User",
-		"age":          30,
-		"country":      "US",
-		"tier":         "premium",
-		"department":   "engineering",
+	e := newTestEvaluator(t)
+	if err := e.ImportState(data); err != nil {
+		t.Fatalf("ImportState failed: %v", err)
 	}
+	assertEqual(t, uint64(2), e.Generation())
+	assertEqual(t, config, e.CurrentConfig())
 
-	result, err := e.EvaluateFlag("email-flag", ctx)
+	// The imported caches are restored rather than rebuilt
+	want, got := src.active.Load().snap, e.active.Load().snap
+	if !reflect.DeepEqual(want.requiredCtxKey, got.requiredCtxKey) || !reflect.DeepEqual(want.flagdFree, got.flagdFree) ||
+		!reflect.DeepEqual(want.flagIndex, got.flagIndex) {
+		t.Errorf("restored caches differ from the exported ones")
+	}
+
+	result, err := e.EvaluateFlag("big-int", nil)
 	if err != nil {
 		t.Fatalf("EvaluateFlag failed: %v", err)
 	}
-	assertEqual(t, true, result.Value)
-	assertEqual(t, "premium", result.Variant)
-	assertEqual(t, "TARGETING_MATCH", result.Reason)
+	assertEqual(t, int64(9007199254740993), result.Value)
+	assertEqual(t, true, result.Cached)
+	assertEqual(t, int64(9007199254740993), e.EvaluateInt("big-int", nil, 0))
+	assertEqual(t, true, e.EvaluateBool("tier-flag", map[string]interface{}{"tier": "gold"}, false))
+	assertEqual(t, true, e.EvaluateBool("key-flag", nil, false))
 
-	// Non-matching email
-	ctx2 := map[string]interface{}{
-		"targetingKey": "user-456",
-		"email":        "regular@example.com",
-		"name":         "Regular User",
-		"age":          25,
+	// Later updates carry on from the imported generation
+	if _, err := e.UpdateState(simpleFlagConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
 	}
-	result, err = e.EvaluateFlag("email-flag", ctx2)
-	if err != nil {
-		t.Fatalf("EvaluateFlag failed: %v", err)
+	assertEqual(t, uint64(3), e.Generation())
+
+	var state map[string]interface{}
+	json.Unmarshal(data, &state)
+	state["version"] = 99
+	future, _ := json.Marshal(state)
+	for name, data := range map[string][]byte{"future version": future, "garbage": []byte("{")} {
+		if err := e.ImportState(data); err == nil {
+			t.Errorf("%s: expected ImportState to fail", name)
+		}
 	}
-	assertEqual(t, false, result.Value)
-	assertEqual(t, "default", result.Variant)
+	assertEqual(t, uint64(3), e.Generation())
 }
 
-func TestPreEvaluatedCache(t *testing.T) {
-	e := newTestEvaluator(t)
-
-	config := `{
+func TestUpdateStateFromSources(t *testing.T) {
+	base := `{
+		"$evaluators": {
+			"is-admin": { "==": [{ "var": "role" }, "admin"] }
+		},
 		"flags": {
-			"static-flag": {
+			"shared-flag": {
 				"state": "ENABLED",
-				"defaultVariant": "on",
-				"variants": { "on": true, "off": false }
+				"defaultVariant": "off",
+				"variants": { "on": "base-on", "off": "base-off" },
+				"targeting": { "if": [{ "$ref": "is-admin" }, "on", "off"] }
 			},
-			"disabled-flag": {
-				"state": "DISABLED",
+			"base-flag": {
+				"state": "ENABLED",
 				"defaultVariant": "on",
-				"variants": { "on": true, "off": false }
+				"variants": { "on": "base" }
 			}
 		}
 	}`
-
-	_, err := e.UpdateState(config)
-	if err != nil {
-		t.Fatalf("UpdateState failed: %v", err)
-	}
-
+	override := `{
+		"flags": {
+			"shared-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "override-on", "off": "override-off" }
+			},
+			"admin-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "admin", "off": "user" },
+				"targeting": { "if": [{ "$ref": "is-admin" }, "on", "off"] }
+			}
+		}
+	}`
+	extra := `{
+		"flags": {
+			"base-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "extra" }
+			}
+		}
+	}`
+
+	e := newTestEvaluator(t)
+	result, err := e.UpdateStateFromSources(base, override, extra)
+	if err != nil {
+		t.Fatalf("UpdateStateFromSources failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("UpdateStateFromSources not successful: %s", result.Error)
+	}
+	assertEqual(t, 2, len(result.SourceOverrides))
+	assertEqual(t, 1, result.SourceOverrides["shared-flag"])
+	assertEqual(t, 2, result.SourceOverrides["base-flag"])
+
+	admin := map[string]interface{}{"role": "admin"}
+
+	// The overriding flag replaces the base definition whole: its targeting
+	// is gone rather than merged in
+	shared, err := e.EvaluateFlag("shared-flag", admin)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, "override-on", shared.Value)
+	assertEqual(t, ReasonStatic, shared.Reason)
+
+	assertEqual(t, "extra", e.EvaluateString("base-flag", nil, "error"))
+
+	// Evaluators from an earlier source remain available to later ones
+	assertEqual(t, "admin", e.EvaluateString("admin-flag", admin, "error"))
+
+	t.Run("invalid source", func(t *testing.T) {
+		_, err := e.UpdateStateFromSources(base, "not json")
+		if err == nil || !strings.Contains(err.Error(), "source 1") {
+			t.Fatalf("expected error naming source 1, got %v", err)
+		}
+		// The applied state is untouched
+		assertEqual(t, "extra", e.EvaluateString("base-flag", nil, "error"))
+	})
+
+	t.Run("no sources", func(t *testing.T) {
+		if _, err := e.UpdateStateFromSources(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("single source", func(t *testing.T) {
+		result, err := e.UpdateStateFromSources(base)
+		if err != nil {
+			t.Fatalf("UpdateStateFromSources failed: %v", err)
+		}
+		if result.SourceOverrides != nil {
+			t.Errorf("expected no overrides, got %v", result.SourceOverrides)
+		}
+		assertEqual(t, "base", e.EvaluateString("base-flag", nil, "error"))
+	})
+}
+
+func TestGroupUpdateState(t *testing.T) {
+	evaluators := []*FlagEvaluator{newTestEvaluator(t), newTestEvaluator(t), newTestEvaluator(t)}
+	g := NewGroup(evaluators...)
+
+	results, err := g.UpdateState(simpleFlagConfig)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, 3, len(results))
+	for i, e := range evaluators {
+		assertEqual(t, true, results[i].Success)
+		assertEqual(t, uint64(1), e.Generation())
+		assertEqual(t, simpleFlagConfig, e.CurrentConfig())
+	}
+
+	// A rejected config is reported per evaluator without an error
+	results, err = g.UpdateState(`{"flags": {"bad": {"state": "ENABLED"}}}`)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	for i, e := range evaluators {
+		assertEqual(t, false, results[i].Success)
+		assertEqual(t, uint64(1), e.Generation())
+	}
+
+	// A failing evaluator doesn't stop the others, and the error names it
+	evaluators[1].Close()
+	results, err = g.UpdateState(simpleTargetingConfig)
+	if !errors.Is(err, ErrEvaluatorClosed) {
+		t.Fatalf("expected ErrEvaluatorClosed, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "evaluator 1: ") {
+		t.Errorf("expected the error to name evaluator 1, got %q", err)
+	}
+	if results[1] != nil {
+		t.Errorf("expected no result for the closed evaluator, got %+v", results[1])
+	}
+	for _, i := range []int{0, 2} {
+		assertEqual(t, true, results[i].Success)
+		assertEqual(t, simpleTargetingConfig, evaluators[i].CurrentConfig())
+	}
+
+	results, err = NewGroup().UpdateState(simpleFlagConfig)
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected an empty group to do nothing, got %v, %v", results, err)
+	}
+}
+
+func TestFlagSets(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	setConfig := func(value string) string {
+		return `{
+			"$evaluators": {
+				"isAdmin": { "==": [{ "var": "role" }, "` + value + `-admin"] }
+			},
+			"metadata": { "team": "` + value + `", "$internal": true },
+			"flags": {
+				"shared": {
+					"state": "ENABLED",
+					"defaultVariant": "v",
+					"variants": { "v": "` + value + `" },
+					"metadata": { "owner": "` + value + `-owner" }
+				},
+				"admin": {
+					"state": "ENABLED",
+					"defaultVariant": "off",
+					"variants": { "on": true, "off": false },
+					"targeting": { "if": [{ "$ref": "isAdmin" }, "on", "off"] }
+				},
+				"rollout": {
+					"state": "ENABLED",
+					"defaultVariant": "a",
+					"variants": { "a": "a", "b": "b", "c": "c" },
+					"targeting": { "fractional": [["a", 1], ["b", 1], ["c", 1]] }
+				}
+			}
+		}`
+	}
+	if _, err := e.UpdateState(setConfig("main")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	result, err := e.UpdateStateSet("tenant-a", setConfig("a"))
+	if err != nil {
+		t.Fatalf("UpdateStateSet failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, fmt.Sprint([]string{"admin", "rollout", "shared"}), fmt.Sprint(result.AddedFlags))
+	if _, err := e.UpdateStateSet("tenant-b", setConfig("b")); err != nil {
+		t.Fatalf("UpdateStateSet failed: %v", err)
+	}
+
+	// Each set sees only its own flags, evaluators and metadata
+	evalIn := func(set, flagKey string, ctx map[string]interface{}) *EvaluationResult {
+		t.Helper()
+		result, err := e.EvaluateFlagInSet(set, flagKey, ctx)
+		if err != nil {
+			t.Fatalf("EvaluateFlagInSet(%q, %q) failed: %v", set, flagKey, err)
+		}
+		return result
+	}
+	assertEqual(t, "main", e.EvaluateString("shared", nil, "error"))
+	assertEqual(t, "a", evalIn("tenant-a", "shared", nil).Value)
+	assertEqual(t, "b", evalIn("tenant-b", "shared", nil).Value)
+	assertEqual(t, fmt.Sprint(map[string]interface{}{"team": "a", "owner": "a-owner"}),
+		fmt.Sprint(evalIn("tenant-a", "shared", nil).FlagMetadata))
+	assertEqual(t, true, evalIn("tenant-a", "admin", map[string]interface{}{"role": "a-admin"}).Value)
+	assertEqual(t, false, evalIn("tenant-b", "admin", map[string]interface{}{"role": "a-admin"}).Value)
+
+	// Bucketing uses the flag's key within its set, as a standalone
+	// evaluator would
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		ctx := map[string]interface{}{"targetingKey": user}
+		assertEqual(t, e.EvaluateString("rollout", ctx, "error"), evalIn("tenant-a", "rollout", ctx).Value)
+	}
+
+	for _, tc := range []struct{ set, flagKey string }{
+		{"tenant-a", "missing"},
+		{"tenant-c", "shared"},
+		{"tenant-a/shared", ""},
+	} {
+		assertEqual(t, ErrorFlagNotFound, evalIn(tc.set, tc.flagKey, nil).ErrorCode)
+	}
+
+	// Updating one set reports only its flags and leaves the others alone
+	result, err = e.UpdateStateSet("tenant-b", strings.Replace(setConfig("b"), `"v": "b"`, `"v": "b2"`, 1))
+	if err != nil {
+		t.Fatalf("UpdateStateSet failed: %v", err)
+	}
+	assertEqual(t, fmt.Sprint([]string{"shared"}), fmt.Sprint(result.ChangedFlags))
+	assertEqual(t, "b2", evalIn("tenant-b", "shared", nil).Value)
+	assertEqual(t, "a", evalIn("tenant-a", "shared", nil).Value)
+	assertEqual(t, "main", e.EvaluateString("shared", nil, "error"))
+
+	// A rejected config keeps the set's previous one
+	if _, err := e.UpdateStateSet("tenant-a", "{not json"); err == nil {
+		t.Error("expected invalid JSON to be rejected")
+	}
+	assertEqual(t, "a", evalIn("tenant-a", "shared", nil).Value)
+
+	// The default context applies in sets too
+	e.SetDefaultContext(map[string]interface{}{"role": "a-admin"})
+	assertEqual(t, true, evalIn("tenant-a", "admin", nil).Value)
+
+	for _, set := range []string{"", "a/b"} {
+		if _, err := e.UpdateStateSet(set, setConfig("x")); err == nil {
+			t.Errorf("UpdateStateSet(%q): expected error", set)
+		}
+	}
+}
+
+func TestSetFlagRemoveFlag(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	// Before any config, SetFlag starts an empty one
+	result, err := e.SetFlag("first-flag", `{
+		"state": "ENABLED",
+		"defaultVariant": "on",
+		"variants": { "on": "first" }
+	}`)
+	if err != nil {
+		t.Fatalf("SetFlag failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, "[first-flag]", fmt.Sprint(result.AddedFlags))
+	assertEqual(t, "first", e.EvaluateString("first-flag", nil, "error"))
+
+	config := `{
+		"$evaluators": {
+			"is-admin": { "==": [{ "var": "role" }, "admin"] }
+		},
+		"flags": {
+			"admin-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "admin", "off": "user" },
+				"targeting": { "if": [{ "$ref": "is-admin" }, "on", "off"] }
+			},
+			"color-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "red", "blue": "blue" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	admin := map[string]interface{}{"role": "admin"}
+
+	t.Run("add", func(t *testing.T) {
+		result, err := e.SetFlag("new-flag", `{
+			"state": "ENABLED",
+			"defaultVariant": "off",
+			"variants": { "on": true, "off": false },
+			"targeting": { "if": [{ "$ref": "is-admin" }, "on", "off"] }
+		}`)
+		if err != nil {
+			t.Fatalf("SetFlag failed: %v", err)
+		}
+		assertEqual(t, "[new-flag]", fmt.Sprint(result.AddedFlags))
+		assertEqual(t, 0, len(result.ChangedFlags))
+		assertEqual(t, 0, len(result.RemovedFlags))
+
+		// The shared evaluators and the other flags are kept
+		assertEqual(t, true, e.EvaluateBool("new-flag", admin, false))
+		assertEqual(t, "admin", e.EvaluateString("admin-flag", admin, "error"))
+		assertEqual(t, "red", e.EvaluateString("color-flag", nil, "error"))
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		result, err := e.SetFlag("color-flag", `{
+			"state": "ENABLED",
+			"defaultVariant": "blue",
+			"variants": { "red": "red", "blue": "blue" }
+		}`)
+		if err != nil {
+			t.Fatalf("SetFlag failed: %v", err)
+		}
+		assertEqual(t, "[color-flag]", fmt.Sprint(result.ChangedFlags))
+		assertEqual(t, 0, len(result.AddedFlags))
+		assertEqual(t, "blue", e.EvaluateString("color-flag", nil, "error"))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		result, err := e.RemoveFlag("color-flag")
+		if err != nil {
+			t.Fatalf("RemoveFlag failed: %v", err)
+		}
+		assertEqual(t, "[color-flag]", fmt.Sprint(result.RemovedFlags))
+		assertEqual(t, 0, len(result.ChangedFlags))
+		assertEqual(t, "default", e.EvaluateString("color-flag", nil, "default"))
+		assertEqual(t, "admin", e.EvaluateString("admin-flag", admin, "error"))
+	})
+
+	t.Run("remove missing flag", func(t *testing.T) {
+		result, err := e.RemoveFlag("no-such-flag")
+		if err != nil {
+			t.Fatalf("RemoveFlag failed: %v", err)
+		}
+		assertEqual(t, 0, len(result.AddedFlags)+len(result.ChangedFlags)+len(result.RemovedFlags))
+
+		// The config is left as written, not re-encoded, so the update is
+		// skipped
+		fresh := newTestEvaluator(t)
+		if _, err := fresh.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		gen := fresh.Generation()
+		events, cancel := fresh.Subscribe()
+		defer cancel()
+		if _, err := fresh.RemoveFlag("no-such-flag"); err != nil {
+			t.Fatalf("RemoveFlag failed: %v", err)
+		}
+		assertEqual(t, gen, fresh.Generation())
+		assertEqual(t, config, fresh.CurrentConfig())
+		select {
+		case ev := <-events:
+			t.Fatalf("unexpected event for a no-op removal: %+v", ev)
+		default:
+		}
+	})
+
+	t.Run("invalid flag JSON", func(t *testing.T) {
+		if _, err := e.SetFlag("bad-flag", "not json"); err == nil {
+			t.Fatal("expected error")
+		}
+		assertEqual(t, true, e.EvaluateBool("new-flag", admin, false))
+	})
+}
+
+func TestCurrentConfigAndGeneration(t *testing.T) {
+	e := newTestEvaluator(t)
+	assertEqual(t, "", e.CurrentConfig())
+	assertEqual(t, uint64(0), e.Generation())
+
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, simpleTargetingConfig, e.CurrentConfig())
+	assertEqual(t, uint64(1), e.Generation())
+
+	// Skipped identical update
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, uint64(1), e.Generation())
+
+	// Rejected update keeps the previous config
+	if result, err := e.UpdateState(`{"flags": "invalid"}`); err == nil && result.Success {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	assertEqual(t, simpleTargetingConfig, e.CurrentConfig())
+	assertEqual(t, uint64(1), e.Generation())
+
+	if _, err := e.UpdateState(simpleFlagConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, simpleFlagConfig, e.CurrentConfig())
+	assertEqual(t, uint64(2), e.Generation())
+}
+
+func TestDryRunUpdateState(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	standard := map[string]interface{}{"department": "engineering", "experience": 7}
+	stats := e.Stats()
+
+	// The diff is against the active config, which stays live
+	v2 := strings.Replace(bigTargetingConfig, `"standard-tier"`, `"standard-tier-v2"`, 1)
+	result, err := e.DryRunUpdateState(v2)
+	if err != nil {
+		t.Fatalf("DryRunUpdateState failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, fmt.Sprint([]string{"big-flag"}), fmt.Sprint(result.ChangedFlags))
+	assertEqual(t, 0, len(result.AddedFlags))
+	assertEqual(t, uint64(1), e.Generation())
+	assertEqual(t, bigTargetingConfig, e.CurrentConfig())
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+
+	result, err = e.DryRunUpdateState(simpleFlagConfig)
+	if err != nil {
+		t.Fatalf("DryRunUpdateState failed: %v", err)
+	}
+	if len(result.AddedFlags) == 0 || len(result.RemovedFlags) == 0 {
+		t.Errorf("expected added and removed flags, got %+v", result)
+	}
+
+	// Identical configs are validated, not skipped
+	result, err = e.DryRunUpdateState(bigTargetingConfig)
+	if err != nil {
+		t.Fatalf("DryRunUpdateState failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, 0, len(result.ChangedFlags))
+
+	if result, err := e.DryRunUpdateState(`{"flags": "invalid"}`); err == nil && result.Success {
+		t.Error("expected invalid config to be rejected")
+	}
+
+	// The live state, and a real update afterwards, are unaffected
+	assertEqual(t, stats.AvailableInstances, e.Stats().AvailableInstances)
+	result, err = e.UpdateState(v2)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, fmt.Sprint([]string{"big-flag"}), fmt.Sprint(result.ChangedFlags))
+	assertEqual(t, "standard-tier-v2", e.EvaluateString("big-flag", standard, "error"))
+
+	e.Close()
+	if _, err := e.DryRunUpdateState(v2); !errors.Is(err, ErrEvaluatorClosed) {
+		t.Errorf("expected ErrEvaluatorClosed, got %v", err)
+	}
+}
+
+func TestPermissiveValidationWarnings(t *testing.T) {
+	invalid := `{
+		"flags": {
+			"bogus-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false },
+				"targeting": { "bogus_op": [1] }
+			}
+		}
+	}`
+
+	e := newTestEvaluator(t)
+	result, err := e.UpdateState(simpleFlagConfig)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, 0, len(result.Warnings))
+
+	result, err = e.UpdateState(invalid)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	if len(result.Warnings) == 0 {
+		t.Fatal("expected validation warnings")
+	}
+	assertEqual(t, fmt.Sprint([]string{"bogus-flag"}), fmt.Sprint(result.AddedFlags))
+
+	// A skipped identical update still reports them, as does a dry run
+	result, err = e.UpdateState(invalid)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if len(result.Warnings) == 0 {
+		t.Error("expected warnings for the skipped update")
+	}
+	result, err = e.DryRunUpdateState(invalid)
+	if err != nil {
+		t.Fatalf("DryRunUpdateState failed: %v", err)
+	}
+	if !result.Success || len(result.Warnings) == 0 {
+		t.Errorf("expected a successful dry run with warnings, got %+v", result)
+	}
+
+	// The instance tried in strict mode is left permissive
+	for i := 0; i < e.poolSize; i++ {
+		set, inst, err := e.acquireInstance(context.Background())
+		if err != nil {
+			t.Fatalf("acquireInstance failed: %v", err)
+		}
+		result, err = updateInstance(e.ctx, inst, []byte(invalid))
+		e.releaseInstance(set, inst, err)
+		if err != nil || !result.Success {
+			t.Fatalf("expected the instance to accept the config, got %+v, %v", result, err)
+		}
+	}
+
+	// Strict mode rejects the config rather than warning
+	strict, err := NewFlagEvaluator(WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	defer strict.Close()
+	result, err = strict.UpdateState(invalid)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, false, result.Success)
+	assertEqual(t, 0, len(result.Warnings))
+}
+
+func TestDuplicateFlagKeys(t *testing.T) {
+	config := `{
+		"$schema": "https://flagd.dev/schema/v0/flags.json",
+		"flags": {
+			"b-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			"a-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true, "off": false } },
+			"a-flag": { "state": "ENABLED", "defaultVariant": "off", "variants": { "on": true, "off": false } },
+			"b-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			"a-flag": { "state": "DISABLED", "defaultVariant": "off", "variants": { "on": true, "off": false } }
+		},
+		"metadata": { "flags": "not the flags" }
+	}`
+	assertEqual(t, "a-flag,b-flag", strings.Join(duplicateFlagKeys([]byte(config)), ","))
+	assertEqual(t, 0, len(duplicateFlagKeys([]byte(simpleTargetingConfig))))
+	assertEqual(t, 0, len(duplicateFlagKeys([]byte(`{"flags": {"a": 1, `))))
+
+	// Strict validation rejects the config, also in a dry run
+	strict, err := NewFlagEvaluator(WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { strict.Close() })
+	for _, update := range []func(string) (*UpdateStateResult, error){strict.DryRunUpdateState, strict.UpdateState} {
+		result, err := update(config)
+		if err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		assertEqual(t, false, result.Success)
+		assertEqual(t, "Flag key 'a-flag' is defined more than once; the last definition is used", result.Error)
+	}
+	assertEqual(t, 0, len(strict.ListFlags()))
+
+	// Permissive validation applies the last definition with a warning for
+	// each duplicated key
+	e := newTestEvaluator(t)
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, true, result.Success)
+	assertEqual(t, 2, len(result.Warnings))
+	assertEqual(t, "Flag key 'b-flag' is defined more than once; the last definition is used", result.Warnings[1])
+	flag, err := e.EvaluateFlag("a-flag", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, ReasonDisabled, flag.Reason)
+}
+
+func TestListFlagsAndMetadata(t *testing.T) {
+	e := newTestEvaluator(t)
+	assertEqual(t, 0, len(e.ListFlags()))
+	if _, ok := e.FlagMetadata("static-flag"); ok {
+		t.Fatal("expected no flags before the first update")
+	}
+	if metadata := e.FlagSetMetadata(); metadata != nil {
+		t.Fatalf("expected no flag set metadata before the first update, got %v", metadata)
+	}
+
+	config := `{
+		"metadata": { "team": "platform", "$internal": "hidden" },
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true },
+				"metadata": { "owner": "alice" }
+			},
+			"targeting-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] },
+				"metadata": { "owner": "bob", "team": "growth", "tags": ["beta"] }
+			},
+			"plain-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "var": "enabled" }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	assertEqual(t, "[plain-flag static-flag targeting-flag]", fmt.Sprint(e.ListFlags()))
+
+	tests := []struct {
+		flagKey string
+		want    string
+	}{
+		{"static-flag", "map[owner:alice team:platform]"},
+		{"targeting-flag", "map[owner:bob tags:[beta] team:growth]"},
+		{"plain-flag", "map[team:platform]"},
+	}
+	for _, tt := range tests {
+		metadata, ok := e.FlagMetadata(tt.flagKey)
+		if !ok {
+			t.Errorf("%s: expected flag to exist", tt.flagKey)
+			continue
+		}
+		assertEqual(t, tt.want, fmt.Sprint(metadata))
+
+		// Matches what evaluation reports
+		result, err := e.EvaluateFlag(tt.flagKey, nil)
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlag failed: %v", tt.flagKey, err)
+		}
+		assertEqual(t, tt.want, fmt.Sprint(result.FlagMetadata))
+	}
+
+	if _, ok := e.FlagMetadata("missing-flag"); ok {
+		t.Error("expected missing flag to be reported as absent")
+	}
+
+	// The returned map is a copy
+	metadata, _ := e.FlagMetadata("static-flag")
+	metadata["owner"] = "mallory"
+	metadata, _ = e.FlagMetadata("static-flag")
+	assertEqual(t, "alice", metadata["owner"])
+
+	setMetadata := e.FlagSetMetadata()
+	assertEqual(t, "map[team:platform]", fmt.Sprint(setMetadata))
+	setMetadata["team"] = "mallory"
+	assertEqual(t, "platform", e.FlagSetMetadata()["team"])
+
+	// Without flag set metadata, flags keep just their own
+	if _, err := e.UpdateState(strings.Replace(config, `"metadata": { "team": "platform", "$internal": "hidden" },`, "", 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if metadata := e.FlagSetMetadata(); metadata != nil {
+		t.Errorf("expected no flag set metadata, got %v", metadata)
+	}
+	metadata, _ = e.FlagMetadata("targeting-flag")
+	assertEqual(t, "map[owner:bob tags:[beta] team:growth]", fmt.Sprint(metadata))
+	_, ok := e.FlagMetadata("plain-flag")
+	assertEqual(t, true, ok)
+}
+
+func TestVariants(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, ok := e.Variants("color"); ok {
+		t.Fatal("expected no flags before the first update")
+	}
+
+	config := `{
+		"flags": {
+			"color": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "#f00", "blue": "#00f" },
+				"targeting": { "if": [{ "var": "blue" }, "blue", "red"] }
+			},
+			"limits": {
+				"state": "DISABLED",
+				"defaultVariant": "low",
+				"variants": {
+					"low": 9007199254740993,
+					"ratio": 0.5,
+					"off": false,
+					"config": { "retries": 3, "hosts": ["a", "b"] }
+				}
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	variants, ok := e.Variants("color")
+	if !ok {
+		t.Fatal("expected color to exist")
+	}
+	assertEqual(t, "map[blue:#00f red:#f00]", fmt.Sprint(variants))
+
+	variants, ok = e.Variants("limits")
+	if !ok {
+		t.Fatal("expected limits to exist")
+	}
+	assertEqual(t, int64(9007199254740993), variants["low"])
+	assertEqual(t, 0.5, variants["ratio"])
+	assertEqual(t, false, variants["off"])
+	assertEqual(t, "map[hosts:[a b] retries:3]", fmt.Sprint(variants["config"]))
+
+	if _, ok := e.Variants("missing"); ok {
+		t.Error("expected missing flag to be reported as absent")
+	}
+
+	// The returned values are copies
+	variants["config"].(map[string]interface{})["retries"] = 0
+	variants, _ = e.Variants("limits")
+	assertEqual(t, int64(3), variants["config"].(map[string]interface{})["retries"])
+
+	// Follows the active generation
+	if _, err := e.UpdateState(strings.Replace(config, `"blue": "#00f"`, `"blue": "#00f", "green": "#0f0"`, 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	variants, _ = e.Variants("color")
+	assertEqual(t, "map[blue:#00f green:#0f0 red:#f00]", fmt.Sprint(variants))
+}
+
+func TestTargetingRuleSource(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, ok := e.TargetingRule("color"); ok {
+		t.Fatal("expected no targeting before the first update")
+	}
+
+	config := `{
+		"flags": {
+			"color": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "#f00", "blue": "#00f" },
+				"targeting": {
+					"if": [{ "in": ["@example.com", { "var": "email" }] }, "blue", "red"]
+				}
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"empty": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false },
+				"targeting": {}
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	rule, ok := e.TargetingRule("color")
+	if !ok {
+		t.Fatal("expected color to have targeting")
+	}
+	assertEqual(t, `{"if":[{"in":["@example.com",{"var":"email"}]},"blue","red"]}`, string(rule))
+	for _, flagKey := range []string{"static", "empty", "missing"} {
+		if _, ok := e.TargetingRule(flagKey); ok {
+			t.Errorf("expected no targeting for %s", flagKey)
+		}
+	}
+
+	// The returned bytes are a copy
+	rule[0] = '['
+	rule, _ = e.TargetingRule("color")
+	assertEqual(t, byte('{'), rule[0])
+
+	// Follows the active generation
+	if _, err := e.UpdateState(strings.Replace(config, "@example.com", "@example.org", 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	rule, _ = e.TargetingRule("color")
+	assertEqual(t, `{"if":[{"in":["@example.org",{"var":"email"}]},"blue","red"]}`, string(rule))
+}
+
+func TestEvaluatorRefs(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"$evaluators": {
+			"is-ballmer": { "==": ["ballmer@macrosoft.com", { "var": "email" }] },
+			"is-macrosoft": { "ends_with": [{ "var": "email" }, "@macrosoft.com"] },
+			"is-staff": { "or": [{ "$ref": "is-ballmer" }, { "$ref": "is-macrosoft" }] }
+		},
+		"flags": {
+			"email-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "bye",
+				"variants": { "hi": "hi", "bye": "bye" },
+				"targeting": { "if": [{ "$ref": "is-ballmer" }, "hi", "bye"] }
+			},
+			"nested-ref-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "bye",
+				"variants": { "hi": "hi", "bye": "bye" },
+				"targeting": { "if": [{ "$ref": "is-staff" }, "hi", "bye"] }
+			}
+		}
+	}`
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("UpdateState not successful: %s", result.Error)
+	}
+
+	tests := []struct {
+		email, flagKey, want string
+	}{
+		{"ballmer@macrosoft.com", "email-flag", "hi"},
+		{"ballmer@macrosoft.com", "nested-ref-flag", "hi"},
+		{"gates@macrosoft.com", "email-flag", "bye"},
+		{"gates@macrosoft.com", "nested-ref-flag", "hi"},
+		{"someone@example.com", "nested-ref-flag", "bye"},
+	}
+	for _, tt := range tests {
+		ctx := map[string]interface{}{"email": tt.email}
+		assertEqual(t, tt.want, e.EvaluateString(tt.flagKey, ctx, "error"))
+	}
+	keys, _ := e.RequiredContextKeys("nested-ref-flag")
+	assertEqual(t, "[email targetingKey]", fmt.Sprint(keys))
+
+	rule, ok := e.FlagTargeting("email-flag")
+	if !ok {
+		t.Fatal("expected email-flag to have targeting")
+	}
+	assertEqual(t, `{"if":[{"==":["ballmer@macrosoft.com",{"var":"email"}]},"hi","bye"]}`, string(rule))
+	if _, ok := e.FlagTargeting("missing-flag"); ok {
+		t.Error("expected no targeting for a missing flag")
+	}
+	rule, _ = e.TargetingRule("email-flag")
+	assertEqual(t, `{"if":[{"$ref":"is-ballmer"},"hi","bye"]}`, string(rule))
+
+	// A $ref that can't be resolved rejects the config, naming the flag and
+	// the evaluator, and leaves the active state serving
+	badRefs := []struct {
+		name, config, want string
+	}{
+		{
+			"undefined evaluator",
+			strings.Replace(config, `{ "$ref": "is-ballmer" }, "hi"`, `{ "$ref": "is-balmer" }, "hi"`, 1),
+			"Failed to resolve $ref in flag 'email-flag': Evaluator 'is-balmer' not found in $evaluators",
+		},
+		{
+			"no evaluators",
+			`{"flags": {"f": {"state": "ENABLED", "defaultVariant": "off", "variants": {"on": true, "off": false},
+				"targeting": {"if": [{"$ref": "is-ballmer"}, "on", "off"]}}}}`,
+			"Failed to resolve $ref in flag 'f': Evaluator 'is-ballmer' not found in $evaluators",
+		},
+		{
+			"circular",
+			strings.Replace(config, `"$ref": "is-macrosoft" }]`, `"$ref": "is-staff" }]`, 1),
+			"Failed to resolve $ref in flag 'nested-ref-flag': Evaluator 'is-staff' is part of a circular $ref",
+		},
+		{
+			"not a name",
+			strings.Replace(config, `"$ref": "is-ballmer" }, "hi"`, `"$ref": 42 }, "hi"`, 1),
+			"Failed to resolve $ref in flag 'email-flag': $ref must be the name of an evaluator, got 42",
+		},
+	}
+	for _, tt := range badRefs {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, update := range map[string]func(string) (*UpdateStateResult, error){
+				"UpdateState":       e.UpdateState,
+				"DryRunUpdateState": e.DryRunUpdateState,
+			} {
+				result, err := update(tt.config)
+				if err != nil {
+					t.Fatalf("%s failed: %v", name, err)
+				}
+				assertEqual(t, false, result.Success)
+				assertEqual(t, tt.want, result.Error)
+			}
+			assertEqual(t, "hi", e.EvaluateString("email-flag", map[string]interface{}{"email": "ballmer@macrosoft.com"}, "error"))
+		})
+	}
+}
+
+// TestTestbedEvaluatorRefs loads the flagd testbed's shared evaluator
+// fixture, when the testbed submodule is checked out.
+func TestTestbedEvaluatorRefs(t *testing.T) {
+	config, err := os.ReadFile("../testbed/flags/evaluator-refs.json")
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("testbed submodule not checked out")
+	}
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	e := newTestEvaluator(t)
+	result, err := e.UpdateState(string(config))
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("UpdateState not successful: %s", result.Error)
+	}
+	ctx := map[string]interface{}{"email": "ballmer@macrosoft.com"}
+	for _, flagKey := range e.ListFlags() {
+		result, err := e.EvaluateFlag(flagKey, ctx)
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlag failed: %v", flagKey, err)
+		}
+		if result.IsError() {
+			t.Errorf("%s: unexpected error %s: %s", flagKey, result.ErrorCode, result.ErrorMessage)
+		}
+	}
+}
+
+func TestUpdateStateSkipsIdenticalConfig(t *testing.T) {
+	config := `{
+		"flags": {
+			"flag-a": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			}
+		}
+	}`
+
+	t.Run("default skips", func(t *testing.T) {
+		e := newTestEvaluator(t)
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		gen := e.generation.Load()
+
+		events, cancel := e.Subscribe()
+		defer cancel()
+
+		result, err := e.UpdateState(config)
+		if err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		if !result.Success {
+			t.Fatalf("expected cached result to report success")
+		}
+		assertEqual(t, 0, len(result.AddedFlags))
+		assertEqual(t, 0, len(result.ChangedFlags))
+		assertEqual(t, 0, len(result.RemovedFlags))
+		assertEqual(t, gen, e.generation.Load())
+		select {
+		case ev := <-events:
+			t.Fatalf("unexpected event for skipped update: %+v", ev)
+		default:
+		}
+
+		// A different config is applied
+		if _, err := e.UpdateState(strings.Replace(config, "gold", "silver", 1)); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		if e.generation.Load() == gen {
+			t.Error("expected generation to advance for a changed config")
+		}
+	})
+
+	t.Run("hash collision applies", func(t *testing.T) {
+		e := newTestEvaluator(t)
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		gen := e.generation.Load()
+
+		// Simulate a config whose hash collides with the applied one's
+		changed := strings.Replace(config, "gold", "silver", 1)
+		h := fnv.New64a()
+		h.Write([]byte(changed))
+		e.lastConfigHash = h.Sum64()
+
+		if _, err := e.UpdateState(changed); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		if e.generation.Load() == gen {
+			t.Error("expected a colliding but different config to be applied")
+		}
+		assertEqual(t, changed, e.CurrentConfig())
+	})
+
+	t.Run("WithForceUpdate re-applies", func(t *testing.T) {
+		e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache), WithForceUpdate())
+		if err != nil {
+			t.Fatalf("failed to create evaluator: %v", err)
+		}
+		t.Cleanup(func() { e.Close() })
+
+		e.UpdateState(config)
+		gen := e.generation.Load()
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		if e.generation.Load() == gen {
+			t.Error("expected generation to advance with WithForceUpdate")
+		}
+	})
+}
+
+// updateRecorder is a MetricsRecorder keeping the update details it receives.
+type updateRecorder struct {
+	mu           sync.Mutex
+	updates      int
+	fanOuts      []time.Duration
+	changedFlags []int
+}
+
+func (r *updateRecorder) RecordEvaluation(reason, errorCode string) {}
+func (r *updateRecorder) RecordEvaluationDuration(d time.Duration)  {}
+func (r *updateRecorder) RecordPoolWait(d time.Duration)            {}
+
+func (r *updateRecorder) RecordUpdateState(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates++
+}
+
+func (r *updateRecorder) RecordUpdateFanOut(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fanOuts = append(r.fanOuts, d)
+}
+
+func (r *updateRecorder) RecordUpdateChangedFlags(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changedFlags = append(r.changedFlags, n)
+}
+
+func TestUpdateStateTimings(t *testing.T) {
+	recorder := &updateRecorder{}
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(3),
+		WithCompilationCache(testCompilationCache), WithMetricsRecorder(recorder))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	result, err := e.UpdateState(simpleTargetingConfig)
+	if err != nil || !result.Success {
+		t.Fatalf("UpdateState failed: %v %+v", err, result)
+	}
+	if result.FanOut <= 0 || result.Elapsed < result.FanOut {
+		t.Errorf("expected 0 < FanOut <= Elapsed, got %s and %s", result.FanOut, result.Elapsed)
+	}
+	stats := e.Stats()
+	assertEqual(t, result.Elapsed, stats.LastUpdateDuration)
+	assertEqual(t, result.FanOut, stats.LastUpdateFanOut)
+
+	// A skipped update is timed, but has no fan-out
+	skipped, err := e.UpdateState(simpleTargetingConfig)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if skipped.Elapsed <= 0 {
+		t.Errorf("expected a positive Elapsed, got %s", skipped.Elapsed)
+	}
+	assertEqual(t, time.Duration(0), skipped.FanOut)
+	assertEqual(t, skipped.Elapsed, e.Stats().LastUpdateDuration)
+	assertEqual(t, result.FanOut, e.Stats().LastUpdateFanOut)
+
+	// Every call is recorded, the details of applied updates only
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	assertEqual(t, 2, recorder.updates)
+	assertEqual(t, 1, len(recorder.fanOuts))
+	assertEqual(t, result.FanOut, recorder.fanOuts[0])
+	assertEqual(t, 1, len(recorder.changedFlags))
+	assertEqual(t, len(result.AddedFlags), recorder.changedFlags[0])
+}
+
+func TestUpdateStateDoesNotBlockEvaluations(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	configFor := func(value string) string {
+		return `{
+			"flags": {
+				"tier-flag": {
+					"state": "ENABLED",
+					"defaultVariant": "v",
+					"variants": { "v": "` + value + `", "w": "other" },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "x"] }, "w", "v"] }
+				}
+			}
+		}`
+	}
+	if _, err := e.UpdateState(configFor("A")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "A", e.EvaluateString("tier-flag", smallCtx, "error"))
+
+	// Simulate a long-running evaluation holding the only active instance
+	set := e.active.Load()
+	inst, _ := set.pool.tryGet()
+
+	updated := make(chan error, 1)
+	go func() {
+		_, err := e.UpdateState(configFor("B"))
+		updated <- err
+	}()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateState waited for an in-flight evaluation")
+	}
+
+	// New evaluations run on the updated set while the old instance is out
+	assertEqual(t, "B", e.EvaluateString("tier-flag", smallCtx, "error"))
+
+	set.pool.put(inst)
+	if _, err := e.UpdateState(configFor("C")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "C", e.EvaluateString("tier-flag", smallCtx, "error"))
+}
+
+func TestPoolWaitersMoveToNewSet(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	configFor := func(value string) string {
+		return `{
+			"flags": {
+				"tier-flag": {
+					"state": "ENABLED",
+					"defaultVariant": "v",
+					"variants": { "v": "` + value + `", "w": "other" },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "x"] }, "w", "v"] }
+				}
+			}
+		}`
+	}
+	if _, err := e.UpdateState(configFor("A")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	// Simulate a long-running evaluation holding the only active instance,
+	// with another evaluation waiting for it
+	set := e.active.Load()
+	inst, _ := set.pool.tryGet()
+	values := make(chan string, 1)
+	go func() {
+		values <- e.EvaluateString("tier-flag", smallCtx, "error")
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().PoolWaits == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("evaluation didn't wait for an instance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The waiting evaluation runs on the updated set without waiting for
+	// the held instance
+	if _, err := e.UpdateState(configFor("B")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	select {
+	case value := <-values:
+		assertEqual(t, "B", value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation kept waiting on the swapped-out set")
+	}
+	set.pool.put(inst)
+}
+
+func TestWithUpdateCoalescing(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithUpdateCoalescing())
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	configFor := func(value string) string {
+		return `{ "flags": { "flag-` + value + `": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "` + value + `" } } } }`
+	}
+	if _, err := e.UpdateState(configFor("A")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	gen := e.Generation()
+
+	// Simulate an update in progress, then queue three more one after the
+	// other: the first waits for it, the other two are merged into the first
+	e.updateMu.Lock()
+	type update struct {
+		result *UpdateStateResult
+		err    error
+	}
+	updates := make(chan update, 3)
+	for i, value := range []string{"B", "C", "D"} {
+		go func() {
+			result, err := e.UpdateState(configFor(value))
+			updates <- update{result, err}
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			e.coalesceMu.Lock()
+			waiting := e.pendingUpdate != nil
+			e.coalesceMu.Unlock()
+			if waiting && e.Stats().UpdatesCoalesced == uint64(i) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("update %s didn't queue", value)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	e.updateMu.Unlock()
+
+	// Only the latest config is applied, and every caller gets its result
+	for range 3 {
+		u := <-updates
+		if u.err != nil || !u.result.Success {
+			t.Fatalf("UpdateState failed: %v %+v", u.err, u.result)
+		}
+		assertEqual(t, "flag-D", strings.Join(u.result.AddedFlags, ","))
+		assertEqual(t, "flag-A", strings.Join(u.result.RemovedFlags, ","))
+	}
+	assertEqual(t, gen+1, e.Generation())
+	assertEqual(t, configFor("D"), e.CurrentConfig())
+	assertEqual(t, uint64(2), e.Stats().UpdatesCoalesced)
+
+	// Updates arriving one at a time are each applied
+	for _, value := range []string{"E", "F"} {
+		if _, err := e.UpdateState(configFor(value)); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+	}
+	assertEqual(t, gen+3, e.Generation())
+	assertEqual(t, uint64(2), e.Stats().UpdatesCoalesced)
+}
+
+func TestSubscribe(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	events, cancel := e.Subscribe()
+	defer cancel()
+
+	config := `{
+		"flags": {
+			"flag-a": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			}
+		}
+	}`
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	// The event doesn't share the result's slices
+	result.AddedFlags[0] = "modified"
+
+	select {
+	case ev := <-events:
+		assertEqual(t, e.generation.Load(), ev.Generation)
+		assertContains(t, ev.AddedFlags, "flag-a")
+		// The event's generation must already be live
+		assertEqual(t, ev.Generation, e.active.Load().snap.generation)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	// A rejected config doesn't notify
+	if _, err := e.UpdateState(`{"flags": {"bad": {"state": "INVALID"}}}`); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event for rejected config: %+v", ev)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected channel to be closed after cancel")
+	}
+	cancel() // idempotent
+}
+
+func TestSubscribeClosedOnClose(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	events, cancel := e.Subscribe()
+	defer cancel()
+	e.Close()
+
+	if _, ok := <-events; ok {
+		t.Error("expected channel to be closed after Close")
+	}
+
+	late, _ := e.Subscribe()
+	if _, ok := <-late; ok {
+		t.Error("expected Subscribe after Close to return a closed channel")
+	}
+}
+
+func TestRequiredContextKeys(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"targeted-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "email" }, "admin@example.com"] },
+						"on", "off"
+					]
+				}
+			},
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			}
+		}
+	}`
+
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("UpdateState not successful")
+	}
+
+	// Should have required context keys for the targeted flag
+	if result.RequiredContextKeys == nil {
+		t.Fatal("RequiredContextKeys is nil")
+	}
+	keys, ok := result.RequiredContextKeys["targeted-flag"]
+	if !ok {
+		t.Fatal("targeted-flag not in RequiredContextKeys")
+	}
+	assertContains(t, keys, "email")
+	assertContains(t, keys, "targetingKey")
+
+	// Static flags should not be in required context keys
+	if _, ok := result.RequiredContextKeys["static-flag"]; ok {
+		t.Error("static-flag should not have required context keys")
+	}
+}
+
+func TestRequiredContextKeysQuery(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, ok := e.RequiredContextKeys("targeted-flag"); ok {
+		t.Fatal("expected no required keys before the first update")
+	}
+
+	config := `{
+		"flags": {
+			"targeted-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ "==": [{ "var": "email" }, "admin@example.com"] },
+							{ "==": [{ "var": "tier" }, "gold"] }
+						]},
+						"on", "off"
+					]
+				}
+			},
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "!!": [{ "var": "" }] }, "on", "off"] }
+			},
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	keys, ok := e.RequiredContextKeys("targeted-flag")
+	if !ok {
+		t.Fatal("expected required keys for targeted-flag")
+	}
+	assertEqual(t, "[email targetingKey tier]", fmt.Sprint(keys))
+
+	for _, flagKey := range []string{"whole-context-flag", "static-flag", "missing-flag"} {
+		if keys, ok := e.RequiredContextKeys(flagKey); ok {
+			t.Errorf("%s: expected ok=false, got %v", flagKey, keys)
+		}
+	}
+}
+
+func TestFlagsUsingContextKey(t *testing.T) {
+	e := newTestEvaluator(t)
+	assertEqual(t, 0, len(e.FlagsUsingContextKey("email")))
+
+	config := `{
+		"flags": {
+			"email-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "email" }, "admin@example.com"] }, "on", "off"] }
+			},
+			"email-tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ "ends_with": [{ "var": "email" }, "@example.com"] },
+							{ "==": [{ "var": "tier" }, "gold"] }
+						]},
+						"on", "off"
+					]
+				}
+			},
+			"nested-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "user.department" }, "eng"] }, "on", "off"] }
+			},
+			"rollout-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "fractional": [["on", 50], ["off", 50]] }
+			},
+			"key-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "targetingKey" }, "user-1"] }, "on", "off"] }
+			},
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "!!": [{ "var": "" }] }, "on", "off"] }
+			},
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"email", "email-flag,email-tier-flag"},
+		{"tier", "email-tier-flag"},
+		{"user", "nested-flag"},
+		{"user.department", "nested-flag"},
+		{"user.email", "nested-flag"},
+		{"use", ""},
+		{"department", ""},
+		{"targetingKey", "key-flag,rollout-flag"},
+	}
+	for _, tt := range tests {
+		assertEqual(t, tt.want, strings.Join(e.FlagsUsingContextKey(tt.key), ","))
+	}
+}
+
+func TestContextValidation(t *testing.T) {
+	config := `{
+		"flags": {
+			"targeted-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ "==": [{ "var": "email" }, "admin@example.com"] },
+							{ "==": [{ "var": "tier" }, "gold"] }
+						]},
+						"on", "off"
+					]
+				}
+			},
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			}
+		}
+	}`
+
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache),
+		WithContextValidation(), WithDefaultContext(map[string]interface{}{"tier": "gold"}))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		ctx         map[string]interface{}
+		wantReason  string
+		wantCode    string
+		wantMissing string
+	}{
+		{"all keys present", map[string]interface{}{"targetingKey": "user-1", "email": "admin@example.com"}, ReasonTargetingMatch, "", "[]"},
+		{"missing email", map[string]interface{}{"targetingKey": "user-1"}, ReasonTargetingMatch, "", "[email]"},
+		{"missing targetingKey", map[string]interface{}{"email": "admin@example.com"}, ReasonError, ErrorTargetingKeyMissing, "[targetingKey]"},
+		{"empty targetingKey", map[string]interface{}{"targetingKey": ""}, ReasonError, ErrorTargetingKeyMissing, "[email targetingKey]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := e.EvaluateFlag("targeted-flag", tt.ctx)
+			if err != nil {
+				t.Fatalf("EvaluateFlag failed: %v", err)
+			}
+			assertEqual(t, tt.wantReason, result.Reason)
+			assertEqual(t, tt.wantCode, result.ErrorCode)
+			assertEqual(t, tt.wantMissing, fmt.Sprint(result.MissingKeys))
+
+			results, err := e.EvaluateFlags([]string{"targeted-flag", "static-flag"}, tt.ctx)
+			if err != nil {
+				t.Fatalf("EvaluateFlags failed: %v", err)
+			}
+			assertEqual(t, tt.wantCode, results["targeted-flag"].ErrorCode)
+			assertEqual(t, tt.wantMissing, fmt.Sprint(results["targeted-flag"].MissingKeys))
+			assertEqual(t, ReasonStatic, results["static-flag"].Reason)
+		})
+	}
+
+	// Static flags are not validated
+	result, err := e.EvaluateFlag("static-flag", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, ReasonStatic, result.Reason)
+	assertEqual(t, 0, len(result.MissingKeys))
+
+	// Without the option nothing is reported
+	plain := newTestEvaluator(t)
+	if _, err := plain.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	result, err = plain.EvaluateFlag("targeted-flag", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, ReasonTargetingMatch, result.Reason)
+	assertEqual(t, 0, len(result.MissingKeys))
+}
+
+func TestFlagIndices(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"flagB": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true }
+			},
+			"flagA": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "off": false }
+			}
+		}
+	}`
+
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("UpdateState not successful")
+	}
+
+	if result.FlagIndices == nil {
+		t.Fatal("FlagIndices is nil")
+	}
+	if _, ok := result.FlagIndices["flagA"]; !ok {
+		t.Fatal("flagA not in FlagIndices")
+	}
+	if _, ok := result.FlagIndices["flagB"]; !ok {
+		t.Fatal("flagB not in FlagIndices")
+	}
+	// Indices should be in sorted order
+	assertEqual(t, uint32(0), result.FlagIndices["flagA"])
+	assertEqual(t, uint32(1), result.FlagIndices["flagB"])
+}
+
+func TestFilteredContextEvaluation(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"email-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "default",
+				"variants": { "default": false, "premium": true },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "email" }, "admin@example.com"] },
+						"premium", null
+					]
+				}
+			}
+		}
+	}`
+
+	_, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	// Large context — only "email" matters
+	ctx := map[string]interface{}{
+		"targetingKey": "user-123",
+		"email":        "admin@example.com",
+		"name":         "Admin User",
+		"age":          30,
+		"country":      "US",
+		"tier":         "premium",
+		"department":   "engineering",
+	}
+
+	result, err := e.EvaluateFlag("email-flag", ctx)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, true, result.Value)
+	assertEqual(t, "premium", result.Variant)
+	assertEqual(t, "TARGETING_MATCH", result.Reason)
+
+	// Non-matching email
+	ctx2 := map[string]interface{}{
+		"targetingKey": "user-456",
+		"email":        "regular@example.com",
+		"name":         "Regular User",
+		"age":          25,
+	}
+	result, err = e.EvaluateFlag("email-flag", ctx2)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, false, result.Value)
+	assertEqual(t, "default", result.Variant)
+}
+
+func TestFilteredContextNestedPaths(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "off": false, "on": true },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "user.profile.tier" }, "gold"] },
+						"on", null
+					]
+				}
+			},
+			"region-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "off": false, "on": true },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "account.region" }, "eu"] },
+						"on", null
+					]
+				}
+			}
+		}
+	}`
+
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		flagKey string
+		ctx     map[string]interface{}
+		want    bool
+	}{
+		{
+			name:    "three levels",
+			flagKey: "tier-flag",
+			ctx: map[string]interface{}{
+				"user": map[string]interface{}{
+					"name":    "Alice",
+					"profile": map[string]interface{}{"tier": "gold", "bio": "unused"},
+				},
+			},
+			want: true,
+		},
+		{
+			name:    "two levels",
+			flagKey: "region-flag",
+			ctx: map[string]interface{}{
+				"account": map[string]interface{}{"region": "eu", "plan": "pro"},
+				"other":   "ignored",
+			},
+			want: true,
+		},
+		{
+			name:    "missing intermediate level",
+			flagKey: "tier-flag",
+			ctx: map[string]interface{}{
+				"user": map[string]interface{}{"name": "Bob"},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := e.EvaluateFlag(tt.flagKey, tt.ctx)
+			if err != nil {
+				t.Fatalf("EvaluateFlag failed: %v", err)
+			}
+			assertEqual(t, tt.want, result.Value)
+		})
+	}
+}
+
+func TestSerializeFilteredContextDottedKeys(t *testing.T) {
+	ctx := map[string]interface{}{
+		"targetingKey": "user-1",
+		"user": map[string]interface{}{
+			"name": "Alice",
+			"profile": map[string]interface{}{
+				"tier": "gold",
+				"bio":  "unused",
+			},
+		},
+		"account": map[string]interface{}{"region": "eu", "plan": "pro"},
+		"device":  map[string]interface{}{"os": "linux"},
+		"unused":  true,
+	}
+
+	tests := []struct {
+		name     string
+		required map[string]bool
+		want     string
+	}{
+		{
+			name:     "two levels",
+			required: map[string]bool{"account.region": true, "targetingKey": true},
+			want:     `{"account":{"region":"eu"},"targetingKey":"user-1"}`,
+		},
+		{
+			name:     "three levels",
+			required: map[string]bool{"user.profile.tier": true, "targetingKey": true},
+			want:     `{"user":{"profile":{"tier":"gold"}},"targetingKey":"user-1"}`,
+		},
+		{
+			name:     "shared prefix",
+			required: map[string]bool{"user.profile.tier": true, "user.name": true, "targetingKey": true},
+			want:     `{"user":{"name":"Alice","profile":{"tier":"gold"}},"targetingKey":"user-1"}`,
+		},
+		{
+			name:     "ancestor required in full",
+			required: map[string]bool{"user.profile": true, "user.profile.tier": true, "targetingKey": true},
+			want:     `{"user":{"profile":{"bio":"unused","tier":"gold"}},"targetingKey":"user-1"}`,
+		},
+		{
+			name:     "missing intermediate level",
+			required: map[string]bool{"device.screen.width": true, "targetingKey": true},
+			want:     `{"device":{},"targetingKey":"user-1"}`,
+		},
+		{
+			name:     "missing top level",
+			required: map[string]bool{"session.id": true, "targetingKey": true},
+			want:     `{"targetingKey":"user-1"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeFilteredContext(&b, ctx, nil, "", tt.required)
+			b.WriteByte('}')
+			assertEqual(t, tt.want, b.String())
+		})
+	}
+}
+
+func TestSerializeFilteredContextSorted(t *testing.T) {
+	ctx := map[string]interface{}{"targetingKey": "user-1", "e": 5, "b": 2, "d": 4, "a": 1, "c": 3, "user": map[string]interface{}{"tier": "gold"}}
+	required := map[string]bool{"e": true, "c": true, "a": true, "user.tier": true, "d": true, "b": true, "targetingKey": true}
+
+	// Map iteration order changes between runs; the output must not
+	for i := 0; i < 20; i++ {
+		var b bytes.Buffer
+		writeFilteredContext(&b, ctx, nil, "", required)
+		assertEqual(t, `{"a":1,"b":2,"c":3,"d":4,"e":5,"user":{"tier":"gold"},"targetingKey":"user-1"`, b.String())
+	}
+}
+
+func TestDefaultContext(t *testing.T) {
+	config := `{
+		"flags": {
+			"region-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "region" }, "eu"] }, "on", "off"] }
+			},
+			"user-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "targetingKey" }, "user-call"] }, "on", "off"] }
+			},
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": {
+					"if": [
+						{ "and": [{ "!!": [{ "var": "" }] }, { "==": [{ "var": "region" }, "eu"] }] },
+						"on", "off"
+					]
+				}
+			}
+		}
+	}`
+	defaults := map[string]interface{}{
+		"region":       "eu",
+		"appVersion":   "1.2.3",
+		"targetingKey": "default-user",
+	}
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithDefaultContext(defaults))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	// The defaults are copied
+	defaults["region"] = "us"
+
+	t.Run("defaults apply", func(t *testing.T) {
+		assertEqual(t, "on", e.EvaluateString("region-flag", nil, "error"))
+		assertEqual(t, "on", e.EvaluateString("whole-context-flag", nil, "error"))
+		assertEqual(t, "off", e.EvaluateString("user-flag", nil, "error"))
+
+		results, err := e.EvaluateFlags([]string{"region-flag", "whole-context-flag"}, nil)
+		if err != nil {
+			t.Fatalf("EvaluateFlags failed: %v", err)
+		}
+		assertEqual(t, "on", results["region-flag"].Value)
+		assertEqual(t, "on", results["whole-context-flag"].Value)
+	})
+
+	t.Run("per-call context wins", func(t *testing.T) {
+		ctx := map[string]interface{}{"region": "us", "targetingKey": "user-call"}
+		assertEqual(t, "off", e.EvaluateString("region-flag", ctx, "error"))
+		assertEqual(t, "off", e.EvaluateString("whole-context-flag", ctx, "error"))
+		assertEqual(t, "on", e.EvaluateString("user-flag", ctx, "error"))
+	})
+
+	t.Run("SetDefaultContext replaces and clears", func(t *testing.T) {
+		e.SetDefaultContext(map[string]interface{}{"region": "us"})
+		assertEqual(t, "off", e.EvaluateString("region-flag", nil, "error"))
+
+		e.SetDefaultContext(nil)
+		assertEqual(t, "off", e.EvaluateString("region-flag", nil, "error"))
+		assertEqual(t, "on", e.EvaluateString("region-flag", map[string]interface{}{"region": "eu"}, "error"))
+	})
+}
+
+func TestEvaluateFlagWith(t *testing.T) {
+	config := `{
+		"flags": {
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "==": [{ "var": "user.tier" }, "premium"] }, { "==": [{ "var": "region" }, "eu"] }] }, "on", "off"] }
+			},
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "!!": [{ "var": "" }] }, { "==": [{ "var": "user.tier" }, "premium"] }] }, "on", "off"] }
+			}
+		}
+	}`
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithDefaultContext(map[string]interface{}{"region": "eu"}))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	base := map[string]interface{}{
+		"targetingKey": "user-1",
+		"user":         map[string]interface{}{"tier": "free"},
+		"email":        "user-1@example.com",
+	}
+	override := map[string]interface{}{"user": map[string]interface{}{"tier": "premium"}}
+	for _, flagKey := range []string{"tier-flag", "whole-context-flag"} {
+		result, err := e.EvaluateFlagWith(flagKey, base, override)
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlagWith failed: %v", flagKey, err)
+		}
+		assertEqual(t, "on", result.Value)
+
+		result, err = e.EvaluateFlagWith(flagKey, base, nil)
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlagWith failed: %v", flagKey, err)
+		}
+		assertEqual(t, "off", result.Value)
+	}
+
+	// Neither map is modified
+	assertEqual(t, 3, len(base))
+	assertEqual(t, "free", base["user"].(map[string]interface{})["tier"])
+	assertEqual(t, 1, len(override))
+
+	// Only the keys the flag reads are copied
+	snap := e.active.Load().snap
+	vals := overlayContext(base, override, snap.requiredCtxKey["tier-flag"], "")
+	assertEqual(t, 2, len(vals))
+	assertEqual(t, "premium", vals["user"].(map[string]interface{})["tier"])
+	assertEqual(t, "user-1", vals["targetingKey"])
+	assertEqual(t, 4, len(overlayContext(base, map[string]interface{}{"plan": "pro"}, nil, "")))
+
+	// An update between the snapshot load and the acquire narrows the
+	// context for the keys the flag reads in the new configuration, in a
+	// single evaluation
+	set := e.active.Load()
+	inst, _ := set.pool.tryGet()
+	waits, evaluations := e.Stats().PoolWaits, e.Stats().Evaluations
+	values := make(chan interface{}, 1)
+	go func() {
+		result, err := e.EvaluateFlagWith("tier-flag", base, override)
+		if err != nil {
+			values <- err
+			return
+		}
+		values <- result.Value
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().PoolWaits == waits {
+		if time.Now().After(deadline) {
+			t.Fatal("evaluation didn't wait for an instance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	emailConfig := strings.Replace(config, `{ "var": "region" }, "eu"`, `{ "var": "email" }, "user-1@example.com"`, 1)
+	if _, err := e.UpdateState(emailConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	select {
+	case value := <-values:
+		assertEqual(t, "on", value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation didn't complete")
+	}
+	set.pool.put(inst)
+	assertEqual(t, evaluations+1, e.Stats().Evaluations)
+}
+
+func TestSerializeContextDefaults(t *testing.T) {
+	ctx := map[string]interface{}{"region": "us", "targetingKey": "user-call"}
+	defaults := map[string]interface{}{"region": "eu", "appVersion": "1.2.3", "tier": "gold", "targetingKey": "default-user"}
+
+	// Only required keys are serialized, wherever they come from
+	var b bytes.Buffer
+	serializeFilteredContext(&b, ctx, defaults, "", map[string]bool{"tier": true, "targetingKey": true}, "f", false, 0)
+	assertEqual(t, `{"tier":"gold","targetingKey":"user-call","$flagd":{}}`, b.String())
+
+	b.Reset()
+	serializeFilteredContext(&b, nil, defaults, "", map[string]bool{"region": true, "targetingKey": true}, "f", false, 0)
+	assertEqual(t, `{"region":"eu","targetingKey":"default-user","$flagd":{}}`, b.String())
+
+	b.Reset()
+	if err := serializeContext(&b, ctx, defaults, "", nil, "f", false, 0); err != nil {
+		t.Fatalf("serializeContext failed: %v", err)
+	}
+	assertEqual(t, `{"appVersion":"1.2.3","region":"us","targetingKey":"user-call","tier":"gold","$flagd":{}}`, b.String())
+}
+
+func TestWriteJSONValueCollections(t *testing.T) {
+	values := []interface{}{
+		[]string{"admin", `quote " and \\ backslash`, "new\nline"},
+		[]string{},
+		[]string(nil),
+		[]interface{}{"a", 1.5, true, nil, []interface{}{"nested"}, map[string]interface{}{"k": "v"}},
+		map[string]interface{}{"b": 1, "a": []string{"x"}, `odd "key"`: map[string]interface{}{"z": false, "y": "\t"}},
+		map[string]interface{}(nil),
+	}
+	for _, val := range values {
+		var b bytes.Buffer
+		writeJSONValue(&b, val)
+		want, err := json.Marshal(val)
+		if err != nil {
+			t.Fatalf("json.Marshal(%#v) failed: %v", val, err)
+		}
+		assertEqual(t, string(want), b.String())
+	}
+
+	// Cycles end in json.Marshal's error rather than a stack overflow
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	var b bytes.Buffer
+	writeJSONValue(&b, cyclic)
+	if !strings.HasSuffix(b.String(), "null"+strings.Repeat("}", maxJSONFastPathDepth)) {
+		t.Errorf("expected the cycle to be cut off with null, got %s", b.String())
+	}
+}
+
+// FuzzEscapeJSONString checks escapeJSONString against encoding/json, without
+// its HTML escaping, for arbitrary bytes including invalid UTF-8.
+func FuzzEscapeJSONString(f *testing.F) {
+	for _, seed := range []string{
+		"plain", `quote " backslash \\`, "ctrl \x00\x01\b\f\n\r\t\x1f", "del \x7f c1 \u0085",
+		"sep \u2028 \u2029", "bad \xff \xc3 \xed\xa0\x80", "emoji \U0001F600", "<html> & </html>",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		var want bytes.Buffer
+		enc := json.NewEncoder(&want)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(s); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		got := `"` + escapeJSONString(s) + `"`
+		// encoding/json may write U+FFFD for invalid bytes verbatim rather
+		// than escaped, so only valid UTF-8 must match byte for byte
+		if utf8.ValidString(s) && got != strings.TrimSuffix(want.String(), "\n") {
+			t.Errorf("escapeJSONString(%q) = %s, want %s", s, got, want.String())
+		}
+		var gotDecoded, wantDecoded string
+		if err := json.Unmarshal([]byte(got), &gotDecoded); err != nil {
+			t.Fatalf("escapeJSONString(%q) produced invalid JSON %s: %v", s, got, err)
+		}
+		json.Unmarshal(want.Bytes(), &wantDecoded)
+		assertEqual(t, wantDecoded, gotDecoded)
+	})
+}
+
+func TestWriteJSONValueIntegers(t *testing.T) {
+	values := []interface{}{
+		int8(math.MinInt8), int16(math.MinInt16), int32(math.MinInt32), int64(math.MinInt64),
+		uint(math.MaxUint), uint8(math.MaxUint8), uint16(math.MaxUint16), uint32(math.MaxUint32),
+		uint64(math.MaxUint64), uint64(math.MaxUint64 - 1),
+	}
+	for _, val := range values {
+		var b bytes.Buffer
+		writeJSONValue(&b, val)
+		assertEqual(t, fmt.Sprint(val), b.String())
+	}
+
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"big-id-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ ">": [{ "var": "id" }, 9223372036854775807] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "on", e.EvaluateString("big-id-flag", map[string]interface{}{"id": uint64(math.MaxUint64 - 1)}, "error"))
+	assertEqual(t, "off", e.EvaluateString("big-id-flag", map[string]interface{}{"id": uint32(math.MaxUint32)}, "error"))
+	assertEqual(t, "off", e.EvaluateString("big-id-flag", map[string]interface{}{"id": int8(-1)}, "error"))
+}
+
+func TestWriteJSONValueNumber(t *testing.T) {
+	// A context decoded with UseNumber keeps its numbers' text
+	dec := json.NewDecoder(strings.NewReader(`{"id": 18446744073709551614, "score": 0.1e2, "age": -7, "tags": [1.50]}`))
+	dec.UseNumber()
+	var ctx map[string]interface{}
+	if err := dec.Decode(&ctx); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	var b bytes.Buffer
+	writeJSONValue(&b, ctx)
+	assertEqual(t, `{"age":-7,"id":18446744073709551614,"score":0.1e2,"tags":[1.50]}`, b.String())
+
+	for _, n := range []json.Number{"", "abc", "01", "1.", ".5", "1e", "+1", "NaN", "1 "} {
+		b.Reset()
+		writeJSONValue(&b, n)
+		if b.String() != "null" && b.String() != "0" {
+			t.Errorf("json.Number(%q): expected null or 0, got %s", n, b.String())
+		}
+	}
+
+	// The module compares them as numbers
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"score-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ ">": [{ "var": "score" }, 9] }, { "<": [{ "var": "age" }, 0] }] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "on", e.EvaluateString("score-flag", ctx, "error"))
+	ctx["score"] = json.Number("9")
+	assertEqual(t, "off", e.EvaluateString("score-flag", ctx, "error"))
+}
+
+func TestWithTargetingKeyField(t *testing.T) {
+	config := `{
+		"flags": {
+			"rollout-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "a",
+				"variants": { "a": "a", "b": "b", "c": "c" },
+				"targeting": { "fractional": [["a", 1], ["b", 1], ["c", 1]] }
+			},
+			"user-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "==": [{ "var": "targetingKey" }, "user-1"] }, { "==": [{ "var": "userId" }, "user-1"] }] }, "on", "off"] }
+			},
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "!!": [{ "var": "" }] }, { "==": [{ "var": "targetingKey" }, "user-1"] }] }, "on", "off"] }
+			}
+		}
+	}`
+	newEvaluator := func(opts ...Option) *FlagEvaluator {
+		e, err := NewFlagEvaluator(append([]Option{WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache)}, opts...)...)
+		if err != nil {
+			t.Fatalf("failed to create evaluator: %v", err)
+		}
+		t.Cleanup(func() { e.Close() })
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		return e
+	}
+	e := newEvaluator(WithTargetingKeyField("userId"), WithContextValidation())
+	plain := newEvaluator()
+
+	// Buckets match those of the same id passed as targetingKey
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		want := plain.EvaluateString("rollout-flag", map[string]interface{}{"targetingKey": id}, "error")
+		assertEqual(t, want, e.EvaluateString("rollout-flag", map[string]interface{}{"userId": id}, "error"))
+		variant, _, err := e.FractionalBucket("rollout-flag", map[string]interface{}{"userId": id})
+		if err != nil {
+			t.Fatalf("FractionalBucket failed: %v", err)
+		}
+		assertEqual(t, want, variant)
+	}
+
+	// The field stays visible to rules, on both serialization paths
+	ctx := map[string]interface{}{"userId": "user-1"}
+	assertEqual(t, "on", e.EvaluateString("user-flag", ctx, "error"))
+	assertEqual(t, "on", e.EvaluateString("whole-context-flag", ctx, "error"))
+	results, err := e.EvaluateFlags([]string{"user-flag", "whole-context-flag"}, ctx)
+	if err != nil {
+		t.Fatalf("EvaluateFlags failed: %v", err)
+	}
+	assertEqual(t, "on", results["user-flag"].Value)
+	assertEqual(t, "on", results["whole-context-flag"].Value)
+
+	// An explicit targetingKey wins, and a per-call field beats a default
+	// targetingKey
+	ctx = map[string]interface{}{"userId": "user-1", "targetingKey": "user-2"}
+	assertEqual(t, "off", e.EvaluateString("whole-context-flag", ctx, "error"))
+	e.SetDefaultContext(map[string]interface{}{"targetingKey": "user-2"})
+	assertEqual(t, "on", e.EvaluateString("whole-context-flag", map[string]interface{}{"userId": "user-1"}, "error"))
+	assertEqual(t, "off", e.EvaluateString("whole-context-flag", nil, "error"))
+	e.SetDefaultContext(nil)
+
+	// Context validation accepts the field as the targeting key
+	result, err := e.EvaluateFlag("user-flag", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, ErrorTargetingKeyMissing, result.ErrorCode)
+
+	var b bytes.Buffer
+	serializeFilteredContext(&b, map[string]interface{}{"userId": "u"}, nil, "userId", map[string]bool{"userId": true}, "f", false, 0)
+	assertEqual(t, `{"userId":"u","targetingKey":"u","$flagd":{}}`, b.String())
+
+	if _, err := NewFlagEvaluator(WithTargetingKeyField("")); err == nil {
+		t.Error("expected an error for an empty targeting key field")
+	}
+}
+
+func TestWithAnonymousKey(t *testing.T) {
+	config := `{
+		"flags": {
+			"known-user-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "!=": [{ "var": "targetingKey" }, ""] }, "on", "off"] }
+			},
+			"anon-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "starts_with": [{ "var": "targetingKey" }, "anon-"] }, "on", "off"] }
+			},
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on" }
+			}
+		}
+	}`
+	var generated atomic.Int32
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithResultCache(100, 0),
+		WithTargetingKeyField("userId"),
+		WithAnonymousKey(func() string {
+			return fmt.Sprintf("anon-%d", generated.Add(1))
+		}))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	assertEqual(t, "on", e.EvaluateString("known-user-flag", nil, "error"))
+	assertEqual(t, "on", e.EvaluateString("anon-flag", map[string]interface{}{"targetingKey": ""}, "error"))
+	assertEqual(t, int32(2), generated.Load())
+
+	// Known users and static flags don't generate keys
+	assertEqual(t, "off", e.EvaluateString("anon-flag", map[string]interface{}{"targetingKey": "user-1"}, "error"))
+	assertEqual(t, "off", e.EvaluateString("anon-flag", map[string]interface{}{"userId": "user-1"}, "error"))
+	assertEqual(t, "on", e.EvaluateString("static-flag", nil, "error"))
+	assertEqual(t, int32(2), generated.Load())
+
+	// One key per call
+	results, err := e.EvaluateAllFlags(nil)
+	if err != nil {
+		t.Fatalf("EvaluateAllFlags failed: %v", err)
+	}
+	assertEqual(t, "on", results["known-user-flag"].Value)
+	assertEqual(t, "on", results["anon-flag"].Value)
+	assertEqual(t, int32(3), generated.Load())
+
+	explanation, err := e.ExplainFlag("anon-flag", nil)
+	if err != nil {
+		t.Fatalf("ExplainFlag failed: %v", err)
+	}
+	assertEqual(t, "on", explanation.Result.Value)
+	assertEqual(t, int32(4), generated.Load())
+
+	// Anonymous results never reach the result cache, even if keys repeat
+	e.anonymousKey = func() string { return "anon-same" }
+	hits := e.Stats().ResultCacheHits
+	for i := 0; i < 2; i++ {
+		e.EvaluateString("known-user-flag", nil, "error")
+		e.EvaluateFlags([]string{"known-user-flag"}, nil)
+	}
+	assertEqual(t, hits, e.Stats().ResultCacheHits)
+
+	// The default generator returns random UUIDs
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, b := randomUUID(), randomUUID()
+	if !uuid.MatchString(a) || a == b {
+		t.Errorf("expected distinct random UUIDs, got %q and %q", a, b)
+	}
+}
+
+func TestPreEvaluatedCache(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"disabled-flag": {
+				"state": "DISABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			}
+		}
+	}`
+
+	_, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
 	// These should be served from pre-evaluated cache
 	ctx := map[string]interface{}{
 		"targetingKey": "user-1",
 		"anything":     "value",
 	}
 
-	result, err := e.EvaluateFlag("static-flag", ctx)
-	if err != nil {
-		t.Fatalf("EvaluateFlag failed: %v", err)
+	result, err := e.EvaluateFlag("static-flag", ctx)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, true, result.Value)
+	assertEqual(t, "STATIC", result.Reason)
+
+	result, err = e.EvaluateFlag("disabled-flag", ctx)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	if result.Value != nil {
+		t.Errorf("expected nil value for disabled flag, got %v", result.Value)
+	}
+	assertEqual(t, "DISABLED", result.Reason)
+}
+
+func TestPreEvaluatedCacheSharedAcrossUpdates(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := func(bVariant, metadata string) string {
+		return `{
+			"metadata": ` + metadata + `,
+			"flags": {
+				"static-a": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+				"static-b": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": "` + bVariant + `" } },
+				"targeted": {
+					"state": "ENABLED",
+					"defaultVariant": "off",
+					"variants": { "on": true, "off": false },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+				}
+			}
+		}`
+	}
+	mapPointer := func(m interface{}) unsafe.Pointer { return reflect.ValueOf(m).UnsafePointer() }
+
+	if _, err := e.UpdateState(config("v1", `{}`)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	snap1 := e.active.Load().snap
+
+	// Only static-b changes: static-a's result and the unchanged key sets
+	// are carried over
+	if _, err := e.UpdateState(config("v2", `{}`)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	snap2 := e.active.Load().snap
+	if snap2.preEvaluated["static-a"] != snap1.preEvaluated["static-a"] {
+		t.Error("expected static-a's pre-evaluated result to be shared")
+	}
+	if snap2.preEvaluated["static-b"] == snap1.preEvaluated["static-b"] {
+		t.Error("expected static-b's pre-evaluated result to be rebuilt")
+	}
+	if mapPointer(snap2.requiredCtxKey) != mapPointer(snap1.requiredCtxKey) {
+		t.Error("expected the unchanged required context keys to be shared")
+	}
+	result, err := e.EvaluateFlag("static-b", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, "v2", result.Value)
+	assertEqual(t, true, result.Cached)
+
+	// Flag-set metadata changes every result without changing any flag
+	if _, err := e.UpdateState(config("v2", `{"env": "prod"}`)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if e.active.Load().snap.preEvaluated["static-a"] == snap2.preEvaluated["static-a"] {
+		t.Error("expected static-a's pre-evaluated result to be rebuilt after a metadata change")
+	}
+	result, err = e.EvaluateFlag("static-a", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, "prod", result.FlagMetadata["env"])
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"concurrent-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "==": [{ "var": "user" }, "admin"] },
+						"on", "off"
+					]
+				}
+			}
+		}
+	}`
+
+	_, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := map[string]interface{}{"user": "admin"}
+			result, err := e.EvaluateFlag("concurrent-flag", ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if result.Value != true {
+				errs <- fmt.Errorf("goroutine %d: expected true, got %v", i, result.Value)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent error: %v", err)
+	}
+}
+
+func TestTypedEvaluators(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"bool-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"string-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "hello",
+				"variants": { "hello": "world" }
+			},
+			"int-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "val",
+				"variants": { "val": 42 }
+			},
+			"float-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "val",
+				"variants": { "val": 3.14 }
+			}
+		}
+	}`
+
+	_, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	ctx := map[string]interface{}{}
+
+	if v := e.EvaluateBool("bool-flag", ctx, false); v != true {
+		t.Errorf("EvaluateBool: expected true, got %v", v)
+	}
+	if v := e.EvaluateString("string-flag", ctx, "default"); v != "world" {
+		t.Errorf("EvaluateString: expected 'world', got %v", v)
+	}
+	if v := e.EvaluateInt("int-flag", ctx, 0); v != 42 {
+		t.Errorf("EvaluateInt: expected 42, got %v", v)
+	}
+	if v := e.EvaluateFloat("float-flag", ctx, 0); v != 3.14 {
+		t.Errorf("EvaluateFloat: expected 3.14, got %v", v)
+	}
+
+	// Test defaults for missing flags
+	if v := e.EvaluateBool("missing", ctx, true); v != true {
+		t.Errorf("EvaluateBool default: expected true, got %v", v)
+	}
+	if v := e.EvaluateString("missing", ctx, "fallback"); v != "fallback" {
+		t.Errorf("EvaluateString default: expected 'fallback', got %v", v)
+	}
+	if v := e.EvaluateInt("missing", ctx, 99); v != 99 {
+		t.Errorf("EvaluateInt default: expected 99, got %v", v)
+	}
+	if v := e.EvaluateFloat("missing", ctx, 1.5); v != 1.5 {
+		t.Errorf("EvaluateFloat default: expected 1.5, got %v", v)
+	}
+}
+
+func TestEvaluateFlags(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"disabled-flag": {
+				"state": "DISABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"email-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [{ "==": [{ "var": "email" }, "admin@example.com"] }, "on", "off"]
+				}
+			},
+			"email-flag-2": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "yes", "off": "no" },
+				"targeting": {
+					"if": [{ "ends_with": [{ "var": "email" }, "@example.com"] }, "on", "off"]
+				}
+			},
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "basic",
+				"variants": { "premium": "premium", "basic": "basic" },
+				"targeting": {
+					"if": [{ "==": [{ "var": "tier" }, "premium"] }, "premium", null]
+				}
+			},
+			"flag-key-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [{ "==": [{ "var": "$flagd.flagKey" }, "flag-key-flag"] }, "on", "off"]
+				}
+			}
+		}
+	}`
+
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	ctx := map[string]interface{}{
+		"targetingKey": "user-1",
+		"email":        "admin@example.com",
+		"tier":         "premium",
+	}
+	keys := []string{"static-flag", "disabled-flag", "email-flag", "email-flag-2", "tier-flag", "flag-key-flag", "missing-flag"}
+
+	results, err := e.EvaluateFlags(keys, ctx)
+	if err != nil {
+		t.Fatalf("EvaluateFlags failed: %v", err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), len(results))
+	}
+
+	// Batch results must match individual evaluations
+	for _, key := range keys {
+		want, err := e.EvaluateFlag(key, ctx)
+		if err != nil {
+			t.Fatalf("EvaluateFlag(%s) failed: %v", key, err)
+		}
+		got := results[key]
+		if got == nil {
+			t.Fatalf("missing result for %s", key)
+		}
+		if got.Value != want.Value || got.Variant != want.Variant || got.Reason != want.Reason || got.ErrorCode != want.ErrorCode {
+			t.Errorf("%s: batch result %+v differs from single result %+v", key, got, want)
+		}
+	}
+
+	assertEqual(t, true, results["email-flag"].Value)
+	assertEqual(t, "yes", results["email-flag-2"].Value)
+	assertEqual(t, "premium", results["tier-flag"].Value)
+	assertEqual(t, true, results["flag-key-flag"].Value)
+	assertEqual(t, "STATIC", results["static-flag"].Reason)
+	assertEqual(t, "DISABLED", results["disabled-flag"].Reason)
+	assertEqual(t, "FLAG_NOT_FOUND", results["missing-flag"].Reason)
+}
+
+func TestEvaluateAllFlags(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false },
+				"metadata": { "owner": "team-a" }
+			},
+			"disabled-flag": {
+				"state": "DISABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "basic",
+				"variants": { "premium": "premium", "basic": "basic" },
+				"targeting": {
+					"if": [{ "==": [{ "var": "tier" }, "premium"] }, "premium", null]
+				}
+			}
+		}
+	}`
+
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	results, err := e.EvaluateAllFlags(map[string]interface{}{"tier": "premium"})
+	if err != nil {
+		t.Fatalf("EvaluateAllFlags failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	assertEqual(t, "on", results["static-flag"].Variant)
+	assertEqual(t, "STATIC", results["static-flag"].Reason)
+	assertEqual(t, "team-a", results["static-flag"].FlagMetadata["owner"])
+	assertEqual(t, "DISABLED", results["disabled-flag"].Reason)
+	assertEqual(t, "premium", results["tier-flag"].Variant)
+	assertEqual(t, "TARGETING_MATCH", results["tier-flag"].Reason)
+}
+
+func TestEvaluateFlagContext(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	config := `{
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "basic",
+				"variants": { "premium": "premium", "basic": "basic" },
+				"targeting": {
+					"if": [{ "==": [{ "var": "tier" }, "premium"] }, "premium", null]
+				}
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	vals := map[string]interface{}{"tier": "premium"}
+
+	result, err := e.EvaluateFlagContext(context.Background(), "tier-flag", vals)
+	if err != nil {
+		t.Fatalf("EvaluateFlagContext failed: %v", err)
+	}
+	assertEqual(t, "premium", result.Value)
+
+	// Hold the only instance so the next evaluation has to wait
+	inst, _ := e.active.Load().pool.tryGet()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = e.EvaluateFlagContext(ctx, "tier-flag", vals)
+	e.active.Load().pool.put(inst)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Already-cancelled context fails without evaluating
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := e.EvaluateFlagContext(cancelled, "tier-flag", vals); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// Pre-evaluated flags never wait on the pool
+	result, err = e.EvaluateFlagContext(cancelled, "static-flag", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlagContext for static flag failed: %v", err)
+	}
+	assertEqual(t, true, result.Value)
+}
+
+func TestEvaluateAfterClose(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation())
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := e.EvaluateFlag("targeting-flag", smallCtx); !errors.Is(err, ErrEvaluatorClosed) {
+		t.Errorf("EvaluateFlag: expected ErrEvaluatorClosed, got %v", err)
+	}
+	if _, err := e.EvaluateFlags([]string{"targeting-flag"}, smallCtx); !errors.Is(err, ErrEvaluatorClosed) {
+		t.Errorf("EvaluateFlags: expected ErrEvaluatorClosed, got %v", err)
+	}
+	if _, err := e.UpdateState(simpleFlagConfig); !errors.Is(err, ErrEvaluatorClosed) {
+		t.Errorf("UpdateState: expected ErrEvaluatorClosed, got %v", err)
+	}
+	if v := e.EvaluateBool("targeting-flag", smallCtx, true); v != true {
+		t.Errorf("EvaluateBool: expected default true, got %v", v)
+	}
+
+	// Second Close is a no-op
+	if err := e.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+}
+
+func TestCloseWaitsForInFlight(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+
+	// Simulate an in-flight evaluation holding the only instance
+	inst, _ := e.active.Load().pool.tryGet()
+
+	closed := make(chan error, 1)
+	go func() { closed <- e.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while an instance was still checked out")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	e.active.Load().pool.put(inst)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the instance was released")
+	}
+}
+
+func TestCloseContextTimeout(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+
+	// Never returned: CloseContext must give up once ctx expires
+	e.active.Load().pool.tryGet()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := e.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Errorf("Close after CloseContext should be a no-op, got %v", err)
+	}
+}
+
+func TestWithPoolSize(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPoolSize(3))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	assertEqual(t, 3, e.active.Load().pool.idle())
+
+	for _, n := range []int{0, -1} {
+		if _, err := NewFlagEvaluator(WithPoolSize(n)); err == nil {
+			t.Errorf("WithPoolSize(%d): expected error", n)
+		}
+	}
+}
+
+func TestWithInterpreter(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithInterpreter())
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "premium-tier", e.EvaluateString("big-flag", map[string]interface{}{
+		"tier": "premium", "score": 95, "region": "us-east", "role": "admin",
+	}, "error"))
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", map[string]interface{}{
+		"department": "engineering", "experience": 7,
+	}, "error"))
+}
+
+func TestWithRuntimeConfig(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithRuntimeConfig(wazero.NewRuntimeConfig().WithCloseOnContextDone(true)))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", map[string]interface{}{
+		"department": "engineering", "experience": 7,
+	}, "error"))
+
+	if _, err := NewFlagEvaluator(WithInterpreter(), WithRuntimeConfig(wazero.NewRuntimeConfig())); err == nil {
+		t.Error("expected WithInterpreter combined with WithRuntimeConfig to fail")
+	}
+}
+
+// TestCatchUpReplacesFailedInstances checks that a standby instance that
+// fails to apply the new config while catching up is replaced rather than
+// stamped with the new generation.
+func TestCatchUpReplacesFailedInstances(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(simpleFlagConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	<-e.standbyReady
+
+	// Break the standby instance so update_state traps, and catch it up again
+	broken, _ := e.standby.tryGet()
+	broken.module.Close(e.ctx)
+	e.standby.put(broken)
+	snap := e.active.Load().snap
+	replaced := e.Stats().InstancesReplaced
+	e.catchUp(e.standby, snap, make(chan struct{}))
+
+	assertEqual(t, replaced+1, e.Stats().InstancesReplaced)
+	inst, _ := e.standby.tryGet()
+	defer e.standby.put(inst)
+	if inst == broken {
+		t.Fatal("expected the failed instance to be replaced")
+	}
+	assertEqual(t, snap.generation, inst.generation)
+	var buf bytes.Buffer
+	data, err := evaluateReusable(e.ctx, inst, "targeting-flag", []byte(`{"tier":"premium"}`), &buf)
+	if err != nil {
+		t.Fatalf("evaluateReusable failed: %v", err)
+	}
+	result, err := parseEvalResult(data)
+	if err != nil {
+		t.Fatalf("parseEvalResult failed: %v", err)
+	}
+	assertEqual(t, true, result.Value)
+}
+
+func TestWithMaxMemoryPages(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(`{"flags":{`)
+	for i := 0; i < 2000; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `"flag-%d":{"state":"ENABLED","defaultVariant":"off","variants":{"on":true,"off":false},"targeting":{"if":[{"==":[{"var":"tier"},"premium"]},"on","off"]}}`, i)
+	}
+	b.WriteString(`}}`)
+	hugeConfig := b.String()
+
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache), WithMaxMemoryPages(96))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	// An update that needs more memory than the cap traps
+	if _, err := e.UpdateState(hugeConfig); !errors.Is(err, ErrWasmTrap) {
+		t.Fatalf("expected ErrWasmTrap, got %v", err)
+	}
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if _, err := e.UpdateState(hugeConfig); !errors.Is(err, ErrWasmTrap) {
+		t.Fatalf("expected ErrWasmTrap, got %v", err)
+	}
+	if e.Stats().InstancesReplaced == 0 {
+		t.Error("expected the trapped instance to be replaced")
+	}
+
+	// The previous state keeps serving, and later updates still apply
+	assertEqual(t, bigTargetingConfig, e.CurrentConfig())
+	ctx := map[string]interface{}{"department": "engineering", "experience": 7}
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", ctx, "error"))
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, true, e.EvaluateBool("targeting-flag", map[string]interface{}{"tier": "premium"}, false))
+
+	// Too small a cap for the context buffer fails up front
+	if _, err := NewFlagEvaluator(WithCompilationCache(testCompilationCache), WithMaxMemoryPages(16)); err == nil {
+		t.Error("expected a cap below the context buffer to fail")
+	}
+	for _, pages := range []uint32{0, 65537} {
+		if _, err := NewFlagEvaluator(WithMaxMemoryPages(pages)); err == nil {
+			t.Errorf("expected WithMaxMemoryPages(%d) to fail", pages)
+		}
+	}
+}
+
+func TestWithShardedPool(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache),
+		WithPoolSize(4), WithShardedPool(3))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	pool := e.active.Load().pool
+	assertEqual(t, 3, len(pool.shards))
+	assertEqual(t, "[2 1 1]", fmt.Sprint([]int{cap(pool.shards[0]), cap(pool.shards[1]), cap(pool.shards[2])}))
+	assertEqual(t, 4, pool.idle())
+
+	// Acquires fall back to other shards until every instance is out
+	var held []*wasmInstance
+	for i := 0; i < 4; i++ {
+		inst, _ := pool.tryGet()
+		if inst == nil {
+			t.Fatalf("tryGet %d: expected an instance", i)
+		}
+		held = append(held, inst)
+	}
+	if inst, _ := pool.tryGet(); inst != nil {
+		t.Fatal("expected an empty pool")
+	}
+	for _, inst := range held {
+		pool.put(inst)
+	}
+
+	// Updates drain and refill every shard of both sets
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				e.EvaluateString("tier-flag", smallCtx, "error")
+			}
+		}()
+	}
+	for _, tier := range []string{"A", "B", "C"} {
+		config := fmt.Sprintf(`{
+			"flags": {
+				"tier-flag": {
+					"state": "ENABLED",
+					"defaultVariant": "default",
+					"variants": { "default": "default", "match": %q },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "match", "default"] }
+				}
+			}
+		}`, tier)
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+	}
+	wg.Wait()
+	assertEqual(t, "C", e.EvaluateString("tier-flag", smallCtx, "error"))
+	assertEqual(t, 4, e.Stats().AvailableInstances)
+
+	// More shards than instances are reduced to the pool size
+	small, err := NewFlagEvaluator(WithCompilationCache(testCompilationCache), WithPoolSize(2), WithShardedPool(8))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { small.Close() })
+	assertEqual(t, 2, len(small.active.Load().pool.shards))
+
+	for _, n := range []int{0, -1} {
+		if _, err := NewFlagEvaluator(WithShardedPool(n)); err == nil {
+			t.Errorf("WithShardedPool(%d): expected error", n)
+		}
+	}
+}
+
+func TestWithPoolWaitTimeout(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache),
+		WithPoolSize(1), WithPoolWaitTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	config := `{
+		"flags": {
+			"static-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			"targeting-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			},
+			"other-targeting-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "silver"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	// Hold the only instance so evaluations time out waiting
+	set := e.active.Load()
+	inst, _ := set.pool.tryGet()
+
+	start := time.Now()
+	result, err := e.EvaluateFlag("targeting-flag", smallCtx)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	if wait := time.Since(start); wait > time.Second {
+		t.Errorf("expected the evaluation to give up after the timeout, took %s", wait)
+	}
+	assertEqual(t, ReasonError, result.Reason)
+	assertEqual(t, ErrorPoolTimeout, result.ErrorCode)
+
+	details := e.EvaluateBoolDetails("targeting-flag", smallCtx, true)
+	assertEqual(t, true, details.Value)
+	assertEqual(t, ReasonError, details.Reason)
+	var evalErr *EvaluationError
+	if !errors.As(details.Err, &evalErr) || evalErr.Code != ErrorPoolTimeout {
+		t.Errorf("expected a POOL_TIMEOUT error, got %v", details.Err)
+	}
+
+	results, err := e.EvaluateAllFlags(smallCtx)
+	if err != nil {
+		t.Fatalf("EvaluateAllFlags failed: %v", err)
+	}
+	assertEqual(t, true, results["static-flag"].Value)
+	assertEqual(t, ErrorPoolTimeout, results["targeting-flag"].ErrorCode)
+	assertEqual(t, ErrorPoolTimeout, results["other-targeting-flag"].ErrorCode)
+	// Each timed-out flag gets its own result, so changing one leaves the
+	// others alone
+	if results["targeting-flag"] == results["other-targeting-flag"] {
+		t.Error("expected distinct results for each timed-out flag")
+	}
+
+	if _, err := e.SimulateFlag("targeting-flag", []map[string]interface{}{smallCtx}); !errors.Is(err, ErrPoolTimeout) {
+		t.Errorf("expected ErrPoolTimeout from SimulateFlag, got %v", err)
+	}
+	assertEqual(t, uint64(4), e.Stats().PoolWaits)
+
+	// Once an instance is free, evaluations succeed again
+	set.pool.put(inst)
+	assertEqual(t, false, e.EvaluateBool("targeting-flag", smallCtx, true))
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, err := NewFlagEvaluator(WithPoolWaitTimeout(d)); err == nil {
+			t.Errorf("WithPoolWaitTimeout(%s): expected error", d)
+		}
+	}
+}
+
+func TestWithMaxContextSize(t *testing.T) {
+	config := `{
+		"flags": {
+			"attr-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "in": ["vip", { "var": "attrs" }] }, "on", "off"] }
+			}
+		}
+	}`
+	newEvaluator := func(t *testing.T, size int) *FlagEvaluator {
+		t.Helper()
+		e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+			WithCompilationCache(testCompilationCache), WithMaxContextSize(size))
+		if err != nil {
+			t.Fatalf("failed to create evaluator: %v", err)
+		}
+		t.Cleanup(func() { e.Close() })
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		return e
+	}
+	attrs := func(n int) map[string]interface{} {
+		return map[string]interface{}{"attrs": "vip" + strings.Repeat("x", n)}
+	}
+
+	t.Run("smaller buffer rejects large context", func(t *testing.T) {
+		e := newEvaluator(t, 256)
+		assertEqual(t, "on", e.EvaluateString("attr-flag", attrs(10), "error"))
+
+		_, err := e.EvaluateFlag("attr-flag", attrs(512))
+		if !errors.Is(err, ErrContextTooLarge) {
+			t.Fatalf("expected ErrContextTooLarge, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "exceeds maximum of 256") {
+			t.Errorf("expected sizes in error message, got %q", err)
+		}
+	})
+
+	t.Run("larger buffer accepts context over the default", func(t *testing.T) {
+		e := newEvaluator(t, 4<<20)
+		result, err := e.EvaluateFlag("attr-flag", attrs(2<<20))
+		if err != nil {
+			t.Fatalf("EvaluateFlag failed: %v", err)
+		}
+		assertEqual(t, "on", result.Value)
+	})
+
+	for _, n := range []int{0, -1} {
+		if _, err := NewFlagEvaluator(WithMaxContextSize(n)); err == nil {
+			t.Errorf("WithMaxContextSize(%d): expected error", n)
+		}
+	}
+}
+
+func TestWithContextBufferSize(t *testing.T) {
+	config := `{
+		"flags": {
+			"attr-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "in": ["vip", { "var": "attrs" }] }, "on", "off"] }
+			}
+		}
+	}`
+	bufferSize := func(e *FlagEvaluator) uint32 {
+		pool := e.active.Load().pool
+		inst, _ := pool.tryGet()
+		defer pool.put(inst)
+		return inst.contextBufSize
+	}
+
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithContextBufferSize(1024), WithMaxContextSize(64<<10))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, uint32(1024), bufferSize(e))
+
+	// A larger context grows the buffer by doubling, up to the max
+	large := map[string]interface{}{"attrs": "vip" + strings.Repeat("x", 3000)}
+	assertEqual(t, "on", e.EvaluateString("attr-flag", large, "error"))
+	assertEqual(t, uint32(4096), bufferSize(e))
+	assertEqual(t, "on", e.EvaluateString("attr-flag", map[string]interface{}{"attrs": "vip"}, "error"))
+	assertEqual(t, uint32(4096), bufferSize(e))
+	_, err = e.EvaluateFlag("attr-flag", map[string]interface{}{"attrs": strings.Repeat("x", 64<<10)})
+	if !errors.Is(err, ErrContextTooLarge) {
+		t.Errorf("expected ErrContextTooLarge, got %v", err)
+	}
+
+	// Defaults to 64KiB, capped by the max context size
+	for _, tt := range []struct {
+		opts []Option
+		want uint32
+	}{
+		{nil, 64 << 10},
+		{[]Option{WithMaxContextSize(256)}, 256},
+	} {
+		e, err := NewFlagEvaluator(append([]Option{WithPoolSize(1), WithCompilationCache(testCompilationCache)}, tt.opts...)...)
+		if err != nil {
+			t.Fatalf("failed to create evaluator: %v", err)
+		}
+		assertEqual(t, tt.want, bufferSize(e))
+		e.Close()
+	}
+
+	if _, err := NewFlagEvaluator(WithContextBufferSize(2048), WithMaxContextSize(1024)); err == nil {
+		t.Error("expected a context buffer larger than the max context size to fail")
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := NewFlagEvaluator(WithContextBufferSize(n)); err == nil {
+			t.Errorf("WithContextBufferSize(%d): expected error", n)
+		}
+	}
+}
+
+// TestContextSizeBoundaries checks the context size limits are inclusive: a
+// context of exactly the buffer size fits without growing it, and one of
+// exactly the max context size is evaluated.
+func TestContextSizeBoundaries(t *testing.T) {
+	config := `{
+		"flags": {
+			"attr-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "in": ["vip", { "var": "attrs" }] }, "on", "off"] }
+			}
+		}
+	}`
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithContextBufferSize(1024), WithMaxContextSize(4096))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	set, inst, err := e.acquireInstance(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInstance failed: %v", err)
+	}
+	defer e.releaseInstance(set, inst, nil)
+
+	// A JSON context of exactly n bytes
+	contextOfSize := func(n int) []byte {
+		const wrapper = `{"attrs":"vip"}`
+		return []byte(`{"attrs":"vip` + strings.Repeat("x", n-len(wrapper)) + `"}`)
+	}
+
+	for _, tt := range []struct {
+		size    int
+		wantErr bool
+	}{
+		{1023, false},
+		{1024, false},
+		{1025, true},
+	} {
+		err := writeToPreallocBuffer(inst.module, inst.contextBufPtr, inst.contextBufSize, contextOfSize(tt.size))
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("data size %d exceeds buffer size 1024", tt.size)) {
+				t.Errorf("size %d: expected an error with both sizes, got %v", tt.size, err)
+			}
+		} else if err != nil {
+			t.Errorf("size %d: writeToPreallocBuffer failed: %v", tt.size, err)
+		}
+	}
+
+	// Exactly the buffer size fits as is; one more byte grows it
+	if _, _, err := writeContext(e.ctx, inst, contextOfSize(1024)); err != nil {
+		t.Fatalf("writeContext failed: %v", err)
+	}
+	assertEqual(t, uint32(1024), inst.contextBufSize)
+	if _, _, err := writeContext(e.ctx, inst, contextOfSize(1025)); err != nil {
+		t.Fatalf("writeContext failed: %v", err)
+	}
+	assertEqual(t, uint32(2048), inst.contextBufSize)
+
+	// A context of exactly the max is evaluated; one more byte is rejected
+	// with both sizes
+	var buf bytes.Buffer
+	data, err := evaluateReusable(e.ctx, inst, "attr-flag", contextOfSize(4096), &buf)
+	if err != nil {
+		t.Fatalf("evaluateReusable at the max context size failed: %v", err)
+	}
+	result, err := parseEvalResult(data)
+	if err != nil {
+		t.Fatalf("parseEvalResult failed: %v", err)
+	}
+	assertEqual(t, "on", result.Value)
+	assertEqual(t, uint32(4096), inst.contextBufSize)
+
+	_, err = evaluateReusable(e.ctx, inst, "attr-flag", contextOfSize(4097), &buf)
+	if !errors.Is(err, ErrContextTooLarge) {
+		t.Fatalf("expected ErrContextTooLarge, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "4097 bytes exceeds maximum of 4096") {
+		t.Errorf("expected both sizes in the error, got %q", err)
+	}
+}
+
+func TestWithMaxFlagKeySize(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithMaxFlagKeySize(512))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(`{"flags": {}}`); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	result, err := e.EvaluateFlag(strings.Repeat("k", 300), nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	assertEqual(t, ErrorFlagNotFound, result.ErrorCode)
+	_, err = e.EvaluateFlag(strings.Repeat("k", 513), nil)
+	if !errors.Is(err, ErrFlagKeyTooLarge) {
+		t.Errorf("expected ErrFlagKeyTooLarge, got %v", err)
+	}
+	var sizeErr *FlagKeyTooLargeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("expected a FlagKeyTooLargeError, got %v", err)
+	}
+	assertEqual(t, 513, sizeErr.Size)
+	assertEqual(t, 512, sizeErr.Max)
+
+	// A config defining a flag that couldn't be evaluated is rejected, and
+	// the current one kept
+	longKey := "tenant/service/" + strings.Repeat("feature/", 63)
+	config := fmt.Sprintf(`{
+		"flags": {
+			"short": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			%q: { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } }
+		}
+	}`, longKey)
+	for _, update := range []func(string) (*UpdateStateResult, error){e.DryRunUpdateState, e.UpdateState} {
+		updated, err := update(config)
+		if err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		assertEqual(t, false, updated.Success)
+		assertEqual(t, fmt.Sprintf("Flag key '%s' is 519 bytes, exceeding the maximum flag key size of 512 bytes", longKey), updated.Error)
+	}
+	assertEqual(t, 0, len(e.ListFlags()))
+
+	// Keys up to the limit are accepted
+	updated, err := e.UpdateState(strings.Replace(config, "tenant/service/", "tenant/", 1))
+	if err != nil || !updated.Success {
+		t.Fatalf("UpdateState failed: %v %+v", err, updated)
+	}
+	assertEqual(t, 2, len(e.ListFlags()))
+
+	for _, n := range []int{0, 64<<10 + 1} {
+		if _, err := NewFlagEvaluator(WithMaxFlagKeySize(n)); err == nil {
+			t.Errorf("WithMaxFlagKeySize(%d): expected error", n)
+		}
+	}
+}
+
+func TestWithCompilationCache(t *testing.T) {
+	cache := wazero.NewCompilationCache()
+	t.Cleanup(func() { cache.Close(context.Background()) })
+
+	// Both evaluators compile through the same cache; the second reuses
+	// the first's machine code.
+	for i := 0; i < 2; i++ {
+		e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(cache))
+		if err != nil {
+			t.Fatalf("evaluator %d: failed to create: %v", i, err)
+		}
+		if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+			t.Fatalf("evaluator %d: UpdateState failed: %v", i, err)
+		}
+		result, err := e.EvaluateFlag("targeting-flag", smallCtx)
+		if err != nil {
+			t.Fatalf("evaluator %d: EvaluateFlag failed: %v", i, err)
+		}
+		assertEqual(t, true, result.Value)
+
+		// Closing an evaluator must leave the shared cache usable
+		if err := e.Close(); err != nil {
+			t.Fatalf("evaluator %d: Close failed: %v", i, err)
+		}
+	}
+}
+
+func TestWithWasmModule(t *testing.T) {
+	// Supplying the embedded bytes explicitly behaves like the default
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithWasmModuleReader(bytes.NewReader(wasmBytes)))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(simpleFlagConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, true, e.EvaluateBool("simple-flag", nil, false))
+
+	// A valid but empty module is rejected with every missing export listed
+	emptyModule := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	_, err = NewFlagEvaluator(WithWasmModule(emptyModule))
+	if err == nil {
+		t.Fatal("expected error for module without exports")
+	}
+	for _, name := range requiredExports {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention missing export %q", err, name)
+		}
+	}
+
+	// Garbage bytes fail compilation
+	if _, err := NewFlagEvaluator(WithWasmModule([]byte("not wasm"))); err == nil {
+		t.Error("expected error for invalid module bytes")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	e := newTestEvaluator(t)
+	info := e.Version()
+	sum := sha256.Sum256(wasmBytes)
+	assertEqual(t, hex.EncodeToString(sum[:]), info.WasmSHA256)
+	assertEqual(t, len(wasmBytes), info.WasmSize)
+	assertEqual(t, "", info.WasmVersion)
+	assertEqual(t, uint32(0), info.ABIVersion)
+	if info.PackageVersion == "" {
+		t.Error("expected a package version from the build info")
+	}
+
+	// A module exporting version and abi_version: version returns the packed
+	// pointer and length of "1.2.3", written at offset 16 by a data segment
+	export := func(name string, kind, index byte) []byte {
+		return append(wasmName(name), kind, index)
+	}
+	body := func(code ...byte) []byte {
+		return append([]byte{byte(len(code) + 1), 0x00}, code...)
+	}
+	const (
+		i32Const, i64Const, i64Shl, i64Or, end = 0x41, 0x42, 0x86, 0x84, 0x0b
+	)
+	var exports, code []byte
+	for i, name := range []string{"version", "abi_version", "alloc", "dealloc", "update_state", "evaluate_reusable"} {
+		exports = append(exports, export(name, 0x00, byte(i))...)
+	}
+	exports = append(exports, export("memory", 0x02, 0)...)
+	code = append(code, body(i64Const, 16, i64Const, 32, i64Shl, i64Const, 5, i64Or, end)...)
+	code = append(code, body(i32Const, 7, end)...)
+	code = append(code, body(i32Const, 0, end)...)
+	for range 3 {
+		code = append(code, body(end)...)
+	}
+	module := wasmModule(wasmSection(0x01, 4, // types: () i64, () i32, (i32) i32, (i32 i32)
+		0x60, 0, 1, 0x7e, 0x60, 0, 1, 0x7f, 0x60, 1, 0x7f, 1, 0x7f, 0x60, 2, 0x7f, 0x7f, 0),
+		wasmSection(0x03, 6, 0, 1, 2, 3, 3, 3),
+		wasmSection(0x05, 1, 0x00, 1),
+		wasmSection(0x07, append([]byte{7}, exports...)...),
+		wasmSection(0x0a, append([]byte{6}, code...)...),
+		wasmSection(0x0b, 1, 0x00, i32Const, 16, end, 5, '1', '.', '2', '.', '3'))
+
+	cm, err := Compile(WithWasmModule(module))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	defer cm.Close()
+	assertEqual(t, "1.2.3", cm.info.WasmVersion)
+	assertEqual(t, uint32(7), cm.info.ABIVersion)
+	assertEqual(t, len(module), cm.info.WasmSize)
+}
+
+func TestWasmModuleABIMismatch(t *testing.T) {
+	// Imports one shim the host provides, one it doesn't, and one with a
+	// signature differing from the host's () -> (i64)
+	imp := func(module, name string, typeIndex byte) []byte {
+		return append(append(wasmName(module), wasmName(name)...), 0x00, typeIndex)
+	}
+	var imports []byte
+	imports = append(imports, 3)
+	imports = append(imports, imp("__wbindgen_placeholder__", "__wbindgen_describe", 0)...)
+	imports = append(imports, imp("__wbindgen_placeholder__", "__wbg_getRandomValues_0000000000000000", 0)...)
+	imports = append(imports, imp("host", "get_current_time_unix_seconds", 0)...)
+	module := wasmModule(
+		wasmSection(0x01, 1, 0x60, 1, 0x7f, 0), // type: (i32) -> ()
+		wasmSection(0x02, imports...))
+
+	_, err := NewFlagEvaluator(WithWasmModule(module))
+	if !errors.Is(err, ErrABIMismatch) {
+		t.Fatalf("expected ErrABIMismatch, got %v", err)
+	}
+	for _, want := range []string{
+		"__wbindgen_placeholder__.__wbg_getRandomValues_0000000000000000 (i32) -> () (not provided)",
+		"host.get_current_time_unix_seconds (i32) -> () (host provides () -> (i64))",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "__wbindgen_describe") {
+		t.Errorf("error %q mentions a satisfied import", err)
+	}
+}
+
+// wasmModule assembles a WASM binary from sections built with wasmSection.
+func wasmModule(sections ...[]byte) []byte {
+	module := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	for _, section := range sections {
+		module = append(module, section...)
+	}
+	return module
+}
+
+// wasmSection encodes a WASM section.
+func wasmSection(id byte, content ...byte) []byte {
+	section := []byte{id}
+	for size := len(content); ; size >>= 7 {
+		if size < 0x80 {
+			section = append(section, byte(size))
+			break
+		}
+		section = append(section, byte(size&0x7f|0x80))
+	}
+	return append(section, content...)
+}
+
+// wasmName encodes a WASM name of fewer than 128 bytes.
+func wasmName(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+func TestFlagdEnrichmentFullContext(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	// {"var": ""} references the whole context, so no required keys are
+	// extracted and the full-context serialization path is used.
+	config := `{
+		"flags": {
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ "==": [{ "var": "$flagd.flagKey" }, "whole-context-flag"] },
+							{ ">": [{ "var": "$flagd.timestamp" }, 0] },
+							{ "!!": [{ "var": "" }] }
+						]},
+						"on", "off"
+					]
+				}
+			}
+		}
+	}`
+
+	result, err := e.UpdateState(config)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if _, ok := result.RequiredContextKeys["whole-context-flag"]; ok {
+		t.Fatal("expected no required context keys for whole-context rule")
+	}
+
+	for _, ctx := range []map[string]interface{}{nil, {"email": "a@example.com"}} {
+		evalResult, err := e.EvaluateFlag("whole-context-flag", ctx)
+		if err != nil {
+			t.Fatalf("EvaluateFlag failed: %v", err)
+		}
+		assertEqual(t, true, evalResult.Value)
+	}
+
+	results, err := e.EvaluateFlags([]string{"whole-context-flag"}, map[string]interface{}{"email": "a@example.com"})
+	if err != nil {
+		t.Fatalf("EvaluateFlags failed: %v", err)
+	}
+	assertEqual(t, true, results["whole-context-flag"].Value)
+}
+
+func TestFlagsWithoutFlagdRefs(t *testing.T) {
+	config := `{
+		"$evaluators": {
+			"is-this-flag": { "==": [{ "var": "$flagd.flagKey" }, "via-ref"] },
+			"is-admin": { "==": [{ "var": "role" }, "admin"] }
+		},
+		"flags": {
+			"static": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			"plain": { "targeting": { "if": [{ "==": [{ "var": "email" }, "a@example.com"] }, "on", null] } },
+			"uses-flagd": { "targeting": { "if": [{ "==": [{ "var": "$flagd.flagKey" }, "uses-flagd"] }, "on", null] } },
+			"fractional": { "targeting": { "fractional": [["on", 50], ["off", 50]] } },
+			"via-ref": { "targeting": { "if": [{ "$ref": "is-this-flag" }, "on", null] } }
+		}
+	}`
+
+	free := flagsWithoutFlagdRefs([]byte(config))
+	for flagKey, want := range map[string]bool{
+		"static":     true,
+		"plain":      true,
+		"uses-flagd": false,
+		"fractional": false,
+		"via-ref":    false,
+	} {
+		if free[flagKey] != want {
+			t.Errorf("%s: expected flagd-free %v, got %v", flagKey, want, free[flagKey])
+		}
+	}
+
+	if free := flagsWithoutFlagdRefs([]byte("not json")); free != nil {
+		t.Errorf("expected nil for unparseable config, got %v", free)
+	}
+}
+
+func TestContextEnrichmentOnlyWhenReferenced(t *testing.T) {
+	config := `{
+		"flags": {
+			"plain-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "email" }, "a@example.com"] }, "on", "off"] }
+			},
+			"flagd-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "$flagd.flagKey" }, "flagd-flag"] }, "on", "off"] }
+			}
+		}
+	}`
+	ctx := map[string]interface{}{"email": "a@example.com"}
+
+	newEvaluator := func(t *testing.T, clockCalls *atomic.Int64, opts ...Option) *FlagEvaluator {
+		t.Helper()
+		opts = append([]Option{WithPermissiveValidation(), WithPoolSize(1),
+			WithCompilationCache(testCompilationCache),
+			WithClock(func() time.Time {
+				clockCalls.Add(1)
+				return time.Now()
+			})}, opts...)
+		e, err := NewFlagEvaluator(opts...)
+		if err != nil {
+			t.Fatalf("failed to create evaluator: %v", err)
+		}
+		t.Cleanup(func() { e.Close() })
+		if _, err := e.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+		return e
+	}
+
+	t.Run("per flag", func(t *testing.T) {
+		var clockCalls atomic.Int64
+		e := newEvaluator(t, &clockCalls)
+
+		assertEqual(t, "on", e.EvaluateString("plain-flag", ctx, "error"))
+		results, err := e.EvaluateFlags([]string{"plain-flag"}, ctx)
+		if err != nil {
+			t.Fatalf("EvaluateFlags failed: %v", err)
+		}
+		assertEqual(t, "on", results["plain-flag"].Value)
+		assertEqual(t, int64(0), clockCalls.Load())
+
+		assertEqual(t, "on", e.EvaluateString("flagd-flag", ctx, "error"))
+		if clockCalls.Load() == 0 {
+			t.Error("expected the clock to be read for a flag referencing $flagd")
+		}
+	})
+
+	t.Run("WithoutContextEnrichment", func(t *testing.T) {
+		var clockCalls atomic.Int64
+		e := newEvaluator(t, &clockCalls, WithoutContextEnrichment())
+
+		assertEqual(t, "on", e.EvaluateString("plain-flag", ctx, "error"))
+		// $flagd.flagKey resolves to null without enrichment
+		assertEqual(t, "off", e.EvaluateString("flagd-flag", ctx, "error"))
+		assertEqual(t, int64(0), clockCalls.Load())
+	})
+}
+
+func TestWithClock(t *testing.T) {
+	// 2030-01-01T00:00:00Z
+	const launch = 1893456000
+
+	config := `{
+		"flags": {
+			"launch-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "before",
+				"variants": { "before": "before", "after": "after" },
+				"targeting": {
+					"if": [{ ">=": [{ "var": "$flagd.timestamp" }, 1893456000] }, "after", "before"]
+				}
+			},
+			"launch-flag-whole-context": {
+				"state": "ENABLED",
+				"defaultVariant": "before",
+				"variants": { "before": "before", "after": "after" },
+				"targeting": {
+					"if": [
+						{ "and": [
+							{ ">=": [{ "var": "$flagd.timestamp" }, 1893456000] },
+							{ "!!": [{ "var": "" }] }
+						]},
+						"after", "before"
+					]
+				}
+			}
+		}
+	}`
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		{"before launch", time.Unix(launch-1, 0), "before"},
+		{"at launch", time.Unix(launch, 0), "after"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+				WithCompilationCache(testCompilationCache), WithClock(func() time.Time { return tt.now }))
+			if err != nil {
+				t.Fatalf("failed to create evaluator: %v", err)
+			}
+			t.Cleanup(func() { e.Close() })
+
+			if _, err := e.UpdateState(config); err != nil {
+				t.Fatalf("UpdateState failed: %v", err)
+			}
+			ctx := map[string]interface{}{"targetingKey": "user-1"}
+			for _, key := range []string{"launch-flag", "launch-flag-whole-context"} {
+				if v := e.EvaluateString(key, ctx, "error"); v != tt.want {
+					t.Errorf("%s: expected %q, got %q", key, tt.want, v)
+				}
+			}
+		})
+	}
+}
+
+// countingReader is a deterministic entropy source recording how many bytes
+// were read from it.
+type countingReader struct {
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r.n.Add(1))
+	}
+	return len(p), nil
+}
+
+func TestWithEntropySource(t *testing.T) {
+	entropy := &countingReader{}
+	e, err := NewFlagEvaluator(WithPoolSize(2), WithCompilationCache(testCompilationCache), WithEntropySource(entropy))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	// Strict validation draws its hash seed from the source
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if entropy.n.Load() == 0 {
+		t.Error("expected the module's random bytes to come from the entropy source")
+	}
+	assertEqual(t, true, e.EvaluateBool("targeting-flag", map[string]interface{}{"tier": "premium"}, false))
+
+	// A source that runs out doesn't break validation or evaluation
+	empty, err := NewFlagEvaluator(WithPoolSize(1), WithCompilationCache(testCompilationCache), WithEntropySource(strings.NewReader("")))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { empty.Close() })
+	if result, err := empty.UpdateState(simpleTargetingConfig); err != nil || !result.Success {
+		t.Fatalf("UpdateState failed: %+v, %v", result, err)
+	}
+	assertEqual(t, true, empty.EvaluateBool("targeting-flag", map[string]interface{}{"tier": "premium"}, false))
+}
+
+func TestEvaluateObject(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"theme": {
+				"state": "ENABLED",
+				"defaultVariant": "light",
+				"variants": {
+					"light": { "name": "light", "fontSize": 14, "seed": 9007199254740993 },
+					"dark": { "name": "dark", "fontSize": 16, "seed": 1 }
+				},
+				"targeting": {
+					"if": [{ "==": [{ "var": "mode" }, "night"] }, "dark", "light"]
+				}
+			},
+			"static-theme": {
+				"state": "ENABLED",
+				"defaultVariant": "light",
+				"variants": {
+					"light": { "name": "light", "fontSize": 14, "seed": 9007199254740993 }
+				}
+			},
+			"string-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	type theme struct {
+		Name     string `json:"name"`
+		FontSize int    `json:"fontSize"`
+		Seed     int64  `json:"seed"`
+	}
+	def := theme{Name: "default"}
+
+	t.Run("targeting match", func(t *testing.T) {
+		got, err := EvaluateObject(e, "theme", map[string]interface{}{"mode": "night"}, def)
+		if err != nil {
+			t.Fatalf("EvaluateObject failed: %v", err)
+		}
+		if want := (theme{Name: "dark", FontSize: 16, Seed: 1}); got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("pre-evaluated keeps integer precision", func(t *testing.T) {
+		got, err := EvaluateObject(e, "static-theme", nil, def)
+		if err != nil {
+			t.Fatalf("EvaluateObject failed: %v", err)
+		}
+		if got.Seed != 9007199254740993 {
+			t.Errorf("expected seed 9007199254740993, got %d", got.Seed)
+		}
+	})
+
+	t.Run("untyped value keeps integer precision", func(t *testing.T) {
+		for _, tt := range []struct {
+			flagKey string
+			ctx     map[string]interface{}
+		}{
+			{"static-theme", nil},
+			{"theme", map[string]interface{}{"mode": "day"}},
+		} {
+			result, err := e.EvaluateFlag(tt.flagKey, tt.ctx)
+			if err != nil {
+				t.Fatalf("EvaluateFlag failed: %v", err)
+			}
+			obj := result.Value.(map[string]interface{})
+			assertEqual(t, int64(9007199254740993), obj["seed"])
+			assertEqual(t, int64(14), obj["fontSize"])
+		}
+	})
+
+	t.Run("type mismatch returns default", func(t *testing.T) {
+		got, err := EvaluateObject(e, "string-flag", nil, def)
+		if err == nil {
+			t.Error("expected error for type mismatch")
+		}
+		if got != def {
+			t.Errorf("expected default %+v, got %+v", def, got)
+		}
+	})
+
+	t.Run("missing flag returns default", func(t *testing.T) {
+		got, err := EvaluateObject(e, "no-such-flag", nil, def)
+		if err == nil {
+			t.Error("expected error for missing flag")
+		}
+		if got != def {
+			t.Errorf("expected default %+v, got %+v", def, got)
+		}
+	})
+}
+
+func TestEvaluateDetails(t *testing.T) {
+	e := newTestEvaluator(t)
+
+	config := `{
+		"flags": {
+			"beta": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": {
+					"if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"]
+				}
+			},
+			"limit": {
+				"state": "ENABLED",
+				"defaultVariant": "low",
+				"variants": { "low": 10, "high": 100 }
+			},
+			"disabled": {
+				"state": "DISABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	t.Run("targeting match", func(t *testing.T) {
+		d := e.EvaluateBoolDetails("beta", map[string]interface{}{"tier": "gold"}, false)
+		if d.Err != nil {
+			t.Fatalf("unexpected error: %v", d.Err)
+		}
+		if !d.Value || d.Variant != "on" || d.Reason != ReasonTargetingMatch {
+			t.Errorf("unexpected details: %+v", d)
+		}
+	})
+
+	t.Run("static", func(t *testing.T) {
+		d := e.EvaluateIntDetails("limit", nil, 0)
+		if d.Err != nil {
+			t.Fatalf("unexpected error: %v", d.Err)
+		}
+		if d.Value != 10 || d.Variant != "low" || d.Reason != ReasonStatic {
+			t.Errorf("unexpected details: %+v", d)
+		}
+		f := e.EvaluateFloatDetails("limit", nil, 0)
+		if f.Value != 10 || f.Variant != "low" {
+			t.Errorf("unexpected float details: %+v", f)
+		}
+	})
+
+	t.Run("disabled returns default", func(t *testing.T) {
+		d := e.EvaluateBoolDetails("disabled", nil, false)
+		if d.Value || d.Reason != ReasonDisabled {
+			t.Errorf("unexpected details: %+v", d)
+		}
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		d := e.EvaluateStringDetails("limit", nil, "fallback")
+		if d.Err == nil || !strings.Contains(d.Err.Error(), ErrorTypeMismatch) {
+			t.Errorf("expected %s error, got %v", ErrorTypeMismatch, d.Err)
+		}
+		if d.Value != "fallback" || d.Reason != ReasonError {
+			t.Errorf("unexpected details: %+v", d)
+		}
+	})
+
+	t.Run("flag not found", func(t *testing.T) {
+		d := e.EvaluateBoolDetails("missing", nil, true)
+		if d.Err == nil {
+			t.Error("expected error for missing flag")
+		}
+		if !d.Value {
+			t.Errorf("expected default value, got %+v", d)
+		}
+	})
+
+	t.Run("object", func(t *testing.T) {
+		d := EvaluateObjectDetails(e, "limit", nil, 0)
+		if d.Err != nil || d.Value != 10 || d.Variant != "low" {
+			t.Errorf("unexpected details: %+v", d)
+		}
+	})
+}
+
+func TestTypeMismatch(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	config := `{
+		"flags": {
+			"color": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "red", "blue": "blue" },
+				"targeting": { "if": [{ "var": "blue" }, "blue", "red"] }
+			},
+			"enabled": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	ctx := map[string]interface{}{"blue": true}
+
+	type object struct{ Name string }
+	tests := []struct {
+		name    string
+		flagKey string
+		variant string
+		def     interface{}
+		// details evaluates with the Details accessor, plain with the plain one
+		details func() (value interface{}, variant, reason string, err error)
+		plain   func() interface{}
+	}{
+		{
+			name: "bool", flagKey: "color", variant: "blue", def: true,
+			details: func() (interface{}, string, string, error) {
+				d := e.EvaluateBoolDetails("color", ctx, true)
+				return d.Value, d.Variant, d.Reason, d.Err
+			},
+			plain: func() interface{} { return e.EvaluateBool("color", ctx, true) },
+		},
+		{
+			name: "string", flagKey: "enabled", variant: "on", def: "fallback",
+			details: func() (interface{}, string, string, error) {
+				d := e.EvaluateStringDetails("enabled", ctx, "fallback")
+				return d.Value, d.Variant, d.Reason, d.Err
+			},
+			plain: func() interface{} { return e.EvaluateString("enabled", ctx, "fallback") },
+		},
+		{
+			name: "int", flagKey: "color", variant: "blue", def: int64(-1),
+			details: func() (interface{}, string, string, error) {
+				d := e.EvaluateIntDetails("color", ctx, -1)
+				return d.Value, d.Variant, d.Reason, d.Err
+			},
+			plain: func() interface{} { return e.EvaluateInt("color", ctx, -1) },
+		},
+		{
+			name: "float", flagKey: "enabled", variant: "on", def: 0.5,
+			details: func() (interface{}, string, string, error) {
+				d := e.EvaluateFloatDetails("enabled", ctx, 0.5)
+				return d.Value, d.Variant, d.Reason, d.Err
+			},
+			plain: func() interface{} { return e.EvaluateFloat("enabled", ctx, 0.5) },
+		},
+		{
+			name: "object", flagKey: "color", variant: "blue", def: object{Name: "fallback"},
+			details: func() (interface{}, string, string, error) {
+				d := EvaluateObjectDetails(e, "color", ctx, object{Name: "fallback"})
+				return d.Value, d.Variant, d.Reason, d.Err
+			},
+			plain: func() interface{} {
+				v, _ := EvaluateObject(e, "color", ctx, object{Name: "fallback"})
+				return v
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, variant, reason, err := tt.details()
+			assertEqual(t, tt.def, value)
+			assertEqual(t, tt.variant, variant)
+			assertEqual(t, ReasonError, reason)
+			var evalErr *EvaluationError
+			if !errors.As(err, &evalErr) {
+				t.Fatalf("expected an EvaluationError, got %v", err)
+			}
+			assertEqual(t, ErrorTypeMismatch, evalErr.Code)
+			assertEqual(t, tt.flagKey, evalErr.FlagKey)
+			assertEqual(t, tt.def, tt.plain())
+		})
+	}
+
+	// Each mismatched flag is logged once per configuration
+	assertEqual(t, 2, strings.Count(logs.String(), "flag value type mismatch"))
+	for _, want := range []string{"flagKey=color variant=blue", "flagKey=enabled variant=on"} {
+		if strings.Count(logs.String(), want) != 1 {
+			t.Errorf("expected log to contain %q once, got:\n%s", want, logs.String())
+		}
+	}
+	logs.Reset()
+	if _, err := e.UpdateState(strings.Replace(config, `"red": "red"`, `"red": "crimson"`, 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	e.EvaluateBool("color", ctx, true)
+	e.EvaluateBool("color", ctx, true)
+	assertEqual(t, 1, strings.Count(logs.String(), "flag value type mismatch"))
+
+	// Matching types aren't logged
+	logs.Reset()
+	assertEqual(t, "blue", e.EvaluateString("color", ctx, "fallback"))
+	assertEqual(t, true, e.EvaluateBool("enabled", ctx, false))
+	assertEqual(t, "", logs.String())
+}
+
+func TestEvaluateFlagRaw(t *testing.T) {
+	config := `{
+		"flags": {
+			"static-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true }, "metadata": { "owner": "alice" } },
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			}
+		}
+	}`
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"result cache", []Option{WithResultCache(16, time.Minute)}},
+		{"context validation", []Option{WithContextValidation()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewFlagEvaluator(append([]Option{WithPermissiveValidation(), WithPoolSize(1),
+				WithCompilationCache(testCompilationCache)}, tt.opts...)...)
+			if err != nil {
+				t.Fatalf("failed to create evaluator: %v", err)
+			}
+			t.Cleanup(func() { e.Close() })
+			if _, err := e.UpdateState(config); err != nil {
+				t.Fatalf("UpdateState failed: %v", err)
+			}
+
+			ctxs := []map[string]interface{}{
+				{"targetingKey": "user-1", "tier": "gold"},
+				{"targetingKey": "user-1", "tier": "gold"}, // served by the result cache
+				{"targetingKey": "user-1"},
+			}
+			for _, flagKey := range []string{"static-flag", "tier-flag", "missing-flag"} {
+				for _, ctx := range ctxs {
+					want, err := e.EvaluateFlag(flagKey, ctx)
+					if err != nil {
+						t.Fatalf("EvaluateFlag failed: %v", err)
+					}
+					wantJSON, _ := json.Marshal(want)
+					raw, err := e.EvaluateFlagRaw(flagKey, ctx)
+					if err != nil {
+						t.Fatalf("EvaluateFlagRaw failed: %v", err)
+					}
+					var got, wanted map[string]interface{}
+					if err := json.Unmarshal(raw, &got); err != nil {
+						t.Fatalf("%s: invalid JSON %s: %v", flagKey, raw, err)
+					}
+					json.Unmarshal(wantJSON, &wanted)
+					assertEqual(t, fmt.Sprint(wanted), fmt.Sprint(got))
+				}
+			}
+
+			// Callers get their own copy of a static flag's JSON
+			raw, _ := e.EvaluateFlagRaw("static-flag", nil)
+			raw[0] = 'x'
+			raw, _ = e.EvaluateFlagRaw("static-flag", nil)
+			assertEqual(t, `{"value":true,"variant":"on","reason":"STATIC","flagMetadata":{"owner":"alice"},"cached":true}`, string(raw))
+		})
+	}
+
+	e := newTestEvaluator(t)
+	e.Close()
+	if _, err := e.EvaluateFlagRaw("static-flag", nil); !errors.Is(err, ErrEvaluatorClosed) {
+		t.Errorf("expected ErrEvaluatorClosed, got %v", err)
+	}
+}
+
+func TestEvaluateFlagJSON(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithMaxContextSize(256))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	config := `{
+		"flags": {
+			"static-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true } },
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			},
+			"key-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "$flagd.flagKey" }, "key-flag"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		flagKey string
+		context string
+		variant string
+		code    string
+	}{
+		{"targeting match", "tier-flag", `{"targetingKey": "user-1", "tier": "gold"}`, "on", ""},
+		{"targeting no match", "tier-flag", `{"targetingKey": "user-1", "tier": "silver"}`, "off", ""},
+		{"empty context", "tier-flag", ``, "off", ""},
+		{"enriched", "key-flag", `{"targetingKey": "user-1"}`, "on", ""},
+		{"caller's $flagd replaced", "key-flag", `{"targetingKey": "user-1", "$flagd": {"flagKey": "other"}}`, "on", ""},
+		{"static flag", "static-flag", `not even JSON`, "on", ""},
+		{"malformed JSON", "tier-flag", `{"tier": `, "", ErrorParseError},
+		{"missing flag", "nope", `{}`, "", ErrorFlagNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := e.EvaluateFlagJSON(tt.flagKey, []byte(tt.context))
+			if err != nil {
+				t.Fatalf("EvaluateFlagJSON failed: %v", err)
+			}
+			assertEqual(t, tt.variant, result.Variant)
+			assertEqual(t, tt.code, result.ErrorCode)
+		})
+	}
+
+	_, err = e.EvaluateFlagJSON("tier-flag", []byte(`{"tier": "`+strings.Repeat("x", 256)+`"}`))
+	if !errors.Is(err, ErrContextTooLarge) {
+		t.Errorf("expected ErrContextTooLarge, got %v", err)
+	}
+	assertEqual(t, uint64(len(tests)+1), e.Stats().Evaluations)
+}
+
+func TestWriteRawContext(t *testing.T) {
+	required := map[string]bool{"tier": true, "user.plan": true, "targetingKey": true}
+	tests := []struct {
+		name     string
+		context  string
+		required map[string]bool
+		want     string
+	}{
+		{"filtered", `{"targetingKey":"u","tier":"gold","other":[1,{"a":"}"}]}`, required, `{"targetingKey":"u","tier":"gold"`},
+		{"dotted path copied whole", `{"user":{"plan":"pro","name":"x"},"tier":1}`, required, `{"user":{"plan":"pro","name":"x"},"tier":1,"targetingKey":""`},
+		{"whitespace", " {\n\t\"tier\" : true ,\"x\": null } ", required, `{"tier":true,"targetingKey":""`},
+		{"escaped key", `{"ti\u0065r":"gold"}`, required, `{"ti\u0065r":"gold","targetingKey":""`},
+		{"$flagd dropped", `{"$flagd":{"flagKey":"x"},"tier":"gold"}`, nil, `{"tier":"gold","targetingKey":""`},
+		{"unknown required keys", `{"a":1,"b":"2"}`, nil, `{"a":1,"b":"2","targetingKey":""`},
+		{"empty object", `{}`, required, `{"targetingKey":""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if !writeRawContext(&b, []byte(tt.context), tt.required) {
+				t.Fatalf("writeRawContext rejected %s", tt.context)
+			}
+			assertEqual(t, tt.want, b.String())
+		})
+	}
+
+	for _, context := range []string{``, `[]`, `{"tier"}`, `{"tier":}`, `{"tier":1,}`, `{"tier":1 "a":2}`, `{"tier":"gold"`, `{} {}`, `{"tier":tru}`} {
+		var b bytes.Buffer
+		if writeRawContext(&b, []byte(context), required) {
+			t.Errorf("writeRawContext accepted %q", context)
+		}
+	}
+}
+
+func TestWithTypeCoercion(t *testing.T) {
+	config := `{
+		"flags": {
+			"bool-string": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "true" } },
+			"zero-string": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "0" } },
+			"int-string": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "42" } },
+			"float-string": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "2.5" } },
+			"word": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": "maybe" } },
+			"number": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": 2.5 } },
+			"bool": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": false } },
+			"object": { "state": "ENABLED", "defaultVariant": "v", "variants": { "v": { "a": 1 } } },
+			"targeted": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "1", "off": "0" },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			}
+		}
+	}`
+	strict := newTestEvaluator(t)
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithCompilationCache(testCompilationCache), WithTypeCoercion())
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	for _, ev := range []*FlagEvaluator{strict, e} {
+		if _, err := ev.UpdateState(config); err != nil {
+			t.Fatalf("UpdateState failed: %v", err)
+		}
+	}
+
+	assertEqual(t, true, e.EvaluateBool("bool-string", nil, false))
+	assertEqual(t, false, e.EvaluateBool("zero-string", nil, true))
+	assertEqual(t, true, e.EvaluateBool("targeted", map[string]interface{}{"tier": "gold"}, false))
+	assertEqual(t, int64(42), e.EvaluateInt("int-string", nil, 0))
+	assertEqual(t, int64(2), e.EvaluateInt("float-string", nil, 0))
+	assertEqual(t, 2.5, e.EvaluateFloat("float-string", nil, 0))
+	assertEqual(t, "2.5", e.EvaluateString("number", nil, ""))
+	assertEqual(t, "false", e.EvaluateString("bool", nil, ""))
+
+	d := e.EvaluateBoolDetails("bool-string", nil, false)
+	if d.Err != nil || d.Variant != "v" || d.Reason != ReasonStatic {
+		t.Errorf("unexpected details: %+v", d)
+	}
+
+	// Values that don't convert are still mismatches
+	for _, d := range []EvaluationDetails[int64]{
+		e.EvaluateIntDetails("word", nil, -1),
+		e.EvaluateIntDetails("object", nil, -1),
+	} {
+		if d.Value != -1 || d.Err == nil || !strings.Contains(d.Err.Error(), ErrorTypeMismatch) {
+			t.Errorf("expected %s with the default, got %+v", ErrorTypeMismatch, d)
+		}
+	}
+	assertEqual(t, true, e.EvaluateBool("word", nil, true))
+	assertEqual(t, "fallback", e.EvaluateString("object", nil, "fallback"))
+
+	// Without the option values aren't converted
+	assertEqual(t, false, strict.EvaluateBool("bool-string", nil, false))
+	assertEqual(t, int64(0), strict.EvaluateInt("int-string", nil, 0))
+	assertEqual(t, 0.0, strict.EvaluateFloat("float-string", nil, 0))
+	assertEqual(t, "", strict.EvaluateString("number", nil, ""))
+}
+
+func TestResultCache(t *testing.T) {
+	configFor := func(match string) string {
+		return fmt.Sprintf(`{
+			"flags": {
+				"tier-flag": {
+					"state": "ENABLED",
+					"defaultVariant": "default",
+					"variants": { "default": "default", "match": %q },
+					"targeting": { "if": [{ "==": [{ "var": "tier" }, "premium"] }, "match", "default"] }
+				}
+			}
+		}`, match)
+	}
+	var now atomic.Int64
+	now.Store(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithClock(func() time.Time { return time.Unix(now.Load(), 0) }), WithResultCache(2, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(configFor("A")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	premium := map[string]interface{}{"targetingKey": "user-1", "tier": "premium"}
+	basic := map[string]interface{}{"targetingKey": "user-1", "tier": "basic"}
+	evaluate := func(ctx map[string]interface{}, want string, wantHits uint64) {
+		t.Helper()
+		assertEqual(t, want, e.EvaluateString("tier-flag", ctx, "error"))
+		assertEqual(t, wantHits, e.Stats().ResultCacheHits)
+	}
+
+	evaluate(premium, "A", 0)
+	evaluate(premium, "A", 1)
+	evaluate(basic, "default", 1)
+	evaluate(basic, "default", 2)
+
+	// Keys the rule doesn't read don't affect the cache key
+	evaluate(map[string]interface{}{"targetingKey": "user-1", "tier": "premium", "region": "eu"}, "A", 3)
+
+	// A state update never serves results of the previous generation
+	if _, err := e.UpdateState(configFor("B")); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	evaluate(premium, "B", 3)
+	evaluate(premium, "B", 4)
+
+	// Batches share the cache
+	results, err := e.EvaluateFlags([]string{"tier-flag"}, premium)
+	if err != nil {
+		t.Fatalf("EvaluateFlags failed: %v", err)
+	}
+	assertEqual(t, "B", results["tier-flag"].Value)
+	assertEqual(t, uint64(5), e.Stats().ResultCacheHits)
+
+	// The least recently used entry is evicted when full
+	evaluate(basic, "default", 5)
+	evaluate(map[string]interface{}{"targetingKey": "user-2", "tier": "premium"}, "B", 5)
+	evaluate(premium, "B", 5)
+
+	// Entries expire after the TTL
+	evaluate(premium, "B", 6)
+	now.Add(int64(time.Minute / time.Second))
+	evaluate(premium, "B", 6)
+
+	for _, opt := range []Option{WithResultCache(0, time.Minute), WithResultCache(-1, 0), WithResultCache(10, -time.Second)} {
+		if _, err := NewFlagEvaluator(opt); err == nil {
+			t.Error("expected invalid WithResultCache to fail")
+		}
+	}
+}
+
+// TestCachedResultsAreCopies checks that modifying a result served from a
+// cache doesn't leak into the results of later evaluations.
+func TestEvaluateFlagNoContext(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"static-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true, "off": false } },
+			"disabled-flag": { "state": "DISABLED", "defaultVariant": "on", "variants": { "on": true, "off": false } },
+			"tier-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	for flagKey, want := range map[string]interface{}{"static-flag": true, "disabled-flag": nil, "tier-flag": false} {
+		result, err := e.EvaluateFlagNoContext(flagKey)
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlagNoContext failed: %v", flagKey, err)
+		}
+		assertEqual(t, want, result.Value)
+	}
+
+	// A static flag's typed evaluation without context allocates nothing;
+	// a full result allocates its copy only
+	allocs := testing.AllocsPerRun(100, func() {
+		e.EvaluateBool("static-flag", nil, false)
+		e.EvaluateBoolDetails("static-flag", nil, false)
+	})
+	assertEqual(t, 0.0, allocs)
+	allocs = testing.AllocsPerRun(100, func() {
+		e.EvaluateFlagNoContext("static-flag")
+	})
+	assertEqual(t, 1.0, allocs)
+}
+
+// TestEvaluateReadsIntoScratchBuffer checks that both evaluate exports copy
+// the result into the caller's buffer rather than a fresh allocation.
+func TestEvaluateReadsIntoScratchBuffer(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, err := e.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	set, inst, err := e.acquireInstance(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInstance failed: %v", err)
+	}
+	defer e.releaseInstance(set, inst, nil)
+
+	var buf bytes.Buffer
+	buf.Grow(4096)
+	contextBytes := []byte(`{"tier":"premium"}`)
+	evals := map[string]func() ([]byte, error){
+		"evaluate_reusable": func() ([]byte, error) {
+			return evaluateReusable(e.ctx, inst, "targeting-flag", contextBytes, &buf)
+		},
+		"evaluate_by_index": func() ([]byte, error) {
+			return evaluateByIndex(e.ctx, inst, set.snap.flagIndex["targeting-flag"], contextBytes, &buf)
+		},
+	}
+	for name, eval := range evals {
+		buf.Reset()
+		data, err := eval()
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if len(data) == 0 || &data[0] != &buf.Bytes()[0] {
+			t.Errorf("%s: expected the result to be read into the scratch buffer", name)
+		}
+		result, err := parseEvalResult(data)
+		if err != nil {
+			t.Fatalf("%s: parseEvalResult failed: %v", name, err)
+		}
+		assertEqual(t, "TARGETING_MATCH", result.Reason)
+	}
+}
+
+func TestCachedResultsAreCopies(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithResultCache(10, 0), WithPrecomputeContext(map[string]interface{}{"tier": "gold"}))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	config := `{
+		"metadata": { "team": "platform" },
+		"flags": {
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": { "limits": [1, 2] } },
+				"metadata": { "owner": "alice" }
+			},
+			"targeted": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": { "limits": [1, 2] }, "off": { "limits": [1, 2], "off": true } },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] },
+				"metadata": { "owner": "bob" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	tamper := func(r *EvaluationResult) {
+		r.FlagMetadata["owner"] = "mallory"
+		r.FlagMetadata["leaked"] = true
+		r.Value.(map[string]interface{})["limits"].([]interface{})[0] = int64(99)
+	}
+	check := func(name string, r *EvaluationResult, owner string) {
+		t.Helper()
+		assertEqual(t, owner, r.FlagMetadata["owner"])
+		if _, ok := r.FlagMetadata["leaked"]; ok {
+			t.Errorf("%s: metadata leaked from an earlier result: %v", name, r.FlagMetadata)
+		}
+		assertEqual(t, "[1 2]", fmt.Sprint(r.Value.(map[string]interface{})["limits"]))
+	}
+
+	gold := map[string]interface{}{"targetingKey": "user-1", "tier": "gold"}
+	evaluations := []struct {
+		name     string
+		flagKey  string
+		owner    string
+		evaluate func(flagKey string) (*EvaluationResult, error)
+	}{
+		{"EvaluateFlag", "static", "alice", func(flagKey string) (*EvaluationResult, error) {
+			return e.EvaluateFlag(flagKey, nil)
+		}},
+		{"EvaluateFlags", "static", "alice", func(flagKey string) (*EvaluationResult, error) {
+			results, err := e.EvaluateFlags([]string{flagKey}, nil)
+			return results[flagKey], err
+		}},
+		{"EvaluateFlagJSON", "static", "alice", func(flagKey string) (*EvaluationResult, error) {
+			return e.EvaluateFlagJSON(flagKey, []byte(`{}`))
+		}},
+		// Served precomputed
+		{"precomputed", "targeted", "bob", func(flagKey string) (*EvaluationResult, error) {
+			return e.EvaluateFlag(flagKey, gold)
+		}},
+		{"precomputed batch", "targeted", "bob", func(flagKey string) (*EvaluationResult, error) {
+			results, err := e.EvaluateFlags([]string{flagKey}, gold)
+			return results[flagKey], err
+		}},
+	}
+	for _, ev := range evaluations {
+		first, err := ev.evaluate(ev.flagKey)
+		if err != nil {
+			t.Fatalf("%s failed: %v", ev.name, err)
+		}
+		tamper(first)
+		second, err := ev.evaluate(ev.flagKey)
+		if err != nil {
+			t.Fatalf("%s failed: %v", ev.name, err)
+		}
+		check(ev.name, second, ev.owner)
+	}
+
+	// Result cache: the result stored by the first evaluation and the hits
+	// served from it
+	silver := map[string]interface{}{"targetingKey": "user-1", "tier": "silver"}
+	hits := e.Stats().ResultCacheHits
+	for i := 0; i < 3; i++ {
+		r, err := e.EvaluateFlag("targeted", silver)
+		if err != nil {
+			t.Fatalf("EvaluateFlag failed: %v", err)
+		}
+		check("result cache", r, "bob")
+		tamper(r)
+	}
+	if got := e.Stats().ResultCacheHits; got != hits+2 {
+		t.Errorf("expected 2 result cache hits, got %d", got-hits)
+	}
+
+	// Results in UpdateStateResult don't share the cache's either
+	result, err := e.UpdateState(strings.Replace(config, "alice", "carol", 1))
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	tamper(result.PreEvaluated["static"])
+	r, err := e.EvaluateFlag("static", nil)
+	if err != nil {
+		t.Fatalf("EvaluateFlag failed: %v", err)
+	}
+	check("UpdateStateResult", r, "carol")
+}
+
+func TestWithPrecomputeContext(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache),
+		WithDefaultContext(map[string]interface{}{"app": "web"}),
+		WithPrecomputeContext(map[string]interface{}{"region": "eu", "plan": "pro", "targetingKey": "ignored"}))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	config := `{
+		"flags": {
+			"segment": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "==": [{ "var": "region" }, "eu"] }, { "==": [{ "var": "plan" }, "pro"] }] }, "on", "off"] }
+			},
+			"with-default": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "app" }, "web"] }, "on", "off"] }
+			},
+			"by-user": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "targetingKey" }, "vip"] }, "on", "off"] }
+			},
+			"split": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "region" }, "eu"] }, { "fractional": [["on", 50], ["off", 50]] }, "off"] }
+			},
+			"by-flag-key": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "var": "$flagd.flagKey" }, "by-flag-key"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	snap := e.active.Load().snap
+	for _, flagKey := range []string{"segment", "with-default"} {
+		if _, ok := snap.precomputed[flagKey]; !ok {
+			t.Errorf("expected %s to be precomputed", flagKey)
+		}
+	}
+	for _, flagKey := range []string{"by-user", "split", "by-flag-key"} {
+		if _, ok := snap.precomputed[flagKey]; ok {
+			t.Errorf("expected %s not to be precomputed", flagKey)
+		}
+	}
+
+	evaluate := func(flagKey string, ctx map[string]interface{}, want string, wantHits uint64) {
+		t.Helper()
+		assertEqual(t, want, e.EvaluateString(flagKey, ctx, "error"))
+		assertEqual(t, wantHits, e.Stats().PrecomputedHits)
+	}
+
+	// Served when the context agrees on every key the flag reads, whatever
+	// the rest of it
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "eu", "plan": "pro"}, "on", 1)
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-2", "region": "eu", "plan": "pro", "tier": "gold"}, "on", 2)
+	evaluate("with-default", map[string]interface{}{"targetingKey": "user-1"}, "on", 3)
+
+	// Evaluated when it doesn't
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "us", "plan": "pro"}, "off", 3)
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "eu"}, "off", 3)
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "eu", "plan": "pro", "extra": 1, "plan2": "x"}, "on", 4)
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "eu", "plan": "Pro"}, "off", 4)
+	evaluate("with-default", map[string]interface{}{"targetingKey": "user-1", "app": "mobile"}, "off", 4)
+	evaluate("by-user", map[string]interface{}{"targetingKey": "vip", "region": "eu", "plan": "pro"}, "on", 4)
+	evaluate("by-flag-key", map[string]interface{}{"targetingKey": "user-1"}, "on", 4)
+
+	// Batches are served too
+	results, err := e.EvaluateFlags([]string{"segment", "with-default", "by-user"}, map[string]interface{}{"targetingKey": "user-1", "region": "eu", "plan": "pro"})
+	if err != nil {
+		t.Fatalf("EvaluateFlags failed: %v", err)
+	}
+	assertEqual(t, "on", results["segment"].Value)
+	assertEqual(t, ReasonTargetingMatch, results["segment"].Reason)
+	assertEqual(t, "off", results["by-user"].Value)
+	assertEqual(t, uint64(6), e.Stats().PrecomputedHits)
+
+	// Defaults changed after the update stop matching rather than serve a
+	// stale result
+	e.SetDefaultContext(map[string]interface{}{"app": "mobile"})
+	evaluate("with-default", map[string]interface{}{"targetingKey": "user-1"}, "off", 6)
+	evaluate("with-default", map[string]interface{}{"targetingKey": "user-1", "app": "web"}, "on", 7)
+
+	// Results are recomputed with each update
+	if _, err := e.UpdateState(strings.Replace(config, `"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and"`, `"variants": { "on": "updated", "off": "off" },
+				"targeting": { "if": [{ "and"`, 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	evaluate("segment", map[string]interface{}{"targetingKey": "user-1", "region": "eu", "plan": "pro"}, "updated", 8)
+
+	if _, err := NewFlagEvaluator(WithPrecomputeContext(nil)); err == nil {
+		t.Error("expected an error for a nil precompute context")
+	}
+}
+
+func TestFractionalBucket(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"$evaluators": {
+			"split": { "fractional": [["red", 25], ["green", 25], ["blue", 50]] }
+		},
+		"flags": {
+			"default-key": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "red", "green": "green", "blue": "blue" },
+				"targeting": { "$ref": "split" }
+			},
+			"email-key": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "red", "green": "green", "blue": "blue" },
+				"targeting": { "fractional": [{ "cat": [{ "var": "$flagd.flagKey" }, { "var": "email" }] }, ["red", 10], ["green", 30], ["blue", 60]] }
+			},
+			"flat-key": {
+				"state": "ENABLED",
+				"defaultVariant": "red",
+				"variants": { "red": "red", "green": "green", "blue": "blue" },
+				"targeting": { "if": [{ "var": "beta" }, { "fractional": [{ "var": "email" }, ["red", 1, "green", 1, "blue", 1]] }, "red"] }
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on" }
+			},
+			"no-fractional": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "var": "beta" }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	order := []string{"red", "green", "blue"}
+	for i := 0; i < 200; i++ {
+		ctx := map[string]interface{}{
+			"targetingKey": fmt.Sprintf("user-%d", i),
+			"email":        fmt.Sprintf("user-%d@example.com", i),
+			"beta":         true,
+		}
+		for _, flagKey := range []string{"default-key", "email-key", "flat-key"} {
+			variant, bucket, err := e.FractionalBucket(flagKey, ctx)
+			if err != nil {
+				t.Fatalf("FractionalBucket(%q) failed: %v", flagKey, err)
+			}
+			assertEqual(t, e.EvaluateString(flagKey, ctx, "error"), variant)
+			assertEqual(t, order[bucket], variant)
+		}
+	}
+
+	if _, _, err := e.FractionalBucket("static", nil); !errors.Is(err, ErrNotFractional) {
+		t.Errorf("expected ErrNotFractional for a static flag, got %v", err)
+	}
+	if _, _, err := e.FractionalBucket("no-fractional", nil); !errors.Is(err, ErrNotFractional) {
+		t.Errorf("expected ErrNotFractional, got %v", err)
+	}
+	_, _, err := e.FractionalBucket("missing", nil)
+	var evalErr *EvaluationError
+	if !errors.As(err, &evalErr) || !errors.Is(err, ErrFlagNotFound) {
+		t.Fatalf("expected a flag not found EvaluationError, got %v", err)
+	}
+	assertEqual(t, ErrorFlagNotFound, evalErr.Code)
+}
+
+// TestFractionalAssignments pins the buckets of known keys, so a change to the
+// hash or bucketing that would move existing users fails here.
+func TestFractionalAssignments(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"coin": {
+				"state": "ENABLED",
+				"defaultVariant": "heads",
+				"variants": { "heads": "heads", "tails": "tails" },
+				"targeting": { "fractional": [["heads", 50], ["tails", 50]] }
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	want := map[string]string{
+		"alice": "tails",
+		"bob":   "tails",
+		"carol": "heads",
+		"dave":  "heads",
+		"erin":  "tails",
+		"frank": "tails",
+		"grace": "tails",
+		"heidi": "heads",
+	}
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	got, err := e.FractionalAssignments("coin", keys)
+	if err != nil {
+		t.Fatalf("FractionalAssignments failed: %v", err)
+	}
+	assertEqual(t, len(want), len(got))
+	for key, variant := range want {
+		assertEqual(t, variant, got[key])
+		assertEqual(t, variant, e.EvaluateString("coin", map[string]interface{}{"targetingKey": key}, "error"))
+	}
+
+	if _, err := e.FractionalAssignments("static", keys); !errors.Is(err, ErrNotFractional) {
+		t.Errorf("expected ErrNotFractional for a static flag, got %v", err)
+	}
+	if _, err := e.FractionalAssignments("missing", keys); !errors.Is(err, ErrFlagNotFound) {
+		t.Errorf("expected ErrFlagNotFound, got %v", err)
+	}
+}
+
+func TestRolloutPercentage(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"rollout": {
+				"state": "ENABLED",
+				"defaultVariant": "old",
+				"variants": { "new": "new", "old": "old" },
+				"targeting": { "fractional": [["new", 20], ["old", 80]] }
+			},
+			"by-email": {
+				"state": "ENABLED",
+				"defaultVariant": "a",
+				"variants": { "a": "a", "b": "b", "c": "c" },
+				"targeting": { "fractional": [{ "var": "email" }, ["a", 1], ["b", 1], ["c", 2]] }
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": "on" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	var below int
+	for i := 0; i < 500; i++ {
+		ctx := map[string]interface{}{
+			"targetingKey": fmt.Sprintf("user-%d", i),
+			"email":        fmt.Sprintf("user-%d@example.com", i),
+		}
+		pct, err := e.RolloutPercentage("rollout", ctx)
+		if err != nil {
+			t.Fatalf("RolloutPercentage failed: %v", err)
+		}
+		if pct < 0 || pct > 100 {
+			t.Fatalf("position %v out of range", pct)
+		}
+		want := "old"
+		if pct < 20 {
+			want = "new"
+			below++
+		}
+		assertEqual(t, want, e.EvaluateString("rollout", ctx, "error"))
+
+		pct, err = e.RolloutPercentage("by-email", ctx)
+		if err != nil {
+			t.Fatalf("RolloutPercentage failed: %v", err)
+		}
+		want = "c"
+		switch {
+		case pct < 25:
+			want = "a"
+		case pct < 50:
+			want = "b"
+		}
+		assertEqual(t, want, e.EvaluateString("by-email", ctx, "error"))
+	}
+	if below < 50 || below > 150 {
+		t.Errorf("expected about 20%% of 500 contexts below 20, got %d", below)
+	}
+
+	if _, err := e.RolloutPercentage("static", nil); !errors.Is(err, ErrNotFractional) {
+		t.Errorf("expected ErrNotFractional for a static flag, got %v", err)
+	}
+	if _, err := e.RolloutPercentage("missing", nil); !errors.Is(err, ErrFlagNotFound) {
+		t.Errorf("expected ErrFlagNotFound, got %v", err)
+	}
+}
+
+func TestExplainFlag(t *testing.T) {
+	e := newTestEvaluator(t)
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	contexts := []map[string]interface{}{
+		{"tier": "premium", "score": 95, "region": "us-east", "role": "admin"},
+		{"tier": "premium", "score": 95, "region": "eu-west", "role": "admin"},
+		{"department": "engineering", "experience": 7},
+		{"country": "US", "level": 2, "score": 30},
+		{"plan": "free", "score": 10},
+		{},
+	}
+	for _, ctx := range contexts {
+		explanation, err := e.ExplainFlag("big-flag", ctx)
+		if err != nil {
+			t.Fatalf("ExplainFlag failed: %v", err)
+		}
+		assertEqual(t, "", explanation.TraceError)
+		root := explanation.Trace[len(explanation.Trace)-1]
+		assertEqual(t, "", root.Path)
+		// A null targeting result falls back to the default variant
+		want := "none"
+		if root.Result != nil {
+			want = root.Result.(string)
+		}
+		assertEqual(t, want, explanation.Result.Variant)
+	}
+
+	// The trace shows which branch matched and skips the ones never reached
+	explanation, err := e.ExplainFlag("big-flag", contexts[2])
+	if err != nil {
+		t.Fatalf("ExplainFlag failed: %v", err)
+	}
+	assertEqual(t, "standard", explanation.Result.Variant)
+	steps := make(map[string]ExplanationStep)
+	for _, step := range explanation.Trace {
+		steps[step.Path] = step
+	}
+	assertEqual(t, false, steps["/if/0"].Truthy)
+	assertEqual(t, "and", steps["/if/0"].Operator)
+	assertEqual(t, false, steps["/if/2/if/0/or/0"].Truthy)
+	assertEqual(t, true, steps["/if/2/if/0/or/1"].Truthy)
+	if _, ok := steps["/if/2/if/0/or/2"]; ok {
+		t.Error("expected the or to short-circuit before its third operand")
+	}
+	if _, ok := steps["/if/2/if/2"]; ok {
+		t.Error("expected the else branch to be skipped")
+	}
+
+	config := `{
+		"flags": {
+			"versioned": {
+				"state": "ENABLED",
+				"defaultVariant": "old",
+				"variants": { "old": "old", "new": "new" },
+				"targeting": { "if": [{ "sem_ver": [{ "var": "version" }, "^", "2.1.0"] }, "new", "old"] }
+			},
+			"split": {
+				"state": "ENABLED",
+				"defaultVariant": "a",
+				"variants": { "a": "a", "b": "b" },
+				"targeting": { "fractional": [["a", 50], ["b", 50]] }
+			},
+			"unsupported": {
+				"state": "ENABLED",
+				"defaultVariant": "a",
+				"variants": { "a": "a", "b": "b" },
+				"targeting": { "if": [{ "==": [{ "substr": [{ "var": "name" }, 0, 1] }, "b"] }, "b", "a"] }
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "a",
+				"variants": { "a": "a" }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	for _, version := range []string{"2.1.0", "2.9.3", "3.0.0", "2.0.9", "v2.2.0-beta.1", "junk"} {
+		explanation, err := e.ExplainFlag("versioned", map[string]interface{}{"version": version})
+		if err != nil {
+			t.Fatalf("ExplainFlag failed: %v", err)
+		}
+		assertEqual(t, explanation.Result.Variant, explanation.Trace[len(explanation.Trace)-1].Result)
+	}
+	for i := 0; i < 20; i++ {
+		explanation, err := e.ExplainFlag("split", map[string]interface{}{"targetingKey": fmt.Sprintf("user-%d", i)})
+		if err != nil {
+			t.Fatalf("ExplainFlag failed: %v", err)
+		}
+		assertEqual(t, explanation.Result.Variant, explanation.Trace[len(explanation.Trace)-1].Result)
+	}
+
+	explanation, err = e.ExplainFlag("unsupported", map[string]interface{}{"name": "bob"})
+	if err != nil {
+		t.Fatalf("ExplainFlag failed: %v", err)
+	}
+	assertEqual(t, "b", explanation.Result.Variant)
+	if !strings.Contains(explanation.TraceError, `unsupported operation "substr"`) {
+		t.Errorf("expected an unsupported operation trace error, got %q", explanation.TraceError)
+	}
+
+	explanation, err = e.ExplainFlag("static", nil)
+	if err != nil {
+		t.Fatalf("ExplainFlag failed: %v", err)
+	}
+	assertEqual(t, "a", explanation.Result.Variant)
+	assertEqual(t, 0, len(explanation.Trace))
+}
+
+func TestSimulateFlag(t *testing.T) {
+	e := newTestEvaluator(t)
+	config := `{
+		"flags": {
+			"rollout": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "fractional": [["on", 20], ["off", 80]] }
+			},
+			"static": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	contexts := make([]map[string]interface{}, 1000)
+	want := make(map[string]int)
+	for i := range contexts {
+		contexts[i] = map[string]interface{}{"targetingKey": fmt.Sprintf("user-%d", i)}
+		result, err := e.EvaluateFlag("rollout", contexts[i])
+		if err != nil {
+			t.Fatalf("EvaluateFlag failed: %v", err)
+		}
+		want[result.Variant]++
+	}
+
+	evaluations := e.Stats().Evaluations
+	counts, err := e.SimulateFlag("rollout", contexts)
+	if err != nil {
+		t.Fatalf("SimulateFlag failed: %v", err)
+	}
+	assertEqual(t, fmt.Sprint(want), fmt.Sprint(counts))
+	assertEqual(t, 1000, counts["on"]+counts["off"])
+	assertEqual(t, evaluations, e.Stats().Evaluations)
+
+	counts, err = e.SimulateFlag("static", contexts)
+	if err != nil {
+		t.Fatalf("SimulateFlag failed: %v", err)
+	}
+	assertEqual(t, "map[on:1000]", fmt.Sprint(counts))
+
+	if _, err := e.SimulateFlag("missing", contexts); !errors.Is(err, ErrFlagNotFound) {
+		t.Errorf("expected ErrFlagNotFound, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	config := `{
+		"flags": {
+			"static-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true, "off": false }
+			},
+			"targeting-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+
+	stats := e.Stats()
+	assertEqual(t, 1, stats.PoolSize)
+	assertEqual(t, 1, stats.AvailableInstances)
+	assertEqual(t, uint64(0), stats.Evaluations)
+
+	e.EvaluateFlag("static-flag", nil)
+	e.EvaluateFlag("targeting-flag", smallCtx)
+	e.EvaluateAllFlags(smallCtx)
+
+	stats = e.Stats()
+	assertEqual(t, uint64(4), stats.Evaluations)
+	assertEqual(t, uint64(2), stats.CacheHits)
+	assertEqual(t, uint64(0), stats.PoolWaits)
+	assertEqual(t, uint64(0), stats.ParseFallbacks)
+
+	// Metadata arrays are outside the fast parser's shapes
+	if _, err := e.decodeEvalResult("meta-flag", []byte(`{"value":true,"reason":"STATIC","flagMetadata":{"tags":["a"]}}`)); err != nil {
+		t.Fatalf("decodeEvalResult failed: %v", err)
+	}
+	assertEqual(t, uint64(1), e.Stats().ParseFallbacks)
+
+	// Hold the only instance so the next evaluation has to wait
+	set := e.active.Load()
+	inst, _ := set.pool.tryGet()
+	assertEqual(t, 0, e.Stats().AvailableInstances)
+
+	evaluated := make(chan struct{})
+	go func() {
+		e.EvaluateFlag("targeting-flag", smallCtx)
+		close(evaluated)
+	}()
+	for e.Stats().PoolWaits == 0 {
+		time.Sleep(time.Millisecond)
 	}
-	assertEqual(t, true, result.Value)
-	assertEqual(t, "STATIC", result.Reason)
+	set.pool.put(inst)
+	<-evaluated
+	assertEqual(t, uint64(1), e.Stats().PoolWaits)
+	assertEqual(t, uint64(0), e.Stats().SnapshotReloads)
 
-	result, err = e.EvaluateFlag("disabled-flag", ctx)
+	// An update landing between an evaluation's snapshot load and its
+	// acquire makes it reload the snapshot. The anonymous key is generated
+	// in that window.
+	e.anonymousKey = func() string {
+		if _, err := e.UpdateState(strings.Replace(config, `"gold"`, `"silver"`, 1)); err != nil {
+			t.Errorf("UpdateState failed: %v", err)
+		}
+		return "anon"
+	}
+	result, err := e.EvaluateFlag("targeting-flag", map[string]interface{}{"tier": "silver"})
 	if err != nil {
 		t.Fatalf("EvaluateFlag failed: %v", err)
 	}
-	if result.Value != nil {
-		t.Errorf("expected nil value for disabled flag, got %v", result.Value)
-	}
-	assertEqual(t, "DISABLED", result.Reason)
+	assertEqual(t, "on", result.Variant)
+	assertEqual(t, uint64(1), e.Stats().SnapshotReloads)
 }
 
-func TestConcurrentAccess(t *testing.T) {
+func TestEvaluationErrors(t *testing.T) {
 	e := newTestEvaluator(t)
-
 	config := `{
 		"flags": {
-			"concurrent-flag": {
+			"big-flag": {
 				"state": "ENABLED",
-				"defaultVariant": "on",
+				"defaultVariant": "off",
 				"variants": { "on": true, "off": false },
-				"targeting": {
-					"if": [
-						{ "==": [{ "var": "user" }, "admin"] },
-						"on", "off"
-					]
-				}
+				"targeting": { "if": [{ "==": [{ "var": "big" }, "x"] }, "on", "off"] }
 			}
 		}
 	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
 
-	_, err := e.UpdateState(config)
+	tests := []struct {
+		name     string
+		flagKey  string
+		ctx      map[string]interface{}
+		sentinel error
+		code     string
+	}{
+		{"context too large", "big-flag", map[string]interface{}{"big": strings.Repeat("x", 1<<20)}, ErrContextTooLarge, ErrorInvalidContext},
+		{"flag key too large", strings.Repeat("k", 300), nil, ErrFlagKeyTooLarge, ErrorGeneral},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := e.EvaluateFlag(tt.flagKey, tt.ctx)
+			if !errors.Is(err, tt.sentinel) {
+				t.Fatalf("expected %v, got %v", tt.sentinel, err)
+			}
+			var evalErr *EvaluationError
+			if !errors.As(err, &evalErr) {
+				t.Fatalf("expected *EvaluationError, got %T", err)
+			}
+			assertEqual(t, tt.flagKey, evalErr.FlagKey)
+			assertEqual(t, tt.code, evalErr.Code)
+		})
+	}
+
+	t.Run("flag not found in details", func(t *testing.T) {
+		d := e.EvaluateBoolDetails("missing", nil, false)
+		var evalErr *EvaluationError
+		if !errors.As(d.Err, &evalErr) {
+			t.Fatalf("expected *EvaluationError, got %v", d.Err)
+		}
+		assertEqual(t, ErrorFlagNotFound, evalErr.Code)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		e.Close()
+		_, err := e.EvaluateFlag("big-flag", nil)
+		if !errors.Is(err, ErrEvaluatorClosed) {
+			t.Fatalf("expected ErrEvaluatorClosed, got %v", err)
+		}
+		var evalErr *EvaluationError
+		if !errors.As(err, &evalErr) || evalErr.FlagKey != "big-flag" {
+			t.Errorf("expected *EvaluationError for big-flag, got %v", err)
+		}
+	})
+}
+
+func TestInstanceMaxEvals(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithInstanceMaxEvals(3))
 	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
 		t.Fatalf("UpdateState failed: %v", err)
 	}
 
-	var wg sync.WaitGroup
-	errs := make(chan error, 20)
+	premium := map[string]interface{}{"tier": "premium", "score": 95, "region": "us-east", "role": "admin"}
+	standard := map[string]interface{}{"department": "engineering", "experience": 7}
+	first := e.active.Load().pool.shards[0]
+	inst := <-first
+	first <- inst
 
-	for i := 0; i < 20; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			ctx := map[string]interface{}{"user": "admin"}
-			result, err := e.EvaluateFlag("concurrent-flag", ctx)
-			if err != nil {
-				errs <- err
-				return
-			}
-			if result.Value != true {
-				errs <- fmt.Errorf("goroutine %d: expected true, got %v", i, result.Value)
-			}
-		}(i)
+	// Results stay correct across every recycle boundary
+	for i := 0; i < 10; i++ {
+		assertEqual(t, "premium-tier", e.EvaluateString("big-flag", premium, "error"))
+		assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+	}
+	assertEqual(t, uint64(6), e.Stats().InstancesRecycled)
+	assertEqual(t, uint64(0), e.Stats().InstancesReplaced)
+	if current := <-first; current == inst {
+		t.Error("expected the instance to have been recycled")
+	} else {
+		first <- current
 	}
 
-	wg.Wait()
-	close(errs)
+	// Batches count every flag they evaluate, and a recycled instance
+	// carries the state of the generation it serves
+	if _, err := e.UpdateState(strings.Replace(bigTargetingConfig, `"standard-tier"`, `"standard-tier-v2"`, 1)); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	recycled := e.Stats().InstancesRecycled
+	for i := 0; i < 3; i++ {
+		results, err := e.EvaluateFlags([]string{"big-flag", "big-flag"}, standard)
+		if err != nil {
+			t.Fatalf("EvaluateFlags failed: %v", err)
+		}
+		assertEqual(t, "standard-tier-v2", results["big-flag"].Value)
+		assertEqual(t, "standard-tier-v2", e.EvaluateString("big-flag", standard, "error"))
+	}
+	if e.Stats().InstancesRecycled == recycled {
+		t.Error("expected batch evaluations to count towards recycling")
+	}
 
-	for err := range errs {
-		t.Errorf("concurrent error: %v", err)
+	if _, err := NewFlagEvaluator(WithInstanceMaxEvals(0)); err == nil {
+		t.Error("expected WithInstanceMaxEvals(0) to fail")
 	}
 }
 
-func TestTypedEvaluators(t *testing.T) {
-	e := newTestEvaluator(t)
+func TestWithLazyPool(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(3),
+		WithCompilationCache(testCompilationCache), WithLazyPool())
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	assertEqual(t, int32(0), e.pools[0].created.Load())
+
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	pool := e.active.Load().pool
+	assertEqual(t, int32(1), pool.created.Load())
+
+	// Sequential evaluations reuse the one instance
+	premium := map[string]interface{}{"tier": "premium", "score": 95, "region": "us-east", "role": "admin"}
+	standard := map[string]interface{}{"department": "engineering", "experience": 7}
+	for i := 0; i < 3; i++ {
+		assertEqual(t, "premium-tier", e.EvaluateString("big-flag", premium, "error"))
+	}
+	assertEqual(t, int32(1), pool.created.Load())
+
+	// Concurrent acquires grow the pool, and a grown instance is loaded
+	// with the live state
+	var held []*wasmInstance
+	for i := 0; i < 2; i++ {
+		_, inst, err := e.acquireInstance(context.Background())
+		if err != nil {
+			t.Fatalf("acquireInstance failed: %v", err)
+		}
+		held = append(held, inst)
+	}
+	assertEqual(t, int32(2), pool.created.Load())
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+	assertEqual(t, int32(3), pool.created.Load())
+
+	// Never past the pool size
+	_, inst, err := e.acquireInstance(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInstance failed: %v", err)
+	}
+	held = append(held, inst)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := e.acquireInstance(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the full pool to block, got %v", err)
+	}
+	assertEqual(t, int32(3), pool.created.Load())
+	set := e.active.Load()
+	for _, inst := range held {
+		e.releaseInstance(set, inst, nil)
+	}
+
+	// The standby set was never used, so the next update creates its
+	// instance from the active state and reports only the real change
+	v2 := strings.Replace(bigTargetingConfig, `"standard-tier"`, `"standard-tier-v2"`, 1)
+	result, err := e.UpdateState(v2)
+	if err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, fmt.Sprint([]string{"big-flag"}), fmt.Sprint(result.ChangedFlags))
+	assertEqual(t, "standard-tier-v2", e.EvaluateString("big-flag", standard, "error"))
+
+	// Swapping back onto the grown set keeps working
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+}
+
+func TestWithMaxPoolSize(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1), WithMaxPoolSize(3),
+		WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(bigTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, 1, e.Stats().CurrentPoolSize)
+
+	// An acquire that keeps waiting grows the pool, and a grown instance
+	// is loaded with the live state
+	var held []*wasmInstance
+	for i := 0; i < 2; i++ {
+		_, inst, err := e.acquireInstance(context.Background())
+		if err != nil {
+			t.Fatalf("acquireInstance failed: %v", err)
+		}
+		held = append(held, inst)
+	}
+	assertEqual(t, 2, e.Stats().CurrentPoolSize)
+	assertEqual(t, e.Generation(), held[1].generation)
+	standard := map[string]interface{}{"department": "engineering", "experience": 7}
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+	assertEqual(t, 3, e.Stats().CurrentPoolSize)
+
+	// Never past the max
+	_, inst, err := e.acquireInstance(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInstance failed: %v", err)
+	}
+	held = append(held, inst)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := e.acquireInstance(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the full pool to block, got %v", err)
+	}
+	assertEqual(t, 3, e.Stats().CurrentPoolSize)
 
+	// Extra instances stay while the pool has recently been contended
+	set := e.active.Load()
+	for _, inst := range held {
+		e.releaseInstance(set, inst, nil)
+	}
+	assertEqual(t, 3, e.Stats().CurrentPoolSize)
+	assertEqual(t, 3, e.Stats().AvailableInstances)
+
+	// After the cooldown, each release closes one, down to the pool size
+	e.lastPoolWait.Store(0)
+	for _, want := range []int{2, 1, 1} {
+		set, inst, err := e.acquireInstance(context.Background())
+		if err != nil {
+			t.Fatalf("acquireInstance failed: %v", err)
+		}
+		e.releaseInstance(set, inst, nil)
+		assertEqual(t, want, e.Stats().CurrentPoolSize)
+	}
+	assertEqual(t, 1, e.Stats().AvailableInstances)
+	assertEqual(t, "standard-tier", e.EvaluateString("big-flag", standard, "error"))
+
+	if _, err := NewFlagEvaluator(WithMaxPoolSize(0)); err == nil {
+		t.Error("expected WithMaxPoolSize(0) to fail")
+	}
+	if _, err := NewFlagEvaluator(WithPoolSize(2), WithMaxPoolSize(1)); err == nil {
+		t.Error("expected a max pool size below the pool size to fail")
+	}
+}
+
+func TestCompiledModuleShared(t *testing.T) {
+	cm, err := Compile(WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	t.Cleanup(func() { cm.Close() })
+
+	// Each evaluator keeps its own clock, including for the host function
+	// the shared module reads the time through
 	config := `{
 		"flags": {
-			"bool-flag": {
-				"state": "ENABLED",
-				"defaultVariant": "on",
-				"variants": { "on": true, "off": false }
-			},
-			"string-flag": {
-				"state": "ENABLED",
-				"defaultVariant": "hello",
-				"variants": { "hello": "world" }
-			},
-			"int-flag": {
+			"whole-context-flag": {
 				"state": "ENABLED",
-				"defaultVariant": "val",
-				"variants": { "val": 42 }
-			},
-			"float-flag": {
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "!!": [{ "var": "" }] }, { "var": "$flagd.flagKey" }] }, "on", "off"] }
+			}
+		}
+	}`
+	var ticks [2]atomic.Int32
+	evaluators := make([]*FlagEvaluator, 2)
+	for i := range evaluators {
+		e, err := NewFlagEvaluatorFromCompiled(cm, WithPermissiveValidation(), WithPoolSize(2),
+			WithClock(func() time.Time { ticks[i].Add(1); return time.Now() }))
+		if err != nil {
+			t.Fatalf("NewFlagEvaluatorFromCompiled failed: %v", err)
+		}
+		evaluators[i] = e
+	}
+	e1, e2 := evaluators[0], evaluators[1]
+	t.Cleanup(func() { e2.Close() })
+	if _, err := e1.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	if _, err := e2.UpdateState(simpleTargetingConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	before := ticks[0].Load()
+	assertEqual(t, "on", e1.EvaluateString("whole-context-flag", map[string]interface{}{"a": 1}, "error"))
+	assertEqual(t, int32(2), ticks[0].Load()-before)
+	assertEqual(t, int32(0), ticks[1].Load())
+
+	// Each evaluator serves its own state
+	assertEqual(t, "error", e2.EvaluateString("whole-context-flag", nil, "error"))
+	if result, err := e2.EvaluateFlag("targeting-flag", smallCtx); err != nil || result.IsError() {
+		t.Errorf("unexpected result %+v, %v", result, err)
+	}
+
+	// Closing an evaluator leaves the module usable by the others and by
+	// new ones
+	if err := e1.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if result, err := e2.EvaluateFlag("targeting-flag", smallCtx); err != nil || result.IsError() {
+		t.Errorf("unexpected result after closing e1: %+v, %v", result, err)
+	}
+	e3, err := NewFlagEvaluatorFromCompiled(cm, WithPermissiveValidation(), WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("NewFlagEvaluatorFromCompiled failed: %v", err)
+	}
+	defer e3.Close()
+	if _, err := e3.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	assertEqual(t, "on", e3.EvaluateString("whole-context-flag", map[string]interface{}{"a": 1}, "error"))
+
+	// Runtime and module options belong to Compile
+	if _, err := NewFlagEvaluatorFromCompiled(cm, WithInterpreter()); err == nil {
+		t.Error("expected WithInterpreter to be rejected")
+	}
+	if _, err := NewFlagEvaluatorFromCompiled(nil); err == nil {
+		t.Error("expected a nil module to be rejected")
+	}
+}
+
+func TestTrappedInstanceIsReplaced(t *testing.T) {
+	// The clock is called once host-side to serialize $flagd.timestamp and
+	// then by the WASM module through a host import. Panicking on that second
+	// call makes the host function throw inside the WASM call, like
+	// __wbindgen_throw does.
+	var armed atomic.Int32
+	clock := func() time.Time {
+		if armed.Load() > 0 && armed.Add(-1) == 0 {
+			panic("injected trap")
+		}
+		return time.Now()
+	}
+
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(2),
+		WithCompilationCache(testCompilationCache), WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	// A whole-context rule evaluates through evaluate_reusable, which always
+	// reads the time from the host. Referencing $flagd makes the host read
+	// the clock first when enriching the context.
+	config := `{
+		"flags": {
+			"whole-context-flag": {
 				"state": "ENABLED",
-				"defaultVariant": "val",
-				"variants": { "val": 3.14 }
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "!!": [{ "var": "" }] }, { "var": "$flagd.flagKey" }] }, "on", "off"] }
 			}
 		}
 	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
 
-	_, err := e.UpdateState(config)
+	// poolInstances lists the idle instances of the active set
+	set := e.active.Load()
+	poolInstances := func() []*wasmInstance {
+		var instances []*wasmInstance
+		set.pool.drain(nil, func(inst *wasmInstance) {
+			instances = append(instances, inst)
+		})
+		for _, inst := range instances {
+			set.pool.put(inst)
+		}
+		return instances
+	}
+	before := make(map[*wasmInstance]bool)
+	for _, inst := range poolInstances() {
+		before[inst] = true
+	}
+
+	armed.Store(2)
+	_, err = e.EvaluateFlag("whole-context-flag", smallCtx)
+	if !errors.Is(err, ErrWasmTrap) {
+		t.Fatalf("expected ErrWasmTrap, got %v", err)
+	}
+
+	// Pool size is restored with one fresh instance carrying the live state
+	after := poolInstances()
+	assertEqual(t, e.poolSize, len(after))
+	assertEqual(t, uint64(1), e.Stats().InstancesReplaced)
+	replaced := 0
+	for _, inst := range after {
+		if !before[inst] {
+			replaced++
+			assertEqual(t, set.snap.generation, inst.generation)
+		}
+	}
+	assertEqual(t, 1, replaced)
+
+	// Every instance, including the replacement, evaluates correctly
+	for i := 0; i < 2*e.poolSize; i++ {
+		assertEqual(t, "on", e.EvaluateString("whole-context-flag", smallCtx, "error"))
+	}
+}
+
+func TestWithEvaluationTimeout(t *testing.T) {
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithEvaluationTimeout(10*time.Millisecond))
 	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	config := `{
+		"flags": {
+			"slow-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": true, "off": false },
+				"targeting": { "if": [{ ">": [{ "reduce": [{ "var": "xs" }, { "+": [{ "var": "current" }, { "var": "accumulator" }] }, 0] }, 0] }, "on", "off"] }
+			},
+			"fast-flag": { "state": "ENABLED", "defaultVariant": "on", "variants": { "on": true, "off": false } }
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
 		t.Fatalf("UpdateState failed: %v", err)
 	}
 
-	ctx := map[string]interface{}{}
+	// Summing this many numbers takes well over the timeout
+	xs := make([]interface{}, 100000)
+	for i := range xs {
+		xs[i] = i
+	}
+	_, err = e.EvaluateFlag("slow-flag", map[string]interface{}{"xs": xs})
+	if !errors.Is(err, ErrEvaluationTimeout) {
+		t.Fatalf("expected ErrEvaluationTimeout, got %v", err)
+	}
+	assertEqual(t, uint64(1), e.Stats().InstancesReplaced)
 
-	if v := e.EvaluateBool("bool-flag", ctx, false); v != true {
-		t.Errorf("EvaluateBool: expected true, got %v", v)
+	// The replacement instance carries the live state
+	for _, flagKey := range []string{"fast-flag", "slow-flag"} {
+		result, err := e.EvaluateFlag(flagKey, map[string]interface{}{"xs": []interface{}{1}})
+		if err != nil {
+			t.Fatalf("%s: EvaluateFlag failed: %v", flagKey, err)
+		}
+		assertEqual(t, true, result.Value)
 	}
-	if v := e.EvaluateString("string-flag", ctx, "default"); v != "world" {
-		t.Errorf("EvaluateString: expected 'world', got %v", v)
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, err := NewFlagEvaluator(WithEvaluationTimeout(d)); err == nil {
+			t.Errorf("WithEvaluationTimeout(%s): expected error", d)
+		}
 	}
-	if v := e.EvaluateInt("int-flag", ctx, 0); v != 42 {
-		t.Errorf("EvaluateInt: expected 42, got %v", v)
+
+	// A shared module must be compiled to honour the timeout
+	cm, err := Compile(WithCompilationCache(testCompilationCache))
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
 	}
-	if v := e.EvaluateFloat("float-flag", ctx, 0); v != 3.14 {
-		t.Errorf("EvaluateFloat: expected 3.14, got %v", v)
+	t.Cleanup(func() { cm.Close() })
+	if _, err := NewFlagEvaluatorFromCompiled(cm, WithEvaluationTimeout(time.Second)); err == nil {
+		t.Error("expected WithEvaluationTimeout without it in Compile to fail")
 	}
+}
 
-	// Test defaults for missing flags
-	if v := e.EvaluateBool("missing", ctx, true); v != true {
-		t.Errorf("EvaluateBool default: expected true, got %v", v)
+func TestWithLogger(t *testing.T) {
+	var armed atomic.Int32
+	clock := func() time.Time {
+		if armed.Load() > 0 && armed.Add(-1) == 0 {
+			panic("injected trap")
+		}
+		return time.Now()
 	}
-	if v := e.EvaluateString("missing", ctx, "fallback"); v != "fallback" {
-		t.Errorf("EvaluateString default: expected 'fallback', got %v", v)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	e, err := NewFlagEvaluator(WithPermissiveValidation(), WithPoolSize(1),
+		WithCompilationCache(testCompilationCache), WithClock(clock),
+		WithMaxContextSize(256), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
 	}
-	if v := e.EvaluateInt("missing", ctx, 99); v != 99 {
-		t.Errorf("EvaluateInt default: expected 99, got %v", v)
+	t.Cleanup(func() { e.Close() })
+
+	// Validation warnings, with the same trap trigger as
+	// TestTrappedInstanceIsReplaced
+	config := `{
+		"flags": {
+			"whole-context-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "and": [{ "!!": [{ "var": "" }] }, { "var": "$flagd.flagKey" }] }, "on", "off"] }
+			},
+			"bogus-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "on",
+				"variants": { "on": true },
+				"targeting": { "bogus_op": [1] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
 	}
-	if v := e.EvaluateFloat("missing", ctx, 1.5); v != 1.5 {
-		t.Errorf("EvaluateFloat default: expected 1.5, got %v", v)
+	armed.Store(2)
+	if _, err := e.EvaluateFlag("whole-context-flag", smallCtx); !errors.Is(err, ErrWasmTrap) {
+		t.Fatalf("expected ErrWasmTrap, got %v", err)
+	}
+	if _, err := e.EvaluateFlag("whole-context-flag", map[string]interface{}{"big": strings.Repeat("x", 512)}); !errors.Is(err, ErrContextTooLarge) {
+		t.Fatalf("expected ErrContextTooLarge, got %v", err)
+	}
+
+	// A slow acquire
+	set, inst, err := e.acquireInstance(context.Background())
+	if err != nil {
+		t.Fatalf("acquireInstance failed: %v", err)
+	}
+	go func() {
+		time.Sleep(slowPoolWait + 20*time.Millisecond)
+		e.releaseInstance(set, inst, nil)
+	}()
+	assertEqual(t, "on", e.EvaluateString("whole-context-flag", smallCtx, "error"))
+
+	// Metadata arrays are outside the fast parser's shapes
+	if _, err := e.decodeEvalResult("meta-flag", []byte(`{"value":true,"reason":"STATIC","flagMetadata":{"tags":["a"]}}`)); err != nil {
+		t.Fatalf("decodeEvalResult failed: %v", err)
+	}
+
+	for _, want := range []string{
+		`level=WARN msg="config applied with validation warnings"`,
+		`level=WARN msg="WASM trap during evaluation, instance replaced"`,
+		`level=WARN msg="evaluation context rejected" flagKey=whole-context-flag`,
+		`level=WARN msg="slow wait for a pool instance"`,
+		`level=DEBUG msg="evaluation result not recognized by the fast parser, falling back to encoding/json" flagKey=meta-flag`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected log containing %q, got:\n%s", want, logs.String())
+		}
+	}
+
+	// Silent by default
+	quiet := newTestEvaluator(t)
+	if quiet.logger == nil || quiet.logger.Enabled(context.Background(), slog.LevelError) {
+		t.Error("expected the default logger to discard records")
 	}
 }
 
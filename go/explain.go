@@ -0,0 +1,637 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EvaluationExplanation describes how a flag's targeting arrived at its
+// result.
+type EvaluationExplanation struct {
+	// Result is the flag's evaluation result, as returned by EvaluateFlag.
+	Result *EvaluationResult `json:"result"`
+
+	// Trace lists the operations of the targeting rule in the order they
+	// were evaluated, each after its operands. Branches that short-circuit
+	// evaluation skipped are absent, so the trace follows the path through
+	// the rule that matched. The last step is the rule itself. Empty for
+	// flags without targeting.
+	Trace []ExplanationStep `json:"trace"`
+
+	// TraceError is set if the trace stopped early, at an operation the host
+	// cannot evaluate or one that fails.
+	TraceError string `json:"traceError,omitempty"`
+}
+
+// ExplanationStep is one evaluated operation of a targeting rule.
+type ExplanationStep struct {
+	// Path is a JSON Pointer to the operation within the flag's targeting,
+	// with $ref references to shared evaluators resolved.
+	Path string `json:"path"`
+
+	Operator string      `json:"operator"`
+	Result   interface{} `json:"result"`
+	Truthy   bool        `json:"truthy"`
+}
+
+// ExplainFlag evaluates flagKey and traces which operations of its targeting
+// rule matched. The trace comes from evaluating the rule host-side for
+// explanation only; the result is the module's. It supports the common
+// JSONLogic operations and flagd's fractional, sem_ver, starts_with and
+// ends_with; others end the trace with TraceError. If the configuration
+// changes during the call, the trace may describe a newer generation than
+// the result.
+func (e *FlagEvaluator) ExplainFlag(flagKey string, ctx map[string]interface{}) (*EvaluationExplanation, error) {
+	// The trace must see the key the evaluation used
+	ctx, _ = e.withAnonymousKey(ctx)
+	result, err := e.EvaluateFlag(flagKey, ctx)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &EvaluationExplanation{Result: result, Trace: []ExplanationStep{}}
+
+	snap := e.active.Load().snap
+	if _, ok := snap.preEvaluated[flagKey]; ok {
+		return explanation, nil
+	}
+	rule, ok := snap.targetingRule(flagKey)
+	if !ok {
+		return explanation, nil
+	}
+	t := &ruleTracer{data: e.ruleData(snap, flagKey, ctx)}
+	if _, err := t.eval(rule, ""); err != nil {
+		explanation.TraceError = err.Error()
+	}
+	explanation.Trace = t.trace
+	return explanation, nil
+}
+
+// ruleData returns the data flagKey's targeting is evaluated against: ctx
+// over the default context, with $flagd as the module's enrichment sets it.
+func (e *FlagEvaluator) ruleData(snap *cacheSnapshot, flagKey string, ctx map[string]interface{}) map[string]interface{} {
+	flagd := map[string]interface{}{}
+	if e.needsEnrichment(snap, flagKey) {
+		flagd["flagKey"] = flagKey
+		flagd["timestamp"] = e.clock().Unix()
+	}
+	return withFlagd(mergeContext(ctx, e.loadDefaultContext(), e.targetingKeyField), flagd)
+}
+
+// ruleTracer is a host-side JSONLogic interpreter recording each operation
+// it evaluates.
+type ruleTracer struct {
+	data  map[string]interface{}
+	trace []ExplanationStep
+}
+
+func (t *ruleTracer) eval(expr interface{}, path string) (interface{}, error) {
+	switch v := expr.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			val, err := t.eval(item, path+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = val
+		}
+		return out, nil
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return nil, fmt.Errorf("%s: operation must have exactly one operator", path)
+		}
+		for op, args := range v {
+			val, err := t.evalOp(op, args, path+"/"+escapePointer(op))
+			if err != nil {
+				return nil, err
+			}
+			t.trace = append(t.trace, ExplanationStep{Path: path, Operator: op, Result: val, Truthy: truthy(val)})
+			return val, nil
+		}
+	}
+	return expr, nil
+}
+
+// evalOp evaluates operator op. argsPath is the JSON Pointer of its
+// arguments.
+func (t *ruleTracer) evalOp(op string, rawArgs interface{}, argsPath string) (interface{}, error) {
+	args, ok := rawArgs.([]interface{})
+	if !ok {
+		args = []interface{}{rawArgs}
+	}
+	arg := func(i int) (interface{}, error) {
+		if i >= len(args) {
+			return nil, nil
+		}
+		if ok {
+			return t.eval(args[i], argsPath+"/"+strconv.Itoa(i))
+		}
+		return t.eval(args[i], argsPath)
+	}
+	all := func() ([]interface{}, error) {
+		vals := make([]interface{}, len(args))
+		for i := range args {
+			val, err := arg(i)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		return vals, nil
+	}
+
+	switch op {
+	case "var":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 || vals[0] == nil || vals[0] == "" {
+			return t.data, nil
+		}
+		path, isString := vals[0].(string)
+		if !isString {
+			if n, isNum := vals[0].(json.Number); isNum {
+				path = n.String()
+			} else {
+				return nil, fmt.Errorf("var: unsupported path %v", vals[0])
+			}
+		}
+		if val, found := lookupContextPath(t.data, nil, path); found && val != nil {
+			return val, nil
+		}
+		if len(vals) > 1 {
+			return vals[1], nil
+		}
+		return nil, nil
+
+	case "missing":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 1 {
+			if list, isArray := vals[0].([]interface{}); isArray {
+				vals = list
+			}
+		}
+		missing := []interface{}{}
+		for _, key := range vals {
+			s, _ := key.(string)
+			if val, found := lookupContextPath(t.data, nil, s); !found || val == nil || val == "" {
+				missing = append(missing, key)
+			}
+		}
+		return missing, nil
+
+	case "if", "?:":
+		for i := 0; i+1 < len(args); i += 2 {
+			cond, err := arg(i)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(cond) {
+				return arg(i + 1)
+			}
+		}
+		if len(args)%2 == 1 {
+			return arg(len(args) - 1)
+		}
+		return nil, nil
+
+	case "and", "or":
+		var val interface{} = false
+		for i := range args {
+			var err error
+			if val, err = arg(i); err != nil {
+				return nil, err
+			}
+			if truthy(val) == (op == "or") {
+				return val, nil
+			}
+		}
+		return val, nil
+
+	case "!", "!!":
+		val, err := arg(0)
+		if err != nil {
+			return nil, err
+		}
+		return truthy(val) == (op == "!!"), nil
+
+	case "==", "!=", "===", "!==":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) < 2 {
+			return nil, fmt.Errorf("%s: requires two arguments", op)
+		}
+		negate := op[0] == '!'
+		if op == "===" || op == "!==" {
+			return negate != strictEqual(vals[0], vals[1]), nil
+		}
+		return negate != looseEqual(vals[0], vals[1]), nil
+
+	case "<", "<=", ">", ">=":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) < 2 || len(vals) > 3 || len(vals) == 3 && op[0] == '>' {
+			return nil, fmt.Errorf("%s: unsupported number of arguments", op)
+		}
+		for i := 0; i+1 < len(vals); i++ {
+			if !compare(op, vals[i], vals[i+1]) {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case "in":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) < 2 {
+			return nil, fmt.Errorf("in: requires two arguments")
+		}
+		switch haystack := vals[1].(type) {
+		case string:
+			needle, isString := vals[0].(string)
+			return isString && strings.Contains(haystack, needle), nil
+		case []interface{}:
+			for _, item := range haystack {
+				if strictEqual(vals[0], item) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "cat":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		for _, val := range vals {
+			b.WriteString(stringify(val))
+		}
+		return b.String(), nil
+
+	case "starts_with", "ends_with":
+		vals, err := all()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) < 2 {
+			return nil, fmt.Errorf("%s: requires two arguments", op)
+		}
+		s, sOK := vals[0].(string)
+		affix, affixOK := vals[1].(string)
+		if !sOK || !affixOK {
+			return false, nil
+		}
+		if op == "starts_with" {
+			return strings.HasPrefix(s, affix), nil
+		}
+		return strings.HasSuffix(s, affix), nil
+
+	case "sem_ver":
+		// The module resolves sem_ver operands itself rather than evaluating
+		// them as expressions
+		if len(args) < 3 {
+			return nil, fmt.Errorf("sem_ver: requires three arguments")
+		}
+		version, err := t.semVerOperand(args[0])
+		if err != nil {
+			return nil, err
+		}
+		cmp, isString := args[1].(string)
+		if !isString {
+			return nil, fmt.Errorf("sem_ver: operator must be a string")
+		}
+		target, err := t.semVerOperand(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return semVerMatch(version, cmp, target), nil
+
+	case "fractional":
+		variant, _, err := fractionalBucket(rawArgs, t.data)
+		if err != nil {
+			return nil, fmt.Errorf("fractional: %w", err)
+		}
+		return variant, nil
+	}
+	return nil, fmt.Errorf("unsupported operation %q", op)
+}
+
+// semVerOperand resolves a sem_ver operand the way the module does: a
+// literal, or a var naming a string or number in the data.
+func (t *ruleTracer) semVerOperand(operand interface{}) (string, error) {
+	if m, ok := operand.(map[string]interface{}); ok {
+		path, isString := m["var"].(string)
+		if !isString {
+			return "", fmt.Errorf("sem_ver: var reference must be a string")
+		}
+		val, found := lookupContextPath(t.data, nil, path)
+		if !found {
+			return "", fmt.Errorf("sem_ver: variable %q not found", path)
+		}
+		operand = val
+		if _, isMap := val.(map[string]interface{}); isMap {
+			return "", fmt.Errorf("sem_ver: variable %q must be a string or number", path)
+		}
+	}
+	switch v := operand.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, []interface{}, map[string]interface{}:
+		return "", fmt.Errorf("sem_ver: unsupported operand %v", v)
+	}
+	if _, ok := toNumber(operand); !ok {
+		return "", fmt.Errorf("sem_ver: unsupported operand %v", operand)
+	}
+	return stringify(operand), nil
+}
+
+// semVerMatch mirrors the module's sem_ver operator. Versions that don't
+// parse never match.
+func semVerMatch(version, op, target string) bool {
+	v, ok := parseSemVer(version)
+	if !ok {
+		return false
+	}
+	tv, ok := parseSemVer(target)
+	if !ok {
+		return false
+	}
+	c := v.compare(tv)
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "^":
+		switch {
+		case c < 0:
+			return false
+		case tv.major == 0 && tv.minor == 0:
+			return v.major == 0 && v.minor == 0 && v.patch == tv.patch
+		case tv.major == 0:
+			return v.major == 0 && v.minor == tv.minor
+		}
+		return v.major == tv.major
+	case "~":
+		return c >= 0 && v.major == tv.major && v.minor == tv.minor
+	}
+	return false
+}
+
+type semVer struct {
+	major, minor, patch uint64
+	prerelease          *string
+}
+
+func parseSemVer(s string) (semVer, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return semVer{}, false
+	}
+	if s[0] == 'v' || s[0] == 'V' {
+		s = s[1:]
+	}
+	s, _, _ = strings.Cut(s, "+")
+	var v semVer
+	if core, pre, ok := strings.Cut(s, "-"); ok {
+		s, v.prerelease = core, &pre
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return semVer{}, false
+	}
+	nums := []*uint64{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semVer{}, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+func (v semVer) compare(o semVer) int {
+	for _, d := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == nil && o.prerelease == nil:
+		return 0
+	case v.prerelease == nil:
+		return 1
+	case o.prerelease == nil:
+		return -1
+	}
+	a, b := strings.Split(*v.prerelease, "."), strings.Split(*o.prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		an, aErr := strconv.ParseUint(a[i], 10, 64)
+		bn, bErr := strconv.ParseUint(b[i], 10, 64)
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareUint(an, bn)
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(a[i], b[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(a)), uint64(len(b)))
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// truthy follows JSONLogic truthiness: false, null, 0, "" and [] are false.
+func truthy(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case string:
+		return val != ""
+	case []interface{}:
+		return len(val) > 0
+	case map[string]interface{}:
+		return true
+	}
+	if n, ok := toNumber(v); ok {
+		return n != 0 && !math.IsNaN(n)
+	}
+	return true
+}
+
+// toNumber converts a JSON or Go numeric value to float64.
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// coerceNumber converts v to a number as JavaScript's loose comparisons do.
+func coerceNumber(v interface{}) float64 {
+	switch val := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if val {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(val)
+		if s == "" {
+			return 0
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	if n, ok := toNumber(v); ok {
+		return n
+	}
+	return math.NaN()
+}
+
+func strictEqual(a, b interface{}) bool {
+	an, aNum := toNumber(a)
+	bn, bNum := toNumber(b)
+	if aNum || bNum {
+		return aNum && bNum && an == bn
+	}
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case bool, string:
+		return a == b
+	default:
+		return reflect.DeepEqual(av, b)
+	}
+}
+
+func looseEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	as, aStr := a.(string)
+	bs, bStr := b.(string)
+	if aStr && bStr {
+		return as == bs
+	}
+	if _, aNum := toNumber(a); !aNum && !aStr {
+		if _, isBool := a.(bool); !isBool {
+			return strictEqual(a, b)
+		}
+	}
+	return coerceNumber(a) == coerceNumber(b)
+}
+
+func compare(op string, a, b interface{}) bool {
+	as, aStr := a.(string)
+	bs, bStr := b.(string)
+	var c int
+	if aStr && bStr {
+		c = strings.Compare(as, bs)
+	} else {
+		an, bn := coerceNumber(a), coerceNumber(b)
+		if math.IsNaN(an) || math.IsNaN(bn) {
+			return false
+		}
+		switch {
+		case an < bn:
+			c = -1
+		case an > bn:
+			c = 1
+		}
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// stringify renders v as cat does: strings as is, null as "", anything else
+// as JSON.
+func stringify(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
@@ -1,7 +1,9 @@
 package evaluator
 
 import (
+	"bytes"
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -137,3 +139,130 @@ func TestParseEvalResult_MetadataTypes(t *testing.T) {
 		t.Errorf("bool_f: got %v, want false", got.FlagMetadata["bool_f"])
 	}
 }
+
+func TestParseEvalResult_Escapes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"newline", []byte(`{"value":"line1\nline2","variant":"on","reason":"STATIC"}`)},
+		{"quote", []byte(`{"value":"quote \" here","variant":"on","reason":"STATIC"}`)},
+		{"backslash and slash", []byte(`{"value":"C:\\path\/to","variant":"on","reason":"STATIC"}`)},
+		{"control", []byte(`{"value":"tab\there\r\b\f","variant":"on","reason":"STATIC"}`)},
+		{"unicode", []byte(`{"value":"caf\u00e9 \u4e16","variant":"v\u00e9","reason":"STATIC"}`)},
+		{"surrogate pair", []byte(`{"value":"smile \ud83d\ude00","variant":"on","reason":"STATIC"}`)},
+		{"lone surrogate", []byte(`{"value":"bad \ud83d end","variant":"on","reason":"STATIC"}`)},
+		{"error message", []byte(`{"reason":"ERROR","errorCode":"GENERAL","errorMessage":"unexpected \"token\"\n"}`)},
+		{"metadata", []byte(`{"value":true,"variant":"on","reason":"STATIC","flagMetadata":{"desc":"say \"hi\"\n","k\u00e9y":"v"}}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want EvaluationResult
+			if err := json.Unmarshal(tt.data, &want); err != nil {
+				t.Fatalf("encoding/json failed: %v", err)
+			}
+
+			got, err := parseEvalResult(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			wantJSON, _ := json.Marshal(want)
+			gotJSON, _ := json.Marshal(got)
+			if string(wantJSON) != string(gotJSON) {
+				t.Errorf("mismatch:\n  want: %s\n  got:  %s", wantJSON, gotJSON)
+			}
+		})
+	}
+}
+
+func TestParseEvalResult_IntegerPrecision(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"fast path", []byte(`{"value":9007199254740993,"variant":"id","reason":"STATIC"}`)},
+		// null variant is not handled by the fast path and forces the fallback
+		{"fallback", []byte(`{"value":9007199254740993,"variant":null,"reason":"STATIC"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEvalResult(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Value != int64(9007199254740993) {
+				t.Errorf("value: got %v (%T), want 9007199254740993 (int64)", got.Value, got.Value)
+			}
+		})
+	}
+
+	got, err := parseEvalResult([]byte(`{"value":1e3,"variant":"v","reason":"STATIC"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Value != float64(1000) {
+		t.Errorf("exponent value: got %v (%T), want 1000 (float64)", got.Value, got.Value)
+	}
+
+	// Numbers nested in object values follow the same rules
+	for name, data := range map[string][]byte{
+		"nested fast path": []byte(`{"value":{"limit":10000000000000001,"ratio":0.5,"ids":[9007199254740993]},"variant":"cfg","reason":"STATIC"}`),
+		"nested fallback":  []byte(`{"value":{"limit":10000000000000001,"ratio":0.5,"ids":[9007199254740993]},"variant":null,"reason":"STATIC"}`),
+	} {
+		got, err := parseEvalResult(data)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		obj, ok := got.Value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: value: got %T, want an object", name, got.Value)
+		}
+		if obj["limit"] != int64(10000000000000001) {
+			t.Errorf("%s: limit: got %v (%T), want 10000000000000001 (int64)", name, obj["limit"], obj["limit"])
+		}
+		if obj["ratio"] != 0.5 {
+			t.Errorf("%s: ratio: got %v (%T), want 0.5 (float64)", name, obj["ratio"], obj["ratio"])
+		}
+		if ids, _ := obj["ids"].([]interface{}); len(ids) != 1 || ids[0] != int64(9007199254740993) {
+			t.Errorf("%s: ids: got %v, want [9007199254740993] of int64", name, obj["ids"])
+		}
+	}
+}
+
+// FuzzParseEvalResult checks that parseEvalResult never panics on arbitrary
+// module output and agrees with encoding/json whenever that accepts it.
+func FuzzParseEvalResult(f *testing.F) {
+	for _, seed := range [][]byte{
+		boolResult, stringResult, metaResult, errorResult, numberResult,
+		[]byte(`{"value":{"nested":[1,"two",null]},"variant":"obj","reason":"STATIC"}`),
+		[]byte(`{"value":null,"reason":"DEFAULT","extra":[true,false,null,{"a":"}"}]}`),
+		[]byte(`{"value":trux,"variant":"on"}`),
+		[]byte(`{"value":fals`),
+		[]byte(`{"value":["\`),
+		[]byte(`{"VALUE":true,"Variant":"on","reason":"STATIC"}`),
+		[]byte(`{"value":"caf` + "\xff" + `","variant":"on"}`),
+		[]byte(`{"value" x : 1}`),
+		[]byte(`{"flagMetadata":{"a":tru}}`),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		got, gotErr := parseEvalResult(data)
+		want, err := unmarshalEvalResult(data)
+		if err != nil {
+			return
+		}
+		if gotErr != nil {
+			t.Fatalf("parseEvalResult(%q) failed where encoding/json succeeded: %v", data, gotErr)
+		}
+		if !bytes.Equal(bytes.TrimSpace(got.rawValue), bytes.TrimSpace(want.rawValue)) {
+			t.Errorf("parseEvalResult(%q) raw value = %q, want %q", data, got.rawValue, want.rawValue)
+		}
+		gotCopy, wantCopy := *got, *want
+		gotCopy.rawValue, wantCopy.rawValue = nil, nil
+		if !reflect.DeepEqual(gotCopy, wantCopy) {
+			t.Errorf("parseEvalResult(%q) = %+v, want %+v", data, gotCopy, wantCopy)
+		}
+	})
+}
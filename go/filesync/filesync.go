@@ -0,0 +1,159 @@
+// Package filesync keeps a FlagEvaluator in sync with a flagd JSON file, the
+// usual shape of a flagd deployment where flags come from a mounted ConfigMap.
+//
+// It lives in its own package so that users of the evaluator who don't load
+// flags from files don't import fsnotify.
+//
+//	go func() {
+//		if err := filesync.WatchFile(ctx, e, "/etc/flagd/flags.json"); err != nil && !errors.Is(err, context.Canceled) {
+//			log.Fatal(err)
+//		}
+//	}()
+package filesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+)
+
+// DefaultDebounce is how long WatchFile waits after the last change event
+// before reloading, so a burst of writes is applied once.
+const DefaultDebounce = 100 * time.Millisecond
+
+// Option configures WatchFile.
+type Option func(*config)
+
+type config struct {
+	debounce time.Duration
+	onError  func(error)
+	onReload func(*evaluator.UpdateStateResult)
+}
+
+// WithDebounce sets the delay between the last change event and the reload.
+// Defaults to DefaultDebounce.
+func WithDebounce(d time.Duration) Option {
+	return func(c *config) {
+		c.debounce = d
+	}
+}
+
+// WithErrorHandler receives reload and watch errors. The previously applied
+// flags stay in effect after an error. Defaults to logging with the standard
+// logger.
+func WithErrorHandler(fn func(error)) Option {
+	return func(c *config) {
+		c.onError = fn
+	}
+}
+
+// WithReloadHandler is called after each successful reload, including reloads
+// UpdateState skipped because the file content did not change.
+func WithReloadHandler(fn func(*evaluator.UpdateStateResult)) Option {
+	return func(c *config) {
+		c.onReload = fn
+	}
+}
+
+// WatchFile loads path into e, then re-applies it whenever it changes until ctx
+// is done. An error loading the file initially is returned straight away;
+// later failures, such as a file that is briefly missing or fails to parse,
+// go to the error handler and leave the previous flags in effect.
+//
+// The file's directory is watched rather than the file itself, so atomic
+// replacements by editors and Kubernetes ConfigMap symlink swaps are picked up.
+//
+// WatchFile blocks. It returns ctx.Err() when ctx is done, or
+// evaluator.ErrEvaluatorClosed once e has been closed.
+func WatchFile(ctx context.Context, e *evaluator.FlagEvaluator, path string, opts ...Option) error {
+	cfg := &config{
+		debounce: DefaultDebounce,
+		onError:  func(err error) { log.Printf("filesync: %v", err) },
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	path = filepath.Clean(path)
+	if err := load(e, path, cfg); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("filesync: failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("filesync: failed to watch %s: %w", filepath.Dir(path), err)
+	}
+
+	// realPath tracks the symlink target so a ConfigMap update, which only
+	// swaps a symlink elsewhere in the directory, is noticed.
+	realPath, _ := filepath.EvalSymlinks(path)
+
+	timer := time.NewTimer(cfg.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			target, _ := filepath.EvalSymlinks(path)
+			if filepath.Clean(event.Name) != path && target == realPath {
+				continue
+			}
+			realPath = target
+			timer.Reset(cfg.debounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			cfg.onError(fmt.Errorf("filesync: watch error: %w", err))
+
+		case <-timer.C:
+			if err := load(e, path, cfg); err != nil {
+				if errors.Is(err, evaluator.ErrEvaluatorClosed) {
+					return err
+				}
+				cfg.onError(err)
+			}
+		}
+	}
+}
+
+// load reads path and applies it to e.
+func load(e *evaluator.FlagEvaluator, path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("filesync: %w", err)
+	}
+	result, err := e.UpdateState(string(data))
+	if err != nil {
+		if errors.Is(err, evaluator.ErrEvaluatorClosed) {
+			return err
+		}
+		return fmt.Errorf("filesync: failed to apply %s: %w", path, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("filesync: failed to apply %s: %s", path, result.Error)
+	}
+	if cfg.onReload != nil {
+		cfg.onReload(result)
+	}
+	return nil
+}
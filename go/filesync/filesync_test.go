@@ -0,0 +1,182 @@
+package filesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+)
+
+func flagConfig(value string) string {
+	return fmt.Sprintf(`{
+		"flags": {
+			"color": {
+				"state": "ENABLED",
+				"defaultVariant": "current",
+				"variants": { "current": %q }
+			}
+		}
+	}`, value)
+}
+
+// watch starts WatchFile on path and returns channels fed by its reload and
+// error handlers, and one receiving its return value.
+func watch(t *testing.T, e *evaluator.FlagEvaluator, path string) (reloads chan struct{}, errs chan error, done chan error, cancel func()) {
+	t.Helper()
+	reloads = make(chan struct{}, 16)
+	errs = make(chan error, 16)
+	done = make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		done <- WatchFile(ctx, e, path,
+			WithDebounce(10*time.Millisecond),
+			WithReloadHandler(func(*evaluator.UpdateStateResult) { reloads <- struct{}{} }),
+			WithErrorHandler(func(err error) { errs <- err }))
+	}()
+	return reloads, errs, done, cancel
+}
+
+func newEvaluator(t *testing.T) *evaluator.FlagEvaluator {
+	t.Helper()
+	e, err := evaluator.NewFlagEvaluator(evaluator.WithPermissiveValidation(), evaluator.WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFile(t, path, flagConfig("red"))
+
+	e := newEvaluator(t)
+	reloads, errs, done, cancel := watch(t, e, path)
+	receive(t, reloads, "initial load")
+	if got := e.EvaluateString("color", nil, "error"); got != "red" {
+		t.Fatalf("expected red, got %q", got)
+	}
+
+	t.Run("write in place", func(t *testing.T) {
+		writeFile(t, path, flagConfig("green"))
+		receive(t, reloads, "reload")
+		if got := e.EvaluateString("color", nil, "error"); got != "green" {
+			t.Errorf("expected green, got %q", got)
+		}
+	})
+
+	t.Run("atomic replace", func(t *testing.T) {
+		tmp := path + ".tmp"
+		writeFile(t, tmp, flagConfig("blue"))
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("rename failed: %v", err)
+		}
+		receive(t, reloads, "reload")
+		if got := e.EvaluateString("color", nil, "error"); got != "blue" {
+			t.Errorf("expected blue, got %q", got)
+		}
+	})
+
+	t.Run("invalid file keeps previous flags", func(t *testing.T) {
+		writeFile(t, path, "not json")
+		if err := receive(t, errs, "reload error"); err == nil {
+			t.Fatal("expected an error")
+		}
+		if got := e.EvaluateString("color", nil, "error"); got != "blue" {
+			t.Errorf("expected blue to stay in effect, got %q", got)
+		}
+
+		writeFile(t, path, flagConfig("yellow"))
+		receive(t, reloads, "reload")
+		if got := e.EvaluateString("color", nil, "error"); got != "yellow" {
+			t.Errorf("expected yellow, got %q", got)
+		}
+	})
+
+	cancel()
+	if err := receive(t, done, "WatchFile to return"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWatchFileSymlinkSwap(t *testing.T) {
+	// Mimic a Kubernetes ConfigMap mount: flags.json -> ..data/flags.json,
+	// where ..data is a symlink swapped atomically to a new directory.
+	dir := t.TempDir()
+	for _, v := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(dir, v), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "v1", "flags.json"), flagConfig("red"))
+	writeFile(t, filepath.Join(dir, "v2", "flags.json"), flagConfig("green"))
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	path := filepath.Join(dir, "flags.json")
+	if err := os.Symlink(filepath.Join("..data", "flags.json"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newEvaluator(t)
+	reloads, _, _, _ := watch(t, e, path)
+	receive(t, reloads, "initial load")
+
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, reloads, "reload")
+	if got := e.EvaluateString("color", nil, "error"); got != "green" {
+		t.Errorf("expected green, got %q", got)
+	}
+}
+
+func TestWatchFileInitialLoadError(t *testing.T) {
+	e := newEvaluator(t)
+	err := WatchFile(context.Background(), e, filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestWatchFileEvaluatorClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFile(t, path, flagConfig("red"))
+
+	e := newEvaluator(t)
+	reloads, _, done, _ := watch(t, e, path)
+	receive(t, reloads, "initial load")
+
+	e.Close()
+	writeFile(t, path, flagConfig("green"))
+	if err := receive(t, done, "WatchFile to return"); !errors.Is(err, evaluator.ErrEvaluatorClosed) {
+		t.Errorf("expected ErrEvaluatorClosed, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// flagSetSeparator joins a flag set's name and a flag key into the key the
+// flag has in the state shared by all named sets.
+const flagSetSeparator = "/"
+
+// UpdateStateSet replaces the configuration of the named flag set set, which
+// is created by its first update. Named sets are independent of the
+// configuration applied by UpdateState and of each other: a flag is only
+// visible to EvaluateFlagInSet with the set that defines it, and each set's
+// shared evaluators ("$evaluators") and flag set metadata apply only to its
+// own flags. Set names must be non-empty and must not contain "/".
+//
+// All named sets share one pool of WASM instances, created on the first
+// UpdateStateSet with the evaluator's options, whose state combines every
+// set's flags. An update re-applies that combined state double-buffered, as
+// UpdateState does, so it never disturbs evaluations in other sets: those
+// in flight finish on the previous state, in which their set's flags are
+// unchanged. Updates to different sets are serialized.
+//
+// This trades memory and update cost for isolation. The module holds a
+// single config per instance and has no way to select a set, so the sets'
+// pool is separate from the pool serving UpdateState's config: an evaluator
+// using both APIs holds two double-buffered pools, twice the instance memory
+// of one (see WithPoolSize), though still one pool for any number of sets.
+// And since the combined state is re-applied whole, one set's update costs
+// time in proportion to the flags of all sets, and its new generation
+// invalidates the result cache (see WithResultCache) of every set.
+//
+// The result's flag keys are those of set. A rejected config leaves set's
+// previous configuration in place.
+func (e *FlagEvaluator) UpdateStateSet(set, configJSON string) (*UpdateStateResult, error) {
+	if set == "" || strings.Contains(set, flagSetSeparator) {
+		return nil, fmt.Errorf("invalid flag set name %q: must be non-empty and not contain %q", set, flagSetSeparator)
+	}
+
+	e.setsMu.Lock()
+	defer e.setsMu.Unlock()
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+
+	configs := maps.Clone(e.setConfigs)
+	if configs == nil {
+		configs = make(map[string][]byte, 1)
+	}
+	configs[set] = []byte(configJSON)
+	combined, err := combineFlagSets(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := e.sets.Load()
+	if sets == nil {
+		sets, err = newFlagEvaluator(e.module, e.cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create flag set evaluator: %w", err)
+		}
+		sets.namespacedKeys = true
+		sets.SetDefaultContext(e.loadDefaultContext())
+		e.sets.Store(sets)
+	}
+
+	result, err := sets.UpdateState(string(combined))
+	if err != nil {
+		return nil, err
+	}
+	if result.Success {
+		e.setConfigs = configs
+	}
+	return flagSetResult(set, result), nil
+}
+
+// EvaluateFlagInSet evaluates flagKey in the named flag set like EvaluateFlag.
+// A flag the set doesn't define, including in a set that was never updated,
+// yields a FLAG_NOT_FOUND result.
+func (e *FlagEvaluator) EvaluateFlagInSet(set, flagKey string, ctx map[string]interface{}) (*EvaluationResult, error) {
+	if e.closed.Load() {
+		return nil, newEvaluationError(flagKey, ErrEvaluatorClosed)
+	}
+	sets := e.sets.Load()
+	key := set + flagSetSeparator + flagKey
+	if sets == nil || strings.Contains(set, flagSetSeparator) || !sets.active.Load().snap.hasFlag(key) {
+		return &EvaluationResult{
+			Reason:       ReasonError,
+			ErrorCode:    ErrorFlagNotFound,
+			ErrorMessage: fmt.Sprintf("Flag '%s' not found in flag set '%s'", flagKey, set),
+		}, nil
+	}
+
+	result, err := sets.EvaluateFlag(key, ctx)
+	var evalErr *EvaluationError
+	if errors.As(err, &evalErr) {
+		err = &EvaluationError{FlagKey: flagKey, Code: evalErr.Code, Err: evalErr.Err}
+	}
+	return result, err
+}
+
+// enrichmentKey returns the key reported as $flagd.flagKey for flagKey, which
+// for the flag-set evaluator is the key within its set.
+func (e *FlagEvaluator) enrichmentKey(flagKey string) string {
+	if e.namespacedKeys {
+		_, key, _ := strings.Cut(flagKey, flagSetSeparator)
+		return key
+	}
+	return flagKey
+}
+
+// combineFlagSets combines the config of each named set into a single config
+// holding every set's flags, keyed "<set>/<flag key>". As the combined config
+// has no per-set evaluators or metadata, each flag's $ref references are
+// resolved against its set's "$evaluators" and its set's metadata is merged
+// under its own, leaving out fields whose names start with '$' as the module
+// does.
+func combineFlagSets(configs map[string][]byte) ([]byte, error) {
+	flags := make(map[string]json.RawMessage)
+	for set, config := range configs {
+		var parsed struct {
+			Flags      map[string]map[string]json.RawMessage `json:"flags"`
+			Evaluators map[string]json.RawMessage            `json:"$evaluators"`
+			Metadata   map[string]json.RawMessage            `json:"metadata"`
+		}
+		if err := json.Unmarshal(config, &parsed); err != nil {
+			return nil, fmt.Errorf("flag set %q: invalid config: %w", set, err)
+		}
+		evaluators := decodeEvaluators(parsed.Evaluators)
+		setMetadata := make(map[string]json.RawMessage, len(parsed.Metadata))
+		for name, value := range parsed.Metadata {
+			if !strings.HasPrefix(name, "$") {
+				setMetadata[name] = value
+			}
+		}
+
+		for flagKey, flag := range parsed.Flags {
+			if targeting := flag["targeting"]; flag != nil && len(evaluators) > 0 && bytes.Contains(targeting, []byte("$ref")) {
+				// An unresolvable reference is left for the module to report
+				if rule, ok := decodeUseNumber(targeting); ok {
+					if rule, err := resolveRefs(rule, evaluators, nil); err == nil {
+						resolved, err := json.Marshal(rule)
+						if err != nil {
+							return nil, fmt.Errorf("flag set %q: flag %q: %w", set, flagKey, err)
+						}
+						flag["targeting"] = resolved
+					}
+				}
+			}
+			if len(setMetadata) > 0 && flag != nil {
+				// Flag metadata that isn't an object is left for the module
+				// to report
+				var own map[string]json.RawMessage
+				if raw, ok := flag["metadata"]; !ok || json.Unmarshal(raw, &own) == nil {
+					metadata := maps.Clone(setMetadata)
+					maps.Copy(metadata, own)
+					raw, err := json.Marshal(metadata)
+					if err != nil {
+						return nil, fmt.Errorf("flag set %q: flag %q: %w", set, flagKey, err)
+					}
+					flag["metadata"] = raw
+				}
+			}
+			raw, err := json.Marshal(flag)
+			if err != nil {
+				return nil, fmt.Errorf("flag set %q: flag %q: %w", set, flagKey, err)
+			}
+			flags[set+flagSetSeparator+flagKey] = raw
+		}
+	}
+	return json.Marshal(map[string]interface{}{"flags": flags})
+}
+
+// flagSetResult returns result restricted to the flags of set, with their
+// keys within the set.
+func flagSetResult(set string, result *UpdateStateResult) *UpdateStateResult {
+	prefix := set + flagSetSeparator
+	out := *result
+	out.AddedFlags = keysInSet(prefix, result.AddedFlags)
+	out.RemovedFlags = keysInSet(prefix, result.RemovedFlags)
+	out.ChangedFlags = keysInSet(prefix, result.ChangedFlags)
+	out.PreEvaluated = entriesInSet(prefix, result.PreEvaluated)
+	out.RequiredContextKeys = entriesInSet(prefix, result.RequiredContextKeys)
+	out.FlagIndices = entriesInSet(prefix, result.FlagIndices)
+	return &out
+}
+
+// keysInSet returns the keys starting with prefix, with prefix removed.
+func keysInSet(prefix string, keys []string) []string {
+	var out []string
+	for _, key := range keys {
+		if local, ok := strings.CutPrefix(key, prefix); ok {
+			out = append(out, local)
+		}
+	}
+	return out
+}
+
+// entriesInSet returns the entries of m whose keys start with prefix, keyed
+// with prefix removed. It returns nil for a nil m.
+func entriesInSet[V any](prefix string, m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]V)
+	for key, v := range m {
+		if local, ok := strings.CutPrefix(key, prefix); ok {
+			out[local] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SetFlag adds the flag key, or replaces its whole definition, leaving every
+// other flag as it is. flagJSON is a single flag object as it would appear
+// under "flags" in a full config. The result has the same shape as
+// UpdateState's, with key reported as added or changed.
+//
+// The module has no incremental update, so the flag is patched into the
+// current config and the result re-applied like UpdateState; SetFlag saves
+// callers from holding on to the whole config. Before the first update the
+// flag becomes the only one in the config.
+func (e *FlagEvaluator) SetFlag(key string, flagJSON string) (*UpdateStateResult, error) {
+	var flag map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(flagJSON), &flag); err != nil {
+		return nil, fmt.Errorf("invalid flag %q: %w", key, err)
+	}
+	return e.updateState(func(current []byte) ([]byte, error) {
+		return patchFlags(current, func(flags map[string]json.RawMessage) bool {
+			flags[key] = json.RawMessage(flagJSON)
+			return true
+		})
+	}, nil)
+}
+
+// RemoveFlag removes the flag key, leaving every other flag as it is, and
+// returns the result in UpdateState's shape with key reported as removed.
+// Removing a flag that does not exist leaves the current config as it is, so
+// it is skipped like an identical UpdateState and reports no changes. Like
+// SetFlag, it otherwise re-applies the patched current config.
+func (e *FlagEvaluator) RemoveFlag(key string) (*UpdateStateResult, error) {
+	return e.updateState(func(current []byte) ([]byte, error) {
+		return patchFlags(current, func(flags map[string]json.RawMessage) bool {
+			if _, ok := flags[key]; !ok {
+				return false
+			}
+			delete(flags, key)
+			return true
+		})
+	}, nil)
+}
+
+// patchFlags applies patch to the "flags" object of config and returns the
+// resulting config. Other top-level fields are kept as they are. If patch
+// reports no change, config is returned as it is, not re-encoded, so it still
+// matches the applied config byte for byte.
+func patchFlags(config []byte, patch func(flags map[string]json.RawMessage) (changed bool)) ([]byte, error) {
+	top := make(map[string]json.RawMessage)
+	if config != nil {
+		if err := json.Unmarshal(config, &top); err != nil {
+			return nil, fmt.Errorf("failed to parse current config: %w", err)
+		}
+	}
+	flags := make(map[string]json.RawMessage)
+	if raw, ok := top["flags"]; ok {
+		if err := json.Unmarshal(raw, &flags); err != nil {
+			return nil, fmt.Errorf("failed to parse current flags: %w", err)
+		}
+	}
+	if !patch(flags) && config != nil {
+		return config, nil
+	}
+
+	raw, err := json.Marshal(flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode flags: %w", err)
+	}
+	top["flags"] = raw
+	return json.Marshal(top)
+}
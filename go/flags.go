@@ -0,0 +1,237 @@
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// ListFlags returns the keys of every flag in the active configuration,
+// sorted.
+func (e *FlagEvaluator) ListFlags() []string {
+	return e.active.Load().snap.allFlagKeys()
+}
+
+// FlagMetadata returns the metadata of flagKey in the active configuration,
+// without evaluating it. As in evaluation results, the flag's own metadata is
+// merged over the flag set's top-level "metadata", leaving out flag set fields
+// whose names start with '$'. ok reports whether the flag exists; a flag with
+// no metadata returns a nil map. The returned map is a copy.
+func (e *FlagEvaluator) FlagMetadata(flagKey string) (metadata map[string]interface{}, ok bool) {
+	snap := e.active.Load().snap
+	if cached, ok := snap.preEvaluated[flagKey]; ok {
+		return maps.Clone(cached.FlagMetadata), true
+	}
+	if _, ok := snap.flagIndex[flagKey]; !ok {
+		return nil, false
+	}
+	snap.loadMetadata()
+	return maps.Clone(snap.metadata[flagKey]), true
+}
+
+// FlagSetMetadata returns the flag set's top-level "metadata" in the active
+// configuration, such as a flagSetId, leaving out fields whose names start
+// with '$'. Evaluation results and FlagMetadata already carry it merged under
+// each flag's own metadata. It returns nil before the first update or if the
+// config has none. The returned map is a copy.
+func (e *FlagEvaluator) FlagSetMetadata() map[string]interface{} {
+	snap := e.active.Load().snap
+	snap.loadMetadata()
+	return maps.Clone(snap.setMetadata)
+}
+
+// loadMetadata parses the flag and flag set metadata of s's config on first
+// use.
+func (s *cacheSnapshot) loadMetadata() {
+	s.metadataOnce.Do(func() {
+		s.metadata, s.setMetadata = parseFlagMetadata(s.config)
+	})
+}
+
+// Variants returns the variants flagKey defines in the active configuration,
+// by name, whichever is currently selected. Values are decoded as in
+// evaluation results: integers as int64, other numbers as float64. ok reports
+// whether the flag exists. The returned map and its values are fresh copies.
+func (e *FlagEvaluator) Variants(flagKey string) (variants map[string]interface{}, ok bool) {
+	snap := e.active.Load().snap
+	if !snap.hasFlag(flagKey) {
+		return nil, false
+	}
+	snap.variantsOnce.Do(func() {
+		snap.variants = parseVariants(snap.config)
+	})
+	raw := snap.variants[flagKey]
+	variants = make(map[string]interface{}, len(raw))
+	for name, value := range raw {
+		if num, isNumber := parseNumber(value); isNumber {
+			variants[name] = num
+			continue
+		}
+		if v, ok := decodeValue(value); ok {
+			variants[name] = v
+		}
+	}
+	return variants, true
+}
+
+// FlagTargeting returns flagKey's targeting rule in the active configuration
+// as JSON, with every $ref replaced by the shared evaluator it names, as the
+// module resolves it. ok is false if the flag doesn't exist or has no
+// targeting.
+func (e *FlagEvaluator) FlagTargeting(flagKey string) (rule json.RawMessage, ok bool) {
+	resolved, ok := e.active.Load().snap.targetingRule(flagKey)
+	if !ok {
+		return nil, false
+	}
+	rule, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, false
+	}
+	return rule, true
+}
+
+// TargetingRule returns flagKey's targeting rule as written in the active
+// configuration, compacted, with any $ref left in place; FlagTargeting
+// returns it with references resolved. ok is false if the flag doesn't exist
+// or has no targeting. The returned bytes are the caller's to modify.
+func (e *FlagEvaluator) TargetingRule(flagKey string) (rule json.RawMessage, ok bool) {
+	snap := e.active.Load().snap
+	snap.targetingOnce.Do(func() {
+		snap.targeting = parseTargeting(snap.config)
+	})
+	rule, ok = snap.targeting[flagKey]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(rule), true
+}
+
+// RequiredContextKeys returns the sorted context keys flagKey's targeting
+// reads in the active configuration, including targetingKey and any $flagd
+// fields. ok is false if the flag doesn't exist, has no targeting (static and
+// disabled flags), or its targeting reads the whole context so no key set is
+// known.
+func (e *FlagEvaluator) RequiredContextKeys(flagKey string) (keys []string, ok bool) {
+	keySet, ok := e.active.Load().snap.requiredCtxKey[flagKey]
+	if !ok {
+		return nil, false
+	}
+	keys = make([]string, 0, len(keySet))
+	for k := range keySet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// FlagsUsingContextKey returns the sorted keys of the flags whose targeting
+// reads key in the active configuration, the reverse of RequiredContextKeys.
+// Keys are matched by top-level field, as flags' required keys are tracked:
+// "user" and "user.email" both match a flag reading "user.department". A
+// fractional operation reads targetingKey, which it buckets on by default.
+// Flags whose targeting reads the whole context are not listed, since the
+// keys they use aren't known; nor are static and disabled flags.
+func (e *FlagEvaluator) FlagsUsingContextKey(key string) []string {
+	snap := e.active.Load().snap
+	// The module lists targetingKey among every flag's required keys, so
+	// for it the rule itself is checked
+	targetingKey := key == "targetingKey" || strings.HasPrefix(key, "targetingKey.")
+	var flagKeys []string
+	for flagKey, keySet := range snap.requiredCtxKey {
+		for k := range keySet {
+			if k == key || strings.HasPrefix(k, key+".") || strings.HasPrefix(key, k+".") {
+				if targetingKey {
+					if rule, ok := snap.targetingRule(flagKey); !ok || !readsTargetingKey(rule) {
+						break
+					}
+				}
+				flagKeys = append(flagKeys, flagKey)
+				break
+			}
+		}
+	}
+	sort.Strings(flagKeys)
+	return flagKeys
+}
+
+// parseVariants returns the raw variant values of every flag in config. It
+// returns nil if config cannot be parsed.
+func parseVariants(config []byte) map[string]map[string]json.RawMessage {
+	var parsed struct {
+		Flags map[string]struct {
+			Variants map[string]json.RawMessage `json:"variants"`
+		} `json:"flags"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil
+	}
+	variants := make(map[string]map[string]json.RawMessage, len(parsed.Flags))
+	for flagKey, flag := range parsed.Flags {
+		variants[flagKey] = flag.Variants
+	}
+	return variants
+}
+
+// parseTargeting returns the compacted targeting rule of every flag in config
+// that has one. Targeting that is null or an empty object counts as none, as
+// in parseTargetingRules. It returns nil if config cannot be parsed.
+func parseTargeting(config []byte) map[string]json.RawMessage {
+	var parsed struct {
+		Flags map[string]struct {
+			Targeting json.RawMessage `json:"targeting"`
+		} `json:"flags"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil
+	}
+	targeting := make(map[string]json.RawMessage, len(parsed.Flags))
+	for flagKey, flag := range parsed.Flags {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, flag.Targeting); err != nil {
+			continue
+		}
+		if rule := buf.Bytes(); len(rule) > 0 && string(rule) != "null" && string(rule) != "{}" {
+			targeting[flagKey] = rule
+		}
+	}
+	return targeting
+}
+
+// parseFlagMetadata returns the merged metadata of every flag in config that
+// has any, and the flag set metadata. It returns nil maps if config cannot be
+// parsed.
+func parseFlagMetadata(config []byte) (metadata map[string]map[string]interface{}, flagSet map[string]interface{}) {
+	var parsed struct {
+		Flags map[string]struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"flags"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil, nil
+	}
+
+	for k, v := range parsed.Metadata {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if flagSet == nil {
+			flagSet = make(map[string]interface{}, len(parsed.Metadata))
+		}
+		flagSet[k] = v
+	}
+
+	metadata = make(map[string]map[string]interface{}, len(parsed.Flags))
+	for flagKey, flag := range parsed.Flags {
+		if len(flagSet) == 0 && len(flag.Metadata) == 0 {
+			continue
+		}
+		merged := make(map[string]interface{}, len(flagSet)+len(flag.Metadata))
+		maps.Copy(merged, flagSet)
+		maps.Copy(merged, flag.Metadata)
+		metadata[flagKey] = merged
+	}
+	return metadata, flagSet
+}
@@ -0,0 +1,365 @@
+package evaluator
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// FractionalBucket reports which bucket of flagKey's fractional operation the
+// evaluation context lands in, computed host-side with the module's hashing so
+// it matches evaluation exactly. variant is the bucket's name and bucket its
+// 0-based position among the bucket definitions.
+//
+// The bucket is reported whether or not the rules around the fractional
+// operation would reach it for this context. The bucketing key may be a
+// string literal, a var lookup, or a cat of those; other expressions are not
+// supported. Returns ErrNotFractional if the flag's targeting has no
+// fractional operation, and an *EvaluationError wrapping ErrFlagNotFound if
+// the flag doesn't exist.
+func (e *FlagEvaluator) FractionalBucket(flagKey string, ctx map[string]interface{}) (variant string, bucket int, err error) {
+	snap := e.active.Load().snap
+	args, err := fractionalOperation(snap, flagKey)
+	if err != nil {
+		return "", 0, err
+	}
+	variant, bucket, err = fractionalBucket(args, e.ruleData(snap, flagKey, ctx))
+	if err != nil {
+		return "", 0, newEvaluationError(flagKey, fmt.Errorf("fractional: %w", err))
+	}
+	return variant, bucket, nil
+}
+
+// FractionalAssignments returns the bucket of flagKey's fractional operation
+// each of keys lands in, as FractionalBucket reports it for a context holding
+// just that targetingKey (over the default context), keyed by targetingKey.
+//
+// Assignments are stable: a key is hashed with MurmurHash3 (x86, 32-bit, seed
+// 0) and placed by the bucket weights alone, so the same key, bucketing
+// expression and weights always give the same bucket, across runs, processes
+// and hosts, as in flagd, whose testbed the module is tested against. Changing
+// the weights, the order of the buckets or the flag key (when it is part of
+// the bucketing key, as by default) can move keys. This makes assertions like
+// "these known keys get treatment" safe to pin in tests.
+func (e *FlagEvaluator) FractionalAssignments(flagKey string, keys []string) (map[string]string, error) {
+	snap := e.active.Load().snap
+	args, err := fractionalOperation(snap, flagKey)
+	if err != nil {
+		return nil, err
+	}
+	assignments := make(map[string]string, len(keys))
+	for _, key := range keys {
+		ctx := map[string]interface{}{"targetingKey": key}
+		variant, _, err := fractionalBucket(args, e.ruleData(snap, flagKey, ctx))
+		if err != nil {
+			return nil, newEvaluationError(flagKey, fmt.Errorf("fractional: %w", err))
+		}
+		assignments[key] = variant
+	}
+	return assignments, nil
+}
+
+// RolloutPercentage returns the position, from 0 to 100, at which the
+// evaluation context lands in flagKey's fractional operation, for showing
+// where a user stands in a rollout. Buckets take up the scale in the order
+// they are defined, each in proportion to its weight: with [["new", 20],
+// ["old", 80]] a context at 37 gets "old", and would get "new" once "new" is
+// raised above 37%.
+//
+// The position is computed host-side from the bucketing key with the
+// module's hash and arithmetic, as FractionalBucket is, and has the same
+// errors. It depends only on the bucketing key, so it stays put as weights
+// change.
+func (e *FlagEvaluator) RolloutPercentage(flagKey string, ctx map[string]interface{}) (float64, error) {
+	snap := e.active.Load().snap
+	args, err := fractionalOperation(snap, flagKey)
+	if err != nil {
+		return 0, err
+	}
+	list, ok := args.([]interface{})
+	if !ok {
+		list = []interface{}{args}
+	}
+	if len(list) == 0 {
+		return 0, newEvaluationError(flagKey, fmt.Errorf("fractional: requires at least one bucket definition"))
+	}
+	key, _, err := fractionalKey(list, e.ruleData(snap, flagKey, ctx))
+	if err != nil {
+		return 0, newEvaluationError(flagKey, fmt.Errorf("fractional: %w", err))
+	}
+	// A hash of math.MinInt32 stays negative in the module, landing in the
+	// first bucket
+	return math.Max(bucketPosition(key), 0), nil
+}
+
+// fractionalOperation returns the arguments of the fractional operation in
+// flagKey's targeting under snap, with FractionalBucket's errors.
+func fractionalOperation(snap *cacheSnapshot, flagKey string) (interface{}, error) {
+	if _, ok := snap.preEvaluated[flagKey]; ok {
+		return nil, ErrNotFractional
+	}
+	if _, ok := snap.flagIndex[flagKey]; !ok {
+		return nil, newEvaluationError(flagKey, ErrFlagNotFound)
+	}
+	rule, _ := snap.targetingRule(flagKey)
+	var nodes []interface{}
+	findOperations(rule, "fractional", &nodes)
+	switch len(nodes) {
+	case 0:
+		return nil, ErrNotFractional
+	case 1:
+		return nodes[0], nil
+	default:
+		return nil, newEvaluationError(flagKey, fmt.Errorf("targeting has %d fractional operations", len(nodes)))
+	}
+}
+
+// withFlagd returns data with its $flagd field set to flagd, copying data
+// rather than modifying it.
+func withFlagd(data, flagd map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(data)+1)
+	maps.Copy(merged, data)
+	merged["$flagd"] = flagd
+	return merged
+}
+
+// findOperations appends every operation named op in rule to nodes, as its
+// argument value.
+func findOperations(rule interface{}, op string, nodes *[]interface{}) {
+	switch v := rule.(type) {
+	case map[string]interface{}:
+		for name, args := range v {
+			if name == op && len(v) == 1 {
+				*nodes = append(*nodes, args)
+			}
+			findOperations(args, op, nodes)
+		}
+	case []interface{}:
+		for _, child := range v {
+			findOperations(child, op, nodes)
+		}
+	}
+}
+
+// fractionalBucket mirrors the module's fractional operator: it resolves the
+// bucketing key and bucket definitions from args against data and returns
+// the bucket the key hashes into.
+func fractionalBucket(args interface{}, data map[string]interface{}) (string, int, error) {
+	list, ok := args.([]interface{})
+	if !ok {
+		list = []interface{}{args}
+	}
+	if len(list) == 0 {
+		return "", 0, fmt.Errorf("requires at least one bucket definition")
+	}
+
+	key, start, err := fractionalKey(list, data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var defs []interface{}
+	if start == 1 && len(list) == 2 {
+		flat, isArray := list[1].([]interface{})
+		if !isArray {
+			return "", 0, fmt.Errorf("second argument must be an array of bucket definitions")
+		}
+		defs = flat
+	} else {
+		for _, arg := range list[start:] {
+			def, isArray := arg.([]interface{})
+			if !isArray {
+				return "", 0, fmt.Errorf("bucket definition must be an array, got %v", arg)
+			}
+			switch {
+			case len(def) >= 2:
+				defs = append(defs, def[0], def[1])
+			case len(def) == 1:
+				defs = append(defs, def[0], json.Number("1"))
+			}
+		}
+	}
+	return pickBucket(key, defs)
+}
+
+// fractionalKey resolves the bucketing key of a fractional operation with
+// arguments list against data. start is the index of the first bucket
+// definition in list: 1 if list starts with the key, 0 if it doesn't.
+func fractionalKey(list []interface{}, data map[string]interface{}) (key string, start int, err error) {
+	first, err := evalKeyExpr(list[0], data)
+	if err != nil {
+		return "", 0, err
+	}
+	if s, isString := first.(string); isString {
+		return s, 1, nil
+	}
+	// The module falls back to the flag key followed by targetingKey
+	tk, _ := data["targetingKey"].(string)
+	fk, _ := data["$flagd"].(map[string]interface{})["flagKey"].(string)
+	return fk + tk, 0, nil
+}
+
+// evalKeyExpr evaluates the bucketing key argument of a fractional operation:
+// a literal, a var lookup, or a cat of those.
+func evalKeyExpr(expr interface{}, data map[string]interface{}) (interface{}, error) {
+	m, ok := expr.(map[string]interface{})
+	if !ok {
+		return expr, nil
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("unsupported bucketing key expression")
+	}
+	if args, ok := m["var"]; ok {
+		path, def := args, interface{}(nil)
+		if list, isArray := args.([]interface{}); isArray {
+			if len(list) == 0 {
+				return data, nil
+			}
+			path = list[0]
+			if len(list) > 1 {
+				def = list[1]
+			}
+		}
+		p, isString := path.(string)
+		if !isString {
+			return nil, fmt.Errorf("unsupported var path %v", path)
+		}
+		if p == "" {
+			return data, nil
+		}
+		if val, found := lookupContextPath(data, nil, p); found && val != nil {
+			return val, nil
+		}
+		return def, nil
+	}
+	if args, ok := m["cat"]; ok {
+		list, isArray := args.([]interface{})
+		if !isArray {
+			list = []interface{}{args}
+		}
+		var s string
+		for _, arg := range list {
+			val, err := evalKeyExpr(arg, data)
+			if err != nil {
+				return nil, err
+			}
+			str, isString := val.(string)
+			if !isString {
+				return nil, fmt.Errorf("unsupported cat operand %v", val)
+			}
+			s += str
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported bucketing key expression")
+}
+
+// pickBucket returns the name and position of the bucket key hashes into.
+// defs alternates bucket names and integer weights.
+func pickBucket(key string, defs []interface{}) (string, int, error) {
+	if len(defs) == 0 {
+		return "", 0, fmt.Errorf("requires at least one bucket")
+	}
+	type bucketDef struct {
+		name   string
+		weight uint32
+	}
+	buckets := make([]bucketDef, 0, len(defs)/2)
+	var total uint32
+	for i := 0; i < len(defs); i += 2 {
+		name, ok := defs[i].(string)
+		if !ok {
+			return "", 0, fmt.Errorf("bucket name at index %d must be a string", i)
+		}
+		if i+1 >= len(defs) {
+			return "", 0, fmt.Errorf("missing weight for bucket %q", name)
+		}
+		num, ok := defs[i+1].(json.Number)
+		if !ok {
+			return "", 0, fmt.Errorf("weight for bucket %q must be a number", name)
+		}
+		w, err := strconv.ParseUint(num.String(), 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("weight for bucket %q must be a positive integer", name)
+		}
+		sum, carry := bits.Add32(total, uint32(w), 0)
+		if carry != 0 {
+			return "", 0, fmt.Errorf("total weight overflow")
+		}
+		total = sum
+		buckets = append(buckets, bucketDef{name, uint32(w)})
+	}
+	if total == 0 {
+		return "", 0, fmt.Errorf("total weight must be greater than zero")
+	}
+
+	value := bucketPosition(key)
+	var cumulative float64
+	for i, b := range buckets {
+		cumulative += float64(b.weight*100) / float64(total)
+		if value < cumulative {
+			return b.name, i, nil
+		}
+	}
+	return buckets[len(buckets)-1].name, len(buckets) - 1, nil
+}
+
+// bucketPosition returns where key hashes to on the module's 0-100 scale,
+// which bucket weights are laid out along in order as percentages of their
+// total.
+func bucketPosition(key string) float64 {
+	// Same arithmetic as the module, including its 32-bit wraparounds
+	h := int32(murmur3x86_32([]byte(key), 0))
+	if h < 0 {
+		h = -h
+	}
+	return float64(h) / float64(math.MaxInt32) * 100
+}
+
+// murmur3x86_32 is MurmurHash3's x86 32-bit variant, the hash the module
+// buckets fractional keys with.
+func murmur3x86_32(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	h := seed
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch tail := data[n:]; len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,51 @@
+package evaluator
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Group applies configuration updates to several evaluators at once, such as
+// one evaluator per shard of a process, so they move to a new config together
+// rather than one after another.
+type Group struct {
+	evaluators []*FlagEvaluator
+}
+
+// NewGroup returns a Group of evaluators. The evaluators remain the caller's
+// to evaluate with and to close; the Group only updates them.
+func NewGroup(evaluators ...*FlagEvaluator) *Group {
+	return &Group{evaluators: append([]*FlagEvaluator(nil), evaluators...)}
+}
+
+// UpdateState calls UpdateState with configJSON on every evaluator in the
+// group concurrently and waits for all of them. results[i] is the result of
+// the i-th evaluator passed to NewGroup, nil if its update failed; err is the
+// first such failure in that order, naming the evaluator's index.
+//
+// Each evaluator swaps in the new config as its own update completes, so
+// evaluations may briefly see different generations across the group. An
+// update is not rolled back on the other evaluators when one fails or rejects
+// the config (result.Success false); evaluators created with the same options
+// accept and reject the same configs, and DryRunUpdateState can check a config
+// beforehand.
+func (g *Group) UpdateState(configJSON string) ([]*UpdateStateResult, error) {
+	results := make([]*UpdateStateResult, len(g.evaluators))
+	errs := make([]error, len(g.evaluators))
+	var wg sync.WaitGroup
+	wg.Add(len(g.evaluators))
+	for i, e := range g.evaluators {
+		go func(i int, e *FlagEvaluator) {
+			defer wg.Done()
+			results[i], errs[i] = e.UpdateState(configJSON)
+		}(i, e)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return results, fmt.Errorf("evaluator %d: %w", i, err)
+		}
+	}
+	return results, nil
+}
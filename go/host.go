@@ -4,19 +4,76 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 )
 
+// clockKey is the context key under which an evaluator passes its clock to the
+// time-related host functions, which are shared by every evaluator on a runtime.
+type clockKey struct{}
+
+// withClock returns ctx carrying clock for the host functions.
+func withClock(ctx context.Context, clock func() time.Time) context.Context {
+	return context.WithValue(ctx, clockKey{}, clock)
+}
+
+// clockFrom returns the clock carried by ctx, or time.Now if it has none.
+func clockFrom(ctx context.Context) func() time.Time {
+	if clock, ok := ctx.Value(clockKey{}).(func() time.Time); ok {
+		return clock
+	}
+	return time.Now
+}
+
+// entropyKey is the context key under which an evaluator passes its entropy
+// source to the random-values host function.
+type entropyKey struct{}
+
+// withEntropy returns ctx carrying r for the host functions. A nil r leaves
+// ctx as is, so the host functions use crypto/rand.
+func withEntropy(ctx context.Context, r io.Reader) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, entropyKey{}, r)
+}
+
+// entropyFrom returns the entropy source carried by ctx, or crypto/rand's
+// Reader if it has none.
+func entropyFrom(ctx context.Context) io.Reader {
+	if r, ok := ctx.Value(entropyKey{}).(io.Reader); ok {
+		return r
+	}
+	return rand.Reader
+}
+
+// lockedReader serializes reads from a WithEntropySource reader, which every
+// instance of an evaluator shares.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return io.ReadFull(l.r, p)
+}
+
 // registerHostFunctions registers all 9 host functions required by the WASM module.
+// The time-related ones read the current time from the clock carried by the
+// calling context (see withClock), and the random-values one reads from its
+// entropy source (see withEntropy).
 func registerHostFunctions(ctx context.Context, r wazero.Runtime) error {
 	// Module "host" — 1 function
 	_, err := r.NewHostModuleBuilder("host").
 		NewFunctionBuilder().
-		WithFunc(func() int64 {
-			return time.Now().Unix()
+		WithFunc(func(ctx context.Context) int64 {
+			return clockFrom(ctx)().Unix()
 		}).
 		Export("get_current_time_unix_seconds").
 		Instantiate(ctx)
@@ -29,8 +86,9 @@ func registerHostFunctions(ctx context.Context, r wazero.Runtime) error {
 		// CRITICAL: random entropy for ahash in boon validation
 		NewFunctionBuilder().
 		WithFunc(func(ctx context.Context, mod api.Module, _self uint32, bufferPtr uint32) {
+			// A source that runs short leaves the remaining bytes zero
 			randomBytes := make([]byte, 32)
-			_, _ = rand.Read(randomBytes)
+			_, _ = entropyFrom(ctx).Read(randomBytes)
 			mod.Memory().Write(bufferPtr, randomBytes)
 		}).
 		Export("__wbg_getRandomValues_1c61fac11405ffdc").
@@ -42,8 +100,8 @@ func registerHostFunctions(ctx context.Context, r wazero.Runtime) error {
 		Export("__wbg_new_0_23cedd11d9b40c9d").
 		// LEGACY: Date.getTime — returns current time millis as f64
 		NewFunctionBuilder().
-		WithFunc(func(_self int32) float64 {
-			return float64(time.Now().UnixMilli())
+		WithFunc(func(ctx context.Context, _self int32) float64 {
+			return float64(clockFrom(ctx)().UnixMilli())
 		}).
 		Export("__wbg_getTime_ad1e9878a735af08").
 		// ERROR: throws a WASM error — we panic and recover at call boundary
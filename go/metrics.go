@@ -0,0 +1,67 @@
+package evaluator
+
+import "time"
+
+// MetricsRecorder receives evaluation telemetry from a FlagEvaluator, e.g. to
+// export it to a metrics backend (see the metrics subpackage for Prometheus).
+// Methods are called on the evaluation hot path, so implementations must be
+// cheap and safe for concurrent use.
+type MetricsRecorder interface {
+	// RecordEvaluation is called once per evaluated flag with the result's
+	// reason and error code (empty on success). Failures that produce no
+	// result are recorded with ReasonError and ErrorGeneral.
+	RecordEvaluation(reason, errorCode string)
+	// RecordEvaluationDuration is called once per evaluation call; a batch
+	// call (EvaluateFlags, EvaluateAllFlags) is recorded as one duration.
+	RecordEvaluationDuration(d time.Duration)
+	// RecordPoolWait is called once per instance acquisition with the time
+	// spent waiting for an idle instance (zero if one was available).
+	RecordPoolWait(d time.Duration)
+	// RecordUpdateState is called once per UpdateState call.
+	RecordUpdateState(d time.Duration)
+}
+
+// UpdateMetricsRecorder is implemented by a MetricsRecorder that also wants
+// details of each applied update, for spotting slow config rollouts.
+type UpdateMetricsRecorder interface {
+	// RecordUpdateFanOut is called once per applied update with the time
+	// spent loading the config into the pool instances after the first (see
+	// UpdateStateResult.FanOut).
+	RecordUpdateFanOut(d time.Duration)
+	// RecordUpdateChangedFlags is called once per applied update with the
+	// number of flags it added, removed or changed.
+	RecordUpdateChangedFlags(n int)
+}
+
+// recordUpdate reports an applied update to the metrics recorder, if it
+// takes update details.
+func (e *FlagEvaluator) recordUpdate(result *UpdateStateResult) {
+	r, ok := e.metrics.(UpdateMetricsRecorder)
+	if !ok {
+		return
+	}
+	r.RecordUpdateFanOut(result.FanOut)
+	r.RecordUpdateChangedFlags(len(result.AddedFlags) + len(result.RemovedFlags) + len(result.ChangedFlags))
+}
+
+// recordEvaluation reports a single-flag evaluation that started at start.
+func (e *FlagEvaluator) recordEvaluation(start time.Time, result *EvaluationResult, err error) {
+	e.metrics.RecordEvaluationDuration(time.Since(start))
+	if err != nil {
+		e.metrics.RecordEvaluation(ReasonError, ErrorGeneral)
+		return
+	}
+	e.metrics.RecordEvaluation(result.Reason, result.ErrorCode)
+}
+
+// recordBatch reports a batch evaluation that started at start.
+func (e *FlagEvaluator) recordBatch(start time.Time, results map[string]*EvaluationResult, err error) {
+	e.metrics.RecordEvaluationDuration(time.Since(start))
+	if err != nil {
+		e.metrics.RecordEvaluation(ReasonError, ErrorGeneral)
+		return
+	}
+	for _, result := range results {
+		e.metrics.RecordEvaluation(result.Reason, result.ErrorCode)
+	}
+}
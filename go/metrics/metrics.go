@@ -0,0 +1,152 @@
+// Package metrics exports FlagEvaluator telemetry as Prometheus metrics.
+//
+// It lives in its own package so that users of the evaluator who don't use
+// Prometheus don't import client_golang.
+//
+//	e, err := evaluator.NewFlagEvaluator(metrics.WithMetrics(prometheus.DefaultRegisterer))
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "flagd_evaluator"
+
+// Recorder is an evaluator.MetricsRecorder backed by Prometheus collectors.
+type Recorder struct {
+	evaluations        *prometheus.CounterVec
+	evaluationDuration prometheus.Histogram
+	poolWait           prometheus.Histogram
+	updateState        prometheus.Histogram
+	updateFanOut       prometheus.Histogram
+	changedFlags       prometheus.Counter
+}
+
+var (
+	_ evaluator.MetricsRecorder       = (*Recorder)(nil)
+	_ evaluator.UpdateMetricsRecorder = (*Recorder)(nil)
+)
+
+// NewRecorder creates a Recorder and registers its collectors with reg.
+// Collectors already registered with reg (e.g. by another evaluator in the
+// same process) are reused, so several evaluators report into the same
+// metrics.
+func NewRecorder(reg prometheus.Registerer) (*Recorder, error) {
+	r := &Recorder{
+		evaluations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "evaluations_total",
+			Help:      "Flag evaluations by reason and error code.",
+		}, []string{"reason", "error_code"}),
+		evaluationDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "evaluation_duration_seconds",
+			Help:      "Duration of evaluation calls; a batch call counts once.",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 10), // 1µs .. ~262ms
+		}),
+		poolWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pool_wait_duration_seconds",
+			Help:      "Time spent waiting for an idle WASM instance.",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 10),
+		}),
+		updateState: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "update_state_duration_seconds",
+			Help:      "Duration of UpdateState calls.",
+			Buckets:   prometheus.ExponentialBuckets(1e-4, 4, 10), // 100µs .. ~26s
+		}),
+		updateFanOut: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "update_fan_out_duration_seconds",
+			Help:      "Time applied updates spent loading the config into all but the first instance.",
+			Buckets:   prometheus.ExponentialBuckets(1e-4, 4, 10),
+		}),
+		changedFlags: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "update_changed_flags_total",
+			Help:      "Flags added, removed or changed by applied updates.",
+		}),
+	}
+
+	var err error
+	if r.evaluations, err = register(reg, r.evaluations); err != nil {
+		return nil, err
+	}
+	if r.evaluationDuration, err = register(reg, r.evaluationDuration); err != nil {
+		return nil, err
+	}
+	if r.poolWait, err = register(reg, r.poolWait); err != nil {
+		return nil, err
+	}
+	if r.updateState, err = register(reg, r.updateState); err != nil {
+		return nil, err
+	}
+	if r.updateFanOut, err = register(reg, r.updateFanOut); err != nil {
+		return nil, err
+	}
+	if r.changedFlags, err = register(reg, r.changedFlags); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// register registers c with reg, returning the already-registered collector
+// if an identical one exists.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// WithMetrics is an evaluator.Option that records metrics through a Recorder
+// registered with reg. Like prometheus.MustRegister, it panics if the
+// collectors cannot be registered.
+func WithMetrics(reg prometheus.Registerer) evaluator.Option {
+	r, err := NewRecorder(reg)
+	if err != nil {
+		panic(err)
+	}
+	return evaluator.WithMetricsRecorder(r)
+}
+
+// RecordEvaluation implements evaluator.MetricsRecorder.
+func (r *Recorder) RecordEvaluation(reason, errorCode string) {
+	r.evaluations.WithLabelValues(reason, errorCode).Inc()
+}
+
+// RecordEvaluationDuration implements evaluator.MetricsRecorder.
+func (r *Recorder) RecordEvaluationDuration(d time.Duration) {
+	r.evaluationDuration.Observe(d.Seconds())
+}
+
+// RecordPoolWait implements evaluator.MetricsRecorder.
+func (r *Recorder) RecordPoolWait(d time.Duration) {
+	r.poolWait.Observe(d.Seconds())
+}
+
+// RecordUpdateState implements evaluator.MetricsRecorder.
+func (r *Recorder) RecordUpdateState(d time.Duration) {
+	r.updateState.Observe(d.Seconds())
+}
+
+// RecordUpdateFanOut implements evaluator.UpdateMetricsRecorder.
+func (r *Recorder) RecordUpdateFanOut(d time.Duration) {
+	r.updateFanOut.Observe(d.Seconds())
+}
+
+// RecordUpdateChangedFlags implements evaluator.UpdateMetricsRecorder.
+func (r *Recorder) RecordUpdateChangedFlags(n int) {
+	r.changedFlags.Add(float64(n))
+}
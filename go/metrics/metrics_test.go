@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"testing"
+
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const config = `{
+	"flags": {
+		"static-flag": {
+			"state": "ENABLED",
+			"defaultVariant": "on",
+			"variants": { "on": true, "off": false }
+		},
+		"targeting-flag": {
+			"state": "ENABLED",
+			"defaultVariant": "off",
+			"variants": { "on": true, "off": false },
+			"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "on", "off"] }
+		}
+	}
+}`
+
+func newEvaluator(t *testing.T, reg prometheus.Registerer) *evaluator.FlagEvaluator {
+	t.Helper()
+	e, err := evaluator.NewFlagEvaluator(evaluator.WithPermissiveValidation(), evaluator.WithPoolSize(1), WithMetrics(reg))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	return e
+}
+
+func TestWithMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	e := newEvaluator(t, reg)
+
+	e.EvaluateFlag("static-flag", nil)
+	e.EvaluateFlag("targeting-flag", map[string]interface{}{"tier": "gold"})
+	e.EvaluateFlag("missing-flag", nil)
+	if _, err := e.EvaluateAllFlags(nil); err != nil {
+		t.Fatalf("EvaluateAllFlags failed: %v", err)
+	}
+
+	r, err := NewRecorder(reg)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+	tests := []struct {
+		reason, errorCode string
+		want              float64
+	}{
+		{evaluator.ReasonStatic, "", 2},
+		{evaluator.ReasonTargetingMatch, "", 2},
+		{evaluator.ReasonFlagNotFound, evaluator.ErrorFlagNotFound, 1},
+	}
+	for _, tt := range tests {
+		got := testutil.ToFloat64(r.evaluations.WithLabelValues(tt.reason, tt.errorCode))
+		if got != tt.want {
+			t.Errorf("evaluations{reason=%q,error_code=%q} = %v, want %v", tt.reason, tt.errorCode, got, tt.want)
+		}
+	}
+
+	if n := testutil.CollectAndCount(reg,
+		"flagd_evaluator_evaluation_duration_seconds",
+		"flagd_evaluator_pool_wait_duration_seconds",
+		"flagd_evaluator_update_state_duration_seconds",
+		"flagd_evaluator_update_fan_out_duration_seconds",
+	); n != 4 {
+		t.Errorf("expected 4 histograms, got %d", n)
+	}
+	// The config's two flags were added
+	if got := testutil.ToFloat64(r.changedFlags); got != 2 {
+		t.Errorf("update_changed_flags_total = %v, want 2", got)
+	}
+	problems, err := testutil.GatherAndLint(reg)
+	if err != nil {
+		t.Fatalf("GatherAndLint failed: %v", err)
+	}
+	for _, p := range problems {
+		t.Errorf("lint: %s: %s", p.Metric, p.Text)
+	}
+}
+
+func TestWithMetricsSharedRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	e1 := newEvaluator(t, reg)
+	e2 := newEvaluator(t, reg)
+
+	e1.EvaluateFlag("static-flag", nil)
+	e2.EvaluateFlag("static-flag", nil)
+
+	r, err := NewRecorder(reg)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+	if got := testutil.ToFloat64(r.evaluations.WithLabelValues(evaluator.ReasonStatic, "")); got != 2 {
+		t.Errorf("expected both evaluators to report into the shared counter, got %v", got)
+	}
+}
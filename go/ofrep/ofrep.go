@@ -0,0 +1,193 @@
+// Package ofrep serves a FlagEvaluator over HTTP using the OpenFeature Remote
+// Evaluation Protocol (OFREP), so any OFREP provider can evaluate flags
+// against it.
+//
+//	http.Handle("/ofrep/", ofrep.NewHandler(e))
+package ofrep
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+)
+
+// maxRequestSize bounds the request body, which only carries the evaluation
+// context.
+const maxRequestSize = 1 << 20
+
+// evaluationRequest is the body of both evaluation endpoints.
+type evaluationRequest struct {
+	Context map[string]interface{} `json:"context"`
+}
+
+// evaluationSuccess is the response to a successful evaluation, and the entry
+// of a successfully evaluated flag in a bulk response.
+type evaluationSuccess struct {
+	Key      string                 `json:"key"`
+	Value    interface{}            `json:"value"`
+	Reason   string                 `json:"reason"`
+	Variant  string                 `json:"variant,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// evaluationFailure is the response to a failed evaluation, and the entry of
+// a flag that failed in a bulk response. Key is empty for request-level
+// failures.
+type evaluationFailure struct {
+	Key          string `json:"key,omitempty"`
+	ErrorCode    string `json:"errorCode,omitempty"`
+	ErrorDetails string `json:"errorDetails"`
+}
+
+// bulkResponse is the response to a bulk evaluation. Flags holds
+// evaluationSuccess and evaluationFailure entries.
+type bulkResponse struct {
+	Flags []interface{} `json:"flags"`
+}
+
+// NewHandler returns a handler for the OFREP evaluation endpoints:
+//
+//	POST /ofrep/v1/evaluate/flags/{key}  evaluates one flag with EvaluateFlag
+//	POST /ofrep/v1/evaluate/flags        evaluates every flag with EvaluateAllFlags
+//
+// The request body is {"context": {...}}; it may be empty to evaluate without
+// context. A flag that isn't defined gets a 404 FLAG_NOT_FOUND, any other
+// failed evaluation of a single flag a 400 with the result's error code. In a
+// bulk response failed flags are listed with their error codes alongside the
+// others, and disabled flags are left out. A context that isn't valid JSON,
+// or that exceeds the evaluator's context size, gets a 400 INVALID_CONTEXT,
+// and other evaluator errors (such as a closed evaluator) a 500. Context
+// numbers reach targeting as written, so integers beyond 2^53 keep their
+// precision.
+func NewHandler(e *evaluator.FlagEvaluator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /ofrep/v1/evaluate/flags/{key}", func(w http.ResponseWriter, r *http.Request) {
+		evaluateFlag(e, w, r)
+	})
+	mux.HandleFunc("POST /ofrep/v1/evaluate/flags", func(w http.ResponseWriter, r *http.Request) {
+		evaluateAllFlags(e, w, r)
+	})
+	return mux
+}
+
+func evaluateFlag(e *evaluator.FlagEvaluator, w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	ctx, err := readContext(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, evaluationFailure{
+			Key:          key,
+			ErrorCode:    evaluator.ErrorInvalidContext,
+			ErrorDetails: err.Error(),
+		})
+		return
+	}
+
+	result, err := e.EvaluateFlagContext(r.Context(), key, ctx)
+	if err != nil {
+		status, failure := failureFromError(err)
+		if status == http.StatusBadRequest {
+			failure.Key = key
+		}
+		writeJSON(w, status, failure)
+		return
+	}
+	if result.IsError() {
+		status := http.StatusBadRequest
+		if result.ErrorCode == evaluator.ErrorFlagNotFound {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, failureFromResult(key, result))
+		return
+	}
+	writeJSON(w, http.StatusOK, successFromResult(key, result))
+}
+
+func evaluateAllFlags(e *evaluator.FlagEvaluator, w http.ResponseWriter, r *http.Request) {
+	ctx, err := readContext(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, evaluationFailure{
+			ErrorCode:    evaluator.ErrorInvalidContext,
+			ErrorDetails: err.Error(),
+		})
+		return
+	}
+
+	results, err := e.EvaluateAllFlags(ctx)
+	if err != nil {
+		status, failure := failureFromError(err)
+		writeJSON(w, status, failure)
+		return
+	}
+
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	resp := bulkResponse{Flags: make([]interface{}, 0, len(keys))}
+	for _, key := range keys {
+		result := results[key]
+		switch {
+		case result.Reason == evaluator.ReasonDisabled:
+			// Not listed, as by flagd
+		case result.IsError():
+			resp.Flags = append(resp.Flags, failureFromResult(key, result))
+		default:
+			resp.Flags = append(resp.Flags, successFromResult(key, result))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readContext decodes the evaluation context from r's body. An empty body
+// yields a nil context. Numbers are decoded as json.Number, which the
+// evaluator serializes verbatim, rather than rounded to float64.
+func readContext(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	var req evaluationRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.UseNumber()
+	err := dec.Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return req.Context, nil
+}
+
+func successFromResult(key string, result *evaluator.EvaluationResult) evaluationSuccess {
+	return evaluationSuccess{
+		Key:      key,
+		Value:    result.Value,
+		Reason:   result.Reason,
+		Variant:  result.Variant,
+		Metadata: result.FlagMetadata,
+	}
+}
+
+func failureFromResult(key string, result *evaluator.EvaluationResult) evaluationFailure {
+	return evaluationFailure{
+		Key:          key,
+		ErrorCode:    result.ErrorCode,
+		ErrorDetails: result.ErrorMessage,
+	}
+}
+
+// failureFromError maps an error returned by the evaluator to a response: a
+// context the evaluator rejected is the client's fault, anything else the
+// server's.
+func failureFromError(err error) (int, evaluationFailure) {
+	var evalErr *evaluator.EvaluationError
+	if errors.As(err, &evalErr) && evalErr.Code == evaluator.ErrorInvalidContext {
+		return http.StatusBadRequest, evaluationFailure{ErrorCode: evalErr.Code, ErrorDetails: err.Error()}
+	}
+	return http.StatusInternalServerError, evaluationFailure{ErrorDetails: err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
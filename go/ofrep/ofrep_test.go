@@ -0,0 +1,210 @@
+package ofrep
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	evaluator "github.com/open-feature/flagd-evaluator/go"
+)
+
+const flagConfig = `{
+	"flags": {
+		"color": {
+			"state": "ENABLED",
+			"defaultVariant": "red",
+			"variants": { "red": "#f00", "blue": "#00f" },
+			"targeting": { "if": [{ "==": [{ "var": "tier" }, "gold"] }, "blue", "red"] },
+			"metadata": { "team": "web" }
+		},
+		"static": {
+			"state": "ENABLED",
+			"defaultVariant": "on",
+			"variants": { "on": true, "off": false }
+		},
+		"broken": {
+			"state": "ENABLED",
+			"defaultVariant": "on",
+			"variants": { "on": true },
+			"targeting": { "if": [true, "missing", "on"] }
+		},
+		"disabled": {
+			"state": "DISABLED",
+			"defaultVariant": "on",
+			"variants": { "on": true }
+		}
+	}
+}`
+
+func newServer(t *testing.T, opts ...evaluator.Option) (*httptest.Server, *evaluator.FlagEvaluator) {
+	t.Helper()
+	e, err := evaluator.NewFlagEvaluator(append([]evaluator.Option{evaluator.WithPermissiveValidation(), evaluator.WithPoolSize(1)}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	if _, err := e.UpdateState(flagConfig); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	srv := httptest.NewServer(NewHandler(e))
+	t.Cleanup(srv.Close)
+	return srv, e
+}
+
+// post sends body to path and returns the status and the decoded response.
+func post(t *testing.T, srv *httptest.Server, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("POST %s: expected JSON content type, got %q", path, ct)
+	}
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatalf("POST %s: failed to decode response: %v", path, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+func assertResponse(t *testing.T, path string, wantStatus int, want string, status int, got map[string]interface{}) {
+	t.Helper()
+	var wantDecoded map[string]interface{}
+	if err := json.Unmarshal([]byte(want), &wantDecoded); err != nil {
+		t.Fatalf("bad expectation %s: %v", want, err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(wantDecoded)
+	if status != wantStatus || string(gotJSON) != string(wantJSON) {
+		t.Errorf("POST %s: expected %d %s, got %d %s", path, wantStatus, wantJSON, status, gotJSON)
+	}
+}
+
+func TestEvaluateFlag(t *testing.T) {
+	srv, _ := newServer(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{
+			name:   "targeting match",
+			path:   "/ofrep/v1/evaluate/flags/color",
+			body:   `{"context": {"targetingKey": "user-1", "tier": "gold"}}`,
+			status: http.StatusOK,
+			want:   `{"key": "color", "value": "#00f", "reason": "TARGETING_MATCH", "variant": "blue", "metadata": {"team": "web"}}`,
+		},
+		{
+			name:   "static without body",
+			path:   "/ofrep/v1/evaluate/flags/static",
+			status: http.StatusOK,
+			want:   `{"key": "static", "value": true, "reason": "STATIC", "variant": "on"}`,
+		},
+		{
+			name:   "not found",
+			path:   "/ofrep/v1/evaluate/flags/nope",
+			body:   `{"context": {}}`,
+			status: http.StatusNotFound,
+			want:   `{"key": "nope", "errorCode": "FLAG_NOT_FOUND", "errorDetails": "Flag 'nope' not found in configuration"}`,
+		},
+		{
+			name:   "evaluation error",
+			path:   "/ofrep/v1/evaluate/flags/broken",
+			body:   `{"context": {}}`,
+			status: http.StatusBadRequest,
+			want:   `{"key": "broken", "errorCode": "GENERAL", "errorDetails": "Targeting rule returned variant 'missing' which is not defined in flag variants"}`,
+		},
+		{
+			name:   "invalid context",
+			path:   "/ofrep/v1/evaluate/flags/color",
+			body:   `{"context": [1]}`,
+			status: http.StatusBadRequest,
+			want:   `{"key": "color", "errorCode": "INVALID_CONTEXT", "errorDetails": "json: cannot unmarshal array into Go struct field evaluationRequest.context of type map[string]interface {}"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, got := post(t, srv, tt.path, tt.body)
+			assertResponse(t, tt.path, tt.status, tt.want, status, got)
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/ofrep/v1/evaluate/flags/color")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected with 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestEvaluateFlagLargeIntegerContext(t *testing.T) {
+	e, err := evaluator.NewFlagEvaluator(evaluator.WithPermissiveValidation(), evaluator.WithPoolSize(1))
+	if err != nil {
+		t.Fatalf("failed to create evaluator: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	// cat compares the ID's text, so a rounded ID can't match
+	config := `{
+		"flags": {
+			"user-flag": {
+				"state": "ENABLED",
+				"defaultVariant": "off",
+				"variants": { "on": "on", "off": "off" },
+				"targeting": { "if": [{ "==": [{ "cat": [{ "var": "userId" }] }, "9007199254740993"] }, "on", "off"] }
+			}
+		}
+	}`
+	if _, err := e.UpdateState(config); err != nil {
+		t.Fatalf("UpdateState failed: %v", err)
+	}
+	srv := httptest.NewServer(NewHandler(e))
+	t.Cleanup(srv.Close)
+
+	path := "/ofrep/v1/evaluate/flags/user-flag"
+	for body, want := range map[string]string{
+		`{"context": {"targetingKey": "u", "userId": 9007199254740993}}`: "on",
+		`{"context": {"targetingKey": "u", "userId": 9007199254740992}}`: "off",
+	} {
+		status, got := post(t, srv, path, body)
+		if status != http.StatusOK || got["value"] != want {
+			t.Errorf("POST %s %s: expected 200 with value %q, got %d %v", path, body, want, status, got)
+		}
+	}
+}
+
+func TestEvaluateAllFlags(t *testing.T) {
+	srv, e := newServer(t, evaluator.WithMaxContextSize(256))
+	const path = "/ofrep/v1/evaluate/flags"
+
+	status, got := post(t, srv, path, `{"context": {"targetingKey": "user-1", "tier": "silver"}}`)
+	assertResponse(t, path, http.StatusOK, `{"flags": [
+		{"key": "broken", "errorCode": "GENERAL", "errorDetails": "Targeting rule returned variant 'missing' which is not defined in flag variants"},
+		{"key": "color", "value": "#f00", "reason": "TARGETING_MATCH", "variant": "red", "metadata": {"team": "web"}},
+		{"key": "static", "value": true, "reason": "STATIC", "variant": "on"}
+	]}`, status, got)
+
+	status, got = post(t, srv, path, `{"context": {"tier": "`+strings.Repeat("x", 512)+`"}}`)
+	if status != http.StatusBadRequest || got["errorCode"] != evaluator.ErrorInvalidContext {
+		t.Errorf("expected 400 INVALID_CONTEXT for an oversized context, got %d %v", status, got)
+	}
+
+	status, got = post(t, srv, path, `{"context":`)
+	if status != http.StatusBadRequest || got["errorCode"] != evaluator.ErrorInvalidContext {
+		t.Errorf("expected 400 INVALID_CONTEXT for a malformed body, got %d %v", status, got)
+	}
+
+	e.Close()
+	status, got = post(t, srv, path, `{}`)
+	if status != http.StatusInternalServerError || got["errorDetails"] != evaluator.ErrEvaluatorClosed.Error() {
+		t.Errorf("expected 500 for a closed evaluator, got %d %v", status, got)
+	}
+}
@@ -1,21 +1,35 @@
 package evaluator
 
 import (
+	"bytes"
 	"encoding/json"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 	"unsafe"
 )
 
-// parseEvalResult is a hand-rolled JSON parser for EvaluationResult.
+// parseEvalResult parses an EvaluationResult with parseEvalResultFast,
+// falling back to json.Unmarshal for shapes it doesn't recognize.
+func parseEvalResult(data []byte) (*EvaluationResult, error) {
+	if r, ok := parseEvalResultFast(data); ok {
+		return r, nil
+	}
+	return unmarshalEvalResult(data)
+}
+
+// parseEvalResultFast is a hand-rolled JSON parser for EvaluationResult.
 // It avoids json.Unmarshal's reflection overhead by scanning the known
-// field names directly. Falls back to json.Unmarshal for unexpected shapes.
+// field names directly. ok is false for unexpected shapes.
 //
 // Expected JSON shape from WASM:
 //
 //	{"value":...,"variant":"...","reason":"...","flagMetadata":{"k":"v","n":1,"b":true}}
 //
 // flagMetadata values are constrained to string, number, or bool per the flagd spec.
-func parseEvalResult(data []byte) (*EvaluationResult, error) {
+func parseEvalResultFast(data []byte) (result *EvaluationResult, ok bool) {
 	var r EvaluationResult
 
 	i := 0
@@ -43,7 +57,8 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 			continue
 		}
 
-		// Parse key
+		// Parse key. Escaped keys, which the module never writes, are left
+		// to encoding/json.
 		if data[i] != '"' {
 			goto fallback
 		}
@@ -51,7 +66,7 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 		keyStart := i
 		for i < n && data[i] != '"' {
 			if data[i] == '\\' {
-				i++
+				goto fallback
 			}
 			i++
 		}
@@ -62,10 +77,10 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 		i++ // skip closing "
 
 		// skip colon
-		for i < n && data[i] != ':' {
+		for i < n && isWhitespace(data[i]) {
 			i++
 		}
-		if i >= n {
+		if i >= n || data[i] != ':' {
 			goto fallback
 		}
 		i++
@@ -83,19 +98,11 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 			if data[i] != '"' {
 				goto fallback
 			}
-			i++
-			valStart := i
-			for i < n && data[i] != '"' {
-				if data[i] == '\\' {
-					i++
-				}
-				i++
-			}
-			if i >= n {
+			val, end := parseString(data, i)
+			if end < 0 {
 				goto fallback
 			}
-			val := string(data[valStart:i])
-			i++
+			i = end
 
 			switch key {
 			case "variant":
@@ -114,6 +121,7 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 			if end < 0 {
 				goto fallback
 			}
+			r.rawValue = data[i:end]
 			i = end
 
 		case "flagMetadata":
@@ -128,6 +136,11 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 			i = end
 
 		default:
+			// encoding/json matches field names case-insensitively and also
+			// sets fields the module doesn't write; leave those to it
+			if isResultField(key) {
+				goto fallback
+			}
 			// Skip unknown field value
 			end := skipValue(data, i)
 			if end < 0 {
@@ -136,16 +149,105 @@ func parseEvalResult(data []byte) (*EvaluationResult, error) {
 			i = end
 		}
 	}
-	return &r, nil
+	return &r, true
 
 fallback:
+	return nil, false
+}
+
+// resultFields are the JSON names of EvaluationResult's fields.
+var resultFields = [...]string{"value", "variant", "reason", "errorCode", "errorMessage", "flagMetadata", "missingKeys", "cached"}
+
+// isResultField reports whether encoding/json would decode key into a field
+// of EvaluationResult.
+func isResultField(key string) bool {
+	for _, field := range resultFields {
+		if strings.EqualFold(key, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalEvalResult parses an EvaluationResult with json.Unmarshal.
+func unmarshalEvalResult(data []byte) (*EvaluationResult, error) {
 	var rf EvaluationResult
 	if err := json.Unmarshal(data, &rf); err != nil {
 		return nil, err
 	}
+	// Keep the raw value bytes as on the fast path. encoding/json decodes
+	// every number as float64, so re-read numeric and object values to keep
+	// integers at full precision.
+	var raw struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if json.Unmarshal(data, &raw) == nil {
+		rf.rawValue = raw.Value
+		switch rf.Value.(type) {
+		case float64:
+			if num, ok := parseNumber(raw.Value); ok {
+				rf.Value = num
+			}
+		case map[string]interface{}, []interface{}:
+			if v, ok := decodeValue(raw.Value); ok {
+				rf.Value = v
+			}
+		}
+	}
 	return &rf, nil
 }
 
+// parseNumber parses a JSON number. Integral numbers (no fraction or exponent)
+// that fit in int64 are returned as int64 so values above 2^53 keep full
+// precision; everything else is returned as float64.
+func parseNumber(b []byte) (interface{}, bool) {
+	for len(b) > 0 && isWhitespace(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	s := unsafeBytesToString(b)
+	if bytes.IndexAny(b, ".eE") < 0 {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v, true
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// decodeValue decodes an object or array value with every nested number
+// converted as by parseNumber, so integers inside objects keep full precision
+// like top-level ones instead of all becoming float64.
+func decodeValue(raw []byte) (interface{}, bool) {
+	v, ok := decodeUseNumber(raw)
+	if !ok {
+		return nil, false
+	}
+	return convertNumbers(v), true
+}
+
+// convertNumbers replaces the json.Number values in v, modifying its maps and
+// slices in place.
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if num, ok := parseNumber([]byte(v)); ok {
+			return num
+		}
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = convertNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = convertNumbers(child)
+		}
+	}
+	return v
+}
+
 // parseValue parses a JSON value starting at data[i].
 // Returns (new index, parsed value). Returns (-1, nil) on error.
 func parseValue(data []byte, i int) (int, interface{}) {
@@ -156,34 +258,26 @@ func parseValue(data []byte, i int) (int, interface{}) {
 
 	switch data[i] {
 	case 't': // true
-		if i+4 <= n {
+		if hasLiteral(data, i, "true") {
 			return i + 4, true
 		}
 		return -1, nil
 	case 'f': // false
-		if i+5 <= n {
+		if hasLiteral(data, i, "false") {
 			return i + 5, false
 		}
 		return -1, nil
 	case 'n': // null
-		if i+4 <= n {
+		if hasLiteral(data, i, "null") {
 			return i + 4, nil
 		}
 		return -1, nil
 	case '"': // string
-		i++
-		strStart := i
-		for i < n && data[i] != '"' {
-			if data[i] == '\\' {
-				i++
-			}
-			i++
-		}
-		if i >= n {
+		val, end := parseString(data, i)
+		if end < 0 {
 			return -1, nil
 		}
-		val := string(data[strStart:i])
-		return i + 1, val
+		return end, val
 	default:
 		// number or complex type — find extent, unmarshal
 		valStart := i
@@ -213,14 +307,17 @@ func parseValue(data []byte, i int) (int, interface{}) {
 			i++
 		}
 	numEnd:
+		if i > n {
+			return -1, nil // unterminated string
+		}
 		valBytes := data[valStart:i]
 		// Fast path: try parsing as number directly
-		if f, err := strconv.ParseFloat(unsafeBytesToString(valBytes), 64); err == nil {
-			return i, f
+		if num, ok := parseNumber(valBytes); ok {
+			return i, num
 		}
 		// Complex type fallback
-		var v interface{}
-		if err := json.Unmarshal(valBytes, &v); err != nil {
+		v, ok := decodeValue(valBytes)
+		if !ok {
 			return -1, nil
 		}
 		return i, v
@@ -254,19 +351,11 @@ func parseMetadata(data []byte, i int) (map[string]interface{}, int) {
 		if data[i] != '"' {
 			return nil, -1
 		}
-		i++
-		keyStart := i
-		for i < n && data[i] != '"' {
-			if data[i] == '\\' {
-				i++
-			}
-			i++
-		}
-		if i >= n {
+		key, end := parseString(data, i)
+		if end < 0 {
 			return nil, -1
 		}
-		key := string(data[keyStart:i])
-		i++ // skip closing "
+		i = end
 
 		// skip colon and whitespace
 		for i < n && (isWhitespace(data[i]) || data[i] == ':') {
@@ -279,25 +368,24 @@ func parseMetadata(data []byte, i int) (map[string]interface{}, int) {
 		// Parse value (string, number, or bool only)
 		switch data[i] {
 		case '"': // string
-			i++
-			valStart := i
-			for i < n && data[i] != '"' {
-				if data[i] == '\\' {
-					i++
-				}
-				i++
-			}
-			if i >= n {
+			val, end := parseString(data, i)
+			if end < 0 {
 				return nil, -1
 			}
-			meta[key] = string(data[valStart:i])
-			i++
+			meta[key] = val
+			i = end
 
 		case 't': // true
+			if !hasLiteral(data, i, "true") {
+				return nil, -1
+			}
 			meta[key] = true
 			i += 4
 
 		case 'f': // false
+			if !hasLiteral(data, i, "false") {
+				return nil, -1
+			}
 			meta[key] = false
 			i += 5
 
@@ -339,12 +427,13 @@ func skipValue(data []byte, i int) int {
 		}
 		return i + 1
 
-	case 't':
-		return i + 4
-	case 'f':
-		return i + 5
-	case 'n':
-		return i + 4
+	case 't', 'f', 'n':
+		for _, lit := range [...]string{"true", "false", "null"} {
+			if hasLiteral(data, i, lit) {
+				return i + len(lit)
+			}
+		}
+		return -1
 
 	case '{', '[':
 		open := data[i]
@@ -371,6 +460,9 @@ func skipValue(data []byte, i int) int {
 			}
 			i++
 		}
+		if depth > 0 || i > n {
+			return -1
+		}
 		return i
 
 	default: // number
@@ -381,6 +473,120 @@ func skipValue(data []byte, i int) int {
 	}
 }
 
+// parseString parses a JSON string whose opening quote is at data[i],
+// decoding escape sequences. Returns (value, index after the closing quote),
+// or ("", -1) on error.
+func parseString(data []byte, i int) (string, int) {
+	n := len(data)
+	i++ // skip opening "
+	start := i
+	escaped := false
+	for i < n && data[i] != '"' {
+		if data[i] == '\\' {
+			escaped = true
+			i++
+		}
+		i++
+	}
+	if i >= n {
+		return "", -1
+	}
+	// encoding/json replaces invalid UTF-8; leave such strings to it
+	if !utf8.Valid(data[start:i]) {
+		return "", -1
+	}
+	if !escaped {
+		return string(data[start:i]), i + 1
+	}
+	val, ok := unescapeJSONString(data[start:i])
+	if !ok {
+		return "", -1
+	}
+	return val, i + 1
+}
+
+// unescapeJSONString decodes the escape sequences in the body of a JSON
+// string (without quotes). Invalid or unpaired surrogates decode to U+FFFD,
+// matching encoding/json. Returns false for malformed escapes.
+func unescapeJSONString(raw []byte) (string, bool) {
+	b := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		i++
+		if i >= len(raw) {
+			return "", false
+		}
+		switch raw[i] {
+		case '"', '\\', '/':
+			b = append(b, raw[i])
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, ok := parseHex4(raw, i+1)
+			if !ok {
+				return "", false
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// A high surrogate must be followed by an escaped low surrogate
+				r2 := unicode.ReplacementChar
+				if i+2 < len(raw) && raw[i+1] == '\\' && raw[i+2] == 'u' {
+					if low, ok := parseHex4(raw, i+3); ok {
+						r2 = utf16.DecodeRune(r, low)
+					}
+				}
+				if r2 != unicode.ReplacementChar {
+					i += 6
+				}
+				r = r2
+			}
+			b = utf8.AppendRune(b, r)
+		default:
+			return "", false
+		}
+	}
+	return string(b), true
+}
+
+// parseHex4 parses the four hex digits at raw[i:i+4] as a rune.
+func parseHex4(raw []byte, i int) (rune, bool) {
+	if i+4 > len(raw) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range raw[i : i+4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r*16 + rune(c)
+	}
+	return r, true
+}
+
+// hasLiteral reports whether data[i:] starts with lit.
+func hasLiteral(data []byte, i int, lit string) bool {
+	return len(data)-i >= len(lit) && string(data[i:i+len(lit)]) == lit
+}
+
 func isWhitespace(b byte) bool {
 	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
 }
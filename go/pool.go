@@ -0,0 +1,114 @@
+package evaluator
+
+import "sync/atomic"
+
+// instancePool holds the idle instances of one instance set. It is split into
+// shards, each a buffered channel owning a fixed subset of the instances, so
+// concurrent acquires spread over several channels instead of contending on
+// one. An instance always returns to its own shard.
+//
+// Acquires waiting on a shard are served in arrival order: a channel hands a
+// returned instance to its longest-waiting receiver, ahead of acquires yet to
+// arrive. An acquire waits on a single shard, so with several shards an
+// instance returned to another one can go to a later acquire. UpdateState
+// never drains the pool serving evaluations: it updates the standby set, and
+// acquires still waiting on a pool once it is swapped out move to the new
+// active one (see instanceSet.retired).
+type instancePool struct {
+	shards []chan *wasmInstance
+
+	// Round-robin counter picking the shard an acquire starts from
+	next atomic.Uint32
+
+	// Number of instances belonging to the pool, idle or checked out. Below
+	// the pool's capacity with WithLazyPool or WithMaxPoolSize.
+	created atomic.Int32
+}
+
+// newInstancePool creates a pool for size instances split over shards
+// channels, sized to hold the instances shardFor assigns them.
+func newInstancePool(size, shards int) *instancePool {
+	p := &instancePool{shards: make([]chan *wasmInstance, shards)}
+	for i := range p.shards {
+		n := size / shards
+		if i < size%shards {
+			n++
+		}
+		p.shards[i] = make(chan *wasmInstance, n)
+	}
+	return p
+}
+
+// shardFor returns the shard of the i-th instance created for the pool.
+func (p *instancePool) shardFor(i int) int {
+	return i % len(p.shards)
+}
+
+// add puts a newly created instance into the pool, assigning it a shard.
+func (p *instancePool) add(inst *wasmInstance) {
+	p.assign(inst)
+	p.put(inst)
+}
+
+// assign counts a newly created instance as belonging to the pool, assigning
+// it a shard, without putting it in.
+func (p *instancePool) assign(inst *wasmInstance) {
+	inst.shard = p.shardFor(int(p.created.Add(1) - 1))
+}
+
+// put returns inst to its shard.
+func (p *instancePool) put(inst *wasmInstance) {
+	p.shards[inst.shard] <- inst
+}
+
+// tryGet takes an idle instance without blocking, starting at the next
+// round-robin shard and falling back to the others in turn. It returns nil if
+// every shard is empty; start is the shard the search began at, for the
+// caller to wait on.
+func (p *instancePool) tryGet() (inst *wasmInstance, start int) {
+	n := len(p.shards)
+	if n > 1 {
+		start = int(p.next.Add(1) % uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case inst = <-p.shards[(start+i)%n]:
+			return inst, start
+		default:
+		}
+	}
+	return nil, start
+}
+
+// drain takes every instance of the pool, waiting for checked-out ones to be
+// returned, and passes each to take. It gives up and returns false once stop
+// is closed; a nil stop waits indefinitely. Instances created for the pool
+// while it drains are not waited for.
+func (p *instancePool) drain(stop <-chan struct{}, take func(*wasmInstance)) bool {
+	created := int(p.created.Load())
+	for s, shard := range p.shards {
+		// Instances are assigned to shards round-robin by creation order
+		n := created / len(p.shards)
+		if s < created%len(p.shards) {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			select {
+			case inst := <-shard:
+				take(inst)
+			case <-stop:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// idle returns the number of instances currently in the pool.
+func (p *instancePool) idle() int {
+	n := 0
+	for _, shard := range p.shards {
+		n += len(shard)
+	}
+	return n
+}
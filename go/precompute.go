@@ -0,0 +1,144 @@
+package evaluator
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"strings"
+)
+
+// precomputedResult is a targeting flag's result for the context set with
+// WithPrecomputeContext.
+type precomputedResult struct {
+	// Context the result was evaluated against, as serialized for the flag,
+	// up to the value of targetingKey. As the flag's required keys are
+	// written first, in sorted order, a context serializing to the same
+	// prefix agrees with it on every key the flag reads.
+	prefix []byte
+	result *EvaluationResult
+}
+
+// precomputedResult returns the precomputed result of flagKey if
+// contextBytes, the context serialized for the flag, agrees with the one it
+// was evaluated against.
+func (s *cacheSnapshot) precomputedResult(flagKey string, contextBytes []byte) (*EvaluationResult, bool) {
+	p, ok := s.precomputed[flagKey]
+	if !ok || !bytes.HasPrefix(contextBytes, p.prefix) {
+		return nil, false
+	}
+	return p.result, true
+}
+
+// precompute evaluates on inst, which holds snap's state, every targeting
+// flag of snap with known required keys against the precompute context
+// layered over the default context. Flags reading targetingKey (see
+// readsTargetingKey) and flags enriched with $flagd (whose timestamp changes)
+// are left out, as are error results. It stops at the first failed call and
+// returns the error with what it has.
+func (e *FlagEvaluator) precompute(inst *wasmInstance, snap *cacheSnapshot) (map[string]*precomputedResult, error) {
+	// Without a targetingKey in either layer, the serialized context ends
+	// with an empty one, which is cut off to get the prefix
+	ctx := maps.Clone(e.precomputeContext)
+	delete(ctx, "targetingKey")
+	defaults := maps.Clone(e.loadDefaultContext())
+	delete(defaults, "targetingKey")
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	resultBuf := getBuffer()
+	defer putBuffer(resultBuf)
+	precomputed := make(map[string]*precomputedResult)
+	for flagKey, requiredKeys := range snap.requiredCtxKey {
+		if !e.precomputable(snap, flagKey) {
+			continue
+		}
+		buf.Reset()
+		writeFilteredContext(buf, ctx, defaults, "", requiredKeys)
+		prefixLen := buf.Len() - len(`""`)
+		writeContextEnd(buf, e.enrichmentKey(flagKey), false, 0)
+
+		resultBuf.Reset()
+		data, err := e.evaluateWithTimeout(e.ctx, inst, snap, flagKey, requiredKeys, buf.Bytes(), resultBuf)
+		if err != nil {
+			return precomputed, err
+		}
+		result, err := e.decodeEvalResult(flagKey, data)
+		if err != nil || result.IsError() {
+			continue
+		}
+		precomputed[flagKey] = &precomputedResult{
+			prefix: bytes.Clone(buf.Bytes()[:prefixLen]),
+			result: result,
+		}
+	}
+	return precomputed, nil
+}
+
+// precomputable reports whether flagKey's result under snap depends only on
+// the keys its targeting reads other than targetingKey, so it can be
+// precomputed. The module lists targetingKey among every flag's required
+// keys, so the rule itself is checked for reading it.
+func (e *FlagEvaluator) precomputable(snap *cacheSnapshot, flagKey string) bool {
+	if _, ok := snap.preEvaluated[flagKey]; ok || e.needsEnrichment(snap, flagKey) {
+		return false
+	}
+	rule, ok := snap.targetingRule(flagKey)
+	return ok && !readsTargetingKey(rule)
+}
+
+// readsTargetingKey reports whether rule may read targetingKey: through a var
+// lookup of it or of a path not known until evaluation, or a fractional
+// operation, which buckets on it by default.
+func readsTargetingKey(rule interface{}) bool {
+	switch v := rule.(type) {
+	case map[string]interface{}:
+		for op, args := range v {
+			switch op {
+			case "fractional":
+				return true
+			case "var":
+				path := args
+				if list, isArray := args.([]interface{}); isArray && len(list) > 0 {
+					path = list[0]
+				}
+				p, isString := path.(string)
+				if !isString || p == "" || p == "targetingKey" || strings.HasPrefix(p, "targetingKey.") {
+					return true
+				}
+			}
+			if readsTargetingKey(args) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if readsTargetingKey(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyPrecompute sets snap's precomputed results, evaluated on
+// instances[0]. An instance that trapped or timed out is replaced with one
+// holding snap's state, keeping the results computed before it.
+func (e *FlagEvaluator) applyPrecompute(instances []*wasmInstance, snap *cacheSnapshot) {
+	precomputed, err := e.precompute(instances[0], snap)
+	snap.precomputed = precomputed
+	if err == nil {
+		return
+	}
+	e.logger.Warn("precomputing flag results failed", "error", err)
+	if !errors.Is(err, ErrWasmTrap) && !errors.Is(err, ErrEvaluationTimeout) {
+		return
+	}
+	fresh, rerr := e.replaceInstance(instances[0], snap)
+	if rerr != nil {
+		e.logger.Error("WASM trap while precomputing, instance could not be replaced",
+			"error", err, "replaceError", rerr)
+		return
+	}
+	e.counters.instancesReplaced.Add(1)
+	instances[0] = fresh
+}
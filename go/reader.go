@@ -0,0 +1,16 @@
+package evaluator
+
+// Reader is the read-only part of a FlagEvaluator: evaluating flags and
+// listing them. Hand a Reader to code that should only read flags, such as
+// request handlers, and keep UpdateState and Close on the *FlagEvaluator held
+// by its owner.
+type Reader interface {
+	EvaluateFlag(flagKey string, ctx map[string]interface{}) (*EvaluationResult, error)
+	EvaluateBool(flagKey string, ctx map[string]interface{}, defaultValue bool) bool
+	EvaluateString(flagKey string, ctx map[string]interface{}, defaultValue string) string
+	EvaluateInt(flagKey string, ctx map[string]interface{}, defaultValue int64) int64
+	EvaluateFloat(flagKey string, ctx map[string]interface{}, defaultValue float64) float64
+	ListFlags() []string
+}
+
+var _ Reader = (*FlagEvaluator)(nil)
@@ -0,0 +1,103 @@
+package evaluator
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// resultCache is an LRU cache of targeting evaluation results, keyed by flag
+// key and the exact serialized context sent to WASM. It holds the results of
+// a single generation: an entry from an older generation is never served, and
+// storing a result of a newer generation drops every entry.
+type resultCache struct {
+	maxEntries int
+	ttl        time.Duration // 0 means entries don't expire
+	clock      func() time.Time
+
+	mu         sync.Mutex
+	generation uint64
+	entries    map[string]*list.Element
+	lru        list.List // of *resultCacheEntry, most recently used first
+}
+
+type resultCacheEntry struct {
+	key     string
+	result  *EvaluationResult
+	expires time.Time
+}
+
+func newResultCache(maxEntries int, ttl time.Duration, clock func() time.Time) *resultCache {
+	return &resultCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		clock:      clock,
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// writeResultCacheKey writes the cache key of flagKey evaluated against
+// contextBytes to b.
+func writeResultCacheKey(b *bytes.Buffer, flagKey string, contextBytes []byte) {
+	b.WriteString(flagKey)
+	b.WriteByte(0)
+	b.Write(contextBytes)
+}
+
+// get returns the result cached under key for generation, if any.
+func (c *resultCache) get(generation uint64, key []byte) (*EvaluationResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return nil, false
+	}
+	el, ok := c.entries[string(key)]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*resultCacheEntry)
+	if c.ttl > 0 && !c.clock().Before(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.result, true
+}
+
+// put caches result under key for generation, evicting the least recently
+// used entry if the cache is full. Results of a generation older than the
+// cached one are dropped.
+func (c *resultCache) put(generation uint64, key []byte, result *EvaluationResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation < c.generation {
+		return
+	}
+	if generation > c.generation {
+		clear(c.entries)
+		c.lru.Init()
+		c.generation = generation
+	}
+
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.clock().Add(c.ttl)
+	}
+	if el, ok := c.entries[string(key)]; ok {
+		entry := el.Value.(*resultCacheEntry)
+		entry.result, entry.expires = result, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	entry := &resultCacheEntry{key: string(key), result: result, expires: expires}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*resultCacheEntry).key)
+}
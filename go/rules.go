@@ -0,0 +1,167 @@
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// parseTargetingRules returns the targeting rule of every flag in config that
+// has one, decoded for host-side inspection with $ref references to shared
+// $evaluators resolved. Numbers are decoded as json.Number so integers keep
+// their exact text. Returns nil if config cannot be parsed.
+func parseTargetingRules(config []byte) map[string]interface{} {
+	var parsed struct {
+		Flags map[string]struct {
+			Targeting json.RawMessage `json:"targeting"`
+		} `json:"flags"`
+		Evaluators map[string]json.RawMessage `json:"$evaluators"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return nil
+	}
+
+	evaluators := decodeEvaluators(parsed.Evaluators)
+
+	rules := make(map[string]interface{}, len(parsed.Flags))
+	for flagKey, flag := range parsed.Flags {
+		if len(flag.Targeting) == 0 || string(flag.Targeting) == "null" {
+			continue
+		}
+		rule, ok := decodeUseNumber(flag.Targeting)
+		if !ok {
+			continue
+		}
+		if rule, err := resolveRefs(rule, evaluators, nil); err == nil {
+			if m, isMap := rule.(map[string]interface{}); !isMap || len(m) > 0 {
+				rules[flagKey] = rule
+			}
+		}
+	}
+	return rules
+}
+
+// decodeUseNumber decodes raw with numbers as json.Number.
+func decodeUseNumber(raw []byte) (interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// decodeEvaluators decodes a config's shared "$evaluators", skipping any that
+// are not valid JSON.
+func decodeEvaluators(raw map[string]json.RawMessage) map[string]interface{} {
+	evaluators := make(map[string]interface{}, len(raw))
+	for name, rule := range raw {
+		if v, ok := decodeUseNumber(rule); ok {
+			evaluators[name] = v
+		}
+	}
+	return evaluators
+}
+
+// resolveRefs replaces {"$ref": name} objects in rule with the named
+// evaluator, as the module does when loading a config. visiting holds the
+// evaluators being expanded, to reject circular references.
+func resolveRefs(rule interface{}, evaluators map[string]interface{}, visiting map[string]bool) (interface{}, error) {
+	switch v := rule.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"]; ok && len(v) == 1 {
+			name, ok := ref.(string)
+			if !ok {
+				return nil, fmt.Errorf("$ref must be the name of an evaluator, got %v", ref)
+			}
+			target, ok := evaluators[name]
+			if !ok {
+				return nil, fmt.Errorf("Evaluator '%s' not found in $evaluators", name)
+			}
+			if visiting[name] {
+				return nil, fmt.Errorf("Evaluator '%s' is part of a circular $ref", name)
+			}
+			if visiting == nil {
+				visiting = make(map[string]bool)
+			}
+			visiting[name] = true
+			defer delete(visiting, name)
+			return resolveRefs(target, evaluators, visiting)
+		}
+		resolved := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			r, err := resolveRefs(child, evaluators, visiting)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, child := range v {
+			r, err := resolveRefs(child, evaluators, visiting)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	}
+	return rule, nil
+}
+
+// checkRefs returns why a $ref in a flag's targeting can't be resolved, in
+// the module's wording, or "" if they all can. The module itself reports an
+// undefined evaluator, but accepts a $ref in a config without "$evaluators",
+// failing each evaluation instead, and rejects a circular or non-string $ref
+// with a schema error that doesn't say which. A config that can't be parsed
+// is left for the module to report.
+func checkRefs(config []byte) string {
+	if !bytes.Contains(config, []byte(`"$ref"`)) {
+		return ""
+	}
+	var parsed struct {
+		Flags map[string]struct {
+			Targeting json.RawMessage `json:"targeting"`
+		} `json:"flags"`
+		Evaluators map[string]json.RawMessage `json:"$evaluators"`
+	}
+	if err := json.Unmarshal(config, &parsed); err != nil {
+		return ""
+	}
+	evaluators := decodeEvaluators(parsed.Evaluators)
+
+	// Sorted, so the same config always reports the same flag
+	flagKeys := make([]string, 0, len(parsed.Flags))
+	for flagKey := range parsed.Flags {
+		flagKeys = append(flagKeys, flagKey)
+	}
+	slices.Sort(flagKeys)
+	for _, flagKey := range flagKeys {
+		targeting := parsed.Flags[flagKey].Targeting
+		if !bytes.Contains(targeting, []byte(`"$ref"`)) {
+			continue
+		}
+		rule, ok := decodeUseNumber(targeting)
+		if !ok {
+			continue
+		}
+		if _, err := resolveRefs(rule, evaluators, nil); err != nil {
+			return fmt.Sprintf("Failed to resolve $ref in flag '%s': %s", flagKey, err)
+		}
+	}
+	return ""
+}
+
+// targetingRule returns the decoded targeting rule of flagKey in the
+// snapshot's config, parsing the config on first use.
+func (s *cacheSnapshot) targetingRule(flagKey string) (interface{}, bool) {
+	s.rulesOnce.Do(func() {
+		s.rules = parseTargetingRules(s.config)
+	})
+	rule, ok := s.rules[flagKey]
+	return rule, ok
+}
@@ -0,0 +1,87 @@
+package evaluator
+
+// SimulateFlag evaluates flagKey against each of contexts and returns how many
+// landed in each variant, for offline rollout analysis. Contexts whose
+// evaluation returns an error result are counted under the empty variant.
+//
+// Every context is evaluated on a single pool instance, with the same
+// required-key filtering as EvaluateFlag, and against one generation of the
+// configuration. Simulated evaluations bypass the result cache and are not
+// counted in Stats or metrics.
+func (e *FlagEvaluator) SimulateFlag(flagKey string, contexts []map[string]interface{}) (counts map[string]int, err error) {
+	defer func() {
+		if err != nil {
+			err = newEvaluationError(flagKey, err)
+		}
+	}()
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+
+	snap := e.active.Load().snap
+	counts = make(map[string]int)
+	if cached, ok := snap.preEvaluated[flagKey]; ok {
+		if len(contexts) > 0 {
+			counts[cached.Variant] = len(contexts)
+		}
+		return counts, nil
+	}
+	if _, ok := snap.flagIndex[flagKey]; !ok {
+		return nil, ErrFlagNotFound
+	}
+	if len(contexts) == 0 {
+		return counts, nil
+	}
+
+	set, inst, err := e.acquireInstance(e.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { e.releaseInstance(set, inst, err) }()
+
+	// Same snapshot check as evaluateFlag
+	if set.snap != snap {
+		snap = set.snap
+		e.counters.snapshotReloads.Add(1)
+		if cached, ok := snap.preEvaluated[flagKey]; ok {
+			counts[cached.Variant] = len(contexts)
+			return counts, nil
+		}
+		if _, ok := snap.flagIndex[flagKey]; !ok {
+			return nil, ErrFlagNotFound
+		}
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	resultBuf := getBuffer()
+	defer putBuffer(resultBuf)
+	for _, vals := range contexts {
+		vals, _ = e.withAnonymousKey(vals)
+		buf.Reset()
+		requiredKeys, _, failed, err := e.prepareContext(buf, snap, flagKey, vals)
+		if err != nil {
+			return nil, err
+		}
+		if failed != nil {
+			counts[""]++
+			continue
+		}
+
+		resultBuf.Reset()
+		data, err := e.evaluateWithTimeout(e.ctx, inst, snap, flagKey, requiredKeys, buf.Bytes(), resultBuf)
+		if err != nil {
+			return nil, err
+		}
+		result, err := e.decodeEvalResult(flagKey, data)
+		if err != nil {
+			return nil, err
+		}
+		if result.IsError() {
+			counts[""]++
+			continue
+		}
+		counts[result.Variant]++
+	}
+	return counts, nil
+}
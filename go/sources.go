@@ -0,0 +1,98 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// UpdateStateFromSources merges several flag configurations and applies the
+// result like UpdateState. Sources are merged in order, as flagd does: a flag
+// defined by more than one source takes the whole flag object from the last
+// of them, with no merging of its fields. Shared evaluators ("$evaluators")
+// and flag set metadata are merged key by key the same way, and any other
+// top-level field is taken from the last source that sets it.
+//
+// The result's SourceOverrides records, for each flag key defined by more
+// than one source, the index of the source whose definition was applied.
+func (e *FlagEvaluator) UpdateStateFromSources(configs ...string) (*UpdateStateResult, error) {
+	merged, overrides, err := mergeSources(configs)
+	if err != nil {
+		return nil, err
+	}
+	// Not coalesced: a coalesced caller may receive the result of a later
+	// config, which SourceOverrides would not describe
+	result, err := e.updateState(func([]byte) ([]byte, error) {
+		return merged, nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		result.SourceOverrides = overrides
+	}
+	return result, nil
+}
+
+// mergedObjectKeys are the top-level fields merged key by key rather than
+// replaced as a whole.
+var mergedObjectKeys = map[string]bool{
+	"flags":       true,
+	"$evaluators": true,
+	"metadata":    true,
+}
+
+// mergeSources merges configs into a single config and reports the winning
+// source index for each flag key defined more than once.
+func mergeSources(configs []string) ([]byte, map[string]int, error) {
+	if len(configs) == 0 {
+		return nil, nil, errors.New("no configuration sources")
+	}
+
+	merged := make(map[string]json.RawMessage)
+	objects := make(map[string]map[string]json.RawMessage)
+	var overrides map[string]int
+	for i, config := range configs {
+		var top map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(config), &top); err != nil {
+			return nil, nil, fmt.Errorf("source %d: invalid JSON: %w", i, err)
+		}
+		for key, raw := range top {
+			if !mergedObjectKeys[key] {
+				merged[key] = raw
+				continue
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				return nil, nil, fmt.Errorf("source %d: %q must be an object: %w", i, key, err)
+			}
+			dst := objects[key]
+			if dst == nil {
+				dst = make(map[string]json.RawMessage, len(fields))
+				objects[key] = dst
+			}
+			for name, value := range fields {
+				if _, exists := dst[name]; exists && key == "flags" {
+					if overrides == nil {
+						overrides = make(map[string]int)
+					}
+					overrides[name] = i
+				}
+				dst[name] = value
+			}
+		}
+	}
+	for key, fields := range objects {
+		raw, err := json.Marshal(fields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to merge %q: %w", key, err)
+		}
+		merged[key] = raw
+	}
+
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to merge sources: %w", err)
+	}
+	return out, overrides, nil
+}
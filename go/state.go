@@ -0,0 +1,133 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// stateFormatVersion is the version of the ExportState format. ImportState
+// rejects other versions, so it must change whenever exportedState does.
+const stateFormatVersion = 1
+
+// exportedState is the serialized form of a cache snapshot written by
+// ExportState.
+type exportedState struct {
+	Version             int                        `json:"version"`
+	Generation          uint64                     `json:"generation"`
+	Config              string                     `json:"config"`
+	PreEvaluated        map[string]json.RawMessage `json:"preEvaluated"`
+	RequiredContextKeys map[string][]string        `json:"requiredContextKeys"`
+	FlagIndices         map[string]uint32          `json:"flagIndices"`
+
+	// Flags exempt from $flagd enrichment; null if every flag is enriched
+	FlagdFree []string `json:"flagdFree"`
+}
+
+// ExportState serializes the active configuration and the host-side caches
+// built from it, for ImportState to restore on a warm start (e.g. after a
+// process restart) without rebuilding them. The format is versioned JSON and
+// only meant to be read by ImportState.
+func (e *FlagEvaluator) ExportState() ([]byte, error) {
+	if e.closed.Load() {
+		return nil, ErrEvaluatorClosed
+	}
+	snap := e.active.Load().snap
+	if snap.config == nil {
+		return nil, fmt.Errorf("no state to export: no configuration has been applied")
+	}
+
+	state := exportedState{
+		Version:             stateFormatVersion,
+		Generation:          snap.generation,
+		Config:              string(snap.config),
+		PreEvaluated:        make(map[string]json.RawMessage, len(snap.preEvaluated)),
+		RequiredContextKeys: make(map[string][]string, len(snap.requiredCtxKey)),
+		FlagIndices:         snap.flagIndex,
+	}
+	for flagKey, result := range snap.preEvaluated {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export flag %q: %w", flagKey, err)
+		}
+		state.PreEvaluated[flagKey] = raw
+	}
+	for flagKey, keys := range snap.requiredCtxKey {
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		slices.Sort(sorted)
+		state.RequiredContextKeys[flagKey] = sorted
+	}
+	if snap.flagdFree != nil {
+		state.FlagdFree = make([]string, 0, len(snap.flagdFree))
+		for flagKey := range snap.flagdFree {
+			state.FlagdFree = append(state.FlagdFree, flagKey)
+		}
+		slices.Sort(state.FlagdFree)
+	}
+	return json.Marshal(state)
+}
+
+// ImportState applies the configuration in data, written by ExportState, and
+// restores the host-side caches exported with it. The config is still loaded
+// into every instance as UpdateState would load it; the caches are only
+// rebuilt if the module reports different flag indices for it, as a
+// different module build may. The generation continues from the exported
+// one if that is later than the current generation.
+//
+// A config identical to the applied one is skipped like an identical
+// UpdateState, and a config the module rejects is returned as an error.
+func (e *FlagEvaluator) ImportState(data []byte) error {
+	var state exportedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+	if state.Version != stateFormatVersion {
+		return fmt.Errorf("unsupported state format version %d, expected %d", state.Version, stateFormatVersion)
+	}
+
+	restored := &cacheSnapshot{
+		generation:     state.Generation,
+		preEvaluated:   make(map[string]*EvaluationResult, len(state.PreEvaluated)),
+		requiredCtxKey: make(map[string]map[string]bool, len(state.RequiredContextKeys)),
+		flagIndex:      state.FlagIndices,
+	}
+	for flagKey, raw := range state.PreEvaluated {
+		result, err := parseEvalResult(raw)
+		if err != nil {
+			return fmt.Errorf("invalid state for flag %q: %w", flagKey, err)
+		}
+		result.Cached = true
+		restored.preEvaluated[flagKey] = result
+	}
+	for flagKey, keys := range state.RequiredContextKeys {
+		keySet := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			keySet[k] = true
+		}
+		restored.requiredCtxKey[flagKey] = keySet
+	}
+	if restored.flagIndex == nil {
+		restored.flagIndex = make(map[string]uint32)
+	}
+	if state.FlagdFree != nil {
+		restored.flagdFree = make(map[string]bool, len(state.FlagdFree))
+		for _, flagKey := range state.FlagdFree {
+			restored.flagdFree[flagKey] = true
+		}
+	}
+
+	config := []byte(state.Config)
+	result, err := e.updateState(func([]byte) ([]byte, error) {
+		return config, nil
+	}, restored)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("imported config was rejected: %s", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package evaluator
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EvaluatorStats is a point-in-time view of pool usage and cache efficiency.
+// Counters are cumulative since the evaluator was created.
+type EvaluatorStats struct {
+	// PoolSize is the configured number of instances serving evaluations
+	// (see WithPoolSize).
+	PoolSize int
+	// CurrentPoolSize is the number of instances the serving set has now:
+	// below PoolSize while WithLazyPool hasn't created them all, above it
+	// while WithMaxPoolSize has grown the pool under contention.
+	CurrentPoolSize int
+	// AvailableInstances is the number of those instances currently idle.
+	AvailableInstances int
+	// Evaluations counts flag evaluations, including cache hits. Each flag of
+	// an EvaluateFlags/EvaluateAllFlags call counts once.
+	Evaluations uint64
+	// CacheHits counts evaluations served from the pre-evaluated cache
+	// without a WASM call.
+	CacheHits uint64
+	// PoolWaits counts instance acquisitions that found the pool empty and
+	// had to wait. A steadily rising rate means the pool is too small.
+	PoolWaits uint64
+	// ResultCacheHits counts evaluations served from the result cache (see
+	// WithResultCache).
+	ResultCacheHits uint64
+	// PrecomputedHits counts evaluations served a result precomputed at
+	// update time (see WithPrecomputeContext).
+	PrecomputedHits uint64
+	// InstancesReplaced counts instances torn down and recreated after a
+	// WASM trap.
+	InstancesReplaced uint64
+	// InstancesRecycled counts instances retired and recreated after
+	// reaching their evaluation quota (see WithInstanceMaxEvals).
+	InstancesRecycled uint64
+	// ParseFallbacks counts evaluation results the fast parser didn't
+	// recognize and that were decoded with encoding/json instead. Any nonzero
+	// value means the module produced an unexpected result shape or the fast
+	// parser has a gap; WithLogger logs each such result at debug level.
+	ParseFallbacks uint64
+	// SnapshotReloads counts evaluations that found the configuration
+	// replaced between loading its snapshot and acquiring an instance, and so
+	// reloaded the snapshot matching the instance's state. A persistently
+	// high rate during deploys means updates arrive faster than evaluations
+	// complete, and would be better batched.
+	SnapshotReloads uint64
+	// UpdatesCoalesced counts UpdateState calls merged into a waiting update
+	// instead of being applied themselves (see WithUpdateCoalescing).
+	UpdatesCoalesced uint64
+	// LastUpdateDuration is how long the latest UpdateState call took, and
+	// LastUpdateFanOut how long the latest applied update took to load the
+	// config into the instances after the first (see UpdateStateResult).
+	LastUpdateDuration time.Duration
+	LastUpdateFanOut   time.Duration
+}
+
+// evaluatorCounters holds the cumulative counters and latest timings
+// reported by Stats.
+type evaluatorCounters struct {
+	evaluations       atomic.Uint64
+	cacheHits         atomic.Uint64
+	poolWaits         atomic.Uint64
+	instancesReplaced atomic.Uint64
+	instancesRecycled atomic.Uint64
+	resultCacheHits   atomic.Uint64
+	precomputedHits   atomic.Uint64
+	parseFallbacks    atomic.Uint64
+	snapshotReloads   atomic.Uint64
+	updatesCoalesced  atomic.Uint64
+
+	// Latest update timings, in nanoseconds
+	lastUpdateDuration atomic.Int64
+	lastUpdateFanOut   atomic.Int64
+}
+
+// Stats returns the current pool and cache statistics.
+func (e *FlagEvaluator) Stats() EvaluatorStats {
+	pool := e.active.Load().pool
+	return EvaluatorStats{
+		PoolSize:           e.poolSize,
+		CurrentPoolSize:    int(pool.created.Load()),
+		AvailableInstances: pool.idle(),
+		Evaluations:        e.counters.evaluations.Load(),
+		CacheHits:          e.counters.cacheHits.Load(),
+		PoolWaits:          e.counters.poolWaits.Load(),
+		ResultCacheHits:    e.counters.resultCacheHits.Load(),
+		PrecomputedHits:    e.counters.precomputedHits.Load(),
+		InstancesReplaced:  e.counters.instancesReplaced.Load(),
+		InstancesRecycled:  e.counters.instancesRecycled.Load(),
+		ParseFallbacks:     e.counters.parseFallbacks.Load(),
+		SnapshotReloads:    e.counters.snapshotReloads.Load(),
+		UpdatesCoalesced:   e.counters.updatesCoalesced.Load(),
+		LastUpdateDuration: time.Duration(e.counters.lastUpdateDuration.Load()),
+		LastUpdateFanOut:   time.Duration(e.counters.lastUpdateFanOut.Load()),
+	}
+}
@@ -0,0 +1,78 @@
+package evaluator
+
+import "sync"
+
+// subscriberBufferSize is the number of undelivered events a subscriber can
+// hold before further events for it are dropped.
+const subscriberBufferSize = 16
+
+// StateChangeEvent describes a successful UpdateState. By the time it is
+// delivered, Generation is already live: evaluations started after the event
+// see the new configuration.
+type StateChangeEvent struct {
+	Generation   uint64
+	AddedFlags   []string
+	RemovedFlags []string
+	ChangedFlags []string
+}
+
+// subscribers fans StateChangeEvents out to Subscribe channels.
+type subscribers struct {
+	mu     sync.Mutex
+	chans  map[chan StateChangeEvent]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel that receives a StateChangeEvent after each
+// successful UpdateState, and a cancel func that unsubscribes and closes the
+// channel. Delivery never blocks UpdateState: if a subscriber falls more than
+// a few events behind, newer events are dropped for it. The channel is also
+// closed when the evaluator is closed.
+func (e *FlagEvaluator) Subscribe() (<-chan StateChangeEvent, func()) {
+	ch := make(chan StateChangeEvent, subscriberBufferSize)
+
+	s := &e.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.chans == nil {
+		s.chans = make(map[chan StateChangeEvent]struct{})
+	}
+	s.chans[ch] = struct{}{}
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.chans[ch]; ok {
+			delete(s.chans, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish delivers ev to every subscriber without blocking.
+func (s *subscribers) publish(ev StateChangeEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.chans {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close closes every subscriber channel and rejects new subscriptions.
+func (s *subscribers) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ch := range s.chans {
+		close(ch)
+	}
+	s.chans = nil
+}
@@ -1,6 +1,27 @@
 package evaluator
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
 // EvaluationResult contains the result of a flag evaluation.
+//
+// Numeric values, including those nested in object and array values, are
+// int64 when the JSON number is integral and fits in int64, and float64
+// otherwise.
+//
+// Every evaluation returns a result of its own, including results served from
+// the pre-evaluated cache, the result cache or precomputed results: its
+// FlagMetadata, Value and MissingKeys may be modified without affecting other
+// evaluations.
 type EvaluationResult struct {
 	Value        interface{}            `json:"value"`
 	Variant      string                 `json:"variant,omitempty"`
@@ -8,6 +29,18 @@ type EvaluationResult struct {
 	ErrorCode    string                 `json:"errorCode,omitempty"`
 	ErrorMessage string                 `json:"errorMessage,omitempty"`
 	FlagMetadata map[string]interface{} `json:"flagMetadata,omitempty"`
+
+	// MissingKeys lists, with WithContextValidation, the context keys the
+	// flag's targeting reads that the evaluation context didn't provide.
+	MissingKeys []string `json:"missingKeys,omitempty"`
+
+	// Cached is true when the result was served from the host-side cache of
+	// pre-evaluated static and disabled flags, without a WASM call.
+	Cached bool `json:"cached,omitempty"`
+
+	// rawValue holds the undecoded JSON of Value, so typed conversions such
+	// as EvaluateObject don't round-trip through interface{}.
+	rawValue json.RawMessage
 }
 
 // IsError returns true if the evaluation resulted in an error.
@@ -15,14 +48,50 @@ func (r *EvaluationResult) IsError() bool {
 	return r.ErrorCode != ""
 }
 
+// EvaluationDetails is a typed evaluation result, following the OpenFeature
+// "details" pattern. When evaluation fails or the value has the wrong type,
+// Value is the caller's default, Reason is ERROR (or the evaluator's reason)
+// and Err describes the failure. On a type mismatch Variant still names the
+// variant whose value didn't fit.
+type EvaluationDetails[T any] struct {
+	Value   T
+	Variant string
+	Reason  string
+	Err     error
+}
+
 // UpdateStateResult contains the result of updating flag state.
+//
+// AddedFlags, RemovedFlags and ChangedFlags are disjoint, sorted lists of the
+// flags added, removed and modified relative to the previous configuration.
+// On the first update every flag is reported as added.
 type UpdateStateResult struct {
 	Success             bool                         `json:"success"`
 	Error               string                       `json:"error,omitempty"`
+	AddedFlags          []string                     `json:"addedFlags,omitempty"`
+	RemovedFlags        []string                     `json:"removedFlags,omitempty"`
 	ChangedFlags        []string                     `json:"changedFlags,omitempty"`
 	PreEvaluated        map[string]*EvaluationResult `json:"preEvaluated,omitempty"`
 	RequiredContextKeys map[string][]string          `json:"requiredContextKeys,omitempty"`
 	FlagIndices         map[string]uint32            `json:"flagIndices,omitempty"`
+
+	// Warnings lists, with WithPermissiveValidation, the schema validation
+	// errors of an applied config that strict validation would have
+	// rejected. The module reports them without per-flag detail. Flag keys
+	// the config defines more than once are reported by name.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// SourceOverrides is set by UpdateStateFromSources: for each flag key
+	// defined by more than one source, the index of the source whose
+	// definition was applied.
+	SourceOverrides map[string]int `json:"sourceOverrides,omitempty"`
+
+	// Elapsed is how long the UpdateState call took, including waiting for
+	// an update in progress. FanOut is the part of it spent loading an
+	// applied config into the pool instances after the first, in parallel,
+	// so as long as the slowest of them; zero for updates not applied.
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+	FanOut  time.Duration `json:"fanOut,omitempty"`
 }
 
 // Option configures a FlagEvaluator.
@@ -31,10 +100,50 @@ type Option func(*evaluatorConfig)
 type evaluatorConfig struct {
 	permissiveValidation bool
 	poolSize             int
+	maxPoolSize          int
+	poolShards           int
+	compilationCache     wazero.CompilationCache
+	interpreter          bool
+	runtimeConfig        wazero.RuntimeConfig
+	maxMemoryPages       uint32
+	instanceMaxEvals     int
+	lazyPool             bool
+	poolWaitTimeout      time.Duration
+	evaluationTimeout    time.Duration
+	wasmModule           []byte
+	clock                func() time.Time
+	entropy              io.Reader
+	forceUpdate          bool
+	coalesceUpdates      bool
+	withoutEnrichment    bool
+	defaultContext       map[string]interface{}
+	metrics              MetricsRecorder
+	logger               *slog.Logger
+	maxContextSize       int
+	contextBufferSize    int
+	maxFlagKeySize       int
+	contextValidation    bool
+	targetingKeyField    string
+	anonymousKey         func() string
+	typeCoercion         bool
+	resultCacheSize      int
+	resultCacheTTL       time.Duration
+	precomputeContext    map[string]interface{}
+
+	// err records the first invalid option; NewFlagEvaluator returns it.
+	err error
+}
+
+// setErr records an option validation error, keeping the first one.
+func (c *evaluatorConfig) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
 }
 
 // WithPermissiveValidation configures the evaluator to accept invalid flag
-// configurations with warnings instead of rejecting them.
+// configurations with warnings instead of rejecting them. The warnings are
+// reported in UpdateStateResult.Warnings.
 func WithPermissiveValidation() Option {
 	return func(c *evaluatorConfig) {
 		c.permissiveValidation = true
@@ -42,18 +151,471 @@ func WithPermissiveValidation() Option {
 }
 
 // WithPoolSize sets the number of WASM instances in the evaluation pool.
-// More instances allow more parallel targeting evaluations.
-// Defaults to runtime.NumCPU().
+// The pool size caps how many targeting evaluations run concurrently; callers
+// beyond that wait for an instance. Each instance carries its own linear
+// memory, so memory use grows with n. UpdateState prepares new state on a
+// second set of n instances, so from the first update on 2n instances are
+// live. n must be positive. Defaults to runtime.NumCPU().
 func WithPoolSize(n int) Option {
 	return func(c *evaluatorConfig) {
+		if n <= 0 {
+			c.setErr(fmt.Errorf("pool size must be positive, got %d", n))
+			return
+		}
 		c.poolSize = n
 	}
 }
 
+// WithMaxPoolSize lets the pool grow past its size (see WithPoolSize) under
+// sustained contention, up to max instances. An acquire that has waited 10ms
+// for an instance creates one more, loaded with the current state before it
+// serves; once no acquire has waited for 30s, released instances beyond the
+// pool size are closed again, one per release. Each extra instance costs its
+// own linear memory, and each of the two instance sets grows independently,
+// so up to 2×max instances may be live. max must be at least the pool size.
+// Stats reports the current size as CurrentPoolSize.
+func WithMaxPoolSize(max int) Option {
+	return func(c *evaluatorConfig) {
+		if max <= 0 {
+			c.setErr(fmt.Errorf("max pool size must be positive, got %d", max))
+			return
+		}
+		c.maxPoolSize = max
+	}
+}
+
+// WithShardedPool splits each instance pool into shards independent channels,
+// so that acquires at high concurrency contend on different channels. Each
+// acquire starts at the next shard in round-robin order and falls back to the
+// others when it is empty. Instances are spread evenly over the shards; more
+// shards than instances are reduced to the pool size. shards must be
+// positive. Defaults to 1.
+func WithShardedPool(shards int) Option {
+	return func(c *evaluatorConfig) {
+		if shards <= 0 {
+			c.setErr(fmt.Errorf("pool shards must be positive, got %d", shards))
+			return
+		}
+		c.poolShards = shards
+	}
+}
+
+// WithMaxContextSize sets the largest serialized evaluation context in bytes.
+// A context of exactly bytes is accepted; larger ones fail with
+// ErrContextTooLarge rather than being truncated. Each instance's context buffer
+// starts at the size set by WithContextBufferSize and doubles, up to bytes,
+// when a larger context arrives. The buffer lives in every instance's linear
+// memory, which never shrinks, so contexts this large cost up to
+// bytes × poolSize, doubled once UpdateState has created the standby set (see
+// WithPoolSize). bytes must be positive and fit in WASM's 32-bit address
+// space. Defaults to 1MB.
+func WithMaxContextSize(bytes int) Option {
+	return func(c *evaluatorConfig) {
+		if bytes <= 0 || int64(bytes) > math.MaxUint32 {
+			c.setErr(fmt.Errorf("max context size must be between 1 and %d bytes, got %d", uint32(math.MaxUint32), bytes))
+			return
+		}
+		c.maxContextSize = bytes
+	}
+}
+
+// WithContextBufferSize sets the size in bytes of the context buffer each
+// instance pre-allocates, and so the memory an instance needs for contexts up
+// to that size. A larger context, up to WithMaxContextSize, grows the buffer;
+// each growth costs an allocation in the instance on that evaluation. bytes
+// must be positive and at most the max context size. Defaults to 64KiB, or
+// the max context size if that is smaller.
+//
+// An instance evaluates one flag at a time, so it has a single context
+// buffer; batch evaluations (EvaluateFlags) reuse it for every flag.
+func WithContextBufferSize(bytes int) Option {
+	return func(c *evaluatorConfig) {
+		if bytes <= 0 || int64(bytes) > math.MaxUint32 {
+			c.setErr(fmt.Errorf("context buffer size must be between 1 and %d bytes, got %d", uint32(math.MaxUint32), bytes))
+			return
+		}
+		c.contextBufferSize = bytes
+	}
+}
+
+// WithMaxFlagKeySize sets the size in bytes of each instance's pre-allocated
+// flag key buffer, which bounds the flag keys evaluated by key. Longer keys
+// fail with a *FlagKeyTooLargeError, and UpdateState rejects configs defining
+// one. bytes must be positive and at most 64KiB. Defaults to 256.
+func WithMaxFlagKeySize(bytes int) Option {
+	return func(c *evaluatorConfig) {
+		if bytes <= 0 || bytes > 64*1024 {
+			c.setErr(fmt.Errorf("max flag key size must be between 1 and %d bytes, got %d", 64*1024, bytes))
+			return
+		}
+		c.maxFlagKeySize = bytes
+	}
+}
+
+// WithCompilationCache compiles the WASM module through the given wazero
+// compilation cache. Sharing one cache across evaluators (or using a
+// filesystem cache via wazero.NewCompilationCacheWithDir across process
+// restarts) avoids recompiling the module for each NewFlagEvaluator call.
+// The cache is owned by the caller and is not closed by Close.
+func WithCompilationCache(cache wazero.CompilationCache) Option {
+	return func(c *evaluatorConfig) {
+		c.compilationCache = cache
+	}
+}
+
+// WithInterpreter runs the WASM module in wazero's interpreter instead of
+// compiling it to machine code, for platforms where the compiler is
+// unavailable or executable memory mappings are not allowed. Creating the
+// evaluator is faster, but targeting evaluations are dozens of times
+// slower (see BenchmarkE13), so prefer the default compiler wherever it
+// works.
+func WithInterpreter() Option {
+	return func(c *evaluatorConfig) {
+		c.interpreter = true
+	}
+}
+
+// WithRuntimeConfig creates the wazero runtime from cfg instead of
+// wazero.NewRuntimeConfig(), for settings without a dedicated option such as
+// memory limits or closing modules when a call's context is done. Host
+// functions are still registered and the module compiled on top of it, and
+// WithCompilationCache still applies. For the interpreter, pass a config
+// from wazero.NewRuntimeConfigInterpreter(); combining WithRuntimeConfig with
+// WithInterpreter is an error. A nil cfg keeps the default.
+func WithRuntimeConfig(cfg wazero.RuntimeConfig) Option {
+	return func(c *evaluatorConfig) {
+		c.runtimeConfig = cfg
+	}
+}
+
+// WithMaxMemoryPages caps each instance's linear memory at pages 64KiB WASM
+// pages. An allocation beyond the cap fails inside the module instead of
+// growing host memory: UpdateState and evaluations return ErrWasmTrap and the
+// instance is replaced, keeping the previous state. The cap must leave room
+// for the module's own data and the context buffer (see WithMaxContextSize),
+// or NewFlagEvaluator fails. pages must be between 1 and 65536. Defaults to
+// wazero's limit of 65536 pages (4GiB).
+func WithMaxMemoryPages(pages uint32) Option {
+	return func(c *evaluatorConfig) {
+		if pages == 0 || pages > maxMemoryPages {
+			c.setErr(fmt.Errorf("max memory pages must be between 1 and %d, got %d", maxMemoryPages, pages))
+			return
+		}
+		c.maxMemoryPages = pages
+	}
+}
+
+// WithInstanceMaxEvals recycles each instance once it has run n evaluations:
+// when it is next returned to the pool, it is closed and replaced by a fresh
+// instance loaded with the same state, releasing linear memory that WASM
+// never shrinks. The replacement is created by the caller returning the
+// instance, so that evaluation pays for it. n must be positive. By default
+// instances are never recycled.
+func WithInstanceMaxEvals(n int) Option {
+	return func(c *evaluatorConfig) {
+		if n <= 0 {
+			c.setErr(fmt.Errorf("instance max evals must be positive, got %d", n))
+			return
+		}
+		c.instanceMaxEvals = n
+	}
+}
+
+// WithPoolWaitTimeout bounds how long an evaluation waits for a pool
+// instance, trading a default value for a bounded tail latency when every
+// instance is busy (e.g. during an update storm). An evaluation that waits
+// longer fails with error code POOL_TIMEOUT: EvaluateFlag and EvaluateFlags
+// return results carrying it, and the typed evaluations return their
+// default. d must be positive. By default evaluations wait until an
+// instance is free.
+func WithPoolWaitTimeout(d time.Duration) Option {
+	return func(c *evaluatorConfig) {
+		if d <= 0 {
+			c.setErr(fmt.Errorf("pool wait timeout must be positive, got %s", d))
+			return
+		}
+		c.poolWaitTimeout = d
+	}
+}
+
+// WithEvaluationTimeout bounds each WASM evaluation call to d, so a runaway
+// targeting rule fails with ErrEvaluationTimeout instead of holding a
+// goroutine and a pool instance indefinitely. wazero stops the call by
+// closing the instance's module, so the instance is replaced like one that
+// trapped. The bound applies per flag, including each flag of a batch, and
+// comes on top of any deadline of the context passed to EvaluateFlagContext.
+// d must be positive.
+//
+// Interrupting calls requires the runtime to watch each call's context,
+// which costs a goroutine per call; with NewFlagEvaluatorFromCompiled the
+// option must also be passed to Compile.
+func WithEvaluationTimeout(d time.Duration) Option {
+	return func(c *evaluatorConfig) {
+		if d <= 0 {
+			c.setErr(fmt.Errorf("evaluation timeout must be positive, got %s", d))
+			return
+		}
+		c.evaluationTimeout = d
+	}
+}
+
+// WithLazyPool creates pool instances on demand instead of when the evaluator
+// is built: an acquire that finds every instance busy creates one, up to the
+// pool size, and loads it with the current state. This shortens start-up for
+// large pools at the cost of a slower first evaluation on each new instance.
+// The standby set used by updates starts with a single instance too.
+func WithLazyPool() Option {
+	return func(c *evaluatorConfig) {
+		c.lazyPool = true
+	}
+}
+
+// WithLogger sets the logger for diagnostics the evaluator otherwise keeps to
+// itself: WASM traps and the replaced instances (warn), configs applied with
+// validation warnings (warn), evaluation contexts rejected as too large
+// (warn), waits of 100ms or more for a pool instance (warn), flag values the
+// typed accessors reject with TYPE_MISMATCH (warn), and evaluation results
+// the fast parser fell back to encoding/json for, with the raw result
+// (debug). A nil logger keeps the default, which discards everything.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *evaluatorConfig) {
+		c.logger = logger
+	}
+}
+
+// WithWasmModule compiles the given WASM module instead of the embedded
+// flagd-evaluator build, e.g. a fork with additional custom operators. The
+// module must export the same functions as the embedded one. A nil slice
+// keeps the embedded module.
+func WithWasmModule(wasm []byte) Option {
+	return func(c *evaluatorConfig) {
+		c.wasmModule = wasm
+	}
+}
+
+// WithWasmModuleReader is like WithWasmModule but reads the module from r.
+func WithWasmModuleReader(r io.Reader) Option {
+	return func(c *evaluatorConfig) {
+		wasm, err := io.ReadAll(r)
+		if err != nil {
+			c.setErr(fmt.Errorf("failed to read WASM module: %w", err))
+			return
+		}
+		c.wasmModule = wasm
+	}
+}
+
+// WithClock sets the time source used for $flagd.timestamp enrichment and for
+// the WASM module's current-time host function. Pinning it makes time-based
+// targeting rules reproducible in tests. Defaults to time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(c *evaluatorConfig) {
+		c.clock = clock
+	}
+}
+
+// WithEntropySource sets the source of the random bytes the WASM module asks
+// the host for. Today the only consumer is the hash seed of the JSON schema
+// validator, which checks configs in UpdateState; it affects neither
+// evaluation results nor fractional bucketing, which hashes
+// deterministically. Pinning it lets tests rule out entropy as a source of
+// flakiness and lets deployments audit where randomness comes from. Reads are
+// serialized, so r need not be safe for concurrent use; a source that runs
+// out leaves the remaining bytes zero. Defaults to crypto/rand. Generated
+// anonymous keys (WithAnonymousKey) don't use it.
+func WithEntropySource(r io.Reader) Option {
+	return func(c *evaluatorConfig) {
+		if r == nil {
+			c.entropy = nil
+			return
+		}
+		c.entropy = &lockedReader{r: r}
+	}
+}
+
+// WithForceUpdate makes UpdateState re-apply every config, even one
+// byte-identical to the config already applied. By default such updates are
+// skipped.
+func WithForceUpdate() Option {
+	return func(c *evaluatorConfig) {
+		c.forceUpdate = true
+	}
+}
+
+// WithUpdateCoalescing collapses bursts of UpdateState calls: while an update
+// is being applied, full-config updates arriving meanwhile wait together, and
+// only the latest of them is applied once the current one finishes. Each
+// waiting caller receives the result of that update, so three file-change
+// events in quick succession drain and reload the pool twice instead of three
+// times. Superseded configs are never validated or applied.
+//
+// UpdateStateReader is coalesced too. SetFlag, RemoveFlag, ImportState,
+// UpdateStateFromSources and the other updates derived from the current
+// config or reporting on the config they applied are applied one by one as
+// without the option, in the order they acquire the update lock.
+func WithUpdateCoalescing() Option {
+	return func(c *evaluatorConfig) {
+		c.coalesceUpdates = true
+	}
+}
+
+// WithoutContextEnrichment omits $flagd.flagKey and $flagd.timestamp from
+// every evaluation context, saving a clock read and some serialization per
+// evaluation. Without it, enrichment is already skipped for flags whose
+// targeting never references $flagd. Use this only if no rule reads those
+// fields, including fractional rules without an explicit bucketing key,
+// which bucket on $flagd.flagKey.
+func WithoutContextEnrichment() Option {
+	return func(c *evaluatorConfig) {
+		c.withoutEnrichment = true
+	}
+}
+
+// WithDefaultContext sets context values merged into every evaluation, such
+// as the deployment region or application version. See SetDefaultContext for
+// precedence rules; it can also replace the defaults later.
+func WithDefaultContext(ctx map[string]interface{}) Option {
+	return func(c *evaluatorConfig) {
+		c.defaultContext = ctx
+	}
+}
+
+// WithMetricsRecorder reports evaluation counts and latencies, pool waits and
+// UpdateState durations to r, and applied updates' details if r implements
+// UpdateMetricsRecorder. For Prometheus, use metrics.WithMetrics from the
+// metrics subpackage.
+func WithMetricsRecorder(r MetricsRecorder) Option {
+	return func(c *evaluatorConfig) {
+		c.metrics = r
+	}
+}
+
+// WithContextValidation checks each targeting evaluation's context against
+// the keys the flag's targeting reads. Keys found in neither the per-call nor
+// the default context are listed in EvaluationResult.MissingKeys. If
+// targetingKey is absent or empty the flag is not evaluated: the result has
+// reason ERROR and code TARGETING_KEY_MISSING. Static flags and rules reading
+// the whole context are not checked.
+func WithContextValidation() Option {
+	return func(c *evaluatorConfig) {
+		c.contextValidation = true
+	}
+}
+
+// WithTargetingKeyField makes field stand in for targetingKey in contexts
+// that don't set targetingKey, for callers whose contexts carry the user id
+// under another name such as "userId". The field's value is sent to the
+// WASM module as targetingKey, and the field itself stays available to rules
+// that read it. A per-call field takes precedence over a targetingKey from
+// the default context.
+//
+// Fractional bucketing hashes the flag key with targetingKey, so the mapping
+// applies everywhere the context is built, ahead of the $flagd enrichment:
+// evaluations, FractionalBucket and ExplainFlag bucket on the field's value,
+// and WithContextValidation accepts it as the targeting key.
+func WithTargetingKeyField(field string) Option {
+	return func(c *evaluatorConfig) {
+		if field == "" {
+			c.setErr(fmt.Errorf("targeting key field must not be empty"))
+			return
+		}
+		c.targetingKeyField = field
+	}
+}
+
+// WithAnonymousKey gives contexts without a targetingKey one generated by
+// generate, or a random UUID if generate is nil, so anonymous users are
+// bucketed by fractional rules and pass rules checking for a targetingKey.
+// A key is generated once per EvaluateFlag or EvaluateFlags call, so every
+// flag of a call sees the same key; static flags served from the
+// pre-evaluated cache don't generate one. With WithTargetingKeyField a context
+// carrying the field isn't anonymous.
+//
+// Fractional bucketing hashes targetingKey, so unless generate returns a
+// stable id for the user (for example from a session cookie), an anonymous
+// user may land in a different bucket on every request. Evaluations with a
+// generated key bypass the result cache, as their contexts never repeat.
+func WithAnonymousKey(generate func() string) Option {
+	return func(c *evaluatorConfig) {
+		if generate == nil {
+			generate = randomUUID
+		}
+		c.anonymousKey = generate
+	}
+}
+
+// WithTypeCoercion makes the typed evaluations convert flag values of other
+// types rather than return the default value with TYPE_MISMATCH:
+// EvaluateBool parses strings with strconv.ParseBool ("true", "false", "1",
+// "0", ...), EvaluateInt and EvaluateFloat parse numeric strings, and
+// EvaluateString formats numbers and booleans. Values that don't convert,
+// and objects and arrays, are still mismatches. EvaluateFlag and
+// EvaluateObject are unaffected.
+func WithTypeCoercion() Option {
+	return func(c *evaluatorConfig) {
+		c.typeCoercion = true
+	}
+}
+
+// WithResultCache caches up to maxEntries targeting evaluation results, keyed
+// by flag key and the filtered context sent to the WASM module, and evicts
+// the least recently used entry when full. An identical evaluation is then
+// served without acquiring an instance. Entries are dropped on every state
+// update and never outlive the generation they were computed for. Error
+// results are not cached.
+//
+// The key is the exact context the rule sees, so flags reading
+// $flagd.timestamp only hit within the same second. Entries older than ttl
+// are not served; a ttl of 0 keeps them until evicted. maxEntries must be
+// positive and ttl must not be negative.
+func WithResultCache(maxEntries int, ttl time.Duration) Option {
+	return func(c *evaluatorConfig) {
+		if maxEntries <= 0 {
+			c.setErr(fmt.Errorf("result cache size must be positive, got %d", maxEntries))
+			return
+		}
+		if ttl < 0 {
+			c.setErr(fmt.Errorf("result cache TTL must not be negative, got %v", ttl))
+			return
+		}
+		c.resultCacheSize = maxEntries
+		c.resultCacheTTL = ttl
+	}
+}
+
+// WithPrecomputeContext evaluates targeting flags against ctx, layered over
+// the default context, on every state update, for "segment" flags whose rules
+// only read a few slowly changing attributes such as region or plan. An
+// evaluation whose context agrees with ctx on every key the flag reads is
+// then served the precomputed result without acquiring an instance; any
+// other is evaluated as usual. Agreement is decided on the context as
+// serialized for the flag, defaults included, so a SetDefaultContext after
+// an update can make evaluations stop matching until the next update, but
+// never serves a wrong result.
+//
+// Only flags whose result is fully determined by the keys they read are
+// precomputed: not those reading targetingKey, fractional flags (which
+// bucket on it), or flags reading $flagd fields unless WithoutContextEnrichment
+// is set. Error results are not precomputed. The map is copied; an empty map
+// is a valid context, matching evaluations that carry none of the keys.
+func WithPrecomputeContext(ctx map[string]interface{}) Option {
+	return func(c *evaluatorConfig) {
+		if ctx == nil {
+			c.setErr(fmt.Errorf("precompute context must not be nil"))
+			return
+		}
+		c.precomputeContext = maps.Clone(ctx)
+	}
+}
+
 // Evaluation reasons
 const (
-	ReasonStatic         = "STATIC"
-	ReasonDefault        = "DEFAULT"
+	// ReasonStatic: the flag has no targeting; the default variant is served
+	ReasonStatic = "STATIC"
+	// ReasonDefault: targeting ran but resolved to null, so the default
+	// variant is served
+	ReasonDefault = "DEFAULT"
+	// ReasonTargetingMatch: targeting ran and selected a variant
 	ReasonTargetingMatch = "TARGETING_MATCH"
 	ReasonDisabled       = "DISABLED"
 	ReasonError          = "ERROR"
@@ -62,8 +624,11 @@ const (
 
 // Error codes
 const (
-	ErrorFlagNotFound = "FLAG_NOT_FOUND"
-	ErrorParseError   = "PARSE_ERROR"
-	ErrorTypeMismatch = "TYPE_MISMATCH"
-	ErrorGeneral      = "GENERAL"
+	ErrorFlagNotFound        = "FLAG_NOT_FOUND"
+	ErrorParseError          = "PARSE_ERROR"
+	ErrorTypeMismatch        = "TYPE_MISMATCH"
+	ErrorInvalidContext      = "INVALID_CONTEXT"
+	ErrorTargetingKeyMissing = "TARGETING_KEY_MISSING"
+	ErrorPoolTimeout         = "POOL_TIMEOUT"
+	ErrorGeneral             = "GENERAL"
 )
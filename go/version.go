@@ -0,0 +1,121 @@
+package evaluator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// EvaluatorInfo identifies the evaluator build, so deployments can be checked
+// to run the same evaluator. See FlagEvaluator.Version.
+type EvaluatorInfo struct {
+	// PackageVersion is the version of this Go module recorded in the
+	// binary's build info: a release tag, a pseudo-version, or "(devel)"
+	// when built from the module's own source tree.
+	PackageVersion string
+
+	// WasmSHA256 is the hex-encoded SHA-256 of the WASM module the evaluator
+	// runs, and WasmSize its size in bytes.
+	WasmSHA256 string
+	WasmSize   int
+
+	// WasmVersion and ABIVersion are reported by the module's version and
+	// abi_version exports. They are empty for modules without them, such as
+	// the embedded one, which WasmSHA256 identifies instead.
+	WasmVersion string
+	ABIVersion  uint32
+}
+
+// Version returns the versions of the evaluator and of the WASM module it
+// runs.
+func (e *FlagEvaluator) Version() EvaluatorInfo {
+	info := e.module.info
+	info.PackageVersion = packageVersion()
+	return info
+}
+
+// packageVersion returns the version of this module in the build info, or ""
+// if the binary has none.
+func packageVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	path := reflect.TypeOf(EvaluatorInfo{}).PkgPath()
+	if bi.Main.Path == path {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			// A replacement by a local directory has no version
+			if dep.Replace.Version == "" {
+				return "(devel)"
+			}
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return ""
+}
+
+// readModuleInfo returns the WASM details of cm, compiled from module. A
+// module with a version or abi_version export is instantiated once to call
+// them: version returns a packed pointer and length (see unpackPtrLen) to the
+// version string, abi_version an integer.
+func readModuleInfo(ctx context.Context, cm *CompiledModule, module []byte) (EvaluatorInfo, error) {
+	sum := sha256.Sum256(module)
+	info := EvaluatorInfo{
+		WasmSHA256: hex.EncodeToString(sum[:]),
+		WasmSize:   len(module),
+	}
+
+	exported := cm.compiled.ExportedFunctions()
+	_, hasVersion := exported["version"]
+	_, hasABIVersion := exported["abi_version"]
+	if !hasVersion && !hasABIVersion {
+		return info, nil
+	}
+
+	name := fmt.Sprintf("flagd_evaluator_%d", cm.instanceSeq.Add(1)-1)
+	mod, err := cm.rt.InstantiateModule(ctx, cm.compiled, wazero.NewModuleConfig().WithName(name))
+	if err != nil {
+		return info, fmt.Errorf("failed to instantiate module %q: %w", name, err)
+	}
+	// The instance is discarded, so the version string needn't be freed
+	defer mod.Close(ctx)
+
+	if hasABIVersion {
+		results, err := mod.ExportedFunction("abi_version").Call(ctx)
+		if err != nil {
+			return info, fmt.Errorf("%w: abi_version failed: %w", ErrWasmTrap, err)
+		}
+		if len(results) != 1 {
+			return info, fmt.Errorf("abi_version returned %d values, expected 1", len(results))
+		}
+		info.ABIVersion = uint32(results[0])
+	}
+	if hasVersion {
+		results, err := mod.ExportedFunction("version").Call(ctx)
+		if err != nil {
+			return info, fmt.Errorf("%w: version failed: %w", ErrWasmTrap, err)
+		}
+		if len(results) != 1 {
+			return info, fmt.Errorf("version returned %d values, expected 1", len(results))
+		}
+		ptr, length := unpackPtrLen(results[0])
+		data, err := readFromWasm(mod, ptr, length)
+		if err != nil {
+			return info, fmt.Errorf("failed to read version: %w", err)
+		}
+		info.WasmVersion = string(data)
+	}
+	return info, nil
+}
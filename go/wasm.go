@@ -1,22 +1,89 @@
 package evaluator
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
 	"fmt"
+	"strings"
 
+	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 )
 
 //go:embed flagd_evaluator.wasm
 var wasmBytes []byte
 
-// Pre-allocated buffer sizes matching Java implementation
+// requiredExports lists the functions a flagd-evaluator WASM module must export.
+var requiredExports = []string{"alloc", "dealloc", "update_state", "evaluate_reusable"}
+
+// checkRequiredExports returns an error naming every required export missing
+// from the compiled module.
+func checkRequiredExports(compiled wazero.CompiledModule) error {
+	exported := compiled.ExportedFunctions()
+	var missing []string
+	for _, name := range requiredExports {
+		if _, ok := exported[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("WASM module missing required exports: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkImports returns an ErrABIMismatch error listing every function the
+// compiled module imports that the host modules registered in r don't
+// export, or export with a different signature. Instantiating such a module
+// would fail with an error naming only the first.
+func checkImports(r wazero.Runtime, compiled wazero.CompiledModule) error {
+	var unsatisfied []string
+	for _, imp := range compiled.ImportedFunctions() {
+		moduleName, name, _ := imp.Import()
+		want := signature(imp)
+		var host api.FunctionDefinition
+		if mod := r.Module(moduleName); mod != nil {
+			host = mod.ExportedFunctionDefinitions()[name]
+		}
+		switch {
+		case host == nil:
+			unsatisfied = append(unsatisfied, fmt.Sprintf("%s.%s %s (not provided)", moduleName, name, want))
+		case signature(host) != want:
+			unsatisfied = append(unsatisfied, fmt.Sprintf("%s.%s %s (host provides %s)", moduleName, name, want, signature(host)))
+		}
+	}
+	if len(unsatisfied) > 0 {
+		return fmt.Errorf("%w: unsatisfied imports: %s", ErrABIMismatch, strings.Join(unsatisfied, ", "))
+	}
+	return nil
+}
+
+// signature formats the parameter and result types of fn, e.g. "(i32,i32) -> (i64)".
+func signature(fn api.FunctionDefinition) string {
+	names := func(types []api.ValueType) string {
+		s := make([]string, len(types))
+		for i, t := range types {
+			s[i] = api.ValueTypeName(t)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("(%s) -> (%s)", names(fn.ParamTypes()), names(fn.ResultTypes()))
+}
+
+// Default sizes of the pre-allocated buffers. The flag key buffer and the
+// largest context match the Java implementation; the context buffer starts
+// smaller and grows on demand. See WithMaxFlagKeySize, WithContextBufferSize
+// and WithMaxContextSize.
 const (
-	maxFlagKeySize = 256
-	maxContextSize = 1024 * 1024 // 1MB
+	defaultMaxFlagKeySize    = 256
+	defaultContextBufferSize = 64 * 1024   // 64KiB
+	defaultMaxContextSize    = 1024 * 1024 // 1MB
 )
 
+// maxMemoryPages is the most 64KiB pages a 32-bit WASM memory can hold.
+const maxMemoryPages = 65536
+
 // unpackPtrLen unpacks a u64 return value into pointer (upper 32) and length (lower 32).
 func unpackPtrLen(packed uint64) (ptr, length uint32) {
 	ptr = uint32(packed >> 32)
@@ -30,9 +97,13 @@ func writeToWasm(ctx context.Context, mod api.Module, allocFn api.Function, data
 	dataLen := uint32(len(data))
 	results, err := allocFn.Call(ctx, uint64(dataLen))
 	if err != nil {
-		return 0, 0, fmt.Errorf("alloc failed: %w", err)
+		return 0, 0, fmt.Errorf("%w: alloc failed: %w", ErrWasmTrap, err)
 	}
 	ptr := uint32(results[0])
+	if ptr == 0 && dataLen > 0 {
+		// The module's allocator returns null once memory can't grow
+		return 0, 0, fmt.Errorf("%w: alloc of %d bytes failed: out of memory", ErrWasmTrap, dataLen)
+	}
 
 	if !mod.Memory().Write(ptr, data) {
 		return 0, 0, fmt.Errorf("memory write failed at ptr=%d len=%d", ptr, dataLen)
@@ -42,7 +113,9 @@ func writeToWasm(ctx context.Context, mod api.Module, allocFn api.Function, data
 
 // readFromWasm reads bytes from WASM linear memory.
 // Returns a copy since wazero's Memory.Read returns a view that may be
-// invalidated by subsequent WASM calls (e.g., dealloc).
+// invalidated by subsequent WASM calls (e.g., dealloc). Evaluations read their
+// results with readFromWasmInto instead; this is for the larger, infrequent
+// reads such as update results.
 func readFromWasm(mod api.Module, ptr, length uint32) ([]byte, error) {
 	view, ok := mod.Memory().Read(ptr, length)
 	if !ok {
@@ -53,6 +126,17 @@ func readFromWasm(mod api.Module, ptr, length uint32) ([]byte, error) {
 	return data, nil
 }
 
+// readFromWasmInto is like readFromWasm but appends the bytes to buf and
+// returns buf's contents, so the copy can reuse a pooled buffer.
+func readFromWasmInto(mod api.Module, ptr, length uint32, buf *bytes.Buffer) ([]byte, error) {
+	view, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		return nil, fmt.Errorf("memory read failed at ptr=%d len=%d", ptr, length)
+	}
+	buf.Write(view)
+	return buf.Bytes(), nil
+}
+
 // writeToPreallocBuffer writes data to a pre-allocated buffer with bounds checking.
 func writeToPreallocBuffer(mod api.Module, bufPtr, bufSize uint32, data []byte) error {
 	if uint32(len(data)) > bufSize {